@@ -1,10 +1,13 @@
 package conf
 
 import (
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"log/slog"
 	"strings"
 
+	"github.com/dustin/go-humanize"
 	libRule "github.com/ringo-is-a-color/heteroglossia/conf/rule"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 )
@@ -16,45 +19,247 @@ type Config struct {
 	} `json:"inbounds"`
 	Outbounds map[string]*ProxyNode `json:"outbounds" validate:"dive"`
 	Route     Route                 `json:"route"`
+	Quota     Quota                 `json:"quota"`
+	Log       Log                   `json:"log"`
 	Misc      Misc                  `json:"misc"`
 }
 
 type HTTPSOCKS struct {
-	Host        string `json:"host" validate:"ip|hostname_rfc1123"`
-	Port        uint16 `json:"port" validate:"gte=0,lte=65536"`
-	Username    string `json:"username"`
-	Password    string `json:"password"`
-	SystemProxy bool   `json:"system-proxy"`
+	Host string `json:"host" validate:"ip|hostname_rfc1123"`
+	Port uint16 `json:"port" validate:"gte=0,lte=65536"`
+	// a shortcut for a single user in 'users'
+	Username    string          `json:"username"`
+	Password    string          `json:"password"`
+	Users       []HTTPSOCKSUser `json:"users" validate:"unique=Username,dive"`
+	SystemProxy bool            `json:"system-proxy"`
 }
 
-func (httpSOCKS *HTTPSOCKS) ToHTTPSOCKSAuthInfo() *HTTPSOCKSAuthInfo {
-	return &HTTPSOCKSAuthInfo{Username: httpSOCKS.Username, Password: httpSOCKS.Password}
+func (httpSOCKS *HTTPSOCKS) allUsers() []HTTPSOCKSUser {
+	if httpSOCKS.Username == "" && httpSOCKS.Password == "" {
+		return httpSOCKS.Users
+	}
+	users := make([]HTTPSOCKSUser, 0, len(httpSOCKS.Users)+1)
+	users = append(users, HTTPSOCKSUser{httpSOCKS.Username, httpSOCKS.Password})
+	return append(users, httpSOCKS.Users...)
+}
+
+func (httpSOCKS *HTTPSOCKS) ToHTTPSOCKSAuthenticator() *HTTPSOCKSAuthenticator {
+	return NewHTTPSOCKSAuthenticator(httpSOCKS.allUsers())
+}
+
+// the system proxy settings need a plain text password, so we use the first user who has one
+
+func (httpSOCKS *HTTPSOCKS) ToSystemProxyAuthInfo() *HTTPSOCKSAuthInfo {
+	for _, user := range httpSOCKS.allUsers() {
+		if !user.IsHashedPassword() {
+			return &HTTPSOCKSAuthInfo{Username: user.Username, Password: user.Password}
+		}
+	}
+	return &HTTPSOCKSAuthInfo{}
 }
 
 type Password struct {
-	Raw    [16]byte
+	// only the first 'Size' bytes are used, which is 16, or 32 for the Shadowsocks 2022 methods with 256-bit keys
+	Raw [32]byte
+	// 0 if the password isn't a key, which is only allowed for a Trojan server
+	Size   int
 	String string
 }
 
+func (pw *Password) Key() []byte {
+	return pw.Raw[:pw.Size]
+}
+
+const (
+	SSMethodAES128GCM        = "2022-blake3-aes-128-gcm"
+	SSMethodAES256GCM        = "2022-blake3-aes-256-gcm"
+	SSMethodChaCha20Poly1305 = "2022-blake3-chacha20-poly1305"
+)
+
+func SSKeySize(method string) int {
+	if method == SSMethodAES128GCM {
+		return 16
+	}
+	return 32
+}
+
 type Hg struct {
-	Host                      string          `json:"host" validate:"ip|hostname_rfc1123"`
-	Password                  Password        `json:"password" validate:"required"`
-	TCPPort                   int             `json:"tcp-port" validate:"gte=0,lte=65536"`
-	TLSPort                   int             `json:"tls-port" validate:"gte=0,lte=65536"`
-	TLSCertKeyPair            *TLSCertKeyPair `json:"tls-cert-key-pair"`
-	TLSBadAuthFallbackSiteDir string          `json:"tls-bad-auth-fallback-site-dir"`
-	QUICPort                  int             `json:"quic-port" validate:"gte=0,lte=65536"`
+	Host string `json:"host" validate:"ip|hostname_rfc1123"`
+	// when 'users' is not empty, it's only used as the identity key for Shadowsocks 2022 identity headers,
+	// and it's no longer accepted as a user's password
+	Password Password `json:"password" validate:"required"`
+	Users    []HgUser `json:"users" validate:"required_with=TLSClientAuth,unique=Name,unique=Password,dive"`
+	TCPPort  int      `json:"tcp-port" validate:"gte=0,lte=65536"`
+	// the Shadowsocks 2022 method of the TCP carrier, which defaults to the AES-GCM one matching the password's length
+	SSMethod       string          `json:"ss-method" validate:"omitempty,oneof=2022-blake3-aes-128-gcm 2022-blake3-aes-256-gcm 2022-blake3-chacha20-poly1305"`
+	TLSPort        int             `json:"tls-port" validate:"gte=0,lte=65536"`
+	TLSCertKeyPair *TLSCertKeyPair `json:"tls-cert-key-pair"`
+	// more cert/key pairs for the other domains, and the one matching the client's SNI is served,
+	// while 'tls-cert-key-pair' or the first one is the default,
+	// all the pairs' files are reloaded when they're modified
+	TLSCertKeyPairs []TLSCertKeyPair `json:"tls-cert-key-pairs"`
+	// how the certificate of 'host' is obtained from an ACME CA when there are no cert/key pairs
+	TLSACME *TLSACME `json:"tls-acme"`
+	// only one of the below fallbacks can be set for the requests which fail to authenticate
+	TLSBadAuthFallbackSiteDir string `json:"tls-bad-auth-fallback-site-dir" validate:"excluded_with=TLSBadAuthFallbackURL TLSBadAuthFallbackAddr"`
+	// reverse proxies the requests to an HTTP(S) upstream, e.g., "http://127.0.0.1:8080" or "https://example.com"
+	TLSBadAuthFallbackURL string `json:"tls-bad-auth-fallback-url" validate:"omitempty,http_url,excluded_with=TLSBadAuthFallbackAddr"`
+	// forwards the decrypted TCP stream to an address as it is, e.g., "127.0.0.1:80" of a local web server
+	TLSBadAuthFallbackAddr string `json:"tls-bad-auth-fallback-addr" validate:"omitempty,hostname_port"`
+	// adds the 'X-Forwarded-For', 'X-Forwarded-Host' and 'X-Forwarded-Proto' headers when reverse proxying
+	TLSBadAuthFallbackXForwarded bool `json:"tls-bad-auth-fallback-x-forwarded"`
+	// the HTTP path where the TLS carrier also accepts the streams wrapped in WebSocket or gRPC (over HTTP/2) from
+	// the clients with 'tls-transport', e.g., "/hg", and the other HTTP requests are served by the fallbacks above
+	TLSTransportPath string `json:"tls-transport-path" validate:"omitempty,startswith=/"`
+	// the REALITY-like mode which borrows a real website's TLS handshakes, so no domain or certificate is needed,
+	// and the TLS carrier ignores 'tls-cert-key-pair' and the 'tls-bad-auth-fallback-*' fields with it,
+	// it can't be used with 'tls-client-auth', 'obfuscation' or 'tls-transport-path'
+	TLSReality *TLSReality `json:"tls-reality"`
+	// enables ECH (Encrypted Client Hello) for the TLS and QUIC carriers, so the clients' real SNI 'host' is hidden,
+	// and the ECHConfigList for the clients is logged when the server starts
+	TLSECH *TLSECH `json:"tls-ech"`
+	// requires the clients of the TLS and QUIC carriers to also present certificates signed by a CA,
+	// whose subject common name must be the name of the user in 'users' matched by the password
+	TLSClientAuth *TLSClientAuth `json:"tls-client-auth"`
+	QUICPort      int            `json:"quic-port" validate:"gte=0,lte=65536"`
+	// the ALPN protocols of the QUIC carrier, which default to "h3" and should be the same as the standard TUIC clients' 'alpn'
+	QUICALPN []string `json:"quic-alpn"`
+	// the max QUIC flow-control windows in bytes for receiving data, up to which quic-go auto-tunes the windows,
+	// and quic-go's defaults are used when they're 0, larger ones help the throughput of long-haul links
+	QUICStreamReceiveWindow     uint64 `json:"quic-stream-receive-window"`
+	QUICConnectionReceiveWindow uint64 `json:"quic-connection-receive-window"`
+	// the congestion control of the QUIC carrier for the data sent by this side, 'cubic' (the default), 'bbr',
+	// or 'fixed-rate', which sends at 'quic-fixed-rate' whatever the packet losses are, like Hysteria's Brutal
+	QUICCongestionControl string `json:"quic-congestion-control" validate:"omitempty,oneof=cubic bbr fixed-rate"`
+	// the sending rate of the 'fixed-rate' congestion control in bytes per second, e.g., "10 MB",
+	// which should be no more than the link's bandwidth
+	QUICFixedRate Bytes `json:"quic-fixed-rate" validate:"required_if=QUICCongestionControl fixed-rate"`
+	// the UUID for a standard TUIC client to authenticate with 'password' when there are no 'users'
+	TUICUUID string `json:"tuic-uuid" validate:"omitempty,uuid"`
+	// obfuscates the TCP and TLS carriers' streams on the sockets, and the TLS carrier ignores it in the REALITY-like mode
+	Obfuscation *Obfuscation `json:"obfuscation"`
+}
+
+type HgUser struct {
+	Name     string   `json:"name" validate:"required"`
+	Password Password `json:"password" validate:"required"`
+	// the UUID for a standard TUIC client to authenticate with the user's 'password'
+	TUICUUID string `json:"tuic-uuid" validate:"omitempty,uuid"`
 }
 
+// returns a single user with an empty name for the 'password' field if no 'users' is configured
+
+func (hg *Hg) AllUsers() []HgUser {
+	if len(hg.Users) == 0 {
+		return []HgUser{{Password: hg.Password, TUICUUID: hg.TUICUUID}}
+	}
+	return hg.Users
+}
+
+// returns 'tls-cert-key-pair' and 'tls-cert-key-pairs' together, which is empty for the ACME certificate
+
+func (hg *Hg) AllTLSCertKeyPairs() []TLSCertKeyPair {
+	var pairs []TLSCertKeyPair
+	if hg.TLSCertKeyPair != nil {
+		pairs = append(pairs, *hg.TLSCertKeyPair)
+	}
+	return append(pairs, hg.TLSCertKeyPairs...)
+}
+
+const (
+	ProtocolHg          = "hg"
+	ProtocolShadowsocks = "shadowsocks"
+	ProtocolTrojan      = "trojan"
+	ProtocolTUIC        = "tuic"
+)
+
 type ProxyNode struct {
-	Host        string   `json:"host" validate:"ip|hostname_rfc1123"`
-	Password    Password `json:"password" validate:"required"`
-	TCPPort     int      `json:"tcp-port" validate:"gte=0,lte=65536"`
-	TLSPort     int      `json:"tls-port" validate:"gte=0,lte=65536"`
-	TLSCertFile string   `json:"tls-cert"`
-	QUICPort    int      `json:"quic-port" validate:"gte=0,lte=65536"`
+	// 'hg' (the default) for an hg server, 'shadowsocks' for a standard Shadowsocks 2022 server,
+	// e.g., shadowsocks-rust or sing-box, which uses 'tcp-port' only,
+	// 'trojan' for a Trojan server, which uses 'tls-port' only and accepts any string as the password,
+	// or 'tuic' for a standard TUIC v5 server, which uses 'quic-port' and 'tuic-uuid' and also accepts any string as the password
+	Protocol string   `json:"protocol" validate:"omitempty,oneof=hg shadowsocks trojan tuic"`
+	Host     string   `json:"host" validate:"ip|hostname_rfc1123"`
+	Password Password `json:"password" validate:"required"`
+	// the hg server's 'password' when the server has 'users' and this node uses one of these users' password,
+	// which is needed by the TCP carrier (Shadowsocks 2022) for its identity header
+	IdentityPassword *Password `json:"identity-password"`
+	TCPPort          int       `json:"tcp-port" validate:"gte=0,lte=65536"`
+	// the same as the 'ss-method' field of the hg inbound
+	SSMethod string `json:"ss-method" validate:"omitempty,oneof=2022-blake3-aes-128-gcm 2022-blake3-aes-256-gcm 2022-blake3-chacha20-poly1305"`
+	TLSPort  int    `json:"tls-port" validate:"gte=0,lte=65536"`
+	// the PEM file of the certificates to trust, which can be a bundle of multiple ones,
+	// and the server name defaults to the first DNS name in them or 'host'
+	TLSCertFile string `json:"tls-cert"`
+	// overrides the server name for the SNI and the certificate verification
+	TLSSNI string `json:"tls-sni" validate:"omitempty,ip|hostname_rfc1123"`
+	// the base64 SHA-256 hashes of the trusted certificates' public keys (SPKI), and one of the certificates in the server's
+	// verified chains must match
+	TLSPinnedSPKISHA256 []string `json:"tls-pinned-spki-sha256" validate:"dive,base64"`
+	// skips verifying the server's certificate chain and name for the lab use, while the server's own certificate
+	// (not the others in its chain) is still checked against the pins above
+	TLSInsecureSkipVerify bool `json:"tls-insecure-skip-verify"`
+	// the browser whose ClientHello is mimicked by the TLS carrier, which is 'chrome', 'firefox' or 'safari',
+	// and Go's ClientHello is used by default ('chrome' with 'tls-reality'). The QUIC carrier of the 'tuic' protocol
+	// only mimics 'chrome'
+	TLSFingerprint string `json:"tls-fingerprint" validate:"omitempty,oneof=chrome firefox safari"`
+	// the certificate and key files' paths separated by whitespace for an hg server with 'tls-client-auth'
+	TLSClientCertKeyPair *TLSCertKeyPair `json:"tls-client-cert-key-pair"`
+	// wraps the TLS carrier's stream in a WebSocket ('ws') or gRPC ('grpc') stream over HTTP/2,
+	// so it can go through CDNs or HTTP reverse proxies to the hg server's 'tls-transport-path'
+	TLSTransport     string `json:"tls-transport" validate:"omitempty,oneof=ws grpc,excluded_with=TLSReality"`
+	TLSTransportPath string `json:"tls-transport-path" validate:"required_with=TLSTransport,omitempty,startswith=/"`
+	// the HTTP 'Host' header of the wrapped streams, which defaults to the TLS server name
+	TLSTransportHost string `json:"tls-transport-host" validate:"omitempty,hostname_rfc1123"`
+	// for an hg server with 'tls-reality', and 'tls-fingerprint' defaults to 'chrome' with it,
+	// it can't be used with 'tls-client-cert-key-pair' or 'obfuscation'
+	TLSReality *TLSRealityClient `json:"tls-reality"`
+	// the server's ECHConfigList encoded in base64 for ECH, or fetched from the 'ech' parameter of the host's DNS HTTPS record
+	// via the DNS-over-HTTPS server 'tls-ech-doh-url', e.g., "https://1.1.1.1/dns-query"
+	TLSECHConfigList string `json:"tls-ech-config-list" validate:"omitempty,base64,excluded_with=TLSECHDoHURL TLSFingerprint"`
+	TLSECHDoHURL     string `json:"tls-ech-doh-url" validate:"omitempty,http_url,excluded_with=TLSFingerprint"`
+	QUICPort         int    `json:"quic-port" validate:"gte=0,lte=65536"`
+	// how the QUIC carrier relays UDP packets, 'native' (the default) uses QUIC datagrams,
+	// and 'quic' uses QUIC streams, which is lossless but slower
+	QUICUDPRelayMode string `json:"quic-udp-relay-mode" validate:"omitempty,oneof=native quic"`
+	// the same as the 'quic-alpn' field of the hg inbound
+	QUICALPN []string `json:"quic-alpn"`
+	TUICUUID string   `json:"tuic-uuid" validate:"required_if=Protocol tuic,omitempty,uuid"`
+	// the max number of the QUIC carrier's parallel QUIC connections, which defaults to 1,
+	// and a new one is only opened when all the others are relaying
+	QUICConnections int `json:"quic-connections" validate:"gte=0,lte=16"`
+	// the same as the fields of the hg inbound, which apply to the data received by this client
+	QUICStreamReceiveWindow     uint64 `json:"quic-stream-receive-window"`
+	QUICConnectionReceiveWindow uint64 `json:"quic-connection-receive-window"`
+	// the same as the fields of the hg inbound, which apply to the data sent by this client
+	QUICCongestionControl string `json:"quic-congestion-control" validate:"omitempty,oneof=cubic bbr fixed-rate"`
+	QUICFixedRate         Bytes  `json:"quic-fixed-rate" validate:"required_if=QUICCongestionControl fixed-rate"`
+	// the same as the 'obfuscation' field of the hg inbound, where the padding must match the server's
+	Obfuscation *Obfuscation `json:"obfuscation"`
 }
 
+const (
+	TLSFingerprintChrome  = "chrome"
+	TLSFingerprintFirefox = "firefox"
+	TLSFingerprintSafari  = "safari"
+)
+
+const (
+	TLSTransportWebSocket = "ws"
+	TLSTransportGRPC      = "grpc"
+)
+
+const (
+	QUICUDPRelayModeNative = "native"
+	QUICUDPRelayModeQUIC   = "quic"
+)
+
+const (
+	QUICCongestionControlCubic     = "cubic"
+	QUICCongestionControlBBR       = "bbr"
+	QUICCongestionControlFixedRate = "fixed-rate"
+)
+
 type Route struct {
 	Rules Rules  `json:"rules" validate:"dive"`
 	Final string `json:"final" validate:"required"`
@@ -76,6 +281,128 @@ type Misc struct {
 	ProfilingPort       int  `json:"profiling-port" validate:"gte=0,lte=65536"`
 }
 
+type Quota struct {
+	// the file to persist the used monthly quotas across restarts
+	StateFile string `json:"state-file"`
+	// the keys are the inbound users' names, from both the 'http-socks' and 'hg' inbounds
+	Users map[string]*UserQuota `json:"users" validate:"dive"`
+}
+
+type UserQuota struct {
+	// the bandwidth in both directions shared by all connections of the user, in bytes per second
+	RateLimit Bytes `json:"rate-limit"`
+	// the bandwidth in both directions of each connection of the user, in bytes per second
+	ConnectionRateLimit Bytes `json:"connection-rate-limit"`
+	// the traffic in both directions that the user can use in a calendar month
+	MonthlyQuota Bytes `json:"monthly-quota"`
+}
+
+// Bytes is a number of bytes, which can be also written as a string like "10 MB" or "1.5GiB" in the config file
+
+type Bytes uint64
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+type Log struct {
+	Level  slog.Level `json:"level"`
+	Format string     `json:"format" validate:"omitempty,oneof=text json"`
+	// overrides the level for the specific components, e.g. '"components": {"tu_carrier": "debug"}'
+	Components map[string]slog.Level `json:"components" validate:"dive,keys,oneof=router socks http tr_carrier tu_carrier ss_carrier updater,endkeys"`
+}
+
+type TLSReality struct {
+	// the real website whose TLS handshakes are borrowed, e.g., "www.example.com:443",
+	// and the connections which fail to authenticate are forwarded to it as they are
+	Dest string `json:"dest" validate:"hostname_port"`
+	// the SNIs which the clients can use, which should be served by 'dest'
+	ServerNames []string `json:"server-names" validate:"required,dive,hostname_rfc1123"`
+	// the X25519 private key encoded in base64url without padding
+	PrivateKey string `json:"private-key" validate:"base64rawurl"`
+	// the hex strings of up to 8 bytes which the clients can use, and it defaults to only the empty one
+	ShortIDs []string `json:"short-ids" validate:"dive,omitempty,hexadecimal,max=16"`
+}
+
+type TLSRealityClient struct {
+	ServerName string `json:"server-name" validate:"hostname_rfc1123"`
+	// the X25519 public key of the server's 'private-key' encoded in base64url without padding
+	PublicKey string `json:"public-key" validate:"base64rawurl"`
+	ShortID   string `json:"short-id" validate:"omitempty,hexadecimal,max=16"`
+}
+
+type TLSECH struct {
+	// the SNI of the outer ClientHello, which is visible to the others, e.g., another domain of the server's IP
+	PublicName string `json:"public-name" validate:"hostname_rfc1123"`
+	// the X25519 private key encoded in base64url without padding, which is the same format as 'tls-reality'
+	PrivateKey string `json:"private-key" validate:"base64rawurl"`
+}
+
+const (
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+	ACMEChallengeHTTP01    = "http-01"
+	ACMEChallengeDNS01     = "dns-01"
+)
+
+type TLSACME struct {
+	// the ACME directory URL of the CA, e.g., "https://acme.zerossl.com/v2/DV90" for ZeroSSL
+	// or "https://localhost:14000/dir" for a local Pebble, which defaults to Let's Encrypt
+	DirectoryURL string `json:"directory-url" validate:"http_url"`
+	// the root certificate file of a test CA's ACME server, e.g., Pebble's 'pebble.minica.pem'
+	CACertFile string `json:"ca-cert"`
+	Email      string `json:"email" validate:"omitempty,email"`
+	// the External Account Binding which some CAs like ZeroSSL need, and the HMAC key is encoded in base64url
+	EABKeyID   string `json:"eab-key-id" validate:"required_with=EABHMACKey"`
+	EABHMACKey string `json:"eab-hmac-key" validate:"required_with=EABKeyID"`
+	// 'http-01' (the default) serves the challenge on 'http-port', and the CA may try 'tls-alpn-01' on 'tls-port' first,
+	// 'tls-alpn-01' only uses 'tls-port', which the CA connects to as 443,
+	// 'dns-01' sets a TXT record via 'dns-provider', so no ports need to be reachable by the CA
+	Challenge   string           `json:"challenge" validate:"oneof=tls-alpn-01 http-01 dns-01"`
+	HTTPPort    int              `json:"http-port" validate:"gte=0,lte=65536"`
+	DNSProvider *ACMEDNSProvider `json:"dns-provider" validate:"required_if=Challenge dns-01"`
+	// where the account key and the certificates are stored
+	StorageDir string `json:"storage-dir" validate:"required"`
+}
+
+const (
+	ACMEDNSProviderCloudflare = "cloudflare"
+	ACMEDNSProviderExec       = "exec"
+)
+
+type ACMEDNSProvider struct {
+	// 'cloudflare' manages the records with the API token 'api-token' which has the 'Zone.DNS' edit permission,
+	// 'exec' runs 'command' with the arguments "present" or "cleanup", the record's FQDN and its value
+	Name     string `json:"name" validate:"oneof=cloudflare exec"`
+	APIToken string `json:"api-token" validate:"required_if=Name cloudflare"`
+	Command  string `json:"command" validate:"required_if=Name exec"`
+	// how long to wait for the record to be visible to the CA after setting it
+	PropagationSeconds int `json:"propagation-seconds" validate:"gte=0"`
+}
+
+type TLSClientAuth struct {
+	// the PEM file of the CA certificates which sign the clients' certificates
+	CACertFile string `json:"ca-cert" validate:"required"`
+	// the CA's certificate revocation list file in PEM or DER, which is reloaded when it's modified
+	CRLFile string `json:"crl"`
+}
+
+// the obfuscation between a carrier and its TCP socket, where the padding is only understood by a peer with the same
+// 'padding-packets', and the shaping only changes how this side writes
+
+type Obfuscation struct {
+	// the first N writes in each direction are framed with random padding of up to 'padding-max-size' bytes
+	PaddingPackets int `json:"padding-packets" validate:"gte=0"`
+	PaddingMaxSize int `json:"padding-max-size" validate:"required_with=PaddingPackets,omitempty,gte=1,lte=65535"`
+	// the writes are split into the segments whose sizes are random between 'shaping-min-size' and 'shaping-max-size',
+	// and in the first 'shaping-delayed-writes' writes, a random delay of up to 'shaping-max-delay-ms' milliseconds
+	// is added before each segment but the first one
+	ShapingMinSize       int `json:"shaping-min-size" validate:"required_with=ShapingMaxSize,omitempty,gte=1"`
+	ShapingMaxSize       int `json:"shaping-max-size" validate:"omitempty,gtefield=ShapingMinSize"`
+	ShapingMaxDelayMS    int `json:"shaping-max-delay-ms" validate:"excluded_without=ShapingMaxSize,gte=0,lte=1000"`
+	ShapingDelayedWrites int `json:"shaping-delayed-writes" validate:"required_with=ShapingMaxDelayMS,gte=0"`
+}
+
 type TLSCertKeyPair struct {
 	CertFile string
 	KeyFile  string
@@ -119,6 +446,12 @@ const (
 	defaultTLSPort       = 443
 	defaultQUICPort      = 443
 	defaultProfilingPort = 6060
+
+	defaultACMEDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	defaultACMEHTTPPort     = 80
+	defaultACMEStorageDir   = "certs"
+
+	defaultQuotaStateFile = "quota_state.json"
 )
 
 func (httpSOCKS *HTTPSOCKS) UnmarshalJSON(data []byte) error {
@@ -134,6 +467,9 @@ func (hg *Hg) UnmarshalJSON(data []byte) error {
 	hgAlias := (*HgAlias)(hg)
 	hgAlias.TLSPort = defaultTLSPort
 	hgAlias.QUICPort = defaultQUICPort
+	// the fields not in 'tls-acme' keep these defaults, as json.Unmarshal decodes into the existing struct
+	hgAlias.TLSACME = &TLSACME{DirectoryURL: defaultACMEDirectoryURL, Challenge: ACMEChallengeHTTP01,
+		HTTPPort: defaultACMEHTTPPort, StorageDir: defaultACMEStorageDir}
 	return json.Unmarshal(data, hgAlias)
 }
 
@@ -152,12 +488,40 @@ func (pw *Password) UnmarshalJSON(data []byte) error {
 		return errors.New(err, "fail to parse the 'password' field")
 	}
 
-	bs, err := hex.DecodeString(pwStr)
-	if err != nil || len(bs) != 16 {
-		return errors.New("the password should be 32 hex characters in length")
+	if pwStr == "" {
+		return errors.New("the password can't be empty")
 	}
-	pw.Raw = [16]byte(bs)
 	pw.String = pwStr
+	bs, err := hex.DecodeString(pwStr)
+	if err != nil {
+		// other Shadowsocks 2022 implementations use base64 encoded keys
+		bs, err = base64.StdEncoding.DecodeString(pwStr)
+	}
+	// a Trojan server's password can be any string, so the key is checked later when it's needed
+	if err == nil && (len(bs) == 16 || len(bs) == 32) {
+		pw.Size = copy(pw.Raw[:], bs)
+	}
+	return nil
+}
+
+func (bytes *Bytes) UnmarshalJSON(data []byte) error {
+	var n uint64
+	err := json.Unmarshal(data, &n)
+	if err == nil {
+		*bytes = Bytes(n)
+		return nil
+	}
+
+	var bytesStr string
+	err = json.Unmarshal(data, &bytesStr)
+	if err != nil {
+		return errors.New(err, "the bytes value should be a number or a string like \"10 MB\"")
+	}
+	n, err = humanize.ParseBytes(bytesStr)
+	if err != nil {
+		return errors.Newf(err, "fail to parse the bytes value '%v'", bytesStr)
+	}
+	*bytes = Bytes(n)
 	return nil
 }
 
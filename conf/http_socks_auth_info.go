@@ -1,5 +1,14 @@
 package conf
 
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
 type HTTPSOCKSAuthInfo struct {
 	Username string
 	Password string
@@ -9,10 +18,61 @@ func (authInfo *HTTPSOCKSAuthInfo) IsEmpty() bool {
 	return authInfo == nil || (authInfo.Username == "" && authInfo.Password == "")
 }
 
-func (authInfo *HTTPSOCKSAuthInfo) NotEqual(anotherAuthInfo *HTTPSOCKSAuthInfo) bool {
-	return !(authInfo.Username == anotherAuthInfo.Username && authInfo.Password == anotherAuthInfo.Password)
+type HTTPSOCKSUser struct {
+	Username string `json:"username" validate:"required"`
+	// a plain text password or a bcrypt hash, e.g. the one generated by 'htpasswd -nbB username password'
+	Password string `json:"password" validate:"required"`
 }
 
-func (authInfo *HTTPSOCKSAuthInfo) NotEqual2(username, password string) bool {
-	return !(authInfo.Username == username && authInfo.Password == password)
+var bcryptHashPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+func (user *HTTPSOCKSUser) IsHashedPassword() bool {
+	for _, prefix := range bcryptHashPrefixes {
+		if strings.HasPrefix(user.Password, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPSOCKSAuthenticator checks the username/password pairs sent by HTTP/SOCKS clients against the configured users.
+
+type HTTPSOCKSAuthenticator struct {
+	users map[string]*HTTPSOCKSUser
+	// a bcrypt comparison is slow on purpose, so we cache the SHA256 sum of the verified password for each user
+	verifiedHashedPasswords sync.Map
+}
+
+func NewHTTPSOCKSAuthenticator(users []HTTPSOCKSUser) *HTTPSOCKSAuthenticator {
+	authenticator := &HTTPSOCKSAuthenticator{users: make(map[string]*HTTPSOCKSUser, len(users))}
+	for i := range users {
+		authenticator.users[users[i].Username] = &users[i]
+	}
+	return authenticator
+}
+
+func (authenticator *HTTPSOCKSAuthenticator) IsEmpty() bool {
+	return authenticator == nil || len(authenticator.users) == 0
+}
+
+func (authenticator *HTTPSOCKSAuthenticator) Authenticate(username, password string) bool {
+	user, ok := authenticator.users[username]
+	if !ok {
+		return false
+	}
+	if !user.IsHashedPassword() {
+		return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+	}
+
+	passwordSum := sha256.Sum256([]byte(password))
+	verifiedSum, ok := authenticator.verifiedHashedPasswords.Load(username)
+	if ok {
+		verifiedSum := verifiedSum.([sha256.Size]byte)
+		return subtle.ConstantTimeCompare(verifiedSum[:], passwordSum[:]) == 1
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return false
+	}
+	authenticator.verifiedHashedPasswords.Store(username, passwordSum)
+	return true
 }
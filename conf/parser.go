@@ -3,6 +3,7 @@ package conf
 import (
 	"encoding/json"
 	stdErrors "errors"
+	"log/slog"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -34,10 +35,16 @@ func Parse(configFilePath string) (*Config, error) {
 	// default to direct for Final field
 	config.Route.Final = "direct"
 	config.Misc.ProfilingPort = defaultProfilingPort
+	config.Log.Format = LogFormatText
+	config.Quota.StateFile = defaultQuotaStateFile
 	err = json.Unmarshal(bs, &config)
 	if err != nil {
 		return nil, errors.Newf(err, "error: %v", configFilePath)
 	}
+	// 'verbose-log' is kept as a shortcut for the debug level
+	if config.Misc.VerboseLog {
+		config.Log.Level = min(config.Log.Level, slog.LevelDebug)
+	}
 
 	err = config.Route.Rules.setupRulesData()
 	if err != nil {
@@ -58,10 +65,152 @@ func Parse(configFilePath string) (*Config, error) {
 			}
 		}
 	}
+	err = setupSSMethods(config)
+	if err != nil {
+		return nil, errors.Newf(err, "error: fail to parse the config file %v", configFilePath)
+	}
+	err = validateTUICUUIDs(config)
+	if err != nil {
+		return nil, errors.Newf(err, "error: fail to parse the config file %v", configFilePath)
+	}
+	err = validateHTTPSOCKSUsernames(config)
+	if err != nil {
+		return nil, errors.Newf(err, "error: fail to parse the config file %v", configFilePath)
+	}
+	err = validateQUICFingerprints(config)
+	if err != nil {
+		return nil, errors.Newf(err, "error: fail to parse the config file %v", configFilePath)
+	}
+	err = validateTLSReality(config)
+	if err != nil {
+		return nil, errors.Newf(err, "error: fail to parse the config file %v", configFilePath)
+	}
 	resolveAllFilePathsToConfigFolder(config, filepath.Dir(configFilePath))
 	return config, nil
 }
 
+// fills the default Shadowsocks 2022 methods, and checks the passwords' lengths and the ports needed by them
+
+func setupSSMethods(config *Config) error {
+	if hg := config.Inbounds.Hg; hg != nil {
+		passwords := []*Password{&hg.Password}
+		for i := range hg.Users {
+			passwords = append(passwords, &hg.Users[i].Password)
+		}
+		err := setupSSMethod(&hg.SSMethod, len(hg.Users) > 0, passwords)
+		if err != nil {
+			return errors.New(err, "the 'hg' inbound")
+		}
+	}
+	for name, node := range config.Outbounds {
+		if node.Protocol == ProtocolShadowsocks && node.TCPPort == 0 {
+			return errors.Newf("the '%v' outbound needs a 'tcp-port' for the '%v' protocol", name, node.Protocol)
+		}
+		// the Trojan and TUIC servers don't use the Shadowsocks 2022 keys
+		if node.Protocol == ProtocolTrojan || node.Protocol == ProtocolTUIC {
+			continue
+		}
+		passwords := []*Password{&node.Password}
+		if node.IdentityPassword != nil {
+			passwords = append(passwords, node.IdentityPassword)
+		}
+		err := setupSSMethod(&node.SSMethod, node.IdentityPassword != nil, passwords)
+		if err != nil {
+			return errors.Newf(err, "the '%v' outbound", name)
+		}
+	}
+	return nil
+}
+
+func setupSSMethod(method *string, hasIdentityHeader bool, passwords []*Password) error {
+	if *method == "" {
+		*method = SSMethodAES128GCM
+		if passwords[0].Size == SSKeySize(SSMethodAES256GCM) {
+			*method = SSMethodAES256GCM
+		}
+	}
+	// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-2-shadowsocks-2022-extensible-identity-headers.md
+	// Identity headers are only defined for the AES methods.
+	if hasIdentityHeader && *method == SSMethodChaCha20Poly1305 {
+		return errors.Newf("the '%v' method doesn't support multiple users", *method)
+	}
+	keySize := SSKeySize(*method)
+	for _, pw := range passwords {
+		if pw.Size == 0 {
+			return errors.New("the password should be a 16 or 32 bytes key, which is encoded in hex (32 or 64 hex characters) or base64")
+		}
+		if pw.Size != keySize {
+			return errors.Newf("the '%v' method needs %v bytes passwords (%v hex characters)", *method, keySize, keySize*2)
+		}
+	}
+	return nil
+}
+
+// a standard TUIC client's user is looked up by its UUID, so the users' UUIDs can't be the same
+
+func validateTUICUUIDs(config *Config) error {
+	hg := config.Inbounds.Hg
+	if hg == nil {
+		return nil
+	}
+	uuids := make(map[string]struct{}, len(hg.Users))
+	for _, user := range hg.Users {
+		if user.TUICUUID == "" {
+			continue
+		}
+		uuid := strings.ToLower(user.TUICUUID)
+		if _, ok := uuids[uuid]; ok {
+			return errors.Newf("the 'hg' inbound's users have the same 'tuic-uuid' %v", user.TUICUUID)
+		}
+		uuids[uuid] = struct{}{}
+	}
+	return nil
+}
+
+// the QUIC carrier only mimics Chrome's HTTP/3 ClientHello, and the browsers' HTTP/3 ClientHellos differ from their TCP ones
+
+func validateQUICFingerprints(config *Config) error {
+	for name, node := range config.Outbounds {
+		if node.Protocol == ProtocolTUIC && node.TLSFingerprint != "" && node.TLSFingerprint != TLSFingerprintChrome {
+			return errors.Newf("the '%v' outbound's 'tls-fingerprint' can only be '%v' for the '%v' protocol",
+				name, TLSFingerprintChrome, node.Protocol)
+		}
+	}
+	return nil
+}
+
+// the REALITY-like mode forwards the raw TCP streams of the other clients to the real website, so the TLS carrier can't
+// check the client certificates, unwrap the obfuscated sockets or serve the wrapped streams with it
+
+func validateTLSReality(config *Config) error {
+	if hg := config.Inbounds.Hg; hg != nil && hg.TLSReality != nil {
+		if hg.TLSClientAuth != nil || hg.Obfuscation != nil || hg.TLSTransportPath != "" {
+			return errors.New("the 'hg' inbound's 'tls-reality' can't be used with 'tls-client-auth', 'obfuscation' or 'tls-transport-path'")
+		}
+	}
+	for name, node := range config.Outbounds {
+		if node.TLSReality != nil && (node.TLSClientCertKeyPair != nil || node.Obfuscation != nil) {
+			return errors.Newf("the '%v' outbound's 'tls-reality' can't be used with 'tls-client-cert-key-pair' or 'obfuscation'", name)
+		}
+	}
+	return nil
+}
+
+// the users are looked up by their usernames, so a user in 'users' can't have the same username as the 'username' shortcut
+
+func validateHTTPSOCKSUsernames(config *Config) error {
+	httpSOCKS := config.Inbounds.HTTPSOCKS
+	if httpSOCKS == nil || (httpSOCKS.Username == "" && httpSOCKS.Password == "") {
+		return nil
+	}
+	for _, user := range httpSOCKS.Users {
+		if user.Username == httpSOCKS.Username {
+			return errors.Newf("the 'http-socks' inbound's users have the same username '%v' as its 'username' field", user.Username)
+		}
+	}
+	return nil
+}
+
 func resolveAllFilePathsToConfigFolder(config *Config, configFileFolder string) {
 	hg := config.Inbounds.Hg
 	if hg != nil {
@@ -70,14 +219,38 @@ func resolveAllFilePathsToConfigFolder(config *Config, configFileFolder string)
 			tlsCertKeyPair.CertFile = resolveTo(tlsCertKeyPair.CertFile, configFileFolder)
 			tlsCertKeyPair.KeyFile = resolveTo(tlsCertKeyPair.KeyFile, configFileFolder)
 		}
+		for i := range hg.TLSCertKeyPairs {
+			tlsCertKeyPair := &hg.TLSCertKeyPairs[i]
+			tlsCertKeyPair.CertFile = resolveTo(tlsCertKeyPair.CertFile, configFileFolder)
+			tlsCertKeyPair.KeyFile = resolveTo(tlsCertKeyPair.KeyFile, configFileFolder)
+		}
+		if hg.TLSACME != nil {
+			hg.TLSACME.StorageDir = resolveTo(hg.TLSACME.StorageDir, configFileFolder)
+			if hg.TLSACME.CACertFile != "" {
+				hg.TLSACME.CACertFile = resolveTo(hg.TLSACME.CACertFile, configFileFolder)
+			}
+		}
+		if hg.TLSClientAuth != nil {
+			hg.TLSClientAuth.CACertFile = resolveTo(hg.TLSClientAuth.CACertFile, configFileFolder)
+			if hg.TLSClientAuth.CRLFile != "" {
+				hg.TLSClientAuth.CRLFile = resolveTo(hg.TLSClientAuth.CRLFile, configFileFolder)
+			}
+		}
 		if hg.TLSBadAuthFallbackSiteDir != "" {
 			hg.TLSBadAuthFallbackSiteDir = resolveTo(hg.TLSBadAuthFallbackSiteDir, configFileFolder)
 		}
 	}
+	if config.Quota.StateFile != "" {
+		config.Quota.StateFile = resolveTo(config.Quota.StateFile, configFileFolder)
+	}
 	for _, v := range config.Outbounds {
 		if v.TLSCertFile != "" {
 			v.TLSCertFile = resolveTo(v.TLSCertFile, configFileFolder)
 		}
+		if v.TLSClientCertKeyPair != nil {
+			v.TLSClientCertKeyPair.CertFile = resolveTo(v.TLSClientCertKeyPair.CertFile, configFileFolder)
+			v.TLSClientCertKeyPair.KeyFile = resolveTo(v.TLSClientCertKeyPair.KeyFile, configFileFolder)
+		}
 	}
 }
 
@@ -14,6 +14,7 @@ type Matcher struct {
 	domainFullAndSuffixMatcher domainFullAndSuffixMatcher
 	domainRegexMatcher         []regexp.Regexp
 	ipCidrMatcher              *netipx.IPSet
+	userMatcher                map[string]struct{}
 	bakedMatchRules            []string
 }
 
@@ -25,6 +26,7 @@ const (
 	cidrPrefix         = "cidr/"
 	domainTagPrefix    = "domain-tag/"
 	ipSetTagPrefix     = "ip-set-tag/"
+	userPrefix         = "user/"
 )
 
 func newMatcher(matchRules []string) *Matcher {
@@ -38,6 +40,7 @@ func (matcher *Matcher) CopyWithBakedRulesOnly() *Matcher {
 func (matcher *Matcher) SetupRulesData(rulesQueryStore *DomainIPSetRulesQueryStore) error {
 	var domainRegexMatcher []regexp.Regexp
 	var ipSetBuilder netipx.IPSetBuilder
+	userMatcher := make(map[string]struct{})
 
 	for _, rule := range matcher.bakedMatchRules {
 		switch {
@@ -90,6 +93,10 @@ func (matcher *Matcher) SetupRulesData(rulesQueryStore *DomainIPSetRulesQuerySto
 			if err != nil {
 				return err
 			}
+
+		case strings.HasPrefix(rule, userPrefix):
+			user := strings.TrimPrefix(rule, userPrefix)
+			userMatcher[user] = struct{}{}
 		default:
 			return errors.Newf("no matched rule item %v", rule)
 		}
@@ -101,6 +108,7 @@ func (matcher *Matcher) SetupRulesData(rulesQueryStore *DomainIPSetRulesQuerySto
 	}
 	matcher.domainRegexMatcher = domainRegexMatcher
 	matcher.ipCidrMatcher = ipSet
+	matcher.userMatcher = userMatcher
 	return nil
 }
 
@@ -122,6 +130,16 @@ func (matcher *Matcher) MatchIP(ip *netip.Addr) bool {
 	return matcher.ipCidrMatcher.Contains(ipv6)
 }
 
+// the user is the authenticated username of an inbound, and it's empty if no authentication is used
+
+func (matcher *Matcher) MatchUser(user string) bool {
+	if user == "" {
+		return false
+	}
+	_, ok := matcher.userMatcher[user]
+	return ok
+}
+
 func (matcher *Matcher) UnmarshalJSON(data []byte) error {
 	var matchRules []string
 	err := json.Unmarshal(data, &matchRules)
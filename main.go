@@ -21,6 +21,7 @@ import (
 	"github.com/ringo-is-a-color/heteroglossia/util/log"
 	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/osutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/quota"
 	"github.com/ringo-is-a-color/heteroglossia/util/updater"
 )
 
@@ -37,7 +38,11 @@ func main() {
 		log.WarnWithError("fail to change the current working directory to '%v'", err, configFileDir)
 	}
 
-	log.SetVerbose(config.Misc.VerboseLog)
+	log.Setup(config.Log.Level, config.Log.Components, config.Log.Format == conf.LogFormatJSON)
+	err = quota.Setup(&config.Quota)
+	if err != nil {
+		log.Fatal("fail to load the quota state", err)
+	}
 	if config.Misc.Profiling {
 		go func() {
 			err := netutil.ListenHTTPAndServe(context.Background(), ":"+strconv.Itoa(config.Misc.ProfilingPort), nil)
@@ -0,0 +1,29 @@
+// Package congestion exposes the congestion control interface of quic-go, so an application can replace the default
+// CUBIC sender with Config.CongestionControl.
+//
+// This package isn't part of upstream quic-go, it's added by heteroglossia's fork.
+package congestion
+
+import (
+	"github.com/quic-go/quic-go/internal/congestion"
+	"github.com/quic-go/quic-go/internal/protocol"
+	"github.com/quic-go/quic-go/internal/utils"
+)
+
+type (
+	// A ByteCount in QUIC
+	ByteCount = protocol.ByteCount
+	// A PacketNumber in QUIC
+	PacketNumber = protocol.PacketNumber
+	// RTTStats provides the RTT measurements of a connection, which are updated by quic-go
+	RTTStats = utils.RTTStats
+	// CongestionControl performs congestion control and pacing for a connection
+	CongestionControl = congestion.SendAlgorithmWithDebugInfos
+)
+
+// InitialPacketSize is the size of the first packets sent, before path MTU discovery
+const InitialPacketSize = protocol.InitialPacketSize
+
+// A Factory creates the CongestionControl of a new connection.
+// It's called once for every connection, and the returned CongestionControl is only used by that connection.
+type Factory func(rttStats *RTTStats, initialMaxDatagramSize ByteCount) CongestionControl
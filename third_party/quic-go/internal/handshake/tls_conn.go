@@ -0,0 +1,43 @@
+package handshake
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+)
+
+// TLSClientConn is the client side of a TLS handshake over QUIC, which is a *tls.QUICConn by default.
+// It's added by heteroglossia's fork, so the TLS stack of the client can be replaced, e.g., by uTLS.
+type TLSClientConn interface {
+	Start(ctx context.Context) error
+	HandleData(level tls.QUICEncryptionLevel, data []byte) error
+	NextEvent() tls.QUICEvent
+	Close() error
+	ConnectionState() tls.ConnectionState
+	SetTransportParameters(params []byte)
+	// ExportKeyingMaterial is needed as the tls.ConnectionState returned by another TLS stack can't export it
+	ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error)
+}
+
+// tlsConn is what the crypto setup needs from the TLS stack
+type tlsConn interface {
+	TLSClientConn
+	SendSessionTicket(opts tls.QUICSessionTicketOptions) error
+}
+
+type stdTLSConn struct {
+	*tls.QUICConn
+}
+
+func (c stdTLSConn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	state := c.ConnectionState()
+	return state.ExportKeyingMaterial(label, context, length)
+}
+
+type customTLSClientConn struct {
+	TLSClientConn
+}
+
+func (c customTLSClientConn) SendSessionTicket(tls.QUICSessionTicketOptions) error {
+	return errors.New("SendSessionTicket called on the client")
+}
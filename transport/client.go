@@ -11,6 +11,17 @@ import (
 
 type Client interface {
 	DialTCP(ctx context.Context, addr *SocketAddress) (net.Conn, error)
+	// the 'addr' is the first packet's target address, and the returned connection can still send packets
+	// to other addresses, which the router routes one by one rather than by the first packet's route
+	DialUDP(ctx context.Context, addr *SocketAddress) (PacketConn, error)
+}
+
+// PacketConn sends UDP packets to their target addresses, and receives them with their source addresses
+
+type PacketConn interface {
+	ReadPacket(b []byte) (n int, addr *SocketAddress, err error)
+	WritePacket(b []byte, addr *SocketAddress) (n int, err error)
+	Close() error
 }
 
 func HTTPClientThroughRouter(client Client) *http.Client {
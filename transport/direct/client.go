@@ -3,6 +3,7 @@ package direct
 import (
 	"context"
 	"net"
+	"net/netip"
 
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
@@ -19,3 +20,11 @@ func NewClient() transport.Client {
 func (*client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (net.Conn, error) {
 	return netutil.DialTCP(ctx, addr.ToHostStr())
 }
+
+func (*client) DialUDP(ctx context.Context, _ *transport.SocketAddress) (transport.PacketConn, error) {
+	udpConn, err := netutil.ListenUDP()
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{UDPConn: udpConn, ctx: ctx, resolvedDomains: make(map[string]netip.Addr)}, nil
+}
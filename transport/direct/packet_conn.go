@@ -0,0 +1,60 @@
+package direct
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+)
+
+type packetConn struct {
+	*net.UDPConn
+	ctx context.Context
+	// a packet connection usually sends packets to the same few domains, so we cache their IPs
+	resolvedDomains   map[string]netip.Addr
+	resolvedDomainsMu sync.Mutex
+}
+
+var _ transport.PacketConn = new(packetConn)
+
+func (c *packetConn) ReadPacket(b []byte) (int, *transport.SocketAddress, error) {
+	n, addrPort, err := c.UDPConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		return n, nil, errors.WithStack(err)
+	}
+	return n, transport.NewSocketAddressByAddrPort(addrPort), nil
+}
+
+func (c *packetConn) WritePacket(b []byte, addr *transport.SocketAddress) (int, error) {
+	ip, err := c.resolve(addr)
+	if err != nil {
+		return 0, err
+	}
+	return errors.WithStack2(c.UDPConn.WriteToUDPAddrPort(b, netip.AddrPortFrom(ip, addr.Port)))
+}
+
+func (c *packetConn) resolve(addr *transport.SocketAddress) (netip.Addr, error) {
+	if addr.AddrType != transport.Domain {
+		return *addr.IP, nil
+	}
+
+	c.resolvedDomainsMu.Lock()
+	defer c.resolvedDomainsMu.Unlock()
+	ip, ok := c.resolvedDomains[addr.Domain]
+	if ok {
+		return ip, nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(c.ctx, "ip", addr.Domain)
+	if err != nil {
+		return netip.Addr{}, errors.WithStack(err)
+	}
+	if len(ips) == 0 {
+		return netip.Addr{}, errors.Newf("no IP found for the domain %v", addr.Domain)
+	}
+	ip = ips[0].Unmap()
+	c.resolvedDomains[addr.Domain] = ip
+	return ip, nil
+}
@@ -9,20 +9,23 @@ import (
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/log"
 )
 
+var logger = log.NewLogger("http")
+
 type Server struct {
-	authInfo     *conf.HTTPSOCKSAuthInfo
-	targetClient transport.Client
+	authenticator *conf.HTTPSOCKSAuthenticator
+	targetClient  transport.Client
 }
 
 var _ transport.Server = new(Server)
 
-func NewServer(authInfo *conf.HTTPSOCKSAuthInfo, targetClient transport.Client) *Server {
-	return &Server{authInfo, targetClient}
+func NewServer(authenticator *conf.HTTPSOCKSAuthenticator, targetClient transport.Client) *Server {
+	return &Server{authenticator, targetClient}
 }
 
 // see https://www.mnot.net/blog/2011/07/11/what_proxies_must_do point 1
@@ -66,12 +69,13 @@ func (s *Server) Serve(ctx context.Context, conn net.Conn) error {
 	if err != nil {
 		return errors.Join(err, httpError(req, conn, http.StatusBadRequest))
 	}
-	if !s.authInfo.IsEmpty() {
+	if !s.authenticator.IsEmpty() {
 		username, password, ok := parse(req)
-		if !ok || s.authInfo.NotEqual2(username, password) {
+		if !ok || !s.authenticator.Authenticate(username, password) {
 			return errors.Join(errors.New("no authentication info, or incorrect username/password"),
 				httpError(req, conn, http.StatusProxyAuthRequired))
 		}
+		ctx = contextutil.WithUser(ctx, username)
 	}
 	if isHTTPConnect {
 		err = ioutil.Write_(conn, connectSuccessBytes)
@@ -132,10 +136,10 @@ func (s *Server) Serve(ctx context.Context, conn net.Conn) error {
 
 		_ = lp.Close()
 		if rerr != nil {
-			log.InfoWithError("fail to read request", rerr)
+			logger.InfoWithError("fail to read request", rerr)
 		}
 		if werr != nil {
-			log.InfoWithError("fail to write resp", werr)
+			logger.InfoWithError("fail to write resp", werr)
 		}
 	}()
 
@@ -29,10 +29,15 @@ type server struct {
 
 var _ transport.Server = new(server)
 
+var (
+	httpLogger  = log.NewLogger("http")
+	socksLogger = log.NewLogger("socks")
+)
+
 func NewServer(httpSOCKS *conf.HTTPSOCKS, targetClient transport.Client) transport.Server {
-	authInfo := httpSOCKS.ToHTTPSOCKSAuthInfo()
+	authenticator := httpSOCKS.ToHTTPSOCKSAuthenticator()
 	return &server{httpSOCKS, targetClient,
-		http.NewServer(authInfo, targetClient), socks.NewServer(authInfo, targetClient)}
+		http.NewServer(authenticator, targetClient), socks.NewServer(authenticator, targetClient)}
 }
 
 func (s *server) ListenAndServe(ctx context.Context) error {
@@ -40,10 +45,10 @@ func (s *server) ListenAndServe(ctx context.Context) error {
 	// so also listen to IPv4 one when using '::1' or '::'
 	host := s.httpSOCKS.Host
 	connHandler := func(conn *net.TCPConn) {
-		err := s.Serve(ctx, conn)
+		logger, err := s.serve(ctx, conn)
 		_ = conn.Close()
 		if err != nil {
-			log.InfoWithError("fail to handle a HTTP/SOCKS request", err)
+			logger.InfoWithError("fail to handle a HTTP/SOCKS request", err)
 		}
 	}
 
@@ -67,7 +72,11 @@ func (s *server) ListenAndServe(ctx context.Context) error {
 				log.Info("try to set the system proxy")
 				// do not use the 'host' variable directly because we changed it for '::'
 				var err error
-				unsetProxyFunction, err := proxy.SetSystemProxy(s.httpSOCKS.Host, s.httpSOCKS.Port, s.httpSOCKS.ToHTTPSOCKSAuthInfo())
+				authInfo := s.httpSOCKS.ToSystemProxyAuthInfo()
+				if authInfo.IsEmpty() && !s.httpSOCKS.ToHTTPSOCKSAuthenticator().IsEmpty() {
+					log.Warn("all users have hashed passwords, so the system proxy is set without authentication info")
+				}
+				unsetProxyFunction, err := proxy.SetSystemProxy(s.httpSOCKS.Host, s.httpSOCKS.Port, authInfo)
 				if err != nil {
 					log.WarnWithError("fail to set the system proxy", err)
 				}
@@ -89,22 +98,29 @@ func (s *server) ListenAndServe(ctx context.Context) error {
 }
 
 func (s *server) Serve(ctx context.Context, conn net.Conn) error {
+	_, err := s.serve(ctx, conn)
+	return err
+}
+
+// returns the logger of the detected protocol, so its errors can be filtered by the 'http' or 'socks' component
+
+func (s *server) serve(ctx context.Context, conn net.Conn) (*log.Logger, error) {
 	b, err := ioutil.Read1(conn)
 	if err != nil {
-		return err
+		return httpLogger, err
 	}
 	switch b {
 	case socks.SOCKS4Version:
-		log.Info("route", contextutil.SourceTag, conn.RemoteAddr().String(),
+		socksLogger.Info("route", contextutil.SourceTag, conn.RemoteAddr().String(),
 			contextutil.InboundTag, "SOCKS4 Proxy", "access", "unknown", "policy", "unsupported & rejected")
-		return errors.New("SOCKS4 protocol is not supported, only SOCKS5 is supported")
+		return socksLogger, errors.New("SOCKS4 protocol is not supported, only SOCKS5 is supported")
 	case socks.SOCKS5Version:
 		ctx = contextutil.WithSourceAndInboundValues(ctx, conn.RemoteAddr().String(), "SOCKS5 Proxy")
-		return s.socks.Serve(ctx, conn)
+		return socksLogger, s.socks.Serve(ctx, conn)
 	default:
 		// assume this is an HTTP proxy request
 		ctx = contextutil.WithSourceAndInboundValues(ctx, conn.RemoteAddr().String(), "HTTP Proxy")
-		return s.http.Serve(ctx, ioutil.NewBytesReadPreloadConn([]byte{b}, conn))
+		return httpLogger, s.http.Serve(ctx, ioutil.NewBytesReadPreloadConn([]byte{b}, conn))
 	}
 }
 
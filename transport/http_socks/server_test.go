@@ -13,6 +13,7 @@ import (
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport/direct"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -51,6 +52,9 @@ func TestProxyConnectionHandle(t *testing.T) {
 			t.Run(name, testHandleConnectionWithEmptyAuthInfo)
 			t.Run(name, testHandleConnectionWithAuthInfo)
 			t.Run(name, testHandleConnectionWithIncorrectAuthInfo)
+			t.Run(name, testHandleConnectionWithOneOfUsers)
+			t.Run(name, testHandleConnectionWithHashedPassword)
+			t.Run(name, testHandleConnectionWithIncorrectHashedPassword)
 		}
 	}
 }
@@ -99,7 +103,63 @@ func testHandleConnectionWithIncorrectAuthInfo(t *testing.T) {
 	assert.NotNil(t, err2)
 }
 
+func testHandleConnectionWithOneOfUsers(t *testing.T) {
+	err1, err2 := parRun(func() error {
+		return startProxyServerWithUsers(t, []conf.HTTPSOCKSUser{
+			{Username: "another username", Password: "another password"},
+			{Username: authInfo.Username, Password: authInfo.Password},
+		})
+	}, func() error {
+		return startClient(authInfo)
+	})
+
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+}
+
+func testHandleConnectionWithHashedPassword(t *testing.T) {
+	err1, err2 := parRun(func() error {
+		return startProxyServerWithUsers(t, []conf.HTTPSOCKSUser{hashedUser(t, authInfo)})
+	}, func() error {
+		return startClient(authInfo)
+	})
+
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+}
+
+func testHandleConnectionWithIncorrectHashedPassword(t *testing.T) {
+	err1, err2 := parRun(func() error {
+		return startProxyServerWithUsers(t, []conf.HTTPSOCKSUser{hashedUser(t, authInfo)})
+	}, func() error {
+		return startClient(wrongAuthInfo)
+	})
+
+	assert.NotNil(t, err1)
+	assert.NotNil(t, err2)
+}
+
+func hashedUser(t *testing.T, authInfo *conf.HTTPSOCKSAuthInfo) conf.HTTPSOCKSUser {
+	hash, err := bcrypt.GenerateFromPassword([]byte(authInfo.Password), bcrypt.MinCost)
+	assert.Nil(t, err)
+	return conf.HTTPSOCKSUser{Username: authInfo.Username, Password: string(hash)}
+}
+
 func startProxyServer(t *testing.T, authInfo *conf.HTTPSOCKSAuthInfo) error {
+	var httpSOCKS *conf.HTTPSOCKS
+	if authInfo == nil {
+		httpSOCKS = &conf.HTTPSOCKS{}
+	} else {
+		httpSOCKS = &conf.HTTPSOCKS{Username: authInfo.Username, Password: authInfo.Password}
+	}
+	return startProxyServerWithConfig(t, httpSOCKS)
+}
+
+func startProxyServerWithUsers(t *testing.T, users []conf.HTTPSOCKSUser) error {
+	return startProxyServerWithConfig(t, &conf.HTTPSOCKS{Users: users})
+}
+
+func startProxyServerWithConfig(t *testing.T, httpSOCKS *conf.HTTPSOCKS) error {
 	ln, err := net.Listen("tcp", proxyServerAddr)
 	if err != nil {
 		return err
@@ -114,12 +174,6 @@ func startProxyServer(t *testing.T, authInfo *conf.HTTPSOCKSAuthInfo) error {
 		return err
 	}
 
-	var httpSOCKS *conf.HTTPSOCKS
-	if authInfo == nil {
-		httpSOCKS = &conf.HTTPSOCKS{}
-	} else {
-		httpSOCKS = &conf.HTTPSOCKS{Username: authInfo.Username, Password: authInfo.Password}
-	}
 	return (NewServer(httpSOCKS, direct.NewClient()).(*server)).Serve(context.Background(), rwc)
 }
 
@@ -21,3 +21,7 @@ var rejectedErr = errors.New("rejected")
 func (*client) DialTCP(_ context.Context, _ *transport.SocketAddress) (net.Conn, error) {
 	return nil, rejectedErr
 }
+
+func (*client) DialUDP(_ context.Context, _ *transport.SocketAddress) (transport.PacketConn, error) {
+	return nil, rejectedErr
+}
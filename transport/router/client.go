@@ -7,20 +7,29 @@ import (
 	"sync"
 
 	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/conf/rule"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/transport/direct"
 	"github.com/ringo-is-a-color/heteroglossia/transport/reject"
+	"github.com/ringo-is-a-color/heteroglossia/transport/ss_carrier"
 	"github.com/ringo-is-a-color/heteroglossia/transport/tr_carrier"
+	"github.com/ringo-is-a-color/heteroglossia/transport/tu_carrier"
 	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/log"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/updater"
 )
 
+var logger = log.NewLogger("router")
+
 type client struct {
 	route        *conf.Route
 	routeRWMutex *sync.RWMutex
 	outbounds    map[string]*conf.ProxyNode
 	tlsKeyLog    bool
+	// a QUIC carrier client keeps its QUIC connection for reuse, so we create only one client for each node
+	quicClients      map[string]transport.Client
+	quicClientsMutex sync.Mutex
 
 	httpClient *http.Client
 }
@@ -28,8 +37,10 @@ type client struct {
 var _ transport.Client = new(client)
 
 func NewClient(route *conf.Route, autoUpdateRuleFiles bool, outbounds map[string]*conf.ProxyNode, tlsKeyLog bool) transport.Client {
-	router := &client{route, new(sync.RWMutex), outbounds, tlsKeyLog, nil}
+	router := &client{route: route, routeRWMutex: new(sync.RWMutex), outbounds: outbounds, tlsKeyLog: tlsKeyLog,
+		quicClients: make(map[string]transport.Client)}
 	router.httpClient = transport.HTTPClientThroughRouter(router)
+	netutil.SetECHDoHHTTPClient(router.httpClient)
 	if autoUpdateRuleFiles {
 		go updater.StartUpdateCron(func() {
 			router.updateRoute()
@@ -39,29 +50,41 @@ func NewClient(route *conf.Route, autoUpdateRuleFiles bool, outbounds map[string
 }
 
 func (c *client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (net.Conn, error) {
+	nextClient, err := c.selectClient(ctx, addr, "TCP")
+	if err != nil {
+		return nil, err
+	}
+	return nextClient.DialTCP(ctx, addr)
+}
+
+// the packets are routed one by one, as they can be sent to different addresses through the returned connection
+
+func (c *client) DialUDP(ctx context.Context, addr *transport.SocketAddress) (transport.PacketConn, error) {
+	return newRoutedPacketConn(ctx, c, addr)
+}
+
+func (c *client) selectClient(ctx context.Context, addr *transport.SocketAddress, network string) (transport.Client, error) {
+	return c.clientOf(ctx, addr, network, c.selectPolicy(ctx, addr))
+}
+
+func (c *client) selectPolicy(ctx context.Context, addr *transport.SocketAddress) string {
+	user := contextutil.User(ctx)
 	c.routeRWMutex.RLock()
 	var policy string
-	switch addr.AddrType {
-	case transport.IPv4, transport.IPv6:
-		for _, rule := range c.route.Rules {
-			if rule.Matcher.MatchIP(addr.IP) {
-				policy = rule.Policy
-				break
-			}
-		}
-	default:
-		for _, rule := range c.route.Rules {
-			if rule.Matcher.MatchDomain(addr.Domain) {
-				policy = rule.Policy
-				break
-			}
+	for _, rule := range c.route.Rules {
+		if c.match(rule.Matcher, addr, user) {
+			policy = rule.Policy
+			break
 		}
 	}
 	c.routeRWMutex.RUnlock()
 	if policy == "final" || policy == "" {
 		policy = c.route.Final
 	}
+	return policy
+}
 
+func (c *client) clientOf(ctx context.Context, addr *transport.SocketAddress, network string, policy string) (transport.Client, error) {
 	var nextClient transport.Client
 	switch policy {
 	case "direct":
@@ -71,20 +94,58 @@ func (c *client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (ne
 	default:
 		proxyNode := c.outbounds[policy]
 		var err error
-		nextClient, err = tr_carrier.NewClient(proxyNode, c.tlsKeyLog)
+		switch proxyNode.Protocol {
+		case conf.ProtocolShadowsocks:
+			nextClient = ss_carrier.NewClient(proxyNode)
+		case conf.ProtocolTUIC:
+			nextClient, err = c.quicClient(policy, proxyNode)
+		default:
+			nextClient, err = tr_carrier.NewClient(proxyNode, c.tlsKeyLog)
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
-	log.Info("route", contextutil.SourceTag, ctx.Value(contextutil.SourceTag),
-		contextutil.InboundTag, ctx.Value(contextutil.InboundTag), "access", addr.ToHostStr(), "policy", policy)
-	return nextClient.DialTCP(ctx, addr)
+	logArgs := []any{contextutil.SourceTag, ctx.Value(contextutil.SourceTag),
+		contextutil.InboundTag, ctx.Value(contextutil.InboundTag), "network", network, "access", addr.ToHostStr(), "policy", policy}
+	if user := contextutil.User(ctx); user != "" {
+		logArgs = append(logArgs, contextutil.UserTag, user)
+	}
+	logger.Info("route", logArgs...)
+	return nextClient, nil
+}
+
+func (c *client) quicClient(name string, proxyNode *conf.ProxyNode) (transport.Client, error) {
+	c.quicClientsMutex.Lock()
+	defer c.quicClientsMutex.Unlock()
+	quicClient, ok := c.quicClients[name]
+	if ok {
+		return quicClient, nil
+	}
+	quicClient, err := tu_carrier.NewClient(proxyNode, c.tlsKeyLog)
+	if err != nil {
+		return nil, err
+	}
+	c.quicClients[name] = quicClient
+	return quicClient, nil
+}
+
+func (c *client) match(matcher *rule.Matcher, addr *transport.SocketAddress, user string) bool {
+	if matcher.MatchUser(user) {
+		return true
+	}
+	switch addr.AddrType {
+	case transport.IPv4, transport.IPv6:
+		return matcher.MatchIP(addr.IP)
+	default:
+		return matcher.MatchDomain(addr.Domain)
+	}
 }
 
 func (c *client) updateRoute() {
 	success, err := updater.UpdateRuleFile(c.httpClient)
 	if err != nil {
-		log.WarnWithError("fail to update rules' files", err)
+		logger.WarnWithError("fail to update rules' files", err)
 		return
 	}
 	if !success {
@@ -95,7 +156,7 @@ func (c *client) updateRoute() {
 	newRules, err := c.route.Rules.CopyWithNewRulesData()
 	if err != nil {
 		c.routeRWMutex.RUnlock()
-		log.WarnWithError("fail to update rules' 'matcher'", err)
+		logger.WarnWithError("fail to update rules' 'matcher'", err)
 		return
 	}
 	c.routeRWMutex.RUnlock()
@@ -103,5 +164,5 @@ func (c *client) updateRoute() {
 	c.routeRWMutex.Lock()
 	c.route.Rules = newRules
 	c.routeRWMutex.Unlock()
-	log.Info("update rules' files successfully")
+	logger.Info("update rules' files successfully")
 }
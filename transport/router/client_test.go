@@ -0,0 +1,102 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRouter(t *testing.T, routeJSON string) transport.Client {
+	route := &conf.Route{}
+	assert.Nil(t, json.Unmarshal([]byte(routeJSON), route))
+	for _, rule := range route.Rules {
+		assert.Nil(t, rule.Matcher.SetupRulesData(nil))
+	}
+	return NewClient(route, false, nil, false)
+}
+
+func startUDPEchoServer(t *testing.T, ip string) *transport.SocketAddress {
+	udpConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(ip), 0)))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = udpConn.Close()
+	})
+	go func() {
+		buf := make([]byte, transport.MaxUDPPacketSize)
+		for {
+			n, addr, err := udpConn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	}()
+	return transport.NewSocketAddressByAddrPort(udpConn.LocalAddr().(*net.UDPAddr).AddrPort())
+}
+
+// the packets to a later address are routed by their own rules rather than the first packet's route
+
+func TestPacketsRoutedByTheirAddresses(t *testing.T) {
+	router := newRouter(t, `{"rules": [{"match": ["ip/127.0.0.2"], "policy": "reject"}], "final": "direct"}`)
+	allowedAddr := startUDPEchoServer(t, "127.0.0.1")
+	rejectedAddr := startUDPEchoServer(t, "127.0.0.2")
+
+	ctx := contextutil.WithSourceAndInboundValues(context.Background(), "test", "test")
+	packetConn, err := router.DialUDP(ctx, allowedAddr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer packetConn.Close()
+	received := make(chan string, 16)
+	go func() {
+		buf := make([]byte, transport.MaxUDPPacketSize)
+		for {
+			n, addr, err := packetConn.ReadPacket(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- addr.ToHostStr() + " " + string(buf[:n])
+		}
+	}()
+
+	for _, packet := range []struct {
+		addr    *transport.SocketAddress
+		payload string
+	}{{allowedAddr, "first"}, {rejectedAddr, "rejected"}, {allowedAddr, "second"}} {
+		n, err := packetConn.WritePacket([]byte(packet.payload), packet.addr)
+		assert.Nil(t, err)
+		assert.Equal(t, len(packet.payload), n)
+	}
+	var replies []string
+	timeout := time.After(time.Second)
+loop:
+	for {
+		select {
+		case reply, ok := <-received:
+			if !ok {
+				break loop
+			}
+			replies = append(replies, reply)
+		case <-timeout:
+			break loop
+		}
+	}
+	assert.Equal(t, []string{allowedAddr.ToHostStr() + " first", allowedAddr.ToHostStr() + " second"}, replies)
+}
+
+func TestFirstPacketRejected(t *testing.T) {
+	router := newRouter(t, `{"rules": [{"match": ["ip/127.0.0.2"], "policy": "reject"}], "final": "direct"}`)
+	_, err := router.DialUDP(context.Background(), startUDPEchoServer(t, "127.0.0.2"))
+	assert.NotNil(t, err)
+}
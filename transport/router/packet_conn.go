@@ -0,0 +1,134 @@
+package router
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+)
+
+// routedPacketConn routes each packet by its target address rather than only the first packet's one,
+// and the packets routed to the same policy share one packet connection of the policy's client
+
+type routedPacketConn struct {
+	ctx    context.Context
+	router *client
+	// nil after closed, and a policy's value is nil if it fails to dial, e.g., the 'reject' policy
+	policyConns   map[string]transport.PacketConn
+	policyConnsMu sync.Mutex
+	packets       chan routedPacket
+	closed        chan struct{}
+}
+
+type routedPacket struct {
+	// a buffer from the pool, which is returned after the packet is read
+	buf  []byte
+	n    int
+	addr *transport.SocketAddress
+	err  error
+}
+
+var _ transport.PacketConn = new(routedPacketConn)
+
+// the first packet's policy is dialed at once, so the association fails early like a TCP connection if it's rejected
+
+func newRoutedPacketConn(ctx context.Context, router *client, addr *transport.SocketAddress) (*routedPacketConn, error) {
+	c := &routedPacketConn{ctx: ctx, router: router, policyConns: make(map[string]transport.PacketConn),
+		packets: make(chan routedPacket), closed: make(chan struct{})}
+	policy := router.selectPolicy(ctx, addr)
+	conn, err := c.dial(policy, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.policyConns[policy] = conn
+	return c, nil
+}
+
+func (c *routedPacketConn) dial(policy string, addr *transport.SocketAddress) (transport.PacketConn, error) {
+	nextClient, err := c.router.clientOf(c.ctx, addr, "UDP", policy)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := nextClient.DialUDP(c.ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	go c.readPackets(conn)
+	return conn, nil
+}
+
+func (c *routedPacketConn) readPackets(conn transport.PacketConn) {
+	for {
+		buf := pool.Get(transport.MaxUDPPacketSize)
+		n, addr, err := conn.ReadPacket(buf)
+		select {
+		case c.packets <- routedPacket{buf, n, addr, err}:
+		case <-c.closed:
+			pool.Put(buf)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *routedPacketConn) ReadPacket(b []byte) (int, *transport.SocketAddress, error) {
+	select {
+	case packet := <-c.packets:
+		defer pool.Put(packet.buf)
+		if packet.err != nil {
+			return 0, nil, packet.err
+		}
+		return copy(b, packet.buf[:packet.n]), packet.addr, nil
+	case <-c.closed:
+		return 0, nil, errors.WithStack(net.ErrClosed)
+	}
+}
+
+// the packets of a policy which fails to dial are dropped, like the ones lost in the network
+
+func (c *routedPacketConn) WritePacket(b []byte, addr *transport.SocketAddress) (int, error) {
+	policy := c.router.selectPolicy(c.ctx, addr)
+	c.policyConnsMu.Lock()
+	if c.policyConns == nil {
+		c.policyConnsMu.Unlock()
+		return 0, errors.WithStack(net.ErrClosed)
+	}
+	conn, ok := c.policyConns[policy]
+	if !ok {
+		var err error
+		conn, err = c.dial(policy, addr)
+		if err != nil {
+			logger.InfoWithError("fail to dial the packet connection of a policy, so its packets are dropped", err,
+				"policy", policy)
+		}
+		c.policyConns[policy] = conn
+	}
+	c.policyConnsMu.Unlock()
+	if conn == nil {
+		return len(b), nil
+	}
+	return conn.WritePacket(b, addr)
+}
+
+func (c *routedPacketConn) Close() error {
+	c.policyConnsMu.Lock()
+	policyConns := c.policyConns
+	c.policyConns = nil
+	c.policyConnsMu.Unlock()
+	if policyConns == nil {
+		return nil
+	}
+	close(c.closed)
+	var err error
+	for _, conn := range policyConns {
+		if conn != nil {
+			err = errors.Join(err, conn.Close())
+		}
+	}
+	return err
+}
@@ -3,9 +3,13 @@ package transport
 import (
 	"context"
 	"io"
+	"net"
 
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/quota"
 )
 
 type Server interface {
@@ -17,11 +21,82 @@ func ForwardTCP(ctx context.Context, accessAddr *SocketAddress, srcRwc io.ReadWr
 	case <-ctx.Done():
 		return errors.WithStack(ctx.Err())
 	default:
+		meter, err := quota.NewConnMeter(ctx, contextutil.User(ctx))
+		if err != nil {
+			_ = srcRwc.Close()
+			return err
+		}
 		targetConn, err := targetClient.DialTCP(ctx, accessAddr)
 		if err != nil {
 			_ = srcRwc.Close()
 			return err
 		}
-		return ioutil.Pipe(srcRwc, targetConn)
+		return ioutil.PipeWithMeter(srcRwc, targetConn, meter)
+	}
+}
+
+// MaxUDPPacketSize is the max size of a UDP packet's payload
+const MaxUDPPacketSize = 65535
+
+// ForwardUDP relays the packets between 'srcPacketConn' and the target until either side fails or is closed.
+// The 'accessAddr' is the first packet's target address.
+
+func ForwardUDP(ctx context.Context, accessAddr *SocketAddress, srcPacketConn PacketConn, targetClient Client) error {
+	select {
+	case <-ctx.Done():
+		_ = srcPacketConn.Close()
+		return errors.WithStack(ctx.Err())
+	default:
+		meter, err := quota.NewConnMeter(ctx, contextutil.User(ctx))
+		if err != nil {
+			_ = srcPacketConn.Close()
+			return err
+		}
+		targetPacketConn, err := targetClient.DialUDP(ctx, accessAddr)
+		if err != nil {
+			_ = srcPacketConn.Close()
+			return err
+		}
+		return pipePackets(srcPacketConn, targetPacketConn, meter)
+	}
+}
+
+func pipePackets(a, b PacketConn, meter ioutil.Meter) error {
+	done := make(chan error, 2)
+	cp := func(src, dst PacketConn) {
+		done <- copyPackets(dst, src, meter)
+		// unblock the other direction
+		_ = src.Close()
+		_ = dst.Close()
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+	// only care about the first error as we close both sides directly when see the first error
+	err := <-done
+	if errors.IsIoEof(err) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func copyPackets(dst, src PacketConn, meter ioutil.Meter) error {
+	buf := pool.Get(MaxUDPPacketSize)
+	defer pool.Put(buf)
+	for {
+		n, addr, err := src.ReadPacket(buf)
+		if err != nil {
+			return err
+		}
+		if meter != nil {
+			err = meter.Account(n)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = dst.WritePacket(buf[:n], addr)
+		if err != nil {
+			return err
+		}
 	}
 }
@@ -42,6 +42,11 @@ func NewSocketAddressByIP(ip *netip.Addr, port uint16) *SocketAddress {
 	return addr
 }
 
+func NewSocketAddressByAddrPort(addrPort netip.AddrPort) *SocketAddress {
+	ip := addrPort.Addr().Unmap()
+	return NewSocketAddressByIP(&ip, addrPort.Port())
+}
+
 func NewSocketAddressByDomain(domain string, port uint16) *SocketAddress {
 	addr := new(SocketAddress)
 	addr.Domain = domain
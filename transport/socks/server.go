@@ -7,20 +7,21 @@ import (
 
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
 	"golang.org/x/exp/slices"
 )
 
 type Server struct {
-	authInfo     *conf.HTTPSOCKSAuthInfo
-	targetClient transport.Client
+	authenticator *conf.HTTPSOCKSAuthenticator
+	targetClient  transport.Client
 }
 
 var _ transport.Server = new(Server)
 
-func NewServer(authInfo *conf.HTTPSOCKSAuthInfo, targetClient transport.Client) *Server {
-	return &Server{authInfo, targetClient}
+func NewServer(authenticator *conf.HTTPSOCKSAuthenticator, targetClient transport.Client) *Server {
+	return &Server{authenticator, targetClient}
 }
 
 const (
@@ -85,12 +86,14 @@ func (s *Server) handleClientHelloRequest(ctx context.Context, conn net.Conn) er
 	}
 
 	switch {
-	case s.authInfo.IsEmpty() && slices.Contains(methods, helloNoAuthRequired):
+	case s.authenticator.IsEmpty() && slices.Contains(methods, helloNoAuthRequired):
 		err = ioutil.Write_(conn, helloNoAuthBytes)
-	case !s.authInfo.IsEmpty() && slices.Contains(methods, helloUsernamePassword):
+	case !s.authenticator.IsEmpty() && slices.Contains(methods, helloUsernamePassword):
 		err = ioutil.Write_(conn, helloUsernamePasswordBytes)
 		if err == nil {
-			err = s.handleClientAuthenticationRequest(conn)
+			var username string
+			username, err = s.handleClientAuthenticationRequest(conn)
+			ctx = contextutil.WithUser(ctx, username)
 		}
 	default:
 		err = ioutil.Write_(conn, helloNoAcceptableMethodsBytes)
@@ -127,16 +130,16 @@ Response
 var authUsernamePasswordSuccessBytes = []byte{authUsernamePasswordVersion, authUsernamePasswordSuccess}
 var authUsernamePasswordFailureBytes = []byte{authUsernamePasswordVersion, authUsernamePasswordFailure}
 
-func (s *Server) handleClientAuthenticationRequest(conn net.Conn) error {
+func (s *Server) handleClientAuthenticationRequest(conn net.Conn) (string, error) {
 	authInfoFromRequest, err := readClientAuthUsernamePassword(conn)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if s.authInfo.NotEqual(authInfoFromRequest) {
+	if !s.authenticator.Authenticate(authInfoFromRequest.Username, authInfoFromRequest.Password) {
 		err = ioutil.Write_(conn, authUsernamePasswordFailureBytes)
-		return errors.Join(errors.New("incorrect username or password"), err)
+		return "", errors.Join(errors.New("incorrect username or password"), err)
 	}
-	return ioutil.Write_(conn, authUsernamePasswordSuccessBytes)
+	return authInfoFromRequest.Username, ioutil.Write_(conn, authUsernamePasswordSuccessBytes)
 }
 
 func readClientAuthUsernamePassword(r io.Reader) (authInfo *conf.HTTPSOCKSAuthInfo, err error) {
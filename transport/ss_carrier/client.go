@@ -10,21 +10,37 @@ import (
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/obfs"
 	"github.com/ringo-is-a-color/heteroglossia/util/randutil"
 )
 
 type client struct {
 	proxyNode    *conf.ProxyNode
 	preSharedKey []byte
-	aeadOverhead int
+	// only used when the server has multiple users
+	identityPreSharedKey []byte
+	method               string
+	newAEAD              aeadConstructor
+	aeadOverhead         int
 	// a function to randomly pick Ex2 and 5 mentioned here https://gfw.report/publications/usenixsecurity23/en/
-	exPicker func() int
+	// it's nil for a standard Shadowsocks 2022 server, then the salt is fully random like the reference implementations
+	exPicker   func() int
+	obfuscator obfs.Obfuscator
 }
 
 var _ transport.Client = new(client)
 
 func NewClient(proxyNode *conf.ProxyNode) transport.Client {
-	return &client{proxyNode, proxyNode.Password.Raw[:], gcmTagOverhead, randutil.WeightedIntN(2)}
+	var identityPreSharedKey []byte
+	if proxyNode.IdentityPassword != nil {
+		identityPreSharedKey = proxyNode.IdentityPassword.Key()
+	}
+	var exPicker func() int
+	if proxyNode.Protocol != conf.ProtocolShadowsocks {
+		exPicker = randutil.WeightedIntN(2)
+	}
+	return &client{proxyNode, proxyNode.Password.Key(), identityPreSharedKey, proxyNode.SSMethod,
+		aeadConstructorOf(proxyNode.SSMethod), aeadTagOverhead, exPicker, obfs.New(proxyNode.Obfuscation)}
 }
 
 func (c *client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (net.Conn, error) {
@@ -32,14 +48,40 @@ func (c *client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (ne
 	if err != nil {
 		return nil, err
 	}
-	c.customFirstReqPrefixes(clientSalt)
+	if c.exPicker != nil {
+		c.customFirstReqPrefixes(clientSalt)
+	}
+	var identityHeader []byte
+	if c.identityPreSharedKey != nil {
+		identityHeader, err = encryptIdentityHeader(c.identityPreSharedKey, c.preSharedKey, clientSalt)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	hostWithPort := c.proxyNode.Host + ":" + strconv.Itoa(c.proxyNode.TCPPort)
 	targetConn, err := netutil.DialTCP(ctx, hostWithPort)
 	if err != nil {
 		return nil, errors.Newf(err, "fail to connect to the TCP server %v", hostWithPort)
 	}
-	return newClientConn(targetConn, addr, c.preSharedKey, clientSalt, c.aeadOverhead), nil
+	return newClientConn(c.obfuscator.WrapConn(targetConn), addr, c.preSharedKey, clientSalt, identityHeader, c.newAEAD,
+		c.aeadOverhead, c.proxyNode.Obfuscation != nil), nil
+}
+
+// the UDP relay is served on the same port number as the TCP one
+
+func (c *client) DialUDP(ctx context.Context, _ *transport.SocketAddress) (transport.PacketConn, error) {
+	hostWithPort := c.proxyNode.Host + ":" + strconv.Itoa(c.proxyNode.TCPPort)
+	udpConn, err := netutil.DialUDP(ctx, hostWithPort)
+	if err != nil {
+		return nil, errors.Newf(err, "fail to connect to the UDP server %v", hostWithPort)
+	}
+	packetConn, err := newPacketConn(udpConn, c.method, c.preSharedKey, c.identityPreSharedKey)
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+	return packetConn, nil
 }
 
 // https://gfw.report/publications/usenixsecurity23/en/
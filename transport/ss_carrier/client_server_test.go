@@ -1,17 +1,332 @@
 package ss_carrier
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/transport/direct"
+	"github.com/ringo-is-a-color/heteroglossia/transport/socks"
 	"github.com/ringo-is-a-color/heteroglossia/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"lukechampine.com/blake3"
 )
 
 func TestClientServerConnection(t *testing.T) {
-	testutil.TestClientServerConnection(t, newClient, NewServer)
+	testutil.TestClientServerConnection(t, nil, nil, newClient, NewServer)
+}
+
+func TestClientServerConnectionWithUsers(t *testing.T) {
+	user := testutil.TestClientServerConnection(t, setUsers(t), useSecondUser, newClient, NewServer)
+	assert.Equal(t, "user2", user)
+}
+
+func TestClientServerConnectionWithAES256GCM(t *testing.T) {
+	testutil.TestClientServerConnection(t, setSSMethod(t, conf.SSMethodAES256GCM), nil, newClient, NewServer)
+}
+
+func TestClientServerConnectionWithChaCha20Poly1305(t *testing.T) {
+	testutil.TestClientServerConnection(t, setSSMethod(t, conf.SSMethodChaCha20Poly1305), nil, newClient, NewServer)
+}
+
+// both sides pad their first packets and shape their writes
+
+func TestClientServerConnectionWithObfuscation(t *testing.T) {
+	testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.Obfuscation = &conf.Obfuscation{PaddingPackets: 4, PaddingMaxSize: 900, ShapingMinSize: 200, ShapingMaxSize: 1400,
+			ShapingMaxDelayMS: 1, ShapingDelayedWrites: 4}
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.Obfuscation = &conf.Obfuscation{PaddingPackets: 4, PaddingMaxSize: 300, ShapingMinSize: 100, ShapingMaxSize: 500}
+	}, newClient, NewServer)
+}
+
+// the segments smaller than the salt and the fixed-length header with delays between them are read fully
+
+func TestClientServerConnectionWithSmallShapingAndDelay(t *testing.T) {
+	testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.Obfuscation = &conf.Obfuscation{ShapingMinSize: 8, ShapingMaxSize: 16, ShapingMaxDelayMS: 2, ShapingDelayedWrites: 2}
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.Obfuscation = &conf.Obfuscation{ShapingMinSize: 8, ShapingMaxSize: 16, ShapingMaxDelayMS: 2, ShapingDelayedWrites: 2}
+	}, newClient, NewServer)
+}
+
+func TestClientServerPacketConnection(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, nil, nil, newClient, NewServer)
+}
+
+func TestClientServerPacketConnectionWithUsers(t *testing.T) {
+	user := testutil.TestClientServerPacketConnection(t, setUsers(t), useSecondUser, newClient, NewServer)
+	assert.Equal(t, "user2", user)
+}
+
+func TestClientServerPacketConnectionWithAES256GCM(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, setSSMethod(t, conf.SSMethodAES256GCM), nil, newClient, NewServer)
+}
+
+func TestClientServerPacketConnectionWithChaCha20Poly1305(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, setSSMethod(t, conf.SSMethodChaCha20Poly1305), nil, newClient, NewServer)
+}
+
+func setUsers(t *testing.T) func(hg *conf.Hg) {
+	return func(hg *conf.Hg) {
+		hg.Users = testutil.Users(t)
+	}
+}
+
+// the 'password' of the hg inbound is the identity key with users
+
+func useSecondUser(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+	proxyNode.Password = hg.Users[1].Password
+	proxyNode.IdentityPassword = &hg.Password
+}
+
+func setSSMethod(t *testing.T, method string) func(hg *conf.Hg) {
+	return func(hg *conf.Hg) {
+		hg.SSMethod = method
+		if conf.SSKeySize(method) == 32 {
+			hg.Password = testutil.NewPassword(t, "5c1f0e9a8b7d6c5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e")
+		}
+	}
 }
 
 func newClient(proxyNode *conf.ProxyNode) (transport.Client, error) {
 	return NewClient(proxyNode), nil
 }
+
+// The below tests talk to a Shadowsocks 2022 peer written directly from the spec with fixed keys and salts,
+// so our client and server are checked against the standard wire format used by shadowsocks-rust and sing-box,
+// rather than against each other.
+// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md
+
+const (
+	// the same key as the 'password' in 'server_example.conf.json' but in base64 like the other implementations use
+	standardPSK          = "ZsrCjibNTW+vlEghxwL62w=="
+	standardRequestSalt  = "0f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	standardResponseSalt = "f0e1d2c3b4a5968778695a4b3c2d1e0f"
+)
+
+type standardTestCase struct {
+	name    string
+	payload []byte
+	// the request salt in the response header, which should be the same as the client's one
+	echoedSalt func(requestSalt []byte) []byte
+	expectErr  bool
+}
+
+func TestClientWithStandardServer(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer ln.Close()
+	proxyNode := &conf.ProxyNode{Protocol: conf.ProtocolShadowsocks, Host: "127.0.0.1", Password: testutil.NewPassword(t, standardPSK),
+		TCPPort: ln.Addr().(*net.TCPAddr).Port}
+	client := NewClient(proxyNode)
+	accessAddr := transport.NewSocketAddressByDomain("example.com", 80)
+	response := []byte("HTTP/1.1 204 No Content\r\n\r\n")
+
+	sameSalt := func(requestSalt []byte) []byte { return requestSalt }
+	tests := []standardTestCase{
+		{"with initial payload", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), sameSalt, false},
+		{"without initial payload", nil, sameSalt, false},
+		{"with an incorrect request salt in the response", []byte("GET / HTTP/1.1\r\n\r\n"), func(requestSalt []byte) []byte {
+			return bytes.Repeat([]byte{0xff}, len(requestSalt))
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverDone := make(chan struct{})
+			go func() {
+				defer close(serverDone)
+				conn, err := ln.Accept()
+				if !assert.Nil(t, err) {
+					return
+				}
+				defer conn.Close()
+				serveAsStandardServer(t, conn, accessAddr, tt, response)
+			}()
+
+			conn, err := client.DialTCP(context.Background(), accessAddr)
+			assert.Nil(t, err)
+			defer conn.Close()
+			// the client sends its request header with the first write
+			_, err = conn.Write(tt.payload)
+			assert.Nil(t, err)
+			buf := make([]byte, len(response))
+			_, err = io.ReadFull(conn, buf)
+			if tt.expectErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, response, buf)
+			}
+			<-serverDone
+		})
+	}
+}
+
+func serveAsStandardServer(t *testing.T, conn net.Conn, expectedAccessAddr *transport.SocketAddress, tt standardTestCase, response []byte) {
+	standardPassword := testutil.NewPassword(t, standardPSK)
+	psk := standardPassword.Key()
+	requestSalt := readStandardBytes(t, conn, len(psk))
+	requestStream := newStandardStream(t, psk, requestSalt)
+
+	// type + timestamp + length
+	fixedLenHeader := requestStream.open(t, readStandardBytes(t, conn, 1+8+2+aeadTagOverhead))
+	assert.Equal(t, byte(clientStreamHeaderType), fixedLenHeader[0])
+	assert.Nil(t, validateUnixTimeInRange(fixedLenHeader[1:9], unixTime()))
+	varLenHeaderSize := int(binary.BigEndian.Uint16(fixedLenHeader[9:]))
+
+	// address + padding length + padding + initial payload
+	varLenHeader := bytes.NewReader(requestStream.open(t, readStandardBytes(t, conn, varLenHeaderSize+aeadTagOverhead)))
+	accessAddr, err := socks.ReadSOCKS5Address(varLenHeader)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedAccessAddr.ToHostStr(), accessAddr.ToHostStr())
+	var paddingLen uint16
+	assert.Nil(t, binary.Read(varLenHeader, binary.BigEndian, &paddingLen))
+	if len(tt.payload) == 0 {
+		assert.True(t, paddingLen >= 1 && paddingLen <= maxPaddingSize, "padding length %v", paddingLen)
+	}
+	_, err = varLenHeader.Seek(int64(paddingLen), io.SeekCurrent)
+	assert.Nil(t, err)
+	payload, err := io.ReadAll(varLenHeader)
+	assert.Nil(t, err)
+	assert.Equal(t, len(tt.payload), len(payload))
+	assert.Equal(t, string(tt.payload), string(payload))
+
+	responseSalt := decodeHex(t, standardResponseSalt)
+	responseStream := newStandardStream(t, psk, responseSalt)
+	header := []byte{serverStreamHeaderType}
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+	header = append(header, tt.echoedSalt(requestSalt)...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(response)))
+	packet := append(responseSalt, responseStream.seal(header)...)
+	packet = append(packet, responseStream.seal(response)...)
+	_, _ = conn.Write(packet)
+}
+
+func TestServerWithStandardClient(t *testing.T) {
+	hg := testutil.ServerConf(t)
+	hg.Password = testutil.NewPassword(t, standardPSK)
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	echoServer, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer echoServer.Close()
+	go func() {
+		for {
+			conn, err := echoServer.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	standardPassword := testutil.NewPassword(t, standardPSK)
+	psk := standardPassword.Key()
+	requestSalt := decodeHex(t, standardRequestSalt)
+	requestStream := newStandardStream(t, psk, requestSalt)
+	payload := []byte("hello")
+	echoServerAddrPort := echoServer.Addr().(*net.TCPAddr).AddrPort()
+	varLenHeaderBuf := new(bytes.Buffer)
+	socks.WriteSOCKSLikeAddr(varLenHeaderBuf, transport.NewSocketAddressByAddrPort(echoServerAddrPort))
+	varLenHeaderBuf.Write([]byte{0, 0})
+	varLenHeaderBuf.Write(payload)
+	fixedLenHeader := []byte{clientStreamHeaderType}
+	fixedLenHeader = binary.BigEndian.AppendUint64(fixedLenHeader, uint64(time.Now().Unix()))
+	fixedLenHeader = binary.BigEndian.AppendUint16(fixedLenHeader, uint16(varLenHeaderBuf.Len()))
+	request := append(requestSalt, requestStream.seal(fixedLenHeader)...)
+	request = append(request, requestStream.seal(varLenHeaderBuf.Bytes())...)
+
+	conn := dialStandardServer(t, hg.TCPPort)
+	defer conn.Close()
+	_, err = conn.Write(request)
+	assert.Nil(t, err)
+	responseSalt := readStandardBytes(t, conn, len(psk))
+	responseStream := newStandardStream(t, psk, responseSalt)
+	// type + timestamp + request salt + length
+	header := responseStream.open(t, readStandardBytes(t, conn, 1+8+len(psk)+2+aeadTagOverhead))
+	assert.Equal(t, byte(serverStreamHeaderType), header[0])
+	assert.Nil(t, validateUnixTimeInRange(header[1:9], unixTime()))
+	assert.Equal(t, requestSalt, header[9:9+len(psk)])
+	responsePayloadSize := int(binary.BigEndian.Uint16(header[9+len(psk):]))
+	responsePayload := responseStream.open(t, readStandardBytes(t, conn, responsePayloadSize+aeadTagOverhead))
+	assert.Equal(t, payload, responsePayload)
+
+	// the same salt is rejected as a replay
+	replayedConn := dialStandardServer(t, hg.TCPPort)
+	defer replayedConn.Close()
+	_, err = replayedConn.Write(request)
+	assert.Nil(t, err)
+	_ = replayedConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = replayedConn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func dialStandardServer(t *testing.T, port int) net.Conn {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	assert.Nil(t, err)
+	return conn
+}
+
+type standardStream struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newStandardStream(t *testing.T, psk, salt []byte) *standardStream {
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", append(append([]byte{}, psk...), salt...))
+	block, err := aes.NewCipher(subkey)
+	assert.Nil(t, err)
+	aead, err := cipher.NewGCM(block)
+	assert.Nil(t, err)
+	return &standardStream{aead, make([]byte, aead.NonceSize())}
+}
+
+func (s *standardStream) seal(plaintext []byte) []byte {
+	defer s.incNonce()
+	return s.aead.Seal(nil, s.nonce, plaintext, nil)
+}
+
+func (s *standardStream) open(t *testing.T, ciphertext []byte) []byte {
+	defer s.incNonce()
+	plaintext, err := s.aead.Open(nil, s.nonce, ciphertext, nil)
+	assert.Nil(t, err)
+	return plaintext
+}
+
+// the nonce is a little-endian counter
+func (s *standardStream) incNonce() {
+	for i := range s.nonce {
+		s.nonce[i]++
+		if s.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func readStandardBytes(t *testing.T, r io.Reader, n int) []byte {
+	bs := make([]byte, n)
+	_, err := io.ReadFull(r, bs)
+	assert.Nil(t, err)
+	return bs
+}
+
+func decodeHex(t *testing.T, str string) []byte {
+	bs, err := hex.DecodeString(str)
+	assert.Nil(t, err)
+	return bs
+}
@@ -7,49 +7,66 @@ import (
 	"io"
 	"math/rand/v2"
 	"net"
-	"time"
 
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/transport/socks"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
 	"github.com/ringo-is-a-color/heteroglossia/util/randutil"
 )
 
 type conn struct {
-	*net.TCPConn
+	// the socket which may be obfuscated
+	net.Conn
+	// only for SO_LINGER on the server side
+	tcpConn      *net.TCPConn
 	accessAddr   *transport.SocketAddress
 	preSharedKey []byte
 
-	clientSalt  []byte
-	aeadWriter  cipher.AEAD
-	nonceWriter []byte
+	clientSalt []byte
+	// an optional identity header for a server with multiple users, which follows the client salt
+	identityHeader []byte
+	aeadWriter     cipher.AEAD
+	nonceWriter    []byte
 
 	aeadReader   cipher.AEAD
 	nonceReader  []byte
 	readerBuf    []byte
+	newAEAD      aeadConstructor
 	aeadOverhead int
 
-	isClient             bool
+	isClient bool
+	// the peer may split its writes with the obfuscation's shaping, so the first header isn't expected in one read
+	obfuscated           bool
 	hasWriteFirstPayload bool
 	hasReadFirstPayload  bool
 	serverSideSaltPool   *saltPool[string]
+	// the users identified by their PSK hashes, which is nil when the server has only one user
+	serverSideUsers map[[identityHeaderSize]byte]*user
+	// the identified user's name on the server side
+	user string
+	// the server salt's and the timestamps' sources, which are fixed in the known-answer tests
+	generateSalt func(preSharedKey []byte) ([]byte, error)
+	unixTime     func() int64
 }
 
 var _ net.Conn = new(conn)
 var _ io.ReaderFrom = new(conn)
 var _ io.WriterTo = new(conn)
 
-func newClientConn(tcpConn *net.TCPConn, accessAddr *transport.SocketAddress,
-	preSharedKey []byte, clientSalt []byte, aeadOverhead int) *conn {
-	return &conn{TCPConn: tcpConn, accessAddr: accessAddr,
-		preSharedKey: preSharedKey, clientSalt: clientSalt, aeadOverhead: aeadOverhead, isClient: true}
+func newClientConn(rawConn net.Conn, accessAddr *transport.SocketAddress, preSharedKey []byte, clientSalt []byte,
+	identityHeader []byte, newAEAD aeadConstructor, aeadOverhead int, obfuscated bool) *conn {
+	return &conn{Conn: rawConn, accessAddr: accessAddr, preSharedKey: preSharedKey, clientSalt: clientSalt,
+		identityHeader: identityHeader, newAEAD: newAEAD, aeadOverhead: aeadOverhead, isClient: true, obfuscated: obfuscated,
+		generateSalt: generateSalt, unixTime: unixTime}
 }
 
-func newServerConn(tcpConn *net.TCPConn, preSharedKey []byte, aeadOverhead int, serverSideSaltPool *saltPool[string]) *conn {
-	return &conn{TCPConn: tcpConn, preSharedKey: preSharedKey, aeadOverhead: aeadOverhead, isClient: false, serverSideSaltPool: serverSideSaltPool}
+func newServerConn(rawConn net.Conn, tcpConn *net.TCPConn, preSharedKey []byte, newAEAD aeadConstructor, aeadOverhead int,
+	serverSideSaltPool *saltPool[string], serverSideUsers map[[identityHeaderSize]byte]*user, obfuscated bool) *conn {
+	return &conn{Conn: rawConn, tcpConn: tcpConn, preSharedKey: preSharedKey, newAEAD: newAEAD, aeadOverhead: aeadOverhead, isClient: false,
+		obfuscated: obfuscated, serverSideSaltPool: serverSideSaltPool, serverSideUsers: serverSideUsers,
+		generateSalt: generateSalt, unixTime: unixTime}
 }
 
 const (
@@ -103,7 +120,10 @@ func (c *conn) writeClientFirstPayload(payload []byte) (int, error) {
 	payloadSize := len(payload)
 	var paddingSize, reqPaddingAndPayloadSize int
 	if payloadSize <= 0 {
-		paddingSize = rand.IntN(maxPaddingSize + 1)
+		// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md#312-format
+		// Servers MUST reject the request if the variable-length header chunk does not contain payload
+		// and the padding length is 0.
+		paddingSize = rand.IntN(maxPaddingSize) + 1
 		reqPaddingAndPayloadSize = paddingSize
 	} else {
 		paddingSize = 0
@@ -113,7 +133,8 @@ func (c *conn) writeClientFirstPayload(payload []byte) (int, error) {
 	reqPaddingOrPayloadStart := socks.SOCKSLikeAddrSizeInBytes(c.accessAddr) + lenFieldSize
 	reqVarLenHeaderSize := reqPaddingOrPayloadStart + reqPaddingAndPayloadSize
 	saltSize := len(c.preSharedKey)
-	reqVarLenHeaderEncryptedStart := saltSize + reqFixedLenHeaderSize + c.aeadOverhead
+	reqFixedLenHeaderEncryptedStart := saltSize + len(c.identityHeader)
+	reqVarLenHeaderEncryptedStart := reqFixedLenHeaderEncryptedStart + reqFixedLenHeaderSize + c.aeadOverhead
 	reqHeaderEncryptedBs := pool.Get(reqVarLenHeaderEncryptedStart + reqVarLenHeaderSize + c.aeadOverhead)
 	defer pool.Put(reqHeaderEncryptedBs)
 
@@ -123,10 +144,10 @@ func (c *conn) writeClientFirstPayload(payload []byte) (int, error) {
 	// +------+------------------+--------+
 	// |  1B  | u64be unix epoch |  u16be |
 	// +------+------------------+--------+
-	reqFixedLenHeaderBs := reqHeaderEncryptedBs[saltSize:reqVarLenHeaderEncryptedStart]
+	reqFixedLenHeaderBs := reqHeaderEncryptedBs[reqFixedLenHeaderEncryptedStart:reqVarLenHeaderEncryptedStart]
 	reqFixedLenHeaderBuf := bytes.NewBuffer(reqFixedLenHeaderBs[:0])
 	reqFixedLenHeaderBuf.WriteByte(clientStreamHeaderType)
-	err := binary.Write(reqFixedLenHeaderBuf, binary.BigEndian, uint64(time.Now().Unix()))
+	err := binary.Write(reqFixedLenHeaderBuf, binary.BigEndian, uint64(c.unixTime()))
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
@@ -148,17 +169,20 @@ func (c *conn) writeClientFirstPayload(payload []byte) (int, error) {
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
-	if payloadSize < 0 {
-		_, err = randutil.RandBytes(reqVarLenHeaderBs[reqPaddingOrPayloadStart : reqPaddingOrPayloadStart+paddingSize])
+	if paddingSize > 0 {
+		padding := reqVarLenHeaderBs[reqPaddingOrPayloadStart : reqPaddingOrPayloadStart+paddingSize]
+		_, err = randutil.RandBytes(padding)
 		if err != nil {
 			return 0, err
 		}
+		reqVarLenHeaderBuf.Write(padding)
 	} else {
 		reqVarLenHeaderBuf.Write(payload[:payloadSize])
 	}
 
 	copy(reqHeaderEncryptedBs, c.clientSalt)
-	clientAEAD, err := aeadCipher(c.preSharedKey, c.clientSalt)
+	copy(reqHeaderEncryptedBs[saltSize:], c.identityHeader)
+	clientAEAD, err := aeadCipher(c.newAEAD, c.preSharedKey, c.clientSalt)
 	if err != nil {
 		return 0, err
 	}
@@ -166,11 +190,11 @@ func (c *conn) writeClientFirstPayload(payload []byte) (int, error) {
 	c.encryptInPlace(reqFixedLenHeaderBuf.Bytes())
 	c.encryptInPlace(reqVarLenHeaderBuf.Bytes())
 
-	_, err = c.TCPConn.Write(reqHeaderEncryptedBs)
+	_, err = c.Conn.Write(reqHeaderEncryptedBs)
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
-	// the total written count (reqHeaderEncryptedBs) is less than the one (payloadSize) written into 'c.TCPConn'
+	// the total written count (reqHeaderEncryptedBs) is less than the one (payloadSize) written into 'c.Conn'
 	return payloadSize, nil
 }
 
@@ -189,7 +213,7 @@ func (c *conn) writeServerFirstPayload(payload []byte) (int, error) {
 	respSaltWithFixedLenHeaderAndPayloadEncryptedBs := pool.Get(respPayloadEncryptedStart + payloadSize + c.aeadOverhead)
 	defer pool.Put(respSaltWithFixedLenHeaderAndPayloadEncryptedBs)
 	respSaltWithFixedLenHeaderAndPayloadEncryptedBuf := bytes.NewBuffer(respSaltWithFixedLenHeaderAndPayloadEncryptedBs[:0])
-	serverSalt, err := generateSalt(c.preSharedKey)
+	serverSalt, err := c.generateSalt(c.preSharedKey)
 	if err != nil {
 		return 0, err
 	}
@@ -202,7 +226,7 @@ func (c *conn) writeServerFirstPayload(payload []byte) (int, error) {
 	// |  1B  | u64be unix epoch |     16/32B     |  u16be |
 	// +------+------------------+----------------+--------+
 	respSaltWithFixedLenHeaderAndPayloadEncryptedBuf.WriteByte(serverStreamHeaderType)
-	err = binary.Write(respSaltWithFixedLenHeaderAndPayloadEncryptedBuf, binary.BigEndian, uint64(time.Now().Unix()))
+	err = binary.Write(respSaltWithFixedLenHeaderAndPayloadEncryptedBuf, binary.BigEndian, uint64(c.unixTime()))
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
@@ -213,7 +237,7 @@ func (c *conn) writeServerFirstPayload(payload []byte) (int, error) {
 	}
 	copy(respSaltWithFixedLenHeaderAndPayloadEncryptedBuf.AvailableBuffer()[c.aeadOverhead:c.aeadOverhead+payloadSize], payload)
 
-	serverAEAD, err := aeadCipher(c.preSharedKey, serverSalt)
+	serverAEAD, err := aeadCipher(c.newAEAD, c.preSharedKey, serverSalt)
 	if err != nil {
 		return 0, err
 	}
@@ -229,7 +253,7 @@ func (c *conn) writeServerFirstPayload(payload []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	_, err = c.TCPConn.Write(respSaltWithFixedLenHeaderAndPayloadEncryptedBs)
+	_, err = c.Conn.Write(respSaltWithFixedLenHeaderAndPayloadEncryptedBs)
 	if err != nil {
 		return 0, err
 	}
@@ -266,7 +290,7 @@ func (c *conn) readOrWriteTo(b []byte, w io.Writer) (n int, err error) {
 	// |   2B + 16B AEAD tag    | variable length + 16B tag |
 	// +------------------------+---------------------------+
 	payloadLenEncryptedSize := lenFieldSize + c.aeadOverhead
-	_, payloadLenEncryptedBs, err := ioutil.ReadN(c.TCPConn, payloadLenEncryptedSize)
+	_, payloadLenEncryptedBs, err := ioutil.ReadN(c.Conn, payloadLenEncryptedSize)
 	if err != nil {
 		return 0, err
 	}
@@ -278,7 +302,7 @@ func (c *conn) readOrWriteTo(b []byte, w io.Writer) (n int, err error) {
 
 	payloadEncryptedBs := pool.Get(payloadSize + c.aeadOverhead)
 	defer pool.Put(payloadEncryptedBs)
-	_, err = ioutil.ReadFull(c.TCPConn, payloadEncryptedBs)
+	_, err = ioutil.ReadFull(c.Conn, payloadEncryptedBs)
 	if err != nil {
 		return 0, err
 	}
@@ -292,17 +316,27 @@ func (c *conn) readOrWriteTo(b []byte, w io.Writer) (n int, err error) {
 	return c.copyReadPayload(b, payloadEncryptedBs[:payloadSize])
 }
 
+// the salt and the fixed-length header are sent in one write, so they're expected in one read like the reference
+// implementations, unless the peer's writes may be split by the obfuscation
+
+func (c *conn) readSaltWithFixedLenHeader(buf []byte) (int, error) {
+	if c.obfuscated {
+		return ioutil.ReadFull(c.Conn, buf)
+	}
+	return ioutil.ReadOnceExpectFull(c.Conn, buf)
+}
+
 func (c *conn) readServerFirstPayload(b []byte, w io.Writer) (int, error) {
 	c.hasReadFirstPayload = true
 	saltSize := len(c.preSharedKey)
 	respSaltWithFixedLenHeaderEncryptedBs := pool.Get(saltSize + reqFixedLenHeaderSize + saltSize + c.aeadOverhead)
 	defer pool.Put(respSaltWithFixedLenHeaderEncryptedBs)
-	_, err := ioutil.ReadOnceExpectFull(c.TCPConn, respSaltWithFixedLenHeaderEncryptedBs)
+	_, err := c.readSaltWithFixedLenHeader(respSaltWithFixedLenHeaderEncryptedBs)
 	if err != nil && !errors.IsIoEof(err) {
 		return 0, err
 	}
 
-	serverAEAD, err := aeadCipher(c.preSharedKey, respSaltWithFixedLenHeaderEncryptedBs[:saltSize])
+	serverAEAD, err := aeadCipher(c.newAEAD, c.preSharedKey, respSaltWithFixedLenHeaderEncryptedBs[:saltSize])
 	if err != nil {
 		return 0, err
 	}
@@ -319,8 +353,8 @@ func (c *conn) readServerFirstPayload(b []byte, w io.Writer) (int, error) {
 	}
 
 	respPayloadEncryptedBs := pool.Get(respPayloadSize + c.aeadOverhead)
-	pool.Put(respPayloadEncryptedBs)
-	_, err = ioutil.ReadFull(c.TCPConn, respPayloadEncryptedBs)
+	defer pool.Put(respPayloadEncryptedBs)
+	_, err = ioutil.ReadFull(c.Conn, respPayloadEncryptedBs)
 	if err != nil {
 		return 0, err
 	}
@@ -341,34 +375,46 @@ func (c *conn) readClientFirstPayload() error {
 		if err != nil {
 			// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md#313-detection-prevention
 			// To consistently send RST even when the received buffer is empty, set 'SO_LINGER' to true with a zero timeout, then close the socket.
-			err = c.TCPConn.SetLinger(0)
+			err = c.tcpConn.SetLinger(0)
 			if err != nil {
-				log.WarnWithError("fail to set SO_LINGER", err)
+				logger.WarnWithError("fail to set SO_LINGER", err)
 			}
 		}
 	}()
 	saltSize := len(c.preSharedKey)
-	reqSaltWithFixedLenHeaderEncryptedSize := saltSize + reqFixedLenHeaderSize + c.aeadOverhead
+	var identityHeaderSizeIfAny int
+	if c.serverSideUsers != nil {
+		identityHeaderSizeIfAny = identityHeaderSize
+	}
+	reqFixedLenHeaderEncryptedStart := saltSize + identityHeaderSizeIfAny
+	reqSaltWithFixedLenHeaderEncryptedSize := reqFixedLenHeaderEncryptedStart + reqFixedLenHeaderSize + c.aeadOverhead
 	reqSaltWithFixedLenHeaderEncryptedBs := pool.Get(reqSaltWithFixedLenHeaderEncryptedSize)
 	defer pool.Put(reqSaltWithFixedLenHeaderEncryptedBs)
-	_, err = ioutil.ReadOnceExpectFull(c.TCPConn, reqSaltWithFixedLenHeaderEncryptedBs)
+	_, err = c.readSaltWithFixedLenHeader(reqSaltWithFixedLenHeaderEncryptedBs)
 	if err != nil {
 		return err
 	}
 
-	c.clientSalt = reqSaltWithFixedLenHeaderEncryptedBs[:saltSize]
+	// the buffer is put back to the pool, but the salt is echoed in our response later
+	c.clientSalt = bytes.Clone(reqSaltWithFixedLenHeaderEncryptedBs[:saltSize])
 	clientSaltStr := string(c.clientSalt)
 	ok := c.serverSideSaltPool.check(clientSaltStr)
 	if !ok {
 		return errors.New("replay detected due to repeated salt found")
 	}
-	clientAEAD, err := aeadCipher(c.preSharedKey, reqSaltWithFixedLenHeaderEncryptedBs[:saltSize])
+	if c.serverSideUsers != nil {
+		err = c.identifyUser(reqSaltWithFixedLenHeaderEncryptedBs[saltSize:reqFixedLenHeaderEncryptedStart])
+		if err != nil {
+			return err
+		}
+	}
+	clientAEAD, err := aeadCipher(c.newAEAD, c.preSharedKey, reqSaltWithFixedLenHeaderEncryptedBs[:saltSize])
 	if err != nil {
 		return err
 	}
 	c.setAEADReader(clientAEAD)
 
-	reqFixedLenHeaderEncryptedBs := reqSaltWithFixedLenHeaderEncryptedBs[saltSize:]
+	reqFixedLenHeaderEncryptedBs := reqSaltWithFixedLenHeaderEncryptedBs[reqFixedLenHeaderEncryptedStart:]
 	err = c.decryptInPlace(reqFixedLenHeaderEncryptedBs)
 	if err != nil {
 		return err
@@ -381,7 +427,7 @@ func (c *conn) readClientFirstPayload() error {
 
 	reqVarLenHeaderEncryptedBs := pool.Get(reqVarLenHeaderSize + c.aeadOverhead)
 	defer pool.Put(reqVarLenHeaderEncryptedBs)
-	_, err = ioutil.ReadFull(c.TCPConn, reqVarLenHeaderEncryptedBs)
+	_, err = ioutil.ReadFull(c.Conn, reqVarLenHeaderEncryptedBs)
 	if err != nil {
 		return err
 	}
@@ -417,6 +463,22 @@ func (c *conn) readClientFirstPayload() error {
 	return err
 }
 
+// switch to the identified user's PSK for the rest of the session
+
+func (c *conn) identifyUser(identityHeader []byte) error {
+	userPSKHash, err := decryptIdentityHeader(c.preSharedKey, c.clientSalt, identityHeader)
+	if err != nil {
+		return err
+	}
+	user, ok := c.serverSideUsers[userPSKHash]
+	if !ok {
+		return errors.New("no user matches the identity header")
+	}
+	c.preSharedKey = user.preSharedKey
+	c.user = user.name
+	return nil
+}
+
 func (c *conn) copyReadPayload(b []byte, payloadBs []byte) (int, error) {
 	n := copy(b, payloadBs)
 	payloadSize := len(payloadBs)
@@ -454,7 +516,7 @@ func (c *conn) validateFixedHeaderAndReturnLen(fixedLenHeaderBs []byte) (int, er
 		return 0, errors.Newf("invalid stream header type '%v', '%v expect",
 			fixedLenHeaderBs[0], streamHeaderType)
 	}
-	err := validateUnixTimeInRange(fixedLenHeaderBs[1:])
+	err := validateUnixTimeInRange(fixedLenHeaderBs[1:], c.unixTime())
 	if err != nil {
 		return 0, err
 	}
@@ -483,7 +545,12 @@ func (c *conn) ReadFrom(r io.Reader) (n int64, err error) {
 
 	if !c.hasWriteFirstPayload {
 		c.hasWriteFirstPayload = true
-		count, err := r.Read(maxPayloadReadBs)
+		// the length fields are u16, so the first payload should fit into one chunk with the request header
+		maxFirstPayloadSize := maxChunkSize
+		if c.isClient {
+			maxFirstPayloadSize -= socks.SOCKSLikeAddrSizeInBytes(c.accessAddr) + lenFieldSize
+		}
+		count, err := r.Read(maxPayloadReadBs[:maxFirstPayloadSize])
 		n += int64(count)
 		if err != nil && !errors.IsIoEof(err) {
 			return n, err
@@ -511,7 +578,7 @@ func (c *conn) ReadFrom(r io.Reader) (n int64, err error) {
 		c.encryptInPlace(maxPayloadReadBs[:lenFieldSize])
 		c.encryptInPlace(maxPayloadReadBs[payloadStart : payloadStart+count])
 
-		_, err = c.TCPConn.Write(maxPayloadReadBs[:payloadStart+count+c.aeadOverhead])
+		_, err = c.Conn.Write(maxPayloadReadBs[:payloadStart+count+c.aeadOverhead])
 		if err != nil {
 			return n, err
 		}
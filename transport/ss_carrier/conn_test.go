@@ -0,0 +1,158 @@
+package ss_carrier
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// The known-answer streams use the fixed PSK and salts in 'client_server_test.go', a fixed timestamp and zero-filled padding,
+// so any change of our wire format fails them.
+// They're generated once by the spec-level peer in 'client_server_test.go', not captured from shadowsocks-rust
+// or sing-box, so the wire format is checked against shadowsocks-rust by the tests in 'interop_test.go',
+// which are only built with the 'interop' tag.
+
+const (
+	knownAnswerUnixTime = 1700000000
+	knownAnswerPayload  = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	knownAnswerResponse = "HTTP/1.1 204 No Content\r\n\r\n"
+
+	// to example.com:80 with the payload and no padding
+	knownAnswerRequestStream = "0f1e2d3c4b5a69788796a5b4c3d2e1f05c1a9ef924518b8b243b8db1bc8bcf3d646a85fe2d7948bc0838fc45e3b7e5d6" +
+		"ff24beee7fc6b00baba05f9f4c0c607496d936da492a02a615b30c22d3ad7e3d64a9f40107494dca707f1417c703ee48882e43c84393610474" +
+		"253c53e3d0181dae"
+	// to example.com:80 with 16 bytes of zero padding and no payload
+	knownAnswerPaddingOnlyRequestStream = "0f1e2d3c4b5a69788796a5b4c3d2e1f05c1a9ef924518b8b243b9a7efdc2dbed6ee96388edb869bb" +
+		"ed26cd45e3b7e5d6ff24beee7fc6b00baba05f8f0b493454b9f97e8e1d7a2d973b8201285bad7ce52ddffec8e3287cf4f29a7bb8"
+	// to example.com:80 with 8 bytes of zero padding and the payload "hello"
+	knownAnswerPaddingAndPayloadRequestStream = "0f1e2d3c4b5a69788796a5b4c3d2e1f05c1a9ef924518b8b243ba56e193d7d1a3c842f72b1e6" +
+		"4ac64d3b3145e3b7e5d6ff24beee7fc6b00baba05f970b493454b9f97e8e751f41fb543b42ab62ba8debaea2d89241c75876e6"
+	// to example.com:80 without padding or payload, which servers must reject
+	knownAnswerEmptyRequestStream = "0f1e2d3c4b5a69788796a5b4c3d2e1f05c1a9ef924518b8b243baaebc4e607d701a2508005526a1794dbbb" +
+		"45e3b7e5d6ff24beee7fc6b00baba05f9f78aae4b0cb108ae29cea450ca55feebf"
+
+	// to the request stream with the response
+	knownAnswerResponseStream = "f0e1d2c3b4a5968778695a4b3c2d1e0f6b33461aa150436579b3f6023100d1df37da3adb7796ebb1870000b09c" +
+		"3be9471c79aa78b00a2c5d8d2d794cd8809f70e35f4795395ad9f7e98991e32630b88515cc1b9535c6dcfd9c26d4f22f1a0e2cd563ab778ef8"
+	// the same as above, but the echoed request salt is all 0xff
+	knownAnswerWrongEchoResponseStream = "f0e1d2c3b4a5968778695a4b3c2d1e0f6b33461aa1504365794317d0f2b47449b0a253813caac6af" +
+		"8800003c898d9f13506dce54d05fd16787adfe4cd8809f70e35f4795395ad9f7e98991e32630b88515cc1b9535c6dcfd9c26d4f22f1a0e2c" +
+		"d563ab778ef8"
+	// to the request stream with the payload "hello"
+	knownAnswerHelloResponseStream = "f0e1d2c3b4a5968778695a4b3c2d1e0f6b33461aa150436579b3f6023100d1df37da3adb7796ebb18700" +
+		"1e7c3e25d641409f9c3ed02abbcfaaab1e6ce9b8a33091bc24bb34c7ff82ec2236d1f7581166"
+)
+
+func fixKnownAnswerSaltAndTime(t *testing.T, c *conn) *conn {
+	responseSalt := decodeHex(t, standardResponseSalt)
+	c.generateSalt = func(preSharedKey []byte) ([]byte, error) { return bytes.Clone(responseSalt), nil }
+	c.unixTime = func() int64 { return knownAnswerUnixTime }
+	return c
+}
+
+// knownAnswerConn records what's written, and its reads return the response stream
+
+type knownAnswerConn struct {
+	net.Conn
+	written  bytes.Buffer
+	response io.Reader
+}
+
+func (c *knownAnswerConn) Read(b []byte) (int, error) {
+	return c.response.Read(b)
+}
+
+func (c *knownAnswerConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestClientWithKnownAnswers(t *testing.T) {
+	password := testutil.NewPassword(t, standardPSK)
+	for _, tt := range []struct {
+		name           string
+		responseStream string
+		expectErr      bool
+	}{
+		{"with the request salt echoed", knownAnswerResponseStream, false},
+		{"with a wrong request salt echoed", knownAnswerWrongEchoResponseStream, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			wire := &knownAnswerConn{response: bytes.NewReader(decodeHex(t, tt.responseStream))}
+			c := fixKnownAnswerSaltAndTime(t, newClientConn(wire, transport.NewSocketAddressByDomain("example.com", 80),
+				password.Key(), decodeHex(t, standardRequestSalt), nil, aeadConstructorOf(conf.SSMethodAES128GCM), aeadTagOverhead,
+				false))
+			_, err := c.Write([]byte(knownAnswerPayload))
+			assert.Nil(t, err)
+			assert.Equal(t, knownAnswerRequestStream, hex.EncodeToString(wire.written.Bytes()))
+
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			if tt.expectErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, knownAnswerResponse, string(buf[:n]))
+		})
+	}
+}
+
+func TestServerWithKnownAnswers(t *testing.T) {
+	password := testutil.NewPassword(t, standardPSK)
+	for _, tt := range []struct {
+		name            string
+		requestStream   string
+		expectedPayload string
+		expectErr       bool
+	}{
+		{"with payload", knownAnswerRequestStream, knownAnswerPayload, false},
+		{"with padding only", knownAnswerPaddingOnlyRequestStream, "", false},
+		{"with padding and payload", knownAnswerPaddingAndPayloadRequestStream, "hello", false},
+		{"without padding or payload", knownAnswerEmptyRequestStream, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverTCPConn := tcpConnPair(t)
+			_, err := clientConn.Write(decodeHex(t, tt.requestStream))
+			assert.Nil(t, err)
+			c := fixKnownAnswerSaltAndTime(t, newServerConn(serverTCPConn, serverTCPConn, password.Key(),
+				aeadConstructorOf(conf.SSMethodAES128GCM), aeadTagOverhead, newSaltPool[string](), nil, false))
+			err = c.readClientFirstPayload()
+			if tt.expectErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, "example.com:80", c.accessAddr.ToHostStr())
+			assert.Equal(t, tt.expectedPayload, string(c.readerBuf))
+
+			_, err = c.Write([]byte("hello"))
+			assert.Nil(t, err)
+			responseStream := make([]byte, len(knownAnswerHelloResponseStream)/2)
+			_, err = io.ReadFull(clientConn, responseStream)
+			assert.Nil(t, err)
+			assert.Equal(t, knownAnswerHelloResponseStream, hex.EncodeToString(responseStream))
+		})
+	}
+}
+
+func tcpConnPair(t *testing.T) (net.Conn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	serverConn, err := ln.AcceptTCP()
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	})
+	return clientConn, serverConn
+}
@@ -0,0 +1,177 @@
+//go:build interop
+
+package ss_carrier
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/transport/direct"
+	"github.com/ringo-is-a-color/heteroglossia/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// The interop tests run our client and server against the 'ssserver' and 'sslocal' binaries of shadowsocks-rust
+// found in $PATH, so the wire format is checked against the reference implementation rather than our own peers:
+//
+//	go test -tags interop -run Interop ./transport/ss_carrier/
+
+var interopMethods = []string{conf.SSMethodAES128GCM, conf.SSMethodAES256GCM, conf.SSMethodChaCha20Poly1305}
+
+const interopAES256PSK = "5c1f0e9a8b7d6c5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e"
+
+func TestInteropClientWithSSServer(t *testing.T) {
+	for _, method := range interopMethods {
+		t.Run(method, func(t *testing.T) {
+			ssserver := referenceBinary(t, "ssserver")
+			password := interopPassword(t, method)
+			port := interopFreePort(t)
+			startReferenceBinary(t, ssserver, port, "-s", "127.0.0.1:"+strconv.Itoa(port), "-m", method,
+				"-k", base64.StdEncoding.EncodeToString(password.Key()), "-U")
+			client := NewClient(&conf.ProxyNode{Protocol: conf.ProtocolShadowsocks, Host: "127.0.0.1", TCPPort: port,
+				Password: password, SSMethod: method})
+
+			webServer := startInteropWebServer(t)
+			resp, err := transport.HTTPClientThroughRouter(client).Get(webServer.URL)
+			if assert.Nil(t, err) {
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				assert.Nil(t, err)
+				assert.Equal(t, "hello", string(body))
+			}
+			assertUDPEcho(t, client)
+		})
+	}
+}
+
+func TestInteropServerWithSSLocal(t *testing.T) {
+	for _, method := range interopMethods {
+		t.Run(method, func(t *testing.T) {
+			sslocal := referenceBinary(t, "sslocal")
+			hg := testutil.ServerConf(t)
+			hg.SSMethod = method
+			hg.Password = interopPassword(t, method)
+			testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+			socksPort := interopFreePort(t)
+			startReferenceBinary(t, sslocal, socksPort, "-b", "127.0.0.1:"+strconv.Itoa(socksPort),
+				"-s", "127.0.0.1:"+strconv.Itoa(hg.TCPPort), "-m", method, "-k", base64.StdEncoding.EncodeToString(hg.Password.Key()))
+
+			webServer := startInteropWebServer(t)
+			proxyURL := &url.URL{Scheme: "socks5", Host: "127.0.0.1:" + strconv.Itoa(socksPort)}
+			httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+			resp, err := httpClient.Get(webServer.URL)
+			if assert.Nil(t, err) {
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				assert.Nil(t, err)
+				assert.Equal(t, "hello", string(body))
+			}
+		})
+	}
+}
+
+func interopPassword(t *testing.T, method string) conf.Password {
+	if conf.SSKeySize(method) == 32 {
+		return testutil.NewPassword(t, interopAES256PSK)
+	}
+	return testutil.NewPassword(t, standardPSK)
+}
+
+func referenceBinary(t *testing.T, name string) string {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skipf("the shadowsocks-rust binary '%v' isn't found in $PATH", name)
+	}
+	return path
+}
+
+// the reference binary is killed after the test, and it's ready when its TCP 'port' is listened on
+
+func startReferenceBinary(t *testing.T, path string, port int, args ...string) {
+	cmd := exec.Command(path, args...)
+	assert.Nil(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("'%v' doesn't listen on the port %v", path, port)
+}
+
+func interopFreePort(t *testing.T) int {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func startInteropWebServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func assertUDPEcho(t *testing.T, client transport.Client) {
+	echoServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer echoServer.Close()
+	go func() {
+		buf := make([]byte, transport.MaxUDPPacketSize)
+		for {
+			n, addr, err := echoServer.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echoServer.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	}()
+
+	echoServerAddr := transport.NewSocketAddressByAddrPort(echoServer.LocalAddr().(*net.UDPAddr).AddrPort())
+	packetConn, err := client.DialUDP(t.Context(), echoServerAddr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer packetConn.Close()
+	payload := []byte("hello over UDP")
+	_, err = packetConn.WritePacket(payload, echoServerAddr)
+	assert.Nil(t, err)
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, transport.MaxUDPPacketSize)
+		n, _, err := packetConn.ReadPacket(buf)
+		if err == nil {
+			received <- bytes.Clone(buf[:n])
+		}
+	}()
+	select {
+	case bs := <-received:
+		assert.Equal(t, payload, bs)
+	case <-time.After(5 * time.Second):
+		t.Error("no UDP packet is echoed through 'ssserver'")
+	}
+}
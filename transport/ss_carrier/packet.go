@@ -0,0 +1,309 @@
+package ss_carrier
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"math/rand/v2"
+	"sync/atomic"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/transport/socks"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/randutil"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md#32-format
+Packet of the AES methods
++---------------------------+---------------------------+---------------------------+
+| encrypted separate header |  identity header if any   |       encrypted body      |
++---------------------------+---------------------------+---------------------------+
+|            16B            |            16B            | variable length + 16B tag |
++---------------------------+---------------------------+---------------------------+
+
+Packet of the ChaCha20-Poly1305 method
++-------+------------------------------------------------+
+| nonce |     encrypted separate header and body         |
++-------+------------------------------------------------+
+|  24B  |           variable length + 16B tag            |
++-------+------------------------------------------------+
+
+Separate header
++------------+-----------+
+| session ID | packet ID |
++------------+-----------+
+|     8B     |   u64be   |
++------------+-----------+
+
+Client body
++------+------------------+----------------+----------+----------+----------+
+| type |     timestamp    | padding length |  padding |  address |  payload |
++------+------------------+----------------+----------+----------+----------+
+|  1B  | u64be unix epoch |     u16be      | variable | variable | variable |
++------+------------------+----------------+----------+----------+----------+
+
+Server body
++------+------------------+-------------------+----------------+----------+----------+----------+
+| type |     timestamp    | client session ID | padding length |  padding |  address |  payload |
++------+------------------+-------------------+----------------+----------+----------+----------+
+|  1B  | u64be unix epoch |         8B        |     u16be      | variable | variable | variable |
++------+------------------+-------------------+----------------+----------+----------+----------+
+*/
+
+const (
+	sessionIDSize      = 8
+	packetIDSize       = 8
+	separateHeaderSize = sessionIDSize + packetIDSize
+	// the AES methods use the last 12 bytes of the plain separate header as the nonce
+	separateHeaderNonceStart = separateHeaderSize - 12
+
+	clientPacketHeaderType = 0
+	serverPacketHeaderType = 1
+
+	// the DNS packets are easy to be recognized by their lengths, so we pad them
+	dnsPort = 53
+)
+
+type sessionID = [sessionIDSize]byte
+
+func newSessionID() (sessionID, error) {
+	var id sessionID
+	_, err := randutil.RandBytes(id[:])
+	return id, err
+}
+
+func isChaCha20Poly1305(method string) bool {
+	return method == conf.SSMethodChaCha20Poly1305
+}
+
+// packetSealer encrypts the packets of one session
+
+type packetSealer struct {
+	isClient  bool
+	sessionID sessionID
+	packetID  atomic.Uint64
+	// the session subkey's AEAD for the AES methods, or the PSK's XChaCha20-Poly1305 AEAD
+	aead cipher.AEAD
+	// nil for the ChaCha20-Poly1305 method
+	separateHeaderBlock cipher.Block
+	// only used by a client when the server has multiple users, then 'separateHeaderBlock' uses the identity PSK
+	hasIdentityHeader bool
+	userPSKHash       [identityHeaderSize]byte
+}
+
+func newPacketSealer(method string, isClient bool, preSharedKey, identityPreSharedKey []byte) (*packetSealer, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sealer := &packetSealer{isClient: isClient, sessionID: id}
+	if isChaCha20Poly1305(method) {
+		sealer.aead, err = errors.WithStack2(chacha20poly1305.NewX(preSharedKey))
+		return sealer, err
+	}
+
+	sealer.aead, err = aeadCipher(newAESGCM, preSharedKey, id[:])
+	if err != nil {
+		return nil, err
+	}
+	separateHeaderKey := preSharedKey
+	if identityPreSharedKey != nil {
+		separateHeaderKey = identityPreSharedKey
+		sealer.hasIdentityHeader = true
+		sealer.userPSKHash = userPSKHash(preSharedKey)
+	}
+	sealer.separateHeaderBlock, err = errors.WithStack2(aes.NewCipher(separateHeaderKey))
+	return sealer, err
+}
+
+func (s *packetSealer) prefixSize() int {
+	if s.separateHeaderBlock == nil {
+		return chacha20poly1305.NonceSizeX
+	}
+	if s.hasIdentityHeader {
+		return separateHeaderSize + identityHeaderSize
+	}
+	return separateHeaderSize
+}
+
+// the 'clientSessionID' is only needed by a server, and the returned packet should be put back to the pool
+
+func (s *packetSealer) seal(clientSessionID *sessionID, addr *transport.SocketAddress, payload []byte) ([]byte, error) {
+	var separateHeader [separateHeaderSize]byte
+	copy(separateHeader[:], s.sessionID[:])
+	binary.BigEndian.PutUint64(separateHeader[sessionIDSize:], s.packetID.Add(1)-1)
+
+	var paddingSize int
+	if addr.Port == dnsPort {
+		paddingSize = rand.IntN(maxPaddingSize) + 1
+	}
+	plaintextSize := typeWithTimestampSize + lenFieldSize + paddingSize + socks.SOCKSLikeAddrSizeInBytes(addr) + len(payload)
+	if !s.isClient {
+		plaintextSize += sessionIDSize
+	}
+	if s.separateHeaderBlock == nil {
+		plaintextSize += separateHeaderSize
+	}
+	prefixSize := s.prefixSize()
+	packet := pool.Get(prefixSize + plaintextSize + aeadTagOverhead)
+
+	plaintextBuf := bytes.NewBuffer(packet[prefixSize:prefixSize])
+	if s.separateHeaderBlock == nil {
+		plaintextBuf.Write(separateHeader[:])
+	}
+	if s.isClient {
+		plaintextBuf.WriteByte(clientPacketHeaderType)
+	} else {
+		plaintextBuf.WriteByte(serverPacketHeaderType)
+	}
+	err := binary.Write(plaintextBuf, binary.BigEndian, uint64(unixTime()))
+	if err != nil {
+		pool.Put(packet)
+		return nil, errors.WithStack(err)
+	}
+	if !s.isClient {
+		plaintextBuf.Write(clientSessionID[:])
+	}
+	err = binary.Write(plaintextBuf, binary.BigEndian, uint16(paddingSize))
+	if err != nil {
+		pool.Put(packet)
+		return nil, errors.WithStack(err)
+	}
+	padding, err := randutil.RandNBytes(paddingSize)
+	if err != nil {
+		pool.Put(packet)
+		return nil, err
+	}
+	plaintextBuf.Write(padding)
+	socks.WriteSOCKSLikeAddr(plaintextBuf, addr)
+	plaintextBuf.Write(payload)
+
+	plaintext := packet[prefixSize : prefixSize+plaintextSize]
+	if s.separateHeaderBlock == nil {
+		nonce := packet[:prefixSize]
+		_, err = randutil.RandBytes(nonce)
+		if err != nil {
+			pool.Put(packet)
+			return nil, err
+		}
+		s.aead.Seal(plaintext[:0], nonce, plaintext, nil)
+		return packet, nil
+	}
+
+	s.aead.Seal(plaintext[:0], separateHeader[separateHeaderNonceStart:], plaintext, nil)
+	// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-2-shadowsocks-2022-extensible-identity-headers.md
+	// identity_header = aes_encrypt(key: iPSKn, plaintext: blake3::hash(iPSKn+1)[0..16] ^ plaintext_separate_header)
+	if s.hasIdentityHeader {
+		identityHeader := packet[separateHeaderSize:prefixSize]
+		subtle.XORBytes(identityHeader, s.userPSKHash[:], separateHeader[:])
+		s.separateHeaderBlock.Encrypt(identityHeader, identityHeader)
+	}
+	s.separateHeaderBlock.Encrypt(packet[:separateHeaderSize], separateHeader[:])
+	return packet, nil
+}
+
+// the session ID and the AEAD of the other side's session, which is used to decrypt its packets
+
+type remoteSession struct {
+	id           sessionID
+	aead         cipher.AEAD
+	replayFilter replayFilter
+}
+
+func newRemoteSession(method string, preSharedKey []byte, id sessionID) (*remoteSession, error) {
+	var aead cipher.AEAD
+	var err error
+	if isChaCha20Poly1305(method) {
+		aead, err = errors.WithStack2(chacha20poly1305.NewX(preSharedKey))
+	} else {
+		aead, err = aeadCipher(newAESGCM, preSharedKey, id[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSession{id: id, aead: aead}, nil
+}
+
+// decrypts the separate header of a packet of the AES methods in place
+
+func openSeparateHeader(separateHeaderBlock cipher.Block, packet []byte) (separateHeader []byte, err error) {
+	if len(packet) < separateHeaderSize+aeadTagOverhead {
+		return nil, errors.Newf("the packet is too short: %v byte(s)", len(packet))
+	}
+	separateHeader = packet[:separateHeaderSize]
+	separateHeaderBlock.Decrypt(separateHeader, separateHeader)
+	return separateHeader, nil
+}
+
+// decrypts the separate header and the body of a packet of the ChaCha20-Poly1305 method in place
+
+func openXChaCha20Poly1305Packet(aead cipher.AEAD, packet []byte) (separateHeader []byte, body []byte, err error) {
+	nonceSize := chacha20poly1305.NonceSizeX
+	if len(packet) < nonceSize+separateHeaderSize+aeadTagOverhead {
+		return nil, nil, errors.Newf("the packet is too short: %v byte(s)", len(packet))
+	}
+	ciphertext := packet[nonceSize:]
+	plaintext, err := aead.Open(ciphertext[:0], packet[:nonceSize], ciphertext, nil)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return plaintext[:separateHeaderSize], plaintext[separateHeaderSize:], nil
+}
+
+// decrypts the body of a packet of the AES methods in place
+
+func openBody(aead cipher.AEAD, separateHeader []byte, encryptedBody []byte) ([]byte, error) {
+	return errors.WithStack2(aead.Open(encryptedBody[:0], separateHeader[separateHeaderNonceStart:], encryptedBody, nil))
+}
+
+func parseSeparateHeader(separateHeader []byte) (sessionID, uint64) {
+	return sessionID(separateHeader[:sessionIDSize]), binary.BigEndian.Uint64(separateHeader[sessionIDSize:])
+}
+
+// parses a decrypted body, the 'clientSessionID' is nil when the body is sent by a client
+
+func parseBody(body []byte, clientSessionID *sessionID) (*transport.SocketAddress, []byte, error) {
+	headerType := byte(clientPacketHeaderType)
+	headerSize := typeWithTimestampSize + lenFieldSize
+	if clientSessionID != nil {
+		headerType = serverPacketHeaderType
+		headerSize += sessionIDSize
+	}
+	if len(body) < headerSize {
+		return nil, nil, errors.Newf("the packet body is too short: %v byte(s)", len(body))
+	}
+	if body[0] != headerType {
+		return nil, nil, errors.Newf("invalid packet header type '%v', '%v' expect", body[0], headerType)
+	}
+	err := validateUnixTimeInRange(body[1:typeWithTimestampSize], unixTime())
+	if err != nil {
+		return nil, nil, err
+	}
+	paddingLenStart := typeWithTimestampSize
+	if clientSessionID != nil {
+		receivedClientSessionID := body[typeWithTimestampSize : typeWithTimestampSize+sessionIDSize]
+		if !bytes.Equal(clientSessionID[:], receivedClientSessionID) {
+			return nil, nil, errors.New("incorrect client session ID in the server packet")
+		}
+		paddingLenStart += sessionIDSize
+	}
+	paddingLen := int(binary.BigEndian.Uint16(body[paddingLenStart:]))
+	addrStart := paddingLenStart + lenFieldSize + paddingLen
+	if addrStart > len(body) {
+		return nil, nil, errors.Newf("expect %v padding byte(s), but only have %v remain bytes in the packet body",
+			paddingLen, len(body)-paddingLenStart-lenFieldSize)
+	}
+
+	bodyReader := bytes.NewReader(body[addrStart:])
+	addr, err := socks.ReadSOCKS5Address(bodyReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, body[len(body)-bodyReader.Len():], nil
+}
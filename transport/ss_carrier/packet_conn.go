@@ -0,0 +1,162 @@
+package ss_carrier
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"maps"
+	"net"
+	"syscall"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// packetConn is a client session of the UDP relay, which sends all packets to the server through a connected UDP socket
+
+type packetConn struct {
+	*net.UDPConn
+	method       string
+	preSharedKey []byte
+	sealer       *packetSealer
+
+	// the server's packets are always encrypted by the user's PSK even if the server has multiple users
+	separateHeaderBlock cipher.Block
+	// only for the ChaCha20-Poly1305 method
+	xChaCha20Poly1305 cipher.AEAD
+	// the server may start a new session for us, e.g., after it restarts,
+	// and the packets of the previous session may still arrive later, so we keep it with its replay filter
+	serverSession         *remoteSession
+	previousServerSession *remoteSession
+	// the sessions before the previous one, whose packets are rejected until they can't pass the timestamp check
+	retiredServerSessionIDs map[sessionID]time.Time
+}
+
+// the packets sent before a session is retired may be 30 seconds earlier or later than our clock
+const retiredServerSessionTTL = 2 * maxAllowedUnixTimeDiffInSecond * time.Second
+
+var _ transport.PacketConn = new(packetConn)
+
+func newPacketConn(udpConn *net.UDPConn, method string, preSharedKey, identityPreSharedKey []byte) (*packetConn, error) {
+	sealer, err := newPacketSealer(method, true, preSharedKey, identityPreSharedKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &packetConn{UDPConn: udpConn, method: method, preSharedKey: preSharedKey, sealer: sealer}
+	if isChaCha20Poly1305(method) {
+		c.xChaCha20Poly1305, err = errors.WithStack2(chacha20poly1305.NewX(preSharedKey))
+	} else {
+		c.separateHeaderBlock, err = errors.WithStack2(aes.NewCipher(preSharedKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *packetConn) WritePacket(b []byte, addr *transport.SocketAddress) (int, error) {
+	packet, err := c.sealer.seal(nil, addr, b)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.Put(packet)
+	_, err = c.UDPConn.Write(packet)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) ReadPacket(b []byte) (int, *transport.SocketAddress, error) {
+	packet := pool.Get(transport.MaxUDPPacketSize)
+	defer pool.Put(packet)
+	for {
+		n, err := c.UDPConn.Read(packet)
+		if err != nil {
+			// a connected UDP socket receives this when the server isn't listening, e.g., it's restarting,
+			// so we keep the session for the server's later packets
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return 0, nil, errors.WithStack(err)
+		}
+		addr, payload, err := c.open(packet[:n])
+		if err != nil {
+			// the invalid packets may be sent by anyone, so we only drop them
+			logger.InfoWithError("drop an invalid packet from the UDP relay", err)
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+func (c *packetConn) open(packet []byte) (*transport.SocketAddress, []byte, error) {
+	var separateHeader, body []byte
+	var err error
+	if c.xChaCha20Poly1305 != nil {
+		separateHeader, body, err = openXChaCha20Poly1305Packet(c.xChaCha20Poly1305, packet)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		separateHeader, err = openSeparateHeader(c.separateHeaderBlock, packet)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	serverSessionID, packetID := parseSeparateHeader(separateHeader)
+	serverSession, isNew, err := c.serverSessionOf(serverSessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.xChaCha20Poly1305 == nil {
+		body, err = openBody(serverSession.aead, separateHeader, packet[separateHeaderSize:])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	addr, payload, err := parseBody(body, &c.sealer.sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !serverSession.replayFilter.validate(packetID) {
+		return nil, nil, errors.Newf("replay detected due to repeated packet ID %v", packetID)
+	}
+	// only switch to the new server session after its packet is authenticated
+	if isNew {
+		c.switchServerSession(serverSession)
+	}
+	return addr, payload, nil
+}
+
+func (c *packetConn) serverSessionOf(id sessionID) (*remoteSession, bool, error) {
+	for _, session := range []*remoteSession{c.serverSession, c.previousServerSession} {
+		if session != nil && session.id == id {
+			return session, false, nil
+		}
+	}
+	retiredTime, ok := c.retiredServerSessionIDs[id]
+	if ok && time.Since(retiredTime) <= retiredServerSessionTTL {
+		return nil, false, errors.Newf("the packet is from an old server session %x", id)
+	}
+	session, err := newRemoteSession(c.method, c.preSharedKey, id)
+	return session, true, err
+}
+
+func (c *packetConn) switchServerSession(session *remoteSession) {
+	if c.previousServerSession != nil {
+		now := time.Now()
+		if c.retiredServerSessionIDs == nil {
+			c.retiredServerSessionIDs = make(map[sessionID]time.Time)
+		}
+		maps.DeleteFunc(c.retiredServerSessionIDs, func(_ sessionID, retiredTime time.Time) bool {
+			return now.Sub(retiredTime) > retiredServerSessionTTL
+		})
+		c.retiredServerSessionIDs[c.previousServerSession.id] = now
+	}
+	c.previousServerSession = c.serverSession
+	c.serverSession = session
+}
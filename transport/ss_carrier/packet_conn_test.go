@@ -0,0 +1,57 @@
+package ss_carrier
+
+import (
+	"testing"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// the server restarts twice, and the packets of its sessions arrive late or are replayed
+
+func TestPacketConnWithServerSessionChanges(t *testing.T) {
+	for _, method := range []string{conf.SSMethodAES128GCM, conf.SSMethodChaCha20Poly1305} {
+		t.Run(method, func(t *testing.T) {
+			password := testutil.NewPassword(t, "66cac28e26cd4d6fa5e84821c702fadb")
+			if conf.SSKeySize(method) == 32 {
+				password = testutil.NewPassword(t, "5c1f0e9a8b7d6c5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e")
+			}
+			psk := password.Key()
+			c, err := newPacketConn(nil, method, psk, nil)
+			assert.Nil(t, err)
+			addr := transport.NewSocketAddressByDomain("example.com", 443)
+			var sealers [3]*packetSealer
+			for i := range sealers {
+				sealers[i], err = newPacketSealer(method, false, psk, nil)
+				assert.Nil(t, err)
+			}
+			seal := func(sealer *packetSealer) []byte {
+				packet, err := sealer.seal(&c.sealer.sessionID, addr, []byte("payload"))
+				assert.Nil(t, err)
+				t.Cleanup(func() { pool.Put(packet) })
+				return packet
+			}
+			open := func(packet []byte) error {
+				_, _, err := c.open(packet)
+				return err
+			}
+
+			firstPacket := seal(sealers[0])
+			assert.Nil(t, open(firstPacket))
+			assert.Nil(t, open(seal(sealers[1])))
+			// the previous session's late packet is accepted, but its replayed packet isn't
+			assert.Nil(t, open(seal(sealers[0])))
+			assert.NotNil(t, open(firstPacket))
+			assert.Equal(t, sealers[1].sessionID, c.serverSession.id)
+
+			// the sessions before the previous one are rejected
+			assert.Nil(t, open(seal(sealers[2])))
+			assert.NotNil(t, open(seal(sealers[0])))
+			assert.Nil(t, open(seal(sealers[1])))
+			assert.Equal(t, sealers[2].sessionID, c.serverSession.id)
+		})
+	}
+}
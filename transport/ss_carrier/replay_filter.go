@@ -0,0 +1,46 @@
+package ss_carrier
+
+// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md#32-format
+// The packet ID is a counter starting from 0 in each session, and the receiver uses a sliding window filter
+// to reject the replayed packets.
+// The below is the algorithm in https://datatracker.ietf.org/doc/html/rfc6479, which is also used by WireGuard.
+const (
+	replayFilterBlockBits = 64
+	replayFilterBlocks    = 64
+	// the latest block may be partially used, so it's not counted in the window size
+	replayFilterWindowSize = (replayFilterBlocks - 1) * replayFilterBlockBits
+)
+
+type replayFilter struct {
+	last   uint64
+	blocks [replayFilterBlocks]uint64
+}
+
+// reports whether the packet ID is seen for the first time, and records it if so
+// it should only be called after the packet is authenticated
+
+func (f *replayFilter) validate(packetID uint64) bool {
+	if packetID+replayFilterWindowSize < f.last {
+		// too old
+		return false
+	}
+
+	blockIndex := packetID / replayFilterBlockBits
+	if packetID > f.last {
+		lastBlockIndex := f.last / replayFilterBlockBits
+		// clear the blocks between the last one and the new one
+		diff := min(blockIndex-lastBlockIndex, replayFilterBlocks)
+		for i := uint64(1); i <= diff; i++ {
+			f.blocks[(lastBlockIndex+i)%replayFilterBlocks] = 0
+		}
+		f.last = packetID
+	}
+
+	blockIndex %= replayFilterBlocks
+	bit := uint64(1) << (packetID % replayFilterBlockBits)
+	if f.blocks[blockIndex]&bit != 0 {
+		return false
+	}
+	f.blocks[blockIndex] |= bit
+	return true
+}
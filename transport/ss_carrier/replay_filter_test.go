@@ -0,0 +1,32 @@
+package ss_carrier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayFilter(t *testing.T) {
+	tests := []struct {
+		packetID uint64
+		expected bool
+	}{
+		{0, true},
+		{0, false},
+		{2, true},
+		{1, true},
+		{1, false},
+		{replayFilterWindowSize + 100, true},
+		// out of the window
+		{2, false},
+		{99, false},
+		// still in the window
+		{101, true},
+		{101, false},
+		{replayFilterWindowSize + 99, true},
+	}
+	var filter replayFilter
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, filter.validate(tt.packetID), "no match", tt)
+	}
+}
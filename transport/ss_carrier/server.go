@@ -8,45 +8,81 @@ import (
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
 	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/obfs"
 )
 
 type server struct {
 	hg           *conf.Hg
 	targetClient transport.Client
 
+	// the identity PSK if there are multiple users
 	preSharedKey []byte
+	newAEAD      aeadConstructor
 	aeadOverhead int
-	// we can use '[16]byte' here actually, but we still use string here
-	// because we may support "2022-blake3-aes-256-gcm" later which uses '[32]byte'
-	saltPool *saltPool[string]
+	// the salt is 16 or 32 bytes depending on the method, so we use string here
+	saltPool   *saltPool[string]
+	users      map[[identityHeaderSize]byte]*user
+	obfuscator obfs.Obfuscator
+}
+
+type user struct {
+	name         string
+	preSharedKey []byte
 }
 
 var _ transport.Server = new(server)
 
 func NewServer(hg *conf.Hg, targetClient transport.Client) transport.Server {
-	return &server{hg, targetClient, hg.Password.Raw[:], gcmTagOverhead, newSaltPool[string]()}
+	var users map[[identityHeaderSize]byte]*user
+	if len(hg.Users) > 0 {
+		users = make(map[[identityHeaderSize]byte]*user, len(hg.Users))
+		for _, hgUser := range hg.Users {
+			userPSK := hgUser.Password.Key()
+			users[userPSKHash(userPSK)] = &user{hgUser.Name, userPSK}
+		}
+	}
+	return &server{hg, targetClient, hg.Password.Key(), aeadConstructorOf(hg.SSMethod), aeadTagOverhead,
+		newSaltPool[string](), users, obfs.New(hg.Obfuscation)}
 }
 
 func (s *server) ListenAndServe(ctx context.Context) error {
+	go func() {
+		// the UDP relay is served on the same port number as the TCP one
+		err := netutil.ListenUDPAndServe(ctx, s.hg.TCPPort, func(udpConn *net.UDPConn) error {
+			relay, err := newUDPRelay(s, udpConn)
+			if err != nil {
+				return err
+			}
+			return relay.serve(ctx)
+		})
+		if err != nil {
+			logger.Fatal("fail to serve the UDP relay", err)
+		}
+	}()
+
 	addr := ":" + strconv.Itoa(s.hg.TCPPort)
 	return netutil.ListenTCPAndServe(ctx, addr, func(conn *net.TCPConn) {
-		ctx = contextutil.WithSourceAndInboundValues(ctx, conn.RemoteAddr().String(), "TCP carrier")
+		ctx := contextutil.WithSourceAndInboundValues(ctx, conn.RemoteAddr().String(), "TCP carrier")
 		err := s.Serve(ctx, conn)
 		_ = conn.Close()
 		if err != nil {
-			log.InfoWithError("fail to handle a request over SS", err)
+			logger.InfoWithError("fail to handle a request over SS", err)
 		}
 	})
 }
 
 func (s *server) Serve(ctx context.Context, conn net.Conn) error {
-	serverConn := newServerConn(conn.(*net.TCPConn), s.preSharedKey, s.aeadOverhead, s.saltPool)
+	tcpConn := conn.(*net.TCPConn)
+	serverConn := newServerConn(s.obfuscator.WrapConn(tcpConn), tcpConn, s.preSharedKey, s.newAEAD, s.aeadOverhead, s.saltPool, s.users,
+		s.hg.Obfuscation != nil)
 	// this is needed to get the access address for 'targetClient'
 	err := serverConn.readClientFirstPayload()
 	if err != nil {
 		return err
 	}
+	if serverConn.user != "" {
+		ctx = contextutil.WithUser(ctx, serverConn.user)
+	}
 	return transport.ForwardTCP(ctx, serverConn.accessAddr, serverConn, s.targetClient)
 }
@@ -0,0 +1,275 @@
+package ss_carrier
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// the same as the default UDP timeout of shadowsocks-rust
+	udpSessionTimeout = 5 * time.Minute
+	// the packets are dropped if the target side can't consume them in time
+	udpSessionQueueSize = 64
+)
+
+// udpRelay serves the UDP relay of the Shadowsocks 2022 spec, it dispatches the packets to the client sessions
+
+type udpRelay struct {
+	*server
+	udpConn *net.UDPConn
+
+	// the identity PSK's cipher when the server has multiple users
+	separateHeaderBlock cipher.Block
+	// only for the ChaCha20-Poly1305 method
+	xChaCha20Poly1305 cipher.AEAD
+
+	sessions      map[sessionID]*serverPacketConn
+	sessionsMutex sync.Mutex
+}
+
+func newUDPRelay(s *server, udpConn *net.UDPConn) (*udpRelay, error) {
+	relay := &udpRelay{server: s, udpConn: udpConn, sessions: make(map[sessionID]*serverPacketConn)}
+	var err error
+	if isChaCha20Poly1305(s.hg.SSMethod) {
+		relay.xChaCha20Poly1305, err = errors.WithStack2(chacha20poly1305.NewX(s.preSharedKey))
+	} else {
+		relay.separateHeaderBlock, err = errors.WithStack2(aes.NewCipher(s.preSharedKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return relay, nil
+}
+
+func (r *udpRelay) serve(ctx context.Context) error {
+	go r.expireSessions(ctx)
+
+	packet := pool.Get(transport.MaxUDPPacketSize)
+	defer pool.Put(packet)
+	for {
+		n, clientAddr, err := r.udpConn.ReadFromUDPAddrPort(packet)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = r.handlePacket(ctx, packet[:n], clientAddr)
+		if err != nil {
+			logger.InfoWithError("fail to handle a packet over SS", err, contextutil.SourceTag, clientAddr.String())
+		}
+	}
+}
+
+func (r *udpRelay) handlePacket(ctx context.Context, packet []byte, clientAddr netip.AddrPort) error {
+	var separateHeader, body []byte
+	var err error
+	encryptedBodyStart := separateHeaderSize
+	if r.xChaCha20Poly1305 != nil {
+		separateHeader, body, err = openXChaCha20Poly1305Packet(r.xChaCha20Poly1305, packet)
+	} else {
+		separateHeader, err = openSeparateHeader(r.separateHeaderBlock, packet)
+		if r.users != nil {
+			encryptedBodyStart += identityHeaderSize
+		}
+		if err == nil && len(packet) < encryptedBodyStart+aeadTagOverhead {
+			err = errors.Newf("the packet is too short: %v byte(s)", len(packet))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	clientSessionID, packetID := parseSeparateHeader(separateHeader)
+	r.sessionsMutex.Lock()
+	session, ok := r.sessions[clientSessionID]
+	r.sessionsMutex.Unlock()
+	if !ok {
+		session, err = r.newSession(clientSessionID, separateHeader, packet[separateHeaderSize:encryptedBodyStart])
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.xChaCha20Poly1305 == nil {
+		body, err = openBody(session.clientSession.aead, separateHeader, packet[encryptedBodyStart:])
+		if err != nil {
+			return err
+		}
+	}
+	addr, payload, err := parseBody(body, nil)
+	if err != nil {
+		return err
+	}
+	// only this goroutine uses the filter, so no lock is needed
+	if !session.clientSession.replayFilter.validate(packetID) {
+		return errors.Newf("replay detected due to repeated packet ID %v", packetID)
+	}
+	// the client's address may change, e.g., due to the NAT rebinding, so we always reply to the latest one
+	session.clientAddr.Store(&clientAddr)
+	session.lastActive.Store(time.Now().Unix())
+
+	if !ok {
+		r.sessionsMutex.Lock()
+		r.sessions[clientSessionID] = session
+		r.sessionsMutex.Unlock()
+		go r.forward(ctx, session, addr, clientAddr)
+	}
+	session.deliver(addr, payload)
+	return nil
+}
+
+// the session isn't added to 'sessions' until its first packet is authenticated
+
+func (r *udpRelay) newSession(clientSessionID sessionID, separateHeader, identityHeader []byte) (*serverPacketConn, error) {
+	userPSK := r.preSharedKey
+	var userName string
+	if r.users != nil {
+		// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-2-shadowsocks-2022-extensible-identity-headers.md
+		// identity_header = aes_encrypt(key: iPSKn, plaintext: blake3::hash(iPSKn+1)[0..16] ^ plaintext_separate_header)
+		var userPSKHash [identityHeaderSize]byte
+		r.separateHeaderBlock.Decrypt(userPSKHash[:], identityHeader)
+		subtle.XORBytes(userPSKHash[:], userPSKHash[:], separateHeader)
+		user, ok := r.users[userPSKHash]
+		if !ok {
+			return nil, errors.New("no user matches the identity header")
+		}
+		userPSK = user.preSharedKey
+		userName = user.name
+	}
+
+	clientSession, err := newRemoteSession(r.hg.SSMethod, userPSK, clientSessionID)
+	if err != nil {
+		return nil, err
+	}
+	// a server's packets are always encrypted by the user's PSK, so there is no identity header in them
+	sealer, err := newPacketSealer(r.hg.SSMethod, false, userPSK, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &serverPacketConn{relay: r, clientSession: clientSession, sealer: sealer, user: userName,
+		packets: make(chan *sessionPacket, udpSessionQueueSize), closed: make(chan struct{})}, nil
+}
+
+func (r *udpRelay) forward(ctx context.Context, session *serverPacketConn, accessAddr *transport.SocketAddress, clientAddr netip.AddrPort) {
+	ctx = contextutil.WithSourceAndInboundValues(ctx, clientAddr.String(), "TCP carrier's UDP relay")
+	if session.user != "" {
+		ctx = contextutil.WithUser(ctx, session.user)
+	}
+	err := transport.ForwardUDP(ctx, accessAddr, session, r.targetClient)
+	_ = session.Close()
+	if err != nil {
+		logger.InfoWithError("fail to relay packets over SS", err)
+	}
+}
+
+func (r *udpRelay) expireSessions(ctx context.Context) {
+	ticker := time.NewTicker(udpSessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.sessionsMutex.Lock()
+			sessions := make([]*serverPacketConn, 0, len(r.sessions))
+			for _, session := range r.sessions {
+				sessions = append(sessions, session)
+			}
+			r.sessionsMutex.Unlock()
+			for _, session := range sessions {
+				_ = session.Close()
+			}
+			return
+		case now := <-ticker.C:
+			var expiredSessions []*serverPacketConn
+			r.sessionsMutex.Lock()
+			for _, session := range r.sessions {
+				if now.Sub(time.Unix(session.lastActive.Load(), 0)) > udpSessionTimeout {
+					expiredSessions = append(expiredSessions, session)
+				}
+			}
+			r.sessionsMutex.Unlock()
+			for _, session := range expiredSessions {
+				_ = session.Close()
+			}
+		}
+	}
+}
+
+type sessionPacket struct {
+	addr    *transport.SocketAddress
+	payload []byte
+}
+
+// serverPacketConn is a client session on the server side, its packets are dispatched by the 'udpRelay'
+
+type serverPacketConn struct {
+	relay         *udpRelay
+	clientSession *remoteSession
+	sealer        *packetSealer
+	user          string
+	clientAddr    atomic.Pointer[netip.AddrPort]
+	// the Unix time in seconds
+	lastActive atomic.Int64
+
+	packets   chan *sessionPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ transport.PacketConn = new(serverPacketConn)
+
+func (c *serverPacketConn) deliver(addr *transport.SocketAddress, payload []byte) {
+	payloadCopy := pool.Get(len(payload))
+	copy(payloadCopy, payload)
+	select {
+	case c.packets <- &sessionPacket{addr, payloadCopy}:
+	default:
+		pool.Put(payloadCopy)
+		logger.Debug("drop a packet over SS as the session's queue is full", "access", addr.ToHostStr())
+	}
+}
+
+func (c *serverPacketConn) ReadPacket(b []byte) (int, *transport.SocketAddress, error) {
+	select {
+	case packet := <-c.packets:
+		n := copy(b, packet.payload)
+		pool.Put(packet.payload)
+		return n, packet.addr, nil
+	case <-c.closed:
+		return 0, nil, errors.WithStack(net.ErrClosed)
+	}
+}
+
+func (c *serverPacketConn) WritePacket(b []byte, addr *transport.SocketAddress) (int, error) {
+	packet, err := c.sealer.seal(&c.clientSession.id, addr, b)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.Put(packet)
+	_, err = c.relay.udpConn.WriteToUDPAddrPort(packet, *c.clientAddr.Load())
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	c.lastActive.Store(time.Now().Unix())
+	return len(b), nil
+}
+
+func (c *serverPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.relay.sessionsMutex.Lock()
+		delete(c.relay.sessions, c.clientSession.id)
+		c.relay.sessionsMutex.Unlock()
+	})
+	return nil
+}
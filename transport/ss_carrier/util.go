@@ -6,41 +6,110 @@ import (
 	"encoding/binary"
 	"time"
 
+	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/log"
 	"github.com/ringo-is-a-color/heteroglossia/util/randutil"
+	"golang.org/x/crypto/chacha20poly1305"
 	"lukechampine.com/blake3"
 )
 
+var logger = log.NewLogger("ss_carrier")
+
 func generateSalt(preSharedKey []byte) ([]byte, error) {
 	saltSize := len(preSharedKey)
 	return randutil.RandNBytes(saltSize)
 }
 
-const gcmTagOverhead = 16
+func unixTime() int64 {
+	return time.Now().Unix()
+}
+
+// both AES-GCM and ChaCha20-Poly1305 use a 16-byte tag
+const aeadTagOverhead = 16
+
+type aeadConstructor func(key []byte) (cipher.AEAD, error)
+
+func aeadConstructorOf(method string) aeadConstructor {
+	if method == conf.SSMethodChaCha20Poly1305 {
+		return newChaCha20Poly1305
+	}
+	// the AES-128 or AES-256 is chosen by the key's length
+	return newAESGCM
+}
 
-func aeadCipher(psk, salt []byte) (cipher.AEAD, error) {
-	subkey := deriveSubkey(psk, salt)
-	block, err := aes.NewCipher(subkey)
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	return errors.WithStack2(cipher.NewGCM(block))
 }
 
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return errors.WithStack2(chacha20poly1305.New(key))
+}
+
+func aeadCipher(newAEAD aeadConstructor, psk, salt []byte) (cipher.AEAD, error) {
+	return newAEAD(deriveSubkey(psk, salt))
+}
+
 func deriveSubkey(psk, salt []byte) []byte {
+	return deriveKey("shadowsocks 2022 session subkey", psk, salt)
+}
+
+func deriveKey(context string, psk, salt []byte) []byte {
 	keyMaterial := make([]byte, len(psk)+len(salt))
 	copy(keyMaterial, psk)
 	copy(keyMaterial[len(psk):], salt)
 	key := make([]byte, len(psk))
-	blake3.DeriveKey(key, "shadowsocks 2022 session subkey", keyMaterial)
+	blake3.DeriveKey(key, context, keyMaterial)
 	return key
 }
 
+// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-2-shadowsocks-2022-extensible-identity-headers.md
+// identity_subkey = blake3::derive_key(context: "shadowsocks 2022 identity subkey", key_material: iPSKn + salt)
+// plaintext = blake3::hash(iPSKn+1)[0..16] // Take the first 16 bytes of the next iPSK's hash.
+// identity_header = aes_encrypt(key: identity_subkey, plaintext: plaintext)
+// We only support one identity header, so the 'iPSKn+1' is always the user's PSK (uPSK).
+
+const identityHeaderSize = aes.BlockSize
+
+func userPSKHash(userPSK []byte) [identityHeaderSize]byte {
+	hash := blake3.Sum256(userPSK)
+	return [identityHeaderSize]byte(hash[:identityHeaderSize])
+}
+
+func identityHeaderCipher(identityPSK, salt []byte) (cipher.Block, error) {
+	identitySubkey := deriveKey("shadowsocks 2022 identity subkey", identityPSK, salt)
+	return errors.WithStack2(aes.NewCipher(identitySubkey))
+}
+
+func encryptIdentityHeader(identityPSK, userPSK, salt []byte) ([]byte, error) {
+	block, err := identityHeaderCipher(identityPSK, salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := userPSKHash(userPSK)
+	identityHeader := make([]byte, identityHeaderSize)
+	block.Encrypt(identityHeader, plaintext[:])
+	return identityHeader, nil
+}
+
+func decryptIdentityHeader(identityPSK, salt, identityHeader []byte) ([identityHeaderSize]byte, error) {
+	var userPSKHash [identityHeaderSize]byte
+	block, err := identityHeaderCipher(identityPSK, salt)
+	if err != nil {
+		return userPSKHash, err
+	}
+	block.Decrypt(userPSKHash[:], identityHeader)
+	return userPSKHash, nil
+}
+
 const maxAllowedUnixTimeDiffInSecond = 30
 
-func validateUnixTimeInRange(bs []byte) error {
+func validateUnixTimeInRange(bs []byte, now int64) error {
 	compared := int64(binary.BigEndian.Uint64(bs))
-	now := time.Now().Unix()
 	diff := max(compared, now) - min(compared, now)
 	if diff > maxAllowedUnixTimeDiffInSecond {
 		return errors.Newf("unix time difference is over 30 seconds: received time was '%v' and now it is %v",
@@ -10,32 +10,116 @@ import (
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/obfs"
 )
 
 type client struct {
-	proxyNode           *conf.ProxyNode
-	tlsConfig           *tls.Config
-	passwordWithoutCRLF [16]byte
+	proxyNode *conf.ProxyNode
+	tlsConfig *tls.Config
+	// the password without CRLF for an hg server, or the hex SHA224 password for a Trojan server
+	passwordLine []byte
+	isTrojan     bool
+	// not nil for an hg server with 'tls-reality'
+	reality *realityClient
+	// wraps the TCP socket under TLS, and it's not used in the REALITY-like mode
+	obfuscator obfs.Obfuscator
 }
 
 var _ transport.Client = new(client)
 
 func NewClient(proxyNode *conf.ProxyNode, tlsKeyLog bool) (transport.Client, error) {
-	clientHandler := &client{proxyNode: proxyNode}
+	clientHandler := &client{proxyNode: proxyNode, isTrojan: proxyNode.Protocol == conf.ProtocolTrojan,
+		obfuscator: obfs.New(proxyNode.Obfuscation)}
 	tlsConfig, err := netutil.TLSClientConfig(proxyNode, tlsKeyLog)
 	if err != nil {
 		return nil, err
 	}
+	switch proxyNode.TLSTransport {
+	case conf.TLSTransportGRPC:
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{"h2"}
+	case conf.TLSTransportWebSocket:
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
 	clientHandler.tlsConfig = tlsConfig
-	clientHandler.passwordWithoutCRLF = replaceCRLF(proxyNode.Password.Raw)
+	if proxyNode.TLSReality != nil {
+		clientHandler.reality, err = newRealityClient(proxyNode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if clientHandler.isTrojan {
+		trojanPassword := toTrojanPassword(proxyNode.Password.String)
+		clientHandler.passwordLine = trojanPassword[:]
+	} else {
+		clientHandler.passwordLine = passwordLine(&proxyNode.Password)
+	}
 	return clientHandler, nil
 }
 
 func (c *client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (net.Conn, error) {
+	tlsConn, err := c.dialTLS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newClientConn(tlsConn, addr, c.passwordLine, c.isTrojan), nil
+}
+
+func (c *client) DialUDP(ctx context.Context, addr *transport.SocketAddress) (transport.PacketConn, error) {
+	if !c.isTrojan {
+		return nil, errors.New("the TLS carrier doesn't support UDP")
+	}
+	tlsConn, err := c.dialTLS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newClientPacketConn(tlsConn, addr, c.passwordLine), nil
+}
+
+func (c *client) dialTLS(ctx context.Context) (net.Conn, error) {
 	targetHostWithPort := c.proxyNode.Host + ":" + strconv.Itoa(c.proxyNode.TLSPort)
-	tlsConn, err := netutil.DialTLS(ctx, targetHostWithPort, c.tlsConfig)
+	var tlsConn net.Conn
+	var err error
+	switch {
+	case c.reality != nil:
+		tlsConn, err = c.reality.dial(ctx, targetHostWithPort, c.tlsConfig.KeyLogWriter)
+	case c.proxyNode.TLSFingerprint != "":
+		tlsConn, err = netutil.DialUTLS(ctx, targetHostWithPort, c.tlsConfig, c.proxyNode.TLSFingerprint, c.obfuscator.WrapConn)
+	default:
+		tlsConn, err = c.dialTLSWithECH(ctx, targetHostWithPort)
+	}
 	if err != nil {
 		return nil, errors.Newf(err, "fail to connect to the TLS server %v", targetHostWithPort)
 	}
-	return newClientConn(tlsConn, addr, c.passwordWithoutCRLF), nil
+	if c.proxyNode.TLSTransport != "" {
+		return c.dialTransport(ctx, tlsConn)
+	}
+	return tlsConn, nil
+}
+
+// with ECH, the handshake is done here, so the dial is retried once with the server's retry configs if it rejects ECH
+
+func (c *client) dialTLSWithECH(ctx context.Context, addr string) (net.Conn, error) {
+	for retried := false; ; retried = true {
+		tlsConfig, err := netutil.TLSClientConfigWithECH(ctx, c.proxyNode, c.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn, err := netutil.DialTLS(ctx, addr, tlsConfig, c.obfuscator.WrapConn)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig.EncryptedClientHelloConfigList == nil {
+			return tlsConn, nil
+		}
+		err = tlsConn.HandshakeContext(ctx)
+		if err == nil {
+			return tlsConn, nil
+		}
+		_ = tlsConn.Close()
+		if retried || !netutil.UpdateECHConfigList(c.proxyNode, err) {
+			return nil, errors.WithStack(err)
+		}
+	}
 }
@@ -15,7 +15,8 @@ import (
 type clientConn struct {
 	net.Conn
 	accessAddr           *transport.SocketAddress
-	passwordWithCRLF     [16]byte
+	passwordLine         []byte
+	isTrojan             bool
 	hasWriteFirstPayload bool
 }
 
@@ -23,8 +24,8 @@ var _ net.Conn = new(clientConn)
 var _ io.ReaderFrom = new(clientConn)
 var _ io.WriterTo = new(clientConn)
 
-func newClientConn(conn net.Conn, accessAddr *transport.SocketAddress, passwordWithoutCRLF [16]byte) *clientConn {
-	return &clientConn{conn, accessAddr, passwordWithoutCRLF, false}
+func newClientConn(conn net.Conn, accessAddr *transport.SocketAddress, passwordLine []byte, isTrojan bool) *clientConn {
+	return &clientConn{conn, accessAddr, passwordLine, isTrojan, false}
 }
 
 func (c *clientConn) Write(b []byte) (n int, err error) {
@@ -45,16 +46,12 @@ https://trojan-gfw.github.io/trojan/protocol
 */
 
 func (c *clientConn) writeClientFirstPayload(payload []byte) (int, error) {
-	// 16 + 2 = len(password) + len(CRLF)
-	// we don't write the second CRLF like Trojan protocol
-	headerSize := 16 + 2 + socksLikeRequestSizeInBytes(c.accessAddr)
+	headerSize := requestHeaderSizeInBytes(c.passwordLine, c.accessAddr, c.isTrojan)
 	firstPayloadBs := pool.Get(headerSize + len(payload))
 	defer pool.Put(firstPayloadBs)
 
 	buf := bytes.NewBuffer(firstPayloadBs[:0])
-	buf.Write(c.passwordWithCRLF[:])
-	buf.Write(crlf)
-	writeSOCKSLikeConnectionCommandRequest(buf, c.accessAddr)
+	writeRequestHeader(buf, c.passwordLine, socks.ConnectionCommandConnect, c.accessAddr, c.isTrojan)
 	buf.Write(payload)
 
 	count, err := buf.WriteTo(c.Conn)
@@ -101,11 +98,23 @@ SOCKS5-like request
 +-----+------+----------+----------+
 */
 
-func socksLikeRequestSizeInBytes(addr *transport.SocketAddress) int {
-	return 1 + socks.SOCKSLikeAddrSizeInBytes(addr)
+func requestHeaderSizeInBytes(passwordLine []byte, addr *transport.SocketAddress, isTrojan bool) int {
+	// 2 = len(CRLF)
+	size := len(passwordLine) + 2 + 1 + socks.SOCKSLikeAddrSizeInBytes(addr)
+	if isTrojan {
+		size += 2
+	}
+	return size
 }
 
-func writeSOCKSLikeConnectionCommandRequest(buf *bytes.Buffer, addr *transport.SocketAddress) {
-	buf.WriteByte(socks.ConnectionCommandConnect)
+// we don't write the second CRLF like the Trojan protocol unless it's for a Trojan server
+
+func writeRequestHeader(buf *bytes.Buffer, passwordLine []byte, command byte, addr *transport.SocketAddress, isTrojan bool) {
+	buf.Write(passwordLine)
+	buf.Write(crlf)
+	buf.WriteByte(command)
 	socks.WriteSOCKSLikeAddr(buf, addr)
+	if isTrojan {
+		buf.Write(crlf)
+	}
 }
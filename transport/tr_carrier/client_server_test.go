@@ -1,17 +1,576 @@
 package tr_carrier
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
 
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/transport/direct"
+	"github.com/ringo-is-a-color/heteroglossia/transport/socks"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/testutil"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestClientServerConnection(t *testing.T) {
-	testutil.TestClientServerConnection(t, newClient, NewServer)
+	testutil.TestClientServerConnection(t, nil, nil, newClient, NewServer)
+}
+
+func TestClientServerConnectionWithUsers(t *testing.T) {
+	user := testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.Users = testutil.Users(t)
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.Password = hg.Users[1].Password
+	}, newClient, NewServer)
+	assert.Equal(t, "user2", user)
+}
+
+// the users are told apart by their whole keys, which only differ after the first 16 bytes
+
+func TestClientServerConnectionWithUsersOf32ByteKeys(t *testing.T) {
+	user := testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.Users = []conf.HgUser{
+			{Name: "user1", Password: testutil.NewPassword(t, "5c1f0e9a8b7d6c5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e")},
+			{Name: "user2", Password: testutil.NewPassword(t, "5c1f0e9a8b7d6c5e4f3a2b1c0d9e8f7a00000000000000000000000000000000")},
+		}
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.Password = hg.Users[0].Password
+	}, newClient, NewServer)
+	assert.Equal(t, "user1", user)
+}
+
+func TestClientServerConnectionWithTLSFingerprints(t *testing.T) {
+	for _, fingerprint := range []string{conf.TLSFingerprintChrome, conf.TLSFingerprintFirefox, conf.TLSFingerprintSafari} {
+		t.Run(fingerprint, func(t *testing.T) {
+			testutil.TestClientServerConnection(t, nil, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				proxyNode.TLSFingerprint = fingerprint
+			}, newClient, NewServer)
+		})
+	}
+}
+
+func TestClientServerConnectionWithTLSVerifications(t *testing.T) {
+	for _, verification := range []struct {
+		name  string
+		setup func(hg *conf.Hg, proxyNode *conf.ProxyNode)
+	}{
+		// another certificate without DNS names comes first
+		{"cert bundle", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.TLSCertFile = testutil.WriteCertBundle(t, hg.TLSCertKeyPair.CertFile)
+		}},
+		{"SNI", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.Host = "127.0.0.1"
+			proxyNode.TLSSNI = "localhost"
+		}},
+		{"pinned SPKI", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.TLSCertFile = ""
+			proxyNode.TLSInsecureSkipVerify = true
+			proxyNode.TLSPinnedSPKISHA256 = []string{testutil.SPKISHA256Pin(t, hg.TLSCertKeyPair.CertFile)}
+		}},
+		{"insecure skip verify", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.TLSCertFile = ""
+			proxyNode.TLSInsecureSkipVerify = true
+		}},
+	} {
+		t.Run(verification.name, func(t *testing.T) {
+			testutil.TestClientServerConnection(t, nil, verification.setup, newClient, NewServer)
+		})
+	}
+}
+
+// a server whose certificate doesn't match the pins is rejected, even with 'tls-insecure-skip-verify'
+
+func TestClientWithWrongTLSPin(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("misc/tls_test_cert.pem", "misc/tls_test_key.pem")
+	assert.Nil(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	wrongPin := sha256.Sum256([]byte("another public key"))
+	proxyNode := &conf.ProxyNode{Protocol: conf.ProtocolTrojan, Host: "localhost", Password: conf.Password{String: "a Trojan password"},
+		TLSPort: ln.Addr().(*net.TCPAddr).Port, TLSInsecureSkipVerify: true, TLSPinnedSPKISHA256: []string{base64.StdEncoding.EncodeToString(wrongPin[:])}}
+	client, err := newClient(proxyNode)
+	assert.Nil(t, err)
+	conn, err := client.DialTCP(context.Background(), transport.NewSocketAddressByDomain("example.com", 80))
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	}
+	assert.ErrorContains(t, err, "SPKI SHA-256 pins")
+}
+
+// the default certificate isn't for the host, so the client only succeeds if the server selects the other one by SNI
+
+func TestClientServerConnectionWithTLSCertKeyPairs(t *testing.T) {
+	testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.TLSCertKeyPairs = []conf.TLSCertKeyPair{*hg.TLSCertKeyPair}
+		hg.TLSCertKeyPair = testutil.WriteCertKeyPair(t, "default.example.com")
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.TLSCertFile = hg.TLSCertKeyPairs[0].CertFile
+	}, newClient, NewServer)
+}
+
+// the streams are wrapped in WebSocket or gRPC, which are told apart from the raw ones by the server
+
+func TestClientServerConnectionWithTLSTransports(t *testing.T) {
+	for _, tlsTransport := range []string{conf.TLSTransportWebSocket, conf.TLSTransportGRPC} {
+		t.Run(tlsTransport, func(t *testing.T) {
+			testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+				hg.TLSTransportPath = "/stream"
+			}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				proxyNode.TLSTransport = tlsTransport
+				proxyNode.TLSTransportPath = hg.TLSTransportPath
+			}, newClient, NewServer)
+		})
+	}
+}
+
+// both sides pad their first packets and shape their writes
+
+func TestClientServerConnectionWithObfuscation(t *testing.T) {
+	testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.Obfuscation = &conf.Obfuscation{PaddingPackets: 4, PaddingMaxSize: 900, ShapingMinSize: 200, ShapingMaxSize: 1400,
+			ShapingMaxDelayMS: 1, ShapingDelayedWrites: 4}
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.Obfuscation = &conf.Obfuscation{PaddingPackets: 4, PaddingMaxSize: 300, ShapingMinSize: 100, ShapingMaxSize: 500}
+	}, newClient, NewServer)
+}
+
+// the client's certificate signed by the CA authenticates it with its subject's user's password, unless it's revoked
+// by the CRL or it's another user's, then the handshake still completes and the client is served by the bad-auth fallback
+
+func TestClientServerConnectionWithTLSClientAuth(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		certUser string
+		revoked  bool
+		accepted bool
+	}{
+		{"valid", "user2", false, true},
+		{"revoked", "user2", true, false},
+		{"another user's", "user1", false, false},
+		{"unknown user's", "cert-user", false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clientAuth, clientCertKeyPair := testutil.WriteClientAuthFiles(t, test.certUser, test.revoked)
+			setClientAuth := func(hg *conf.Hg) {
+				hg.Users = testutil.Users(t)
+				hg.TLSClientAuth = clientAuth
+			}
+			setClientCert := func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				proxyNode.Password = hg.Users[1].Password
+				proxyNode.TLSClientCertKeyPair = clientCertKeyPair
+			}
+			if !test.accepted {
+				testutil.TestClientServerConnectionFailure(t, setClientAuth, setClientCert, newClient, NewServer)
+				testRejectedClientCertHandshake(t, clientAuth, clientCertKeyPair)
+				return
+			}
+			user := testutil.TestClientServerConnection(t, setClientAuth, setClientCert, newClient, NewServer)
+			assert.Equal(t, "user2", user)
+		})
+	}
+}
+
+// a rejected certificate doesn't fail the handshake, which would tell the probes that the server checks it
+
+func testRejectedClientCertHandshake(t *testing.T, clientAuth *conf.TLSClientAuth, clientCertKeyPair *conf.TLSCertKeyPair) {
+	hg := testutil.ServerConf(t)
+	hg.Users = testutil.Users(t)
+	hg.TLSClientAuth = clientAuth
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+	cert, err := tls.LoadX509KeyPair(clientCertKeyPair.CertFile, clientCertKeyPair.KeyFile)
+	assert.Nil(t, err)
+	certPool := x509.NewCertPool()
+	certBs, err := os.ReadFile("misc/tls_test_cert.pem")
+	assert.Nil(t, err)
+	certPool.AppendCertsFromPEM(certBs)
+	tlsConfig := &tls.Config{RootCAs: certPool, ServerName: "localhost", Certificates: []tls.Certificate{cert}}
+	tlsConn, err := tls.Dial("tcp", "localhost:"+strconv.Itoa(hg.TLSPort), tlsConfig)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer tlsConn.Close()
+	// TLS 1.3 reports the client certificate's rejection on the first read
+	_, err = tlsConn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Nil(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if assert.Nil(t, err) {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+// the client's ECHConfigList is set inline or fetched from a DNS-over-HTTPS server,
+// and the client fails if the server rejects ECH, as its certificate isn't for the public name
+
+func TestClientServerConnectionWithECH(t *testing.T) {
+	for _, viaDoH := range []bool{false, true} {
+		t.Run("via DoH "+strconv.FormatBool(viaDoH), func(t *testing.T) {
+			privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+			assert.Nil(t, err)
+			ech := &conf.TLSECH{PublicName: "ech.example.com", PrivateKey: base64.RawURLEncoding.EncodeToString(privateKey.Bytes())}
+			_, configList, err := netutil.ECHKey(ech)
+			assert.Nil(t, err)
+			testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+				hg.TLSECH = ech
+			}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				if viaDoH {
+					proxyNode.TLSECHDoHURL = testutil.StartDoHServer(t, configList).URL + "/dns-query"
+				} else {
+					proxyNode.TLSECHConfigList = base64.StdEncoding.EncodeToString(configList)
+				}
+			}, newClient, NewServer)
+		})
+	}
+}
+
+// the client's ECHConfigList is stale, so the server rejects ECH with its retry configs,
+// which are authenticated with the certificate of the public name, and the client dials again with them
+
+func TestClientServerConnectionWithStaleECHConfigList(t *testing.T) {
+	for _, viaDoH := range []bool{false, true} {
+		t.Run("via DoH "+strconv.FormatBool(viaDoH), func(t *testing.T) {
+			// Go's ECH needs a public name with a dot, so it has its own certificate besides the one of 'localhost'
+			publicNamePair := testutil.WriteCertKeyPair(t, "ech.example.com")
+			certBundleFile := filepath.Join(t.TempDir(), "cert_bundle.pem")
+			var certBundle []byte
+			for _, certFile := range []string{"misc/tls_test_cert.pem", publicNamePair.CertFile} {
+				certBs, err := os.ReadFile(certFile)
+				assert.Nil(t, err)
+				certBundle = append(certBundle, certBs...)
+			}
+			assert.Nil(t, os.WriteFile(certBundleFile, certBundle, 0600))
+
+			var echs []*conf.TLSECH
+			var configLists [][]byte
+			for range 2 {
+				privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+				assert.Nil(t, err)
+				ech := &conf.TLSECH{PublicName: "ech.example.com", PrivateKey: base64.RawURLEncoding.EncodeToString(privateKey.Bytes())}
+				_, configList, err := netutil.ECHKey(ech)
+				assert.Nil(t, err)
+				echs = append(echs, ech)
+				configLists = append(configLists, configList)
+			}
+			testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+				hg.TLSECH = echs[0]
+				hg.TLSCertKeyPairs = append(hg.TLSCertKeyPairs, *publicNamePair)
+			}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				proxyNode.TLSCertFile = certBundleFile
+				if viaDoH {
+					proxyNode.TLSECHDoHURL = testutil.StartDoHServer(t, configLists[1]).URL + "/dns-query"
+				} else {
+					proxyNode.TLSECHConfigList = base64.StdEncoding.EncodeToString(configLists[1])
+				}
+			}, newClient, NewServer)
+		})
+	}
+}
+
+// the ECHConfigList is fetched through the HTTP client set by the router, and it's cached for the dials until its TTL expires
+
+func TestECHConfigListFetchedOnce(t *testing.T) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	_, configList, err := netutil.ECHKey(&conf.TLSECH{PublicName: "ech.example.com",
+		PrivateKey: base64.RawURLEncoding.EncodeToString(privateKey.Bytes())})
+	assert.Nil(t, err)
+	var fetchCount atomic.Int32
+	netutil.SetECHDoHHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fetchCount.Add(1)
+		return http.DefaultTransport.RoundTrip(req)
+	})})
+	t.Cleanup(func() {
+		netutil.SetECHDoHHTTPClient(nil)
+	})
+
+	proxyNode := &conf.ProxyNode{Host: "fetched-once.example.com", TLSECHDoHURL: testutil.StartDoHServer(t, configList).URL + "/dns-query"}
+	for range 2 {
+		tlsConfig, err := netutil.TLSClientConfigWithECH(context.Background(), proxyNode, &tls.Config{})
+		assert.Nil(t, err)
+		assert.Equal(t, configList, tlsConfig.EncryptedClientHelloConfigList)
+	}
+	assert.Equal(t, int32(1), fetchCount.Load())
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
 
 func newClient(proxyNode *conf.ProxyNode) (transport.Client, error) {
 	return NewClient(proxyNode, false)
 }
+
+// the client uses Trojan, which our server also accepts
+
+func TestClientServerConnectionWithTrojan(t *testing.T) {
+	testutil.TestClientServerConnection(t, nil, useTrojan, newClient, NewServer)
+}
+
+func TestClientServerPacketConnectionWithTrojan(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, nil, useTrojan, newClient, NewServer)
+}
+
+func useTrojan(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+	proxyNode.Protocol = conf.ProtocolTrojan
+}
+
+// a Trojan server written directly from the spec, so the client is checked against the standard wire format
+// rather than our server
+// https://trojan-gfw.github.io/trojan/protocol
+
+func TestTrojanClientPacketConnection(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("misc/tls_test_cert.pem", "misc/tls_test_key.pem")
+	assert.Nil(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	password := "a Trojan password which isn't a key"
+	accessAddr := transport.NewSocketAddressByDomain("example.com", 53)
+	anotherAddr := transport.NewSocketAddressByDomain("example.org", 123)
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		conn, err := ln.Accept()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		// hex(SHA224(password)) + CRLF + CMD + address + CRLF
+		hash := sha256.Sum224([]byte(password))
+		line, err := r.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, hex.EncodeToString(hash[:])+"\r\n", line)
+		command, err := r.ReadByte()
+		assert.Nil(t, err)
+		assert.Equal(t, byte(3), command)
+		addr, err := socks.ReadSOCKS5Address(r)
+		assert.Nil(t, err)
+		assert.Equal(t, accessAddr.ToHostStr(), addr.ToHostStr())
+		crlfBs := make([]byte, 2)
+		_, err = io.ReadFull(r, crlfBs)
+		assert.Nil(t, err)
+		assert.Equal(t, crlf, crlfBs)
+
+		// echo the packets with their addresses
+		for range 2 {
+			addr, err := socks.ReadSOCKS5Address(r)
+			if !assert.Nil(t, err) {
+				return
+			}
+			lengthWithCRLF := make([]byte, 4)
+			_, err = io.ReadFull(r, lengthWithCRLF)
+			assert.Nil(t, err)
+			assert.Equal(t, crlf, lengthWithCRLF[2:])
+			payload := make([]byte, binary.BigEndian.Uint16(lengthWithCRLF))
+			_, err = io.ReadFull(r, payload)
+			assert.Nil(t, err)
+
+			buf := new(bytes.Buffer)
+			socks.WriteSOCKSLikeAddr(buf, addr)
+			buf.Write(lengthWithCRLF)
+			buf.Write(payload)
+			_, err = conn.Write(buf.Bytes())
+			assert.Nil(t, err)
+		}
+	}()
+
+	proxyNode := &conf.ProxyNode{Protocol: conf.ProtocolTrojan, Host: "localhost", Password: conf.Password{String: password},
+		TLSPort: ln.Addr().(*net.TCPAddr).Port, TLSCertFile: "misc/tls_test_cert.pem"}
+	client, err := newClient(proxyNode)
+	assert.Nil(t, err)
+	packetConn, err := client.DialUDP(context.Background(), accessAddr)
+	assert.Nil(t, err)
+	defer packetConn.Close()
+
+	buf := make([]byte, transport.MaxUDPPacketSize)
+	for _, packet := range []struct {
+		addr    *transport.SocketAddress
+		payload []byte
+	}{{accessAddr, []byte("a DNS query")}, {anotherAddr, []byte("an NTP request")}} {
+		_, err = packetConn.WritePacket(packet.payload, packet.addr)
+		assert.Nil(t, err)
+		n, addr, err := packetConn.ReadPacket(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, packet.addr.ToHostStr(), addr.ToHostStr())
+		assert.Equal(t, packet.payload, buf[:n])
+	}
+	<-serverDone
+}
+
+// a request which fails to authenticate is served by the site directory, the reverse proxy or the TCP forward,
+// and the local upstream sees the visited host
+
+func TestBadAuthFallback(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		assert.Nil(t, err)
+		body := "the upstream's " + r.URL.Path + " at " + host
+		if r.Header.Get("X-Forwarded-For") != "" {
+			body += " forwarded from " + r.Header.Get("X-Forwarded-Proto")
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+	siteIndex, err := os.ReadFile("misc/site/index.html")
+	assert.Nil(t, err)
+
+	for _, fallback := range []struct {
+		name         string
+		setup        func(hg *conf.Hg)
+		expectedBody string
+	}{
+		{"site directory", func(hg *conf.Hg) {}, string(siteIndex)},
+		{"reverse proxy", func(hg *conf.Hg) {
+			hg.TLSBadAuthFallbackSiteDir = ""
+			hg.TLSBadAuthFallbackURL = upstream.URL
+		}, "the upstream's / at localhost"},
+		{"reverse proxy with X-Forwarded", func(hg *conf.Hg) {
+			hg.TLSBadAuthFallbackSiteDir = ""
+			hg.TLSBadAuthFallbackURL = upstream.URL
+			hg.TLSBadAuthFallbackXForwarded = true
+		}, "the upstream's / at localhost forwarded from https"},
+		{"TCP forward", func(hg *conf.Hg) {
+			hg.TLSBadAuthFallbackSiteDir = ""
+			hg.TLSBadAuthFallbackAddr = upstream.Listener.Addr().String()
+		}, "the upstream's / at localhost"},
+		// the requests besides 'tls-transport-path' are reverse proxied to the TCP forward's address
+		{"TCP forward with the TLS transport", func(hg *conf.Hg) {
+			hg.TLSBadAuthFallbackSiteDir = ""
+			hg.TLSBadAuthFallbackAddr = upstream.Listener.Addr().String()
+			hg.TLSTransportPath = "/stream"
+		}, "the upstream's / at localhost"},
+	} {
+		t.Run(fallback.name, func(t *testing.T) {
+			hg := testutil.ServerConf(t)
+			fallback.setup(hg)
+			testBadAuthFallback(t, hg, fallback.expectedBody)
+		})
+	}
+}
+
+func testBadAuthFallback(t *testing.T, hg *conf.Hg, expectedBody string) {
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	certPool := x509.NewCertPool()
+	certBs, err := os.ReadFile("misc/tls_test_cert.pem")
+	assert.Nil(t, err)
+	certPool.AppendCertsFromPEM(certBs)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool, ServerName: "localhost"}}}
+	defer httpClient.CloseIdleConnections()
+	resp, err := httpClient.Get("https://localhost:" + strconv.Itoa(hg.TLSPort) + "/")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedBody, string(body))
+}
+
+// a REALITY client is served by the TLS carrier, while the other TLS clients see the real website
+
+func TestREALITY(t *testing.T) {
+	realSite := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("the real website"))
+	}))
+	defer realSite.Close()
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	hg := testutil.ServerConf(t)
+	hg.TLSReality = &conf.TLSReality{
+		Dest:        realSite.Listener.Addr().String(),
+		ServerNames: []string{"example.com"},
+		PrivateKey:  base64.RawURLEncoding.EncodeToString(privateKey.Bytes()),
+		ShortIDs:    []string{"", "0123456789abcdef"},
+	}
+
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	webServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("the target website"))
+	}))
+	defer webServer.Close()
+	for _, shortID := range []string{"", "0123456789abcdef"} {
+		proxyNode := &conf.ProxyNode{Host: "localhost", Password: hg.Password, TLSPort: hg.TLSPort, TLSReality: &conf.TLSRealityClient{
+			ServerName: "example.com",
+			PublicKey:  base64.RawURLEncoding.EncodeToString(privateKey.PublicKey().Bytes()),
+			ShortID:    shortID,
+		}}
+		client, err := newClient(proxyNode)
+		assert.Nil(t, err)
+		assert.Equal(t, "the target website", getBody(t, transport.HTTPClientThroughRouter(client), webServer.URL))
+	}
+
+	// a wrong short ID or public key fails to authenticate, and the client rejects the real website's certificate
+	anotherPrivateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	for _, reality := range []*conf.TLSRealityClient{
+		{ServerName: "example.com", PublicKey: base64.RawURLEncoding.EncodeToString(privateKey.PublicKey().Bytes()), ShortID: "01"},
+		{ServerName: "example.com", PublicKey: base64.RawURLEncoding.EncodeToString(anotherPrivateKey.PublicKey().Bytes())},
+	} {
+		proxyNode := &conf.ProxyNode{Host: "localhost", Password: hg.Password, TLSPort: hg.TLSPort, TLSReality: reality}
+		client, err := newClient(proxyNode)
+		assert.Nil(t, err)
+		_, err = client.DialTCP(context.Background(), transport.NewSocketAddressByDomain("example.org", 80))
+		assert.NotNil(t, err)
+	}
+
+	// a normal TLS client gets the real website's certificate and response
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}}}
+	defer httpClient.CloseIdleConnections()
+	resp, err := httpClient.Get("https://localhost:" + strconv.Itoa(hg.TLSPort) + "/")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, realSite.Certificate().Raw, resp.TLS.PeerCertificates[0].Raw)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "the real website", string(body))
+}
+
+func getBody(t *testing.T, httpClient *http.Client, url string) string {
+	resp, err := httpClient.Get(url)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
@@ -0,0 +1,195 @@
+package tr_carrier
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+)
+
+/*
+grpcConn carries the stream in gRPC messages like v2ray's gun, so it goes through the CDNs which support gRPC
+https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#requests
++------------+--------+-------------------------------------------+
+| Compressed | Length | Message: protobuf 'Hunk { bytes data = 1 }' |
++------------+--------+-------------------------------------------+
+|     1      |   4    |                 Variable                  |
++------------+--------+-------------------------------------------+
+*/
+
+type grpcConn struct {
+	// only for the addresses and deadlines, as it's shared by the other streams for a server
+	net.Conn
+	reader *bufio.Reader
+	// the size left in the current message, and the data size left in its current 'data' field
+	messageLeft int
+	unreadSize  int
+
+	writer     io.Writer
+	flush      func()
+	writeMutex sync.Mutex
+	// the writes fail after closing, as a server's 'writer' can't be used after its handler returns
+	closed    bool
+	closeFunc func() error
+}
+
+var _ net.Conn = new(grpcConn)
+
+const (
+	grpcMessageHeaderSize = 5
+	// the tag of the field 1 with the wire type 2 (length-delimited)
+	grpcHunkDataTag = 0x0A
+
+	// https://protobuf.dev/programming-guides/encoding/#structure
+	protobufWireTypeVarint          = 0
+	protobufWireTypeI64             = 1
+	protobufWireTypeLengthDelimited = 2
+	protobufWireTypeI32             = 5
+	grpcHunkDataFieldNumber         = 1
+)
+
+func newGRPCConn(conn net.Conn, reader io.Reader, writer io.Writer, flush func(), closeFunc func() error) *grpcConn {
+	return &grpcConn{Conn: conn, reader: bufio.NewReader(reader), writer: writer, flush: flush, closeFunc: closeFunc}
+}
+
+func (c *grpcConn) Read(b []byte) (int, error) {
+	for c.unreadSize == 0 {
+		var err error
+		if c.messageLeft == 0 {
+			err = c.readMessageHeader()
+		} else {
+			err = c.readField()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.reader.Read(b[:min(len(b), c.unreadSize)])
+	c.unreadSize -= n
+	c.messageLeft -= n
+	if errors.Is(err, io.EOF) {
+		return n, errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+func (c *grpcConn) readMessageHeader() error {
+	var header [grpcMessageHeaderSize]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return err
+	}
+	if header[0] != 0 {
+		return errors.New("the compressed gRPC messages aren't supported")
+	}
+	c.messageLeft = int(binary.BigEndian.Uint32(header[1:]))
+	return nil
+}
+
+// reads the next protobuf field in the message, and the unknown fields are skipped,
+// while the fields can't exceed the message's length
+
+func (c *grpcConn) readField() error {
+	byteReader := grpcMessageByteReader{c}
+	tag, err := binary.ReadUvarint(byteReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	switch tag & 0x7 {
+	case protobufWireTypeVarint:
+		_, err = binary.ReadUvarint(byteReader)
+		return errors.WithStack(err)
+	case protobufWireTypeI64:
+		return c.skip(8)
+	case protobufWireTypeI32:
+		return c.skip(4)
+	case protobufWireTypeLengthDelimited:
+		size, err := binary.ReadUvarint(byteReader)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if size > uint64(c.messageLeft) {
+			return errors.Newf("the protobuf field of %v bytes exceeds the gRPC message's %v bytes left", size, c.messageLeft)
+		}
+		if tag>>3 == grpcHunkDataFieldNumber {
+			c.unreadSize = int(size)
+			return nil
+		}
+		return c.skip(int(size))
+	default:
+		return errors.Newf("unsupported protobuf wire type %v in the gRPC message", tag&0x7)
+	}
+}
+
+func (c *grpcConn) skip(n int) error {
+	if n > c.messageLeft {
+		return errors.Newf("the protobuf field of %v bytes exceeds the gRPC message's %v bytes left", n, c.messageLeft)
+	}
+	_, err := c.reader.Discard(n)
+	if err != nil {
+		return errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	c.messageLeft -= n
+	return nil
+}
+
+// reads the bytes of the current message, which fails at its end
+type grpcMessageByteReader struct {
+	c *grpcConn
+}
+
+func (r grpcMessageByteReader) ReadByte() (byte, error) {
+	if r.c.messageLeft == 0 {
+		return 0, errors.New("the protobuf field exceeds the gRPC message")
+	}
+	b, err := r.c.reader.ReadByte()
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.c.messageLeft--
+	return b, nil
+}
+
+func (c *grpcConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closed {
+		return 0, errors.WithStack(net.ErrClosed)
+	}
+
+	var dataSizeBs [binary.MaxVarintLen64]byte
+	dataSizeBsLen := binary.PutUvarint(dataSizeBs[:], uint64(len(b)))
+	messageSize := 1 + dataSizeBsLen + len(b)
+	frame := pool.Get(grpcMessageHeaderSize + messageSize)
+	defer pool.Put(frame)
+	frame[0] = 0
+	binary.BigEndian.PutUint32(frame[1:grpcMessageHeaderSize], uint32(messageSize))
+	frame[grpcMessageHeaderSize] = grpcHunkDataTag
+	copy(frame[grpcMessageHeaderSize+1:], dataSizeBs[:dataSizeBsLen])
+	copy(frame[grpcMessageHeaderSize+1+dataSizeBsLen:], b)
+	_, err := c.writer.Write(frame)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if c.flush != nil {
+		c.flush()
+	}
+	return len(b), nil
+}
+
+// 'closeFunc' is called first to unblock the reads and writes in progress
+
+func (c *grpcConn) Close() error {
+	err := c.closeFunc()
+	c.writeMutex.Lock()
+	c.closed = true
+	c.writeMutex.Unlock()
+	return err
+}
@@ -0,0 +1,64 @@
+package tr_carrier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the unknown protobuf fields are skipped, and the fields can't exceed the gRPC message's length
+
+func TestGRPCConnRead(t *testing.T) {
+	data := []byte("the data")
+	dataField := append([]byte{grpcHunkDataTag, byte(len(data))}, data...)
+	unknownFields := []byte{
+		// field 2, varint 300
+		0x10, 0xAC, 0x02,
+		// field 3, fixed32
+		0x1D, 1, 2, 3, 4,
+		// field 4, fixed64
+		0x21, 1, 2, 3, 4, 5, 6, 7, 8,
+		// field 5, 3 bytes
+		0x2A, 3, 'a', 'b', 'c',
+	}
+	for _, tt := range []struct {
+		name     string
+		stream   []byte
+		expected []byte
+		errMsg   string
+	}{
+		{"one message", grpcMessage(0, dataField), data, ""},
+		{"two messages with an empty one", bytes.Join([][]byte{grpcMessage(0, dataField), grpcMessage(0, nil),
+			grpcMessage(0, dataField)}, nil), append(bytes.Clone(data), data...), ""},
+		{"unknown fields around the data", grpcMessage(0, bytes.Join([][]byte{unknownFields, dataField, unknownFields}, nil)), data, ""},
+		{"data longer than the message", grpcMessageWithSize(0, dataField, len(dataField)-1), nil, "exceeds the gRPC message"},
+		{"message longer than the stream", grpcMessageWithSize(0, dataField, len(dataField)+1), data, "unexpected EOF"},
+		{"unknown field longer than the message", grpcMessage(0, []byte{0x2A, 4, 'a'}), nil, "exceeds the gRPC message"},
+		{"truncated varint", grpcMessage(0, []byte{0x10, 0xAC}), nil, "exceeds the gRPC message"},
+		{"group wire type", grpcMessage(0, []byte{0x13}), nil, "unsupported protobuf wire type 3"},
+		{"compressed message", grpcMessage(1, dataField), nil, "compressed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newGRPCConn(nil, bytes.NewReader(tt.stream), io.Discard, nil, nil)
+			read, err := io.ReadAll(conn)
+			assert.Equal(t, string(tt.expected), string(read))
+			if tt.errMsg == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func grpcMessage(compressed byte, message []byte) []byte {
+	return grpcMessageWithSize(compressed, message, len(message))
+}
+
+func grpcMessageWithSize(compressed byte, message []byte, size int) []byte {
+	frame := binary.BigEndian.AppendUint32([]byte{compressed}, uint32(size))
+	return append(frame, message...)
+}
@@ -0,0 +1,84 @@
+package tr_carrier
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/transport/socks"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
+)
+
+/*
+https://trojan-gfw.github.io/trojan/protocol
+UDP Associate packet
++------+----------+----------+--------+---------+----------+
+| ATYP | DST.ADDR | DST.PORT | Length |  CRLF   | Payload  |
++------+----------+----------+--------+---------+----------+
+|  1   | Variable |    2     |   2    | X'0D0A' | Variable |
++------+----------+----------+--------+---------+----------+
+*/
+
+const udpAssociateCommand byte = 3
+
+func packetSizeInBytes(addr *transport.SocketAddress, payload []byte) int {
+	// 2 + 2 = len(Length) + len(CRLF)
+	return socks.SOCKSLikeAddrSizeInBytes(addr) + 2 + 2 + len(payload)
+}
+
+func writePacket(buf *bytes.Buffer, addr *transport.SocketAddress, payload []byte) error {
+	if len(payload) > transport.MaxUDPPacketSize {
+		return errors.Newf("the UDP packet is too large: %v byte(s)", len(payload))
+	}
+	socks.WriteSOCKSLikeAddr(buf, addr)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+	buf.Write(crlf)
+	buf.Write(payload)
+	return nil
+}
+
+// reads a packet into 'b', and the payload which doesn't fit into 'b' is discarded like a UDP socket
+
+func readPacket(r *bufio.Reader, b []byte) (int, *transport.SocketAddress, error) {
+	addr, err := socks.ReadSOCKS5Address(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var lengthWithCRLF [4]byte
+	_, err = ioutil.ReadFull(r, lengthWithCRLF[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(lengthWithCRLF[2:], crlf) {
+		return 0, nil, errors.New("no CRLF after the UDP packet's length")
+	}
+	payloadSize := int(binary.BigEndian.Uint16(lengthWithCRLF[:2]))
+	n, err := ioutil.ReadFull(r, b[:min(payloadSize, len(b))])
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = r.Discard(payloadSize - n)
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+	return n, addr, nil
+}
+
+// a packet is written with one 'Write' call, so the packets from different goroutines aren't interleaved
+
+func writePacketTo(w io.Writer, header []byte, addr *transport.SocketAddress, payload []byte) error {
+	packetBs := pool.Get(len(header) + packetSizeInBytes(addr, payload))
+	defer pool.Put(packetBs)
+	buf := bytes.NewBuffer(packetBs[:0])
+	buf.Write(header)
+	err := writePacket(buf, addr, payload)
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return errors.WithStack(err)
+}
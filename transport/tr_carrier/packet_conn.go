@@ -0,0 +1,50 @@
+package tr_carrier
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+)
+
+// packetConn relays the packets over one TLS connection with the Trojan UDP Associate command
+
+type packetConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// a client sends the request header with the first packet, it's nil for a server
+	header     []byte
+	writeMutex sync.Mutex
+}
+
+var _ transport.PacketConn = new(packetConn)
+
+func newClientPacketConn(conn net.Conn, accessAddr *transport.SocketAddress, passwordLine []byte) *packetConn {
+	header := bytes.NewBuffer(make([]byte, 0, requestHeaderSizeInBytes(passwordLine, accessAddr, true)))
+	writeRequestHeader(header, passwordLine, udpAssociateCommand, accessAddr, true)
+	return &packetConn{Conn: conn, reader: bufio.NewReader(conn), header: header.Bytes()}
+}
+
+// the 'reader' has read the request header from the 'conn', and it may have buffered the following packets
+
+func newServerPacketConn(conn net.Conn, reader *bufio.Reader) *packetConn {
+	return &packetConn{Conn: conn, reader: reader}
+}
+
+func (c *packetConn) ReadPacket(b []byte) (int, *transport.SocketAddress, error) {
+	return readPacket(c.reader, b)
+}
+
+func (c *packetConn) WritePacket(b []byte, addr *transport.SocketAddress) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	err := writePacketTo(c.Conn, c.header, addr, b)
+	if err != nil {
+		return 0, err
+	}
+	c.header = nil
+	return len(b), nil
+}
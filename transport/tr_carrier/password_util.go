@@ -4,8 +4,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 
+	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
 )
 
 const (
@@ -14,8 +14,14 @@ const (
 	escapedLF = lf + 1
 )
 
-func replaceCRLF(passwordRaw [16]byte) [16]byte {
-	var newPw [16]byte
+// the password line of a TLS carrier client is the password's whole key without CRLF, which is 16 or 32 bytes
+
+func passwordLine(password *conf.Password) []byte {
+	return replaceCRLF(password.Key())
+}
+
+func replaceCRLF(passwordRaw []byte) []byte {
+	newPw := make([]byte, len(passwordRaw))
 
 	isCR := false
 	for i, b := range passwordRaw {
@@ -38,7 +44,7 @@ func toTrojanPassword(password string) [56]byte {
 	hash := sha256.New224()
 	err := ioutil.Write_(hash, []byte(password))
 	if err != nil {
-		log.Fatal("unexpected code path", err)
+		logger.Fatal("unexpected code path", err)
 	}
 	hex.Encode(key[:], hash.Sum(nil))
 	return key
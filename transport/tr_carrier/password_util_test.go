@@ -3,21 +3,33 @@ package tr_carrier
 import (
 	"testing"
 
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestReplaceCRLF(t *testing.T) {
 	tests := []struct {
-		arr      [16]byte
-		expected [16]byte
+		arr      []byte
+		expected []byte
 	}{
-		{[16]byte{1, 2, 3, 4}, [16]byte{1, 2, 3, 4}},
-		{[16]byte{cr, lf, 3, 4}, [16]byte{cr, escapedLF, 3, 4}},
-		{[16]byte{cr, lf, lf, 4}, [16]byte{cr, escapedLF, lf, 4}},
-		{[16]byte{cr, lf, cr, 4}, [16]byte{cr, escapedLF, cr, 4}},
-		{[16]byte{cr, lf, cr, lf}, [16]byte{cr, escapedLF, cr, escapedLF}},
+		{[]byte{1, 2, 3, 4}, []byte{1, 2, 3, 4}},
+		{[]byte{cr, lf, 3, 4}, []byte{cr, escapedLF, 3, 4}},
+		{[]byte{cr, lf, lf, 4}, []byte{cr, escapedLF, lf, 4}},
+		{[]byte{cr, lf, cr, 4}, []byte{cr, escapedLF, cr, 4}},
+		{[]byte{cr, lf, cr, lf}, []byte{cr, escapedLF, cr, escapedLF}},
 	}
 	for _, tt := range tests {
 		assert.Equal(t, tt.expected, replaceCRLF(tt.arr), "no match", tt)
 	}
 }
+
+// the keys are different, but their password lines are the same after CRLF is replaced
+
+func TestLoadPasswordsWithSameLines(t *testing.T) {
+	s := &server{hg: &conf.Hg{Users: []conf.HgUser{
+		{Name: "user1", Password: testutil.NewPassword(t, "0d0a0000000000000000000000000000")},
+		{Name: "user2", Password: testutil.NewPassword(t, "0d0b0000000000000000000000000000")},
+	}}}
+	assert.NotNil(t, s.loadPasswords())
+}
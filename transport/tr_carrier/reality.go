@@ -0,0 +1,204 @@
+package tr_carrier
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+The REALITY-like mode, which is inspired by https://github.com/XTLS/REALITY
+
+A client hides its authentication in the 32-byte session ID of a TLS 1.3 ClientHello:
+auth key   = HKDF-SHA256(secret = X25519(the client's X25519 key share, the server's public key), salt = random[:20], info = "hg REALITY")
+session ID = AES-256-GCM(auth key, nonce = random[20:], plaintext = Unix time (8 bytes) + short ID (8 bytes),
+                         additional data = the ClientHello message with a zero session ID)
+
+The server forwards the connections which fail to authenticate to the real website as they are.
+Otherwise, it completes the handshake with a temporary ECDSA certificate whose signature is HMAC-SHA256(auth key, the
+certificate's public key), which the client checks instead of verifying a certificate chain.
+*/
+
+const (
+	realitySessionIDSize          = 32
+	realitySessionIDPlaintextSize = 16
+	realityShortIDSize            = 8
+	// the offset of the session ID in the ClientHello message, after the type (1), length (3), version (2),
+	// random (32) and the session ID's length (1)
+	realitySessionIDOffset = 39
+
+	realityMaxTimeDifference = 2 * time.Minute
+)
+
+var realityAuthKeyInfo = []byte("hg REALITY")
+
+func realityAuthKey(sharedSecret, random []byte) ([]byte, error) {
+	authKey := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, random[:20], realityAuthKeyInfo), authKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return authKey, nil
+}
+
+func newRealityAEAD(authKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(authKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return errors.WithStack2(cipher.NewGCM(block))
+}
+
+func realityCertSignature(authKey, rawSubjectPublicKeyInfo []byte) []byte {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(rawSubjectPublicKeyInfo)
+	return mac.Sum(nil)
+}
+
+func decodeRealityShortID(shortIDStr string) ([realityShortIDSize]byte, error) {
+	var shortID [realityShortIDSize]byte
+	bs, err := hex.DecodeString(shortIDStr)
+	if err != nil {
+		return shortID, errors.Newf(err, "fail to decode the REALITY short ID '%v'", shortIDStr)
+	}
+	if len(bs) > realityShortIDSize {
+		return shortID, errors.Newf("the REALITY short ID '%v' is longer than %v bytes", shortIDStr, realityShortIDSize)
+	}
+	copy(shortID[:], bs)
+	return shortID, nil
+}
+
+func decodeRealityKey(keyStr string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(keyStr)
+	if err != nil {
+		return nil, errors.Newf(err, "fail to decode the REALITY key '%v'", keyStr)
+	}
+	return key, nil
+}
+
+type realityClient struct {
+	serverName  string
+	publicKey   *ecdh.PublicKey
+	shortID     [realityShortIDSize]byte
+	fingerprint string
+}
+
+func newRealityClient(proxyNode *conf.ProxyNode) (*realityClient, error) {
+	reality := proxyNode.TLSReality
+	publicKeyBs, err := decodeRealityKey(reality.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(publicKeyBs)
+	if err != nil {
+		return nil, errors.New(err, "invalid REALITY public key")
+	}
+	shortID, err := decodeRealityShortID(reality.ShortID)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := proxyNode.TLSFingerprint
+	if fingerprint == "" {
+		fingerprint = conf.TLSFingerprintChrome
+	}
+	return &realityClient{serverName: reality.ServerName, publicKey: publicKey, shortID: shortID, fingerprint: fingerprint}, nil
+}
+
+func (c *realityClient) dial(ctx context.Context, addr string, keyLogWriter io.Writer) (net.Conn, error) {
+	conn, err := netutil.DialTCP(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var authKey []byte
+	uTLSConfig := &utls.Config{
+		ServerName:             c.serverName,
+		InsecureSkipVerify:     true,
+		SessionTicketsDisabled: true,
+		MinVersion:             utls.VersionTLS13,
+		KeyLogWriter:           keyLogWriter,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyRealityCert(rawCerts, authKey)
+		},
+	}
+	uTLSConn := netutil.UTLSClient(conn, uTLSConfig, c.fingerprint)
+	authKey, err = c.writeSessionID(uTLSConn)
+	if err == nil {
+		err = errors.WithStack(uTLSConn.HandshakeContext(ctx))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return uTLSConn, nil
+}
+
+// builds the ClientHello and replaces its session ID with the encrypted authentication, then returns the auth key
+
+func (c *realityClient) writeSessionID(uTLSConn *utls.UConn) ([]byte, error) {
+	err := uTLSConn.BuildHandshakeState()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	state := uTLSConn.HandshakeState
+	hello := state.Hello
+	if len(hello.SessionId) != realitySessionIDSize {
+		return nil, errors.Newf("the ClientHello's session ID has %v bytes rather than %v", len(hello.SessionId), realitySessionIDSize)
+	}
+	ecdheKey, ok := state.State13.KeySharesParams.GetEcdheKey(utls.X25519)
+	if !ok {
+		ecdheKey = state.State13.EcdheKey
+	}
+	if ecdheKey == nil || ecdheKey.Curve() != ecdh.X25519() {
+		return nil, errors.New("the ClientHello has no X25519 key share")
+	}
+	sharedSecret, err := ecdheKey.ECDH(c.publicKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	authKey, err := realityAuthKey(sharedSecret, hello.Random)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newRealityAEAD(authKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, realitySessionIDPlaintextSize, realitySessionIDSize)
+	binary.BigEndian.PutUint64(plaintext, uint64(time.Now().Unix()))
+	copy(plaintext[8:], c.shortID[:])
+	clear(hello.Raw[realitySessionIDOffset : realitySessionIDOffset+realitySessionIDSize])
+	hello.SessionId = aead.Seal(plaintext[:0], hello.Random[20:], plaintext, hello.Raw)
+	copy(hello.Raw[realitySessionIDOffset:], hello.SessionId)
+	return authKey, nil
+}
+
+func verifyRealityCert(rawCerts [][]byte, authKey []byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no REALITY certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !hmac.Equal(cert.Signature, realityCertSignature(authKey, cert.RawSubjectPublicKeyInfo)) {
+		return errors.New("the server's certificate isn't a REALITY certificate, which may be the real website's")
+	}
+	return nil
+}
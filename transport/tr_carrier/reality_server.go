@@ -0,0 +1,283 @@
+package tr_carrier
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	tlsRecordHeaderSize            = 5
+	tlsRecordTypeHandshake         = 0x16
+	tlsMaxRecordSize               = 1 << 14
+	tlsHandshakeTypeClientHello    = 1
+	tlsExtensionServerName         = 0
+	tlsExtensionKeyShare           = 51
+	tlsServerNameTypeHostName      = 0
+	tlsGroupX25519                 = 29
+	realityClientHelloReadTimeout  = 10 * time.Second
+	realityCertValidity            = 365 * 24 * time.Hour
+	realityReplayCacheCleanUpCount = 1024
+)
+
+type realityServer struct {
+	dest        *transport.SocketAddress
+	serverNames map[string]struct{}
+	privateKey  *ecdh.PrivateKey
+	shortIDs    map[[realityShortIDSize]byte]struct{}
+
+	certKey           *ecdsa.PrivateKey
+	certPublicKeyInfo []byte
+	// the certificate's parts for replacing its signature per connection
+	certTBS, certSignatureAlgorithm asn1.RawValue
+
+	// the randoms of the authenticated ClientHellos in the last 'realityMaxTimeDifference' * 2 against the replay attacks
+	usedRandoms      map[[32]byte]time.Time
+	usedRandomsMutex sync.Mutex
+}
+
+func newRealityServer(reality *conf.TLSReality) (*realityServer, error) {
+	dest, err := transport.ToSocketAddr(reality.Dest, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	server := &realityServer{dest: dest, usedRandoms: make(map[[32]byte]time.Time)}
+	server.serverNames = make(map[string]struct{}, len(reality.ServerNames))
+	for _, serverName := range reality.ServerNames {
+		server.serverNames[serverName] = struct{}{}
+	}
+	privateKeyBs, err := decodeRealityKey(reality.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	server.privateKey, err = ecdh.X25519().NewPrivateKey(privateKeyBs)
+	if err != nil {
+		return nil, errors.New(err, "invalid REALITY private key")
+	}
+	shortIDs := reality.ShortIDs
+	if len(shortIDs) == 0 {
+		shortIDs = []string{""}
+	}
+	server.shortIDs = make(map[[realityShortIDSize]byte]struct{}, len(shortIDs))
+	for _, shortIDStr := range shortIDs {
+		shortID, err := decodeRealityShortID(shortIDStr)
+		if err != nil {
+			return nil, err
+		}
+		server.shortIDs[shortID] = struct{}{}
+	}
+
+	server.certKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: now.Add(-time.Hour), NotAfter: now.Add(realityCertValidity)}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &server.certKey.PublicKey, server.certKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var cert certificateASN1
+	_, err = asn1.Unmarshal(certDER, &cert)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	server.certTBS, server.certSignatureAlgorithm = cert.TBSCertificate, cert.SignatureAlgorithm
+	server.certPublicKeyInfo, err = x509.MarshalPKIXPublicKey(&server.certKey.PublicKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return server, nil
+}
+
+// https://datatracker.ietf.org/doc/html/rfc5280#section-4.1
+
+type certificateASN1 struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	SignatureValue     asn1.BitString
+}
+
+// authenticate reads the ClientHello record and returns the read bytes, and the auth key for an authenticated client
+
+func (s *realityServer) authenticate(r io.Reader) ([]byte, []byte, error) {
+	record := make([]byte, tlsRecordHeaderSize)
+	_, err := ioutil.ReadFull(r, record)
+	if err != nil {
+		return nil, nil, err
+	}
+	recordSize := int(binary.BigEndian.Uint16(record[3:]))
+	if record[0] != tlsRecordTypeHandshake || recordSize > tlsMaxRecordSize {
+		return record, nil, nil
+	}
+	record = append(record, make([]byte, recordSize)...)
+	_, err = ioutil.ReadFull(r, record[tlsRecordHeaderSize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, s.authKey(record[tlsRecordHeaderSize:]), nil
+}
+
+// returns nil if the ClientHello isn't from an authenticated client
+
+func (s *realityServer) authKey(clientHelloMsg []byte) []byte {
+	hello, ok := parseClientHello(clientHelloMsg)
+	if !ok || len(hello.sessionID) != realitySessionIDSize || hello.x25519KeyShare == nil {
+		return nil
+	}
+	if _, ok := s.serverNames[hello.serverName]; !ok {
+		return nil
+	}
+	clientPublicKey, err := ecdh.X25519().NewPublicKey(hello.x25519KeyShare)
+	if err != nil {
+		return nil
+	}
+	sharedSecret, err := s.privateKey.ECDH(clientPublicKey)
+	if err != nil {
+		return nil
+	}
+	authKey, err := realityAuthKey(sharedSecret, hello.random)
+	if err != nil {
+		return nil
+	}
+	aead, err := newRealityAEAD(authKey)
+	if err != nil {
+		return nil
+	}
+	additionalData := bytes.Clone(clientHelloMsg)
+	clear(additionalData[realitySessionIDOffset : realitySessionIDOffset+realitySessionIDSize])
+	plaintext, err := aead.Open(nil, hello.random[20:], hello.sessionID, additionalData)
+	if err != nil {
+		return nil
+	}
+
+	clientTime := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	now := time.Now()
+	if clientTime.Before(now.Add(-realityMaxTimeDifference)) || clientTime.After(now.Add(realityMaxTimeDifference)) {
+		logger.Info("a REALITY client's time differs from the server's too much", "clientTime", clientTime)
+		return nil
+	}
+	if _, ok := s.shortIDs[[realityShortIDSize]byte(plaintext[8:])]; !ok {
+		return nil
+	}
+	if !s.markRandomUsed([32]byte(hello.random), now) {
+		return nil
+	}
+	return authKey
+}
+
+func (s *realityServer) markRandomUsed(random [32]byte, now time.Time) bool {
+	s.usedRandomsMutex.Lock()
+	defer s.usedRandomsMutex.Unlock()
+	if _, ok := s.usedRandoms[random]; ok {
+		return false
+	}
+	if len(s.usedRandoms) >= realityReplayCacheCleanUpCount {
+		for usedRandom, usedTime := range s.usedRandoms {
+			if now.Sub(usedTime) > realityMaxTimeDifference*2 {
+				delete(s.usedRandoms, usedRandom)
+			}
+		}
+	}
+	s.usedRandoms[random] = now
+	return true
+}
+
+func (s *realityServer) tlsConfig(authKey []byte) (*tls.Config, error) {
+	signature := realityCertSignature(authKey, s.certPublicKeyInfo)
+	certDER, err := asn1.Marshal(certificateASN1{
+		TBSCertificate:     s.certTBS,
+		SignatureAlgorithm: s.certSignatureAlgorithm,
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &tls.Config{
+		MinVersion:             tls.VersionTLS13,
+		SessionTicketsDisabled: true,
+		Certificates:           []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: s.certKey}},
+	}, nil
+}
+
+type clientHello struct {
+	random         []byte
+	sessionID      []byte
+	serverName     string
+	x25519KeyShare []byte
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8446#section-4.1.2
+
+func parseClientHello(msg []byte) (*clientHello, bool) {
+	s := cryptobyte.String(msg)
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != tlsHandshakeTypeClientHello || !s.ReadUint24LengthPrefixed(&body) || !s.Empty() {
+		return nil, false
+	}
+	hello := &clientHello{}
+	var sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !body.Skip(2) || !body.ReadBytes(&hello.random, 32) || !body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) || !body.ReadUint8LengthPrefixed(&compressionMethods) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, false
+	}
+	hello.sessionID = sessionID
+	for !extensions.Empty() {
+		var extensionType uint16
+		var extensionData cryptobyte.String
+		if !extensions.ReadUint16(&extensionType) || !extensions.ReadUint16LengthPrefixed(&extensionData) {
+			return nil, false
+		}
+		switch extensionType {
+		case tlsExtensionServerName:
+			var serverNames cryptobyte.String
+			if !extensionData.ReadUint16LengthPrefixed(&serverNames) {
+				return nil, false
+			}
+			for !serverNames.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !serverNames.ReadUint8(&nameType) || !serverNames.ReadUint16LengthPrefixed(&name) {
+					return nil, false
+				}
+				if nameType == tlsServerNameTypeHostName {
+					hello.serverName = string(name)
+				}
+			}
+		case tlsExtensionKeyShare:
+			var keyShares cryptobyte.String
+			if !extensionData.ReadUint16LengthPrefixed(&keyShares) {
+				return nil, false
+			}
+			for !keyShares.Empty() {
+				var group uint16
+				var key cryptobyte.String
+				if !keyShares.ReadUint16(&group) || !keyShares.ReadUint16LengthPrefixed(&key) {
+					return nil, false
+				}
+				if group == tlsGroupX25519 {
+					hello.x25519KeyShare = key
+				}
+			}
+		}
+	}
+	return hello, true
+}
@@ -1,13 +1,16 @@
 package tr_carrier
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/textproto"
+	"slices"
 	"strconv"
+	"time"
 
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/ringo-is-a-color/heteroglossia/conf"
@@ -16,63 +19,151 @@ import (
 	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
 	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/obfs"
 )
 
 type server struct {
 	hg           *conf.Hg
 	targetClient transport.Client
 
-	passwordWithCRLF [16]byte
-	trojanPassword   [56]byte
+	// the values are the users' names
+	passwordLines   map[string]string
+	trojanPasswords map[[56]byte]string
 
-	tlsConfig                    *tls.Config
-	tlsBadAuthFallbackServerPort uint16
+	tlsConfig *tls.Config
+	// the requests which fail to authenticate are forwarded to 'tls-bad-auth-fallback-addr',
+	// or a local HTTP server for the other fallbacks
+	badAuthFallbackAddr *transport.SocketAddress
+	// serves the HTTP requests which aren't to 'tls-transport-path' if it's set
+	fallbackHTTPHandler http.Handler
+	// not nil in the REALITY-like mode, which replaces 'tlsConfig' and 'badAuthFallbackAddr'
+	reality *realityServer
 }
 
 var _ transport.Server = new(server)
 
 func NewServer(hg *conf.Hg, targetClient transport.Client) transport.Server {
-	server := &server{hg: hg, targetClient: targetClient}
-	server.passwordWithCRLF = replaceCRLF(hg.Password.Raw)
-	server.trojanPassword = toTrojanPassword(hg.Password.String)
-	return server
+	return &server{hg: hg, targetClient: targetClient}
+}
+
+// different keys may have the same password line after CRLF is replaced, so they're rejected as the same password
+
+func (s *server) loadPasswords() error {
+	users := s.hg.AllUsers()
+	s.passwordLines = make(map[string]string, len(users))
+	s.trojanPasswords = make(map[[56]byte]string, len(users))
+	for _, user := range users {
+		// a password which isn't a key is only for the Trojan clients
+		if user.Password.Size > 0 {
+			line := string(passwordLine(&user.Password))
+			if _, ok := s.passwordLines[line]; ok {
+				return errors.Newf("the user '%v' has the same password line as another user for the TLS carrier", user.Name)
+			}
+			s.passwordLines[line] = user.Name
+		}
+		trojanPassword := toTrojanPassword(user.Password.String)
+		if _, ok := s.trojanPasswords[trojanPassword]; ok {
+			return errors.Newf("the user '%v' has the same Trojan password as another user", user.Name)
+		}
+		s.trojanPasswords[trojanPassword] = user.Name
+	}
+	return nil
 }
 
 func (s *server) ListenAndServe(ctx context.Context) error {
-	var err error
+	err := s.loadPasswords()
+	if err != nil {
+		return err
+	}
+	addr := ":" + strconv.Itoa(s.hg.TLSPort)
+	if s.hg.TLSReality != nil {
+		s.reality, err = newRealityServer(s.hg.TLSReality)
+		if err != nil {
+			return err
+		}
+		return netutil.ListenTCPAndServe(ctx, addr, func(tcpConn *net.TCPConn) {
+			ctx := contextutil.WithSourceAndInboundValues(ctx, tcpConn.RemoteAddr().String(), "TLS carrier")
+			err := s.serveReality(ctx, tcpConn)
+			_ = tcpConn.Close()
+			if err != nil {
+				logger.InfoWithError("fail to handle a request over TLS", err)
+			}
+		})
+	}
+
 	s.tlsConfig, err = netutil.TLSServerConfig(s.hg)
 	if err != nil {
 		return err
 	}
+	if s.hg.TLSTransportPath != "" {
+		// the TLS config is shared with other carriers
+		s.tlsConfig = s.tlsConfig.Clone()
+		// HTTP/2 is needed by gRPC, while the raw streams are still accepted, as they're told apart by the first line
+		otherProtos := slices.DeleteFunc(slices.Clone(s.tlsConfig.NextProtos), func(proto string) bool {
+			return proto == "h2" || proto == "http/1.1"
+		})
+		s.tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, otherProtos...)
+		s.fallbackHTTPHandler, err = netutil.FallbackHTTPHandler(s.hg)
+		if err != nil {
+			return err
+		}
+	}
 
-	port := make(chan uint16, 1)
-	go func() {
-		var httpHandler http.Handler
-		if s.hg.TLSBadAuthFallbackSiteDir != "" {
-			httpHandler = http.FileServer(http.Dir(s.hg.TLSBadAuthFallbackSiteDir))
+	if s.hg.TLSBadAuthFallbackAddr != "" {
+		s.badAuthFallbackAddr, err = transport.ToSocketAddr(s.hg.TLSBadAuthFallbackAddr, true, 0)
+		if err != nil {
+			return err
 		}
-		err := netutil.ListenHTTPAndServeWithListenerCallback(ctx, ":0", httpHandler, func(ln net.Listener) {
-			port <- uint16(ln.Addr().(*net.TCPAddr).Port)
-		})
+	} else {
+		httpHandler, err := netutil.FallbackHTTPHandler(s.hg)
 		if err != nil {
-			log.Fatal("fail to serve a fallback server", err)
+			return err
 		}
-	}()
-	s.tlsBadAuthFallbackServerPort = <-port
+		port := make(chan uint16, 1)
+		go func() {
+			err := netutil.ListenHTTPAndServeWithListenerCallback(ctx, ":0", httpHandler, func(ln net.Listener) {
+				port <- uint16(ln.Addr().(*net.TCPAddr).Port)
+			})
+			if err != nil {
+				logger.Fatal("fail to serve a fallback server", err)
+			}
+		}()
+		ip := netip.IPv6Loopback()
+		s.badAuthFallbackAddr = transport.NewSocketAddressByIP(&ip, <-port)
+	}
 
-	addr := ":" + strconv.Itoa(s.hg.TLSPort)
-	return netutil.ListenTLSAndAccept(ctx, addr, s.tlsConfig, func(conn net.Conn) {
-		ctx = contextutil.WithSourceAndInboundValues(ctx, conn.RemoteAddr().String(), "TLS carrier")
+	return netutil.ListenTLSAndAccept(ctx, addr, s.tlsConfig, obfs.New(s.hg.Obfuscation).WrapConn, func(conn net.Conn) {
+		ctx := contextutil.WithSourceAndInboundValues(ctx, conn.RemoteAddr().String(), "TLS carrier")
 		err := s.Serve(ctx, conn)
 		_ = conn.Close()
 		if err != nil {
-			log.InfoWithError("fail to handle a request over TLS", err)
+			logger.InfoWithError("fail to handle a request over TLS", err)
 		}
 	})
 }
 
+// the connections which fail to authenticate are forwarded to the real website before the TLS handshake
+
+func (s *server) serveReality(ctx context.Context, conn net.Conn) error {
+	_ = conn.SetReadDeadline(time.Now().Add(realityClientHelloReadTimeout))
+	readBs, authKey, err := s.reality.authenticate(conn)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	conn = ioutil.NewBytesReadPreloadConn(readBs, conn)
+	if authKey == nil {
+		ctx := contextutil.WithValues(ctx, contextutil.InboundTag, "TLS carrier's REALITY fallback")
+		return transport.ForwardTCP(ctx, s.reality.dest, conn, s.targetClient)
+	}
+	tlsConfig, err := s.reality.tlsConfig(authKey)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, tls.Server(conn, tlsConfig))
+}
+
 func (s *server) Serve(ctx context.Context, conn net.Conn) error {
 	buf := pool.Get(ioutil.BufSize)
 	defer pool.Put(buf)
@@ -89,30 +180,48 @@ func (s *server) Serve(ctx context.Context, conn net.Conn) error {
 	}
 
 	isTrojan := false
-	if len(lineBs) != 16 || [16]byte(lineBs[0:16]) != s.passwordWithCRLF {
-		if len(lineBs) != 56 || [56]byte(lineBs[0:56]) != s.trojanPassword {
-			unreadBufSize := bufReader.Buffered()
-			unreadBs, err := bufReader.Peek(unreadBufSize)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			// 2 = len(CRLF)
-			unrelatedBs := pool.Get(len(lineBs) + 2 + len(unreadBs))[:0]
-			defer pool.Put(unrelatedBs)
-			unrelatedBs = append(unrelatedBs, crlf...)
-			unrelatedBs = append(unrelatedBs, unreadBs...)
-			ip := netip.IPv6Loopback()
-			ctx := contextutil.WithValues(ctx, contextutil.InboundTag, "TLS carrier with wrong auth")
-			fallbackAddr := transport.NewSocketAddressByIP(&ip, s.tlsBadAuthFallbackServerPort)
-			return transport.ForwardTCP(ctx, fallbackAddr, ioutil.NewBytesReadPreloadConn(unrelatedBs, conn), s.targetClient)
-		} else {
-			isTrojan = true
+	user, ok := s.lookUpUser(lineBs)
+	if !ok {
+		user, ok = s.lookUpTrojanUser(lineBs)
+		isTrojan = ok
+	}
+	if ok && s.hg.TLSClientAuth != nil {
+		ok = s.verifyClientCertUser(conn, user)
+	}
+	if !ok {
+		// only the clients with the REALITY key get here, so there's no need to look like a website
+		if s.reality != nil {
+			return errors.New("a REALITY client fails to authenticate with its password")
 		}
+		unreadBufSize := bufReader.Buffered()
+		unreadBs, err := bufReader.Peek(unreadBufSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// 2 = len(CRLF)
+		unrelatedBs := pool.Get(len(lineBs) + 2 + len(unreadBs))[:0]
+		defer pool.Put(unrelatedBs)
+		unrelatedBs = append(unrelatedBs, lineBs...)
+		unrelatedBs = append(unrelatedBs, crlf...)
+		unrelatedBs = append(unrelatedBs, unreadBs...)
+		// the wrapped streams which fail to authenticate are forwarded like the raw ones
+		if tlsConn, ok := conn.(*tls.Conn); ok && s.hg.TLSTransportPath != "" {
+			isHTTP2 := bytes.HasPrefix(unrelatedBs, netutil.HTTP2ClientPreface)
+			return s.serveHTTP(ctx, ioutil.NewBytesReadPreloadConn(unrelatedBs, conn), tlsConn.ConnectionState(), isHTTP2)
+		}
+		ctx := contextutil.WithValues(ctx, contextutil.InboundTag, "TLS carrier with wrong auth")
+		return transport.ForwardTCP(ctx, s.badAuthFallbackAddr, ioutil.NewBytesReadPreloadConn(unrelatedBs, conn), s.targetClient)
 	}
 
+	if user != "" {
+		ctx = contextutil.WithUser(ctx, user)
+	}
 	commandType, err := ioutil.Read1(bufReader)
-	if commandType != socks.ConnectionCommandConnect {
-		return errors.Newf("unsupported command type %v", lineBs[1])
+	if err != nil {
+		return err
+	}
+	if commandType != socks.ConnectionCommandConnect && commandType != udpAssociateCommand {
+		return errors.Newf("unsupported command type %v", commandType)
 	}
 	accessAddr, err := socks.ReadSOCKS5Address(bufReader)
 	if err != nil {
@@ -120,11 +229,16 @@ func (s *server) Serve(ctx context.Context, conn net.Conn) error {
 	}
 	if isTrojan {
 		crlfBs := make([]byte, 2)
-		_, err := bufReader.Read(crlfBs)
+		_, err := ioutil.ReadFull(bufReader, crlfBs)
 		if err != nil {
-			return errors.WithStack(err)
+			return err
 		}
 	}
+	// the packets follow the request in the same stream, so we keep reading them from 'bufReader'
+	if commandType == udpAssociateCommand {
+		ctx = contextutil.WithValues(ctx, contextutil.InboundTag, "TLS carrier's UDP Associate")
+		return transport.ForwardUDP(ctx, accessAddr, newServerPacketConn(conn, bufReader), s.targetClient)
+	}
 
 	unreadSize := bufReader.Buffered()
 	unreadBs, err := bufReader.Peek(unreadSize)
@@ -133,3 +247,41 @@ func (s *server) Serve(ctx context.Context, conn net.Conn) error {
 	}
 	return transport.ForwardTCP(ctx, accessAddr, ioutil.NewBytesReadPreloadConn(unreadBs, conn), s.targetClient)
 }
+
+// the clients without a valid certificate of the password's user are served like the ones with wrong passwords
+
+func (s *server) verifyClientCertUser(conn net.Conn, user string) bool {
+	state, ok := connectionState(conn)
+	if !ok {
+		return false
+	}
+	err := netutil.VerifyClientCertUser(s.hg, state, user)
+	if err != nil {
+		logger.InfoWithError("fail to authenticate the client certificate", err)
+		return false
+	}
+	return true
+}
+
+// the connection is a TLS one or a stream wrapped in the 'tls-transport'
+
+func connectionState(conn net.Conn) (tls.ConnectionState, bool) {
+	stater, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return stater.ConnectionState(), true
+}
+
+func (s *server) lookUpUser(lineBs []byte) (string, bool) {
+	user, ok := s.passwordLines[string(lineBs)]
+	return user, ok
+}
+
+func (s *server) lookUpTrojanUser(lineBs []byte) (string, bool) {
+	if len(lineBs) != 56 {
+		return "", false
+	}
+	user, ok := s.trojanPasswords[[56]byte(lineBs)]
+	return user, ok
+}
@@ -0,0 +1,164 @@
+package tr_carrier
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+)
+
+const grpcContentType = "application/grpc"
+
+// the stream wrapped in the 'tls-transport' keeps the TLS connection's state for 'tls-client-auth'
+
+type tlsStateConn struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c *tlsStateConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+// wraps the stream in WebSocket or gRPC after the TLS connection is established
+
+func (c *client) dialTransport(ctx context.Context, tlsConn net.Conn) (net.Conn, error) {
+	host := c.proxyNode.TLSTransportHost
+	if host == "" {
+		host = c.tlsConfig.ServerName
+	}
+	// the handshakes have no contexts, so the dial's deadline is set on the connection instead
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tlsConn.SetDeadline(deadline)
+		defer func() {
+			_ = tlsConn.SetDeadline(time.Time{})
+		}()
+	}
+
+	var conn net.Conn
+	var err error
+	if c.proxyNode.TLSTransport == conf.TLSTransportGRPC {
+		conn, err = dialGRPC(tlsConn, host, c.proxyNode.TLSTransportPath)
+	} else {
+		conn, err = dialWebSocket(tlsConn, host, c.proxyNode.TLSTransportPath)
+	}
+	if err != nil {
+		_ = tlsConn.Close()
+		return nil, errors.Newf(err, "fail to establish the '%v' transport stream", c.proxyNode.TLSTransport)
+	}
+	return conn, nil
+}
+
+func dialWebSocket(tlsConn net.Conn, host, path string) (net.Conn, error) {
+	config, err := websocket.NewConfig("wss://"+host+path, "https://"+host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	wsConn, err := websocket.NewClient(config, tlsConn)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	wsConn.PayloadType = websocket.BinaryFrame
+	return wsConn, nil
+}
+
+// each stream has its own HTTP/2 connection like the TLS carrier without transports
+
+func dialGRPC(tlsConn net.Conn, host, path string) (net.Conn, error) {
+	clientConn, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+path, pipeReader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", grpcContentType)
+	req.Header.Set("TE", "trailers")
+	resp, err := clientConn.RoundTrip(req)
+	if err != nil {
+		_ = pipeWriter.Close()
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = pipeWriter.Close()
+		_ = resp.Body.Close()
+		return nil, errors.Newf("the server responds %v", resp.Status)
+	}
+	return newGRPCConn(tlsConn, resp.Body, pipeWriter, nil, func() error {
+		_ = pipeWriter.Close()
+		_ = resp.Body.Close()
+		return tlsConn.Close()
+	}), nil
+}
+
+// serves the HTTP requests which fail to authenticate, where the ones to 'tls-transport-path' carry the wrapped streams,
+// and the others are served by the fallbacks
+
+func (s *server) serveHTTP(ctx context.Context, conn net.Conn, state tls.ConnectionState, isHTTP2 bool) error {
+	httpHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == s.hg.TLSTransportPath {
+			switch {
+			case r.ProtoMajor == 1 && strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+				s.serveWebSocket(ctx, state, w, r)
+				return
+			case r.ProtoMajor == 2 && r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType):
+				s.serveGRPC(ctx, conn, state, w, r)
+				return
+			}
+		}
+		if s.fallbackHTTPHandler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.fallbackHTTPHandler.ServeHTTP(w, r)
+	})
+	return netutil.ServeHTTPConn(ctx, conn, httpHandler, isHTTP2)
+}
+
+func (s *server) serveWebSocket(ctx context.Context, state tls.ConnectionState, w http.ResponseWriter, r *http.Request) {
+	wsServer := websocket.Server{
+		// the clients' origins aren't checked, as they're not browsers
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(wsConn *websocket.Conn) {
+			wsConn.PayloadType = websocket.BinaryFrame
+			// the HTTP server's deadlines are kept after the connection is hijacked
+			_ = wsConn.SetDeadline(time.Time{})
+			ctx := contextutil.WithValues(ctx, contextutil.InboundTag, "TLS carrier over WebSocket")
+			err := s.Serve(ctx, &tlsStateConn{wsConn, state})
+			if err != nil {
+				logger.InfoWithError("fail to handle a request over WebSocket", err)
+			}
+		},
+	}
+	wsServer.ServeHTTP(w, r)
+}
+
+func (s *server) serveGRPC(ctx context.Context, conn net.Conn, state tls.ConnectionState, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+
+	grpcConn := newGRPCConn(conn, r.Body, w, flusher.Flush, r.Body.Close)
+	ctx = contextutil.WithValues(ctx, contextutil.InboundTag, "TLS carrier over gRPC")
+	err := s.Serve(ctx, &tlsStateConn{grpcConn, state})
+	// the writer can't be used after the handler returns
+	_ = grpcConn.Close()
+	if err != nil {
+		logger.InfoWithError("fail to handle a request over gRPC", err)
+	}
+	w.Header().Set("Grpc-Status", "0")
+}
@@ -1,3 +1,8 @@
 package tr_carrier
 
-var crlf = []byte{'\r', '\n'}
+import "github.com/ringo-is-a-color/heteroglossia/util/log"
+
+var (
+	crlf   = []byte{'\r', '\n'}
+	logger = log.NewLogger("tr_carrier")
+)
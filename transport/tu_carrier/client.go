@@ -6,7 +6,9 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/quic-go/quic-go"
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
@@ -18,9 +20,21 @@ type client struct {
 	proxyNode  *conf.ProxyNode
 	tlsConfig  *tls.Config
 	quicConfig *quic.Config
+	// the user's UUID for a standard TUIC server, or 'authCommandUUID' for an hg server
+	authUUID [authCommandUUIDSize]byte
 
-	quicConn      *clientQUICConn
-	quicConnMutex sync.Mutex
+	// a new QUIC connection is only opened when all the others are relaying, until there are 'quic-connections' ones
+	quicConns []*clientQUICConn
+	// a slot is reserved by its dial while the QUIC connection is being dialed without holding the mutex
+	quicConnDials  []*quicConnDial
+	quicConnsMutex sync.Mutex
+}
+
+type quicConnDial struct {
+	// closed when the dial is done and the slot is filled in or released
+	done chan struct{}
+	conn *clientQUICConn
+	err  error
 }
 
 var _ transport.Client = new(client)
@@ -30,49 +44,180 @@ func NewClient(proxyNode *conf.ProxyNode, tlsKeyLog bool) (transport.Client, err
 	if err != nil {
 		return nil, err
 	}
-	return &client{proxyNode: proxyNode, tlsConfig: tlsConfig, quicConfig: quicClientConfig}, nil
-}
-
-func (c *client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (net.Conn, error) {
-	c.quicConnMutex.Lock()
-	if c.quicConn == nil || !isActive(c.quicConn) {
-		c.quicConn = nil
-		quicConn, err := c.newQUICConn(ctx)
+	// the TLS config is shared with other carriers
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = quicALPN(proxyNode.QUICALPN)
+	// keep the session tickets to reconnect with 0-RTT, which the fingerprinted handshake doesn't use
+	if proxyNode.TLSFingerprint == "" {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	authUUID := [authCommandUUIDSize]byte([]byte(authCommandUUID))
+	if proxyNode.Protocol == conf.ProtocolTUIC {
+		authUUID, err = errors.WithStack2(uuid.Parse(proxyNode.TUICUUID))
 		if err != nil {
-			c.quicConnMutex.Unlock()
-			targetHostWithPort := c.proxyNode.Host + ":" + strconv.Itoa(c.proxyNode.QUICPort)
-			return nil, errors.Newf(err, "fail to connect to the QUIC server %v", targetHostWithPort)
+			return nil, err
 		}
-		c.quicConn = quicConn
 	}
-	quicConn := c.quicConn
-	c.quicConnMutex.Unlock()
+	quicConfig := quicConfigWithReceiveWindows(quicClientConfig, proxyNode.QUICStreamReceiveWindow,
+		proxyNode.QUICConnectionReceiveWindow)
+	quicConfig = quicConfigWithCongestionControl(quicConfig, proxyNode.QUICCongestionControl, proxyNode.QUICFixedRate)
+	quicConfig, err = netutil.QUICClientConfigWithFingerprint(quicConfig, proxyNode.TLSFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return &client{proxyNode: proxyNode, tlsConfig: tlsConfig, quicConfig: quicConfig, authUUID: authUUID,
+		quicConns:     make([]*clientQUICConn, max(proxyNode.QUICConnections, 1)),
+		quicConnDials: make([]*quicConnDial, max(proxyNode.QUICConnections, 1))}, nil
+}
 
+func (c *client) DialTCP(ctx context.Context, addr *transport.SocketAddress) (net.Conn, error) {
+	quicConn, err := c.acquireQUICConn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	stream, err := quicConn.OpenStream()
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// the server rejects 0-RTT, and we can open streams again when the handshake completes
+		_, err = quicConn.NextConnection(ctx)
+		if err == nil {
+			stream, err = quicConn.OpenStream()
+		}
+	}
 	if err != nil {
+		quicConn.finishTask()
 		return nil, errors.WithStack(err)
 	}
-	quicConn.relayingTaskCount.Add(1)
-	return newClientTCPConn(quicConn, stream, addr, func() { quicConn.relayingTaskCount.Add(^uint64(0)) }), nil
+	return newClientTCPConn(quicConn, stream, addr, quicConn.finishTask), nil
+}
+
+// the 'addr' isn't needed as every packet of a UDP association has its own address
+
+func (c *client) DialUDP(ctx context.Context, _ *transport.SocketAddress) (transport.PacketConn, error) {
+	quicConn, err := c.acquireQUICConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicConn.newAssociation(c.proxyNode.QUICUDPRelayMode == conf.QUICUDPRelayModeQUIC)
+}
+
+// returns the QUIC connection with the fewest relaying tasks for a new task, and the caller has to call 'finishTask'
+// when the task is done
+
+func (c *client) acquireQUICConn(ctx context.Context) (*clientQUICConn, error) {
+	for {
+		c.quicConnsMutex.Lock()
+		selected, emptySlot, ongoingDial := c.selectQUICConn()
+		if selected != nil && (selected.relayingTaskCount.Load() == 0 || emptySlot == -1) {
+			selected.relayingTaskCount.Add(1)
+			c.quicConnsMutex.Unlock()
+			return selected, nil
+		}
+		if emptySlot != -1 {
+			dial := &quicConnDial{done: make(chan struct{})}
+			c.quicConnDials[emptySlot] = dial
+			c.quicConnsMutex.Unlock()
+			return c.dialQUICConn(ctx, emptySlot, dial)
+		}
+		c.quicConnsMutex.Unlock()
+
+		// all the slots are being dialed, so we wait for one of them and select again
+		select {
+		case <-ongoingDial.done:
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+// the caller holds 'quicConnsMutex', and it drains the connections which aren't reusable
+
+func (c *client) selectQUICConn() (selected *clientQUICConn, emptySlot int, ongoingDial *quicConnDial) {
+	emptySlot = -1
+	for i, quicConn := range c.quicConns {
+		if quicConn != nil && !quicConn.isReusable() {
+			quicConn.drain()
+			c.quicConns[i] = nil
+		}
+		if c.quicConnDials[i] != nil {
+			ongoingDial = c.quicConnDials[i]
+			continue
+		}
+		if c.quicConns[i] == nil {
+			if emptySlot == -1 {
+				emptySlot = i
+			}
+			continue
+		}
+		if selected == nil || quicConn.relayingTaskCount.Load() < selected.relayingTaskCount.Load() {
+			selected = quicConn
+		}
+	}
+	return
+}
+
+// dials outside 'quicConnsMutex' for the reserved slot, then fills the slot in with the connection acquired for the caller
+
+func (c *client) dialQUICConn(ctx context.Context, slot int, dial *quicConnDial) (*clientQUICConn, error) {
+	dial.conn, dial.err = c.newQUICConn(ctx)
+	c.quicConnsMutex.Lock()
+	c.quicConnDials[slot] = nil
+	if dial.err == nil {
+		dial.conn.relayingTaskCount.Add(1)
+		c.quicConns[slot] = dial.conn
+	}
+	c.quicConnsMutex.Unlock()
+	close(dial.done)
+
+	if dial.err != nil {
+		targetHostWithPort := c.proxyNode.Host + ":" + strconv.Itoa(c.proxyNode.QUICPort)
+		return nil, errors.Newf(dial.err, "fail to connect to the QUIC server %v", targetHostWithPort)
+	}
+	return dial.conn, nil
+}
+
+func (c *client) removeQUICConn(quicConn *clientQUICConn) {
+	c.quicConnsMutex.Lock()
+	defer c.quicConnsMutex.Unlock()
+	for i := range c.quicConns {
+		if c.quicConns[i] == quicConn {
+			c.quicConns[i] = nil
+		}
+	}
 }
 
 func (c *client) newQUICConn(ctx context.Context) (*clientQUICConn, error) {
 	targetHostWithPort := c.proxyNode.Host + ":" + strconv.Itoa(c.proxyNode.QUICPort)
 	// TODO: https://quic-go.net/docs/quic/transport/#stateless-reset
-	quicConn, err := netutil.DialQUIC(ctx, targetHostWithPort, c.tlsConfig, c.quicConfig)
+	tlsConfig, err := netutil.TLSClientConfigWithECH(ctx, c.proxyNode, c.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	quicConn, err := netutil.DialQUICEarly(ctx, targetHostWithPort, tlsConfig, c.quicConfig)
+	if err != nil {
+		// quic-go doesn't keep the server's retry configs when it rejects ECH, so the ECHConfigList is fetched again
+		netutil.DropECHConfigList(c.proxyNode)
+		return nil, err
+	}
 
-	clientQUICConn := &clientQUICConn{client: c, Connection: quicConn}
+	clientQUICConn := &clientQUICConn{client: c, EarlyConnection: quicConn, assembler: newPacketAssembler(),
+		associations: newAssociations()}
+	clientQUICConn.idleSince.Store(time.Now().UnixNano())
+	clientQUICConn.localIP, err = netutil.RouteLocalIP(quicConn.RemoteAddr().(*net.UDPAddr))
+	if err != nil {
+		_ = quicConn.CloseWithError(connectionDrainedErrCode, connectionDrainedErrStr)
+		return nil, err
+	}
 	go closeConnWhenParentContextDone(ctx, clientQUICConn)
 	go func() {
-		err := clientQUICConn.sendAuthenticationCommand()
+		err := clientQUICConn.authenticate()
 		if err != nil {
 			_ = clientQUICConn.CloseWithError(authCommandSendErrCode, authCommandSendErrStr)
 		}
 	}()
 	go clientQUICConn.sendHeartbeats()
+	go clientQUICConn.checkRouteChanges()
+	go clientQUICConn.processIncomingDatagram()
+	go clientQUICConn.associations.closeAllWhenDone(clientQUICConn)
 	return clientQUICConn, nil
 }
 
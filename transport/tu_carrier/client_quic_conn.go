@@ -2,21 +2,53 @@ package tu_carrier
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
 	"sync/atomic"
 	"time"
 
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/quic-go/quic-go"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 )
 
 // one client has one clientQUICConn/quic.Connection
 type clientQUICConn struct {
-	client          *client
-	quic.Connection // avoid using client.quicConn from this directly to avoid concurrency issues
+	client               *client
+	quic.EarlyConnection // avoid using client.quicConns from this directly to avoid concurrency issues
 
 	relayingTaskCount atomic.Uint64
+	// the Unix time in nanoseconds when the last relaying task is done
+	idleSince atomic.Int64
+	// the local IP of the route to the server when dialing, and the connection is replaced when it changes
+	localIP netip.Addr
+	// set by 'checkRouteChanges' rather than checking the route for every new task
+	routeChanged atomic.Bool
+	// a draining connection takes no new tasks, and it's closed when its tasks are done
+	draining atomic.Bool
+
+	assembler    *packetAssembler
+	associations *associations
+	nextAssocID  uint16
+}
+
+// the requests are sent as 0-RTT data before the handshake completes when the TLS session is resumed,
+// but the authentication command has to wait for the handshake, as Go's TLS keying material exporter isn't available
+// before it, and the server only handles the requests after the authentication
+
+func (c *clientQUICConn) authenticate() error {
+	// it also makes the connection usable again if the server rejects 0-RTT
+	_, err := c.NextConnection(context.Background())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// a 0-RTT rejection stops accepting streams, so we start after it
+	go c.processIncomingUniStreams()
+	return c.sendAuthenticationCommand()
 }
 
 func (c *clientQUICConn) sendAuthenticationCommand() (err error) {
@@ -24,7 +56,7 @@ func (c *clientQUICConn) sendAuthenticationCommand() (err error) {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	authToken, err := authToken(c, []byte(c.client.proxyNode.Password.String))
+	authToken, err := authToken(c, c.client.authUUID, []byte(c.client.proxyNode.Password.String))
 	if err != nil {
 		return err
 	}
@@ -34,7 +66,7 @@ func (c *clientQUICConn) sendAuthenticationCommand() (err error) {
 	authBuf := bytes.NewBuffer(authBs[:0])
 	authBuf.WriteByte(tuicVersion)
 	authBuf.WriteByte(authCommandType)
-	authBuf.WriteString(authCommandUUID)
+	authBuf.Write(c.client.authUUID[:])
 	authBuf.Write(authToken)
 	_, err = authBuf.WriteTo(sendStream)
 	if err != nil {
@@ -44,6 +76,62 @@ func (c *clientQUICConn) sendAuthenticationCommand() (err error) {
 	return nil
 }
 
+// quic-go doesn't support migrating a client's connection to a new path, so we open a new connection for the new tasks
+// when the local address changes, and we don't reuse the connection which is about to reach the idle timeout
+
+func (c *clientQUICConn) isReusable() bool {
+	if !isActive(c) || c.draining.Load() {
+		return false
+	}
+	if c.relayingTaskCount.Load() == 0 && time.Since(time.Unix(0, c.idleSince.Load())) > netutil.IdleTimeout-heartbeatInterval {
+		return false
+	}
+	return !c.routeChanged.Load()
+}
+
+func (c *clientQUICConn) checkRouteChanges() {
+	ticker := time.NewTicker(routeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case <-ticker.C:
+			if c.checkRoute() {
+				return
+			}
+		}
+	}
+}
+
+// returns true when the local IP of the route to the server isn't the one when dialing
+
+func (c *clientQUICConn) checkRoute() bool {
+	localIP, err := netutil.RouteLocalIP(c.RemoteAddr().(*net.UDPAddr))
+	if err != nil || localIP != c.localIP {
+		c.routeChanged.Store(true)
+		return true
+	}
+	return false
+}
+
+func (c *clientQUICConn) drain() {
+	c.draining.Store(true)
+	if c.relayingTaskCount.Load() == 0 {
+		_ = c.EarlyConnection.CloseWithError(connectionDrainedErrCode, connectionDrainedErrStr)
+	}
+}
+
+func (c *clientQUICConn) finishTask() {
+	if c.relayingTaskCount.Add(^uint64(0)) != 0 {
+		return
+	}
+	c.idleSince.Store(time.Now().UnixNano())
+	if c.draining.Load() {
+		_ = c.EarlyConnection.CloseWithError(connectionDrainedErrCode, connectionDrainedErrStr)
+	}
+}
+
 func (c *clientQUICConn) sendHeartbeats() {
 	ticker := time.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
@@ -55,7 +143,7 @@ func (c *clientQUICConn) sendHeartbeats() {
 			if c.relayingTaskCount.Load() != 0 {
 				err := c.SendDatagram([]byte{tuicVersion, heartbeatCommandType})
 				if err != nil {
-					log.InfoWithError("fail to send a datagram", err)
+					logger.InfoWithError("fail to send a datagram", err)
 					_ = c.CloseWithError(heartbeatCommandSendErrCode, heartbeatCommandSendErrStr)
 				}
 			}
@@ -63,9 +151,98 @@ func (c *clientQUICConn) sendHeartbeats() {
 	}
 }
 
+// the caller has acquired the connection for the association
+
+func (c *clientQUICConn) newAssociation(overStream bool) (*packetConn, error) {
+	c.associations.mutex.Lock()
+	defer c.associations.mutex.Unlock()
+	if len(c.associations.conns) >= 1<<16 {
+		c.finishTask()
+		return nil, errors.New("too many UDP associations in a QUIC connection")
+	}
+	for {
+		_, ok := c.associations.conns[c.nextAssocID]
+		if !ok {
+			break
+		}
+		c.nextAssocID++
+	}
+	assocID := c.nextAssocID
+	c.nextAssocID++
+
+	conn := newPacketConn(c, assocID, overStream, func() {
+		c.associations.remove(assocID)
+		if isActive(c) {
+			err := sendDissociateCommand(c, assocID)
+			if err != nil {
+				logger.InfoWithError("fail to send a dissociate command", err)
+			}
+		}
+		c.finishTask()
+	})
+	c.associations.conns[assocID] = conn
+	return conn, nil
+}
+
+// the server sends the UDP packets of the associations to us over QUIC datagrams or unidirectional streams
+
+func (c *clientQUICConn) processIncomingUniStreams() {
+	for {
+		uniStream, err := c.AcceptUniStream(context.Background())
+		if err != nil {
+			// this can happen when timeout
+			return
+		}
+		go func() {
+			err := c.handleIncomingPacketCommand(uniStream)
+			if err != nil {
+				logger.InfoWithError("fail to handle a QUIC unidirectional stream", err)
+				_ = c.CloseWithError(handleUniStreamErrCode, fmt.Sprintf("%v: %v", handleUniStreamErrStr, err.Error()))
+			}
+		}()
+	}
+}
+
+func (c *clientQUICConn) processIncomingDatagram() {
+	for {
+		datagram, err := c.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		err = c.handleIncomingPacketCommand(bytes.NewReader(datagram))
+		if err != nil {
+			logger.InfoWithError("fail to handle a QUIC datagram", err)
+			_ = c.CloseWithError(handleDatagramErrCode, handleDatagramStreamErrStr)
+			return
+		}
+	}
+}
+
+func (c *clientQUICConn) handleIncomingPacketCommand(r io.Reader) error {
+	command, err := validateVersionAndGetCommandType(r)
+	if err != nil {
+		return err
+	}
+	if command != packetCommandType {
+		return errors.Newf("unknown command type %v", command)
+	}
+	fragment, err := readPacketFragment(r)
+	if err != nil {
+		return err
+	}
+	addr, payload, ok := c.assembler.add(fragment)
+	if !ok {
+		return nil
+	}
+	conn, ok := c.associations.get(fragment.assocID)
+	// the association may be closed by us already
+	if ok {
+		conn.deliver(addr, payload)
+	}
+	return nil
+}
+
 func (c *clientQUICConn) CloseWithError(code quic.ApplicationErrorCode, desc string) error {
-	c.client.quicConnMutex.Lock()
-	c.client.quicConn = nil
-	c.client.quicConnMutex.Unlock()
-	return c.Connection.CloseWithError(code, desc)
+	c.client.removeQUICConn(c)
+	return c.EarlyConnection.CloseWithError(code, desc)
 }
@@ -1,17 +1,639 @@
 package tu_carrier
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/transport/direct"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/testutil"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestClientServerConnection(t *testing.T) {
-	testutil.TestClientServerConnection(t, newClient, NewServer)
+	testutil.TestClientServerConnection(t, nil, nil, newClient, NewServer)
+}
+
+func TestClientServerConnectionWithUsers(t *testing.T) {
+	user := testutil.TestClientServerConnection(t, setUsers(t), useSecondUser, newClient, NewServer)
+	assert.Equal(t, "user2", user)
+}
+
+func TestClientServerPacketConnection(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, nil, nil, newClient, NewServer)
+}
+
+func TestClientServerPacketConnectionWithUsers(t *testing.T) {
+	user := testutil.TestClientServerPacketConnection(t, setUsers(t), useSecondUser, newClient, NewServer)
+	assert.Equal(t, "user2", user)
+}
+
+func setUsers(t *testing.T) func(hg *conf.Hg) {
+	return func(hg *conf.Hg) {
+		hg.Users = testutil.Users(t)
+	}
+}
+
+func useSecondUser(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+	proxyNode.Password = hg.Users[1].Password
+}
+
+func TestClientServerPacketConnectionOverStreams(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, nil, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.QUICUDPRelayMode = conf.QUICUDPRelayModeQUIC
+	}, newClient, NewServer)
+}
+
+func TestClientServerConnectionWithReceiveWindows(t *testing.T) {
+	testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.QUICStreamReceiveWindow = 16 << 20
+		hg.QUICConnectionReceiveWindow = 32 << 20
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.QUICStreamReceiveWindow = hg.QUICStreamReceiveWindow
+		proxyNode.QUICConnectionReceiveWindow = hg.QUICConnectionReceiveWindow
+	}, newClient, NewServer)
+}
+
+func TestClientServerConnectionWithCongestionControls(t *testing.T) {
+	for _, congestionControl := range []string{conf.QUICCongestionControlBBR, conf.QUICCongestionControlFixedRate} {
+		t.Run(congestionControl, func(t *testing.T) {
+			testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+				hg.QUICCongestionControl = congestionControl
+				hg.QUICFixedRate = 10 << 20
+			}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				proxyNode.QUICCongestionControl = hg.QUICCongestionControl
+				proxyNode.QUICFixedRate = hg.QUICFixedRate
+			}, newClient, NewServer)
+		})
+	}
+}
+
+func TestClientServerConnectionWithTLSVerifications(t *testing.T) {
+	for _, verification := range []struct {
+		name  string
+		setup func(hg *conf.Hg, proxyNode *conf.ProxyNode)
+	}{
+		// another certificate without DNS names comes first
+		{"cert bundle", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.TLSCertFile = testutil.WriteCertBundle(t, hg.TLSCertKeyPair.CertFile)
+		}},
+		{"SNI", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.Host = "127.0.0.1"
+			proxyNode.TLSSNI = "localhost"
+		}},
+		{"pinned SPKI", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.TLSCertFile = ""
+			proxyNode.TLSInsecureSkipVerify = true
+			proxyNode.TLSPinnedSPKISHA256 = []string{testutil.SPKISHA256Pin(t, hg.TLSCertKeyPair.CertFile)}
+		}},
+		{"insecure skip verify", func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+			proxyNode.TLSCertFile = ""
+			proxyNode.TLSInsecureSkipVerify = true
+		}},
+	} {
+		t.Run(verification.name, func(t *testing.T) {
+			testutil.TestClientServerConnection(t, nil, verification.setup, newClient, NewServer)
+		})
+	}
+}
+
+// the default certificate isn't for the host, so the client only succeeds if the server selects the other one by SNI
+
+func TestClientServerConnectionWithTLSCertKeyPairs(t *testing.T) {
+	testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+		hg.TLSCertKeyPairs = []conf.TLSCertKeyPair{*hg.TLSCertKeyPair}
+		hg.TLSCertKeyPair = testutil.WriteCertKeyPair(t, "default.example.com")
+	}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+		proxyNode.TLSCertFile = hg.TLSCertKeyPairs[0].CertFile
+	}, newClient, NewServer)
+}
+
+// the client's certificate signed by the CA authenticates it with its subject's user's password, unless it's revoked
+// by the CRL or it's another user's
+
+func TestClientServerConnectionWithTLSClientAuth(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		certUser string
+		revoked  bool
+		accepted bool
+	}{
+		{"valid", "user2", false, true},
+		{"revoked", "user2", true, false},
+		{"another user's", "user1", false, false},
+		{"unknown user's", "cert-user", false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clientAuth, clientCertKeyPair := testutil.WriteClientAuthFiles(t, test.certUser, test.revoked)
+			setClientAuth := func(hg *conf.Hg) {
+				hg.Users = testutil.Users(t)
+				hg.TLSClientAuth = clientAuth
+			}
+			setClientCert := func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				proxyNode.Password = hg.Users[1].Password
+				proxyNode.TLSClientCertKeyPair = clientCertKeyPair
+			}
+			if !test.accepted {
+				testutil.TestClientServerConnectionFailure(t, setClientAuth, setClientCert, newClient, NewServer)
+				return
+			}
+			user := testutil.TestClientServerConnection(t, setClientAuth, setClientCert, newClient, NewServer)
+			assert.Equal(t, "user2", user)
+		})
+	}
+}
+
+// the client's ECHConfigList is set inline or fetched from a DNS-over-HTTPS server,
+// and the client fails if the server rejects ECH, as its certificate isn't for the public name
+
+func TestClientServerConnectionWithECH(t *testing.T) {
+	for _, viaDoH := range []bool{false, true} {
+		t.Run("via DoH "+strconv.FormatBool(viaDoH), func(t *testing.T) {
+			privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+			assert.Nil(t, err)
+			ech := &conf.TLSECH{PublicName: "ech.example.com", PrivateKey: base64.RawURLEncoding.EncodeToString(privateKey.Bytes())}
+			_, configList, err := netutil.ECHKey(ech)
+			assert.Nil(t, err)
+			testutil.TestClientServerConnection(t, func(hg *conf.Hg) {
+				hg.TLSECH = ech
+			}, func(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+				if viaDoH {
+					proxyNode.TLSECHDoHURL = testutil.StartDoHServer(t, configList).URL + "/dns-query"
+				} else {
+					proxyNode.TLSECHConfigList = base64.StdEncoding.EncodeToString(configList)
+				}
+			}, newClient, NewServer)
+		})
+	}
 }
 
 func newClient(proxyNode *conf.ProxyNode) (transport.Client, error) {
 	return NewClient(proxyNode, false)
 }
+
+// the client uses TUIC, which our server also accepts
+
+func TestClientServerConnectionWithTUIC(t *testing.T) {
+	testutil.TestClientServerConnection(t, setTUICUUID, useTUIC, newClient, NewServer)
+}
+
+func TestClientServerPacketConnectionWithTUIC(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, setTUICUUID, useTUIC, newClient, NewServer)
+}
+
+func setTUICUUID(hg *conf.Hg) {
+	hg.TUICUUID = testutil.TUICTestUUID
+	hg.QUICALPN = []string{"h3"}
+}
+
+func useTUIC(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+	proxyNode.Protocol = conf.ProtocolTUIC
+	proxyNode.TUICUUID = hg.TUICUUID
+	proxyNode.QUICALPN = hg.QUICALPN
+}
+
+func TestClientServerConnectionWithChromeFingerprint(t *testing.T) {
+	testutil.TestClientServerConnection(t, setTUICUUID, useTUICWithChromeFingerprint, newClient, NewServer)
+}
+
+func TestClientServerPacketConnectionWithChromeFingerprint(t *testing.T) {
+	testutil.TestClientServerPacketConnection(t, setTUICUUID, useTUICWithChromeFingerprint, newClient, NewServer)
+}
+
+func useTUICWithChromeFingerprint(hg *conf.Hg, proxyNode *conf.ProxyNode) {
+	useTUIC(hg, proxyNode)
+	proxyNode.TLSFingerprint = conf.TLSFingerprintChrome
+}
+
+// the first datagram is Chrome's Initial packet shape: 1250 bytes, an 8 bytes Destination Connection ID and no Source
+// Connection ID
+
+func TestClientInitialPacketWithChromeFingerprint(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer udpConn.Close()
+	proxyNode := &conf.ProxyNode{Host: "127.0.0.1", Password: testutil.ServerConf(t).Password,
+		QUICPort: udpConn.LocalAddr().(*net.UDPAddr).Port, TLSCertFile: "misc/tls_test_cert.pem",
+		Protocol: conf.ProtocolTUIC, TUICUUID: testutil.TUICTestUUID, TLSFingerprint: conf.TLSFingerprintChrome}
+	quicClient, err := NewClient(proxyNode, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, _ = quicClient.DialTCP(ctx, transport.NewSocketAddressByDomain("example.com", 80))
+	}()
+
+	buf := make([]byte, 2048)
+	_ = udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := udpConn.ReadFrom(buf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 1250, n)
+	// the long header's first byte and version, then the Destination Connection ID and the Source Connection ID
+	dcidLength := int(buf[5])
+	assert.Equal(t, 8, dcidLength)
+	assert.Equal(t, byte(0), buf[6+dcidLength])
+}
+
+// a TUIC client written directly from the spec, so the server is checked against the standard wire format
+// rather than our client
+// https://github.com/EAimTY/tuic/blob/dev/SPEC.md
+
+func TestServerWithStandardTUICClient(t *testing.T) {
+	quicConn := dialAsStandardTUICClient(t)
+	if quicConn == nil {
+		return
+	}
+	webServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer webServer.Close()
+	webServerAddrPort := webServer.Listener.Addr().(*net.TCPAddr).AddrPort()
+
+	// Connect: VER + TYPE + ADDR over a bidirectional stream, then the relayed data
+	stream, err := quicConn.OpenStream()
+	assert.Nil(t, err)
+	connectCommand := append([]byte{5, 1}, standardTUICAddress(webServerAddrPort)...)
+	connectCommand = append(connectCommand, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"...)
+	_, err = stream.Write(connectCommand)
+	assert.Nil(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+// the packets are echoed in the same UDP relay mode as they're sent, and the fragments are reassembled
+
+func TestServerWithStandardTUICClientPackets(t *testing.T) {
+	echoServerAddrPort := startStandardUDPServer(t, func(payload []byte, _ netip.AddrPort) []byte {
+		return payload
+	})
+	tests := []struct {
+		name       string
+		overStream bool
+		// the packet's fragments with the same ASSOC_ID and PKT_ID
+		fragments [][]byte
+	}{
+		{"over a datagram", false, [][]byte{[]byte("hello over a datagram")}},
+		{"over a unidirectional stream", true, [][]byte{[]byte("hello over a stream")}},
+		{"over fragmented datagrams", false, [][]byte{[]byte("hello over "), []byte("fragmented "), []byte("datagrams")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quicConn := dialAsStandardTUICClient(t)
+			if quicConn == nil {
+				return
+			}
+			for i, fragment := range tt.fragments {
+				addr := &echoServerAddrPort
+				if i > 0 {
+					addr = nil
+				}
+				command := standardPacketCommand(1, 0, byte(len(tt.fragments)), byte(i), addr, fragment)
+				sendStandardCommand(t, quicConn, tt.overStream, command)
+			}
+			assocID, addr, payload := receiveStandardPacketCommand(t, quicConn, tt.overStream)
+			assert.Equal(t, uint16(1), assocID)
+			assert.Equal(t, echoServerAddrPort, addr)
+			var expectedPayload []byte
+			for _, fragment := range tt.fragments {
+				expectedPayload = append(expectedPayload, fragment...)
+			}
+			assert.Equal(t, expectedPayload, payload)
+		})
+	}
+}
+
+// a dissociate command closes the association, so the next packet with the same ASSOC_ID starts a new one
+// from another source port
+
+func TestServerWithStandardTUICClientDissociate(t *testing.T) {
+	quicConn := dialAsStandardTUICClient(t)
+	if quicConn == nil {
+		return
+	}
+	sourceServerAddrPort := startStandardUDPServer(t, func(_ []byte, source netip.AddrPort) []byte {
+		return []byte(source.String())
+	})
+	sendPacket := func() {
+		sendStandardCommand(t, quicConn, false, standardPacketCommand(1, 0, 1, 0, &sourceServerAddrPort, []byte("hello")))
+	}
+	sendPacket()
+	_, _, firstSource := receiveStandardPacketCommand(t, quicConn, false)
+	assert.NotEmpty(t, firstSource)
+	sendPacket()
+	_, _, source := receiveStandardPacketCommand(t, quicConn, false)
+	assert.Equal(t, firstSource, source)
+
+	// Dissociate: VER + TYPE + ASSOC_ID over a unidirectional stream
+	sendStandardCommand(t, quicConn, true, []byte{5, 3, 0, 1})
+	// the dissociate command and the next packet are over different streams, which can be handled in any order,
+	// and a packet delivered to the closed association is dropped
+	assert.Eventually(t, func() bool {
+		sendPacket()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		command, err := quicConn.ReceiveDatagram(ctx)
+		// the header and the IPv4 address are 17 bytes
+		return err == nil && len(command) > 17 && string(command[17:]) != string(firstSource)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// dialAsStandardTUICClient returns a QUIC connection authenticated by a TUIC client written from the spec,
+// or nil if it fails
+
+func dialAsStandardTUICClient(t *testing.T) quic.Connection {
+	hg := testutil.ServerConf(t)
+	hg.TUICUUID = testutil.TUICTestUUID
+	hg.QUICALPN = []string{"h3"}
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	certPool := x509.NewCertPool()
+	certBs, err := os.ReadFile("misc/tls_test_cert.pem")
+	assert.Nil(t, err)
+	certPool.AppendCertsFromPEM(certBs)
+	tlsConfig := &tls.Config{RootCAs: certPool, ServerName: "localhost", NextProtos: []string{"h3"}}
+	quicConn, err := quic.DialAddr(context.Background(), "localhost:"+strconv.Itoa(hg.QUICPort), tlsConfig,
+		&quic.Config{EnableDatagrams: true})
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	t.Cleanup(func() {
+		_ = quicConn.CloseWithError(0, "")
+	})
+	assert.Equal(t, "h3", quicConn.ConnectionState().TLS.NegotiatedProtocol)
+
+	// Authenticate: VER + TYPE + UUID + TOKEN over a unidirectional stream
+	// TOKEN = TLS Keying Material Exporter(label: UUID, context: password, length: 32)
+	userUUID := uuid.MustParse(testutil.TUICTestUUID)
+	tlsState := quicConn.ConnectionState().TLS
+	token, err := tlsState.ExportKeyingMaterial(string(userUUID[:]), []byte(hg.Password.String), 32)
+	assert.Nil(t, err)
+	sendStandardCommand(t, quicConn, true, append(append([]byte{5, 0}, userUUID[:]...), token...))
+	return quicConn
+}
+
+// ADDR: TYPE + ADDR + PORT, where the TYPE 0x01 is an IPv4 address
+
+func standardTUICAddress(addrPort netip.AddrPort) []byte {
+	addr := append([]byte{0x01}, addrPort.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(addr, addrPort.Port())
+}
+
+// Packet: VER + TYPE + ASSOC_ID + PKT_ID + FRAG_TOTAL + FRAG_ID + SIZE + ADDR + DATA,
+// where the ADDR is the None address (0xff) if 'addr' is nil, which is used by the fragments after the first one
+
+func standardPacketCommand(assocID, packetID uint16, fragTotal, fragID byte, addr *netip.AddrPort, data []byte) []byte {
+	command := []byte{5, 2}
+	command = binary.BigEndian.AppendUint16(command, assocID)
+	command = binary.BigEndian.AppendUint16(command, packetID)
+	command = append(command, fragTotal, fragID)
+	command = binary.BigEndian.AppendUint16(command, uint16(len(data)))
+	if addr == nil {
+		command = append(command, 0xff)
+	} else {
+		command = append(command, standardTUICAddress(*addr)...)
+	}
+	return append(command, data...)
+}
+
+func sendStandardCommand(t *testing.T, quicConn quic.Connection, overStream bool, command []byte) {
+	if !overStream {
+		assert.Nil(t, quicConn.SendDatagram(command))
+		return
+	}
+	stream, err := quicConn.OpenUniStream()
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = stream.Write(command)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Close())
+}
+
+// the server's packet isn't fragmented, as it's as small as the sent one
+
+func receiveStandardPacketCommand(t *testing.T, quicConn quic.Connection, overStream bool) (uint16, netip.AddrPort, []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var command []byte
+	if overStream {
+		stream, err := quicConn.AcceptUniStream(ctx)
+		if !assert.Nil(t, err) {
+			return 0, netip.AddrPort{}, nil
+		}
+		command, err = io.ReadAll(stream)
+		assert.Nil(t, err)
+	} else {
+		var err error
+		command, err = quicConn.ReceiveDatagram(ctx)
+		if !assert.Nil(t, err) {
+			return 0, netip.AddrPort{}, nil
+		}
+	}
+	// VER + TYPE + ASSOC_ID + PKT_ID + FRAG_TOTAL + FRAG_ID + SIZE + ADDR(1 + 4 + 2)
+	if !assert.GreaterOrEqual(t, len(command), 17) {
+		return 0, netip.AddrPort{}, nil
+	}
+	assert.Equal(t, []byte{5, 2}, command[:2])
+	assert.Equal(t, []byte{1, 0}, command[6:8])
+	assert.Equal(t, byte(0x01), command[10])
+	addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte(command[11:15])), binary.BigEndian.Uint16(command[15:17]))
+	payload := command[17:]
+	assert.Equal(t, int(binary.BigEndian.Uint16(command[8:10])), len(payload))
+	return binary.BigEndian.Uint16(command[2:4]), addr, payload
+}
+
+func startStandardUDPServer(t *testing.T, reply func(payload []byte, source netip.AddrPort) []byte) netip.AddrPort {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = udpConn.Close()
+	})
+	go func() {
+		buf := make([]byte, transport.MaxUDPPacketSize)
+		for {
+			n, source, err := udpConn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteToUDPAddrPort(reply(buf[:n], source), source)
+		}
+	}()
+	return udpConn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// a QUIC connection without an authentication command is served as the fallback HTTP/3 site
+
+func TestBadAuthFallbackSite(t *testing.T) {
+	hg := testutil.ServerConf(t)
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	certPool := x509.NewCertPool()
+	certBs, err := os.ReadFile("misc/tls_test_cert.pem")
+	assert.Nil(t, err)
+	certPool.AppendCertsFromPEM(certBs)
+	roundTripper := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: certPool, ServerName: "localhost"}}
+	defer roundTripper.Close()
+	httpClient := &http.Client{Transport: roundTripper, Timeout: authTimeout / 2}
+	resp, err := httpClient.Get("https://localhost:" + strconv.Itoa(hg.QUICPort) + "/")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	expectedBody, err := os.ReadFile("misc/site/index.html")
+	assert.Nil(t, err)
+	assert.Equal(t, expectedBody, body)
+}
+
+// a reconnection after the QUIC connection is closed, e.g., by the idle timeout, resumes the TLS session with 0-RTT
+
+func TestClientServerReconnectionWith0RTT(t *testing.T) {
+	hg := testutil.ServerConf(t)
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	webServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer webServer.Close()
+	proxyNode := &conf.ProxyNode{Host: "localhost", Password: hg.Password, QUICPort: hg.QUICPort,
+		TLSCertFile: "misc/tls_test_cert.pem"}
+	quicClient, err := NewClient(proxyNode, false)
+	assert.Nil(t, err)
+	httpClient := transport.HTTPClientThroughRouter(quicClient)
+
+	for i := range 2 {
+		resp, err := httpClient.Get(webServer.URL)
+		if !assert.Nil(t, err) {
+			return
+		}
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		quicConn, err := quicClient.(*client).acquireQUICConn(context.Background())
+		assert.Nil(t, err)
+		quicConn.finishTask()
+		assert.Equal(t, i == 1, quicConn.ConnectionState().Used0RTT)
+		httpClient.CloseIdleConnections()
+		_ = quicConn.CloseWithError(0, "")
+	}
+}
+
+func TestClientQUICConnectionPool(t *testing.T) {
+	hg := testutil.ServerConf(t)
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	proxyNode := &conf.ProxyNode{Host: "localhost", Password: hg.Password, QUICPort: hg.QUICPort,
+		TLSCertFile: "misc/tls_test_cert.pem", QUICConnections: 2}
+	quicClient, err := NewClient(proxyNode, false)
+	assert.Nil(t, err)
+	c := quicClient.(*client)
+	first, err := c.acquireQUICConn(context.Background())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// a new connection is opened as the first one is relaying, then the one with fewer tasks is used
+	second, err := c.acquireQUICConn(context.Background())
+	assert.Nil(t, err)
+	assert.NotSame(t, first, second)
+	second.finishTask()
+	third, err := c.acquireQUICConn(context.Background())
+	assert.Nil(t, err)
+	assert.Same(t, second, third)
+	first.finishTask()
+	third.finishTask()
+
+	// the connections about to reach the idle timeout or with a changed local address are drained and replaced
+	first.idleSince.Store(time.Now().Add(-netutil.IdleTimeout).UnixNano())
+	second.localIP = netip.MustParseAddr("192.0.2.1")
+	assert.True(t, second.checkRoute())
+	replacement, err := c.acquireQUICConn(context.Background())
+	assert.Nil(t, err)
+	replacement.finishTask()
+	assert.NotSame(t, first, replacement)
+	assert.NotSame(t, second, replacement)
+	for _, quicConn := range []*clientQUICConn{first, second} {
+		select {
+		case <-quicConn.Context().Done():
+		case <-time.After(time.Second):
+			assert.Fail(t, "the drained QUIC connection isn't closed")
+		}
+	}
+	_ = replacement.CloseWithError(0, "")
+}
+
+func TestClientQUICConnectionPoolWithConcurrentDials(t *testing.T) {
+	hg := testutil.ServerConf(t)
+	testutil.StartServer(t, hg, NewServer(hg, direct.NewClient()))
+
+	proxyNode := &conf.ProxyNode{Host: "localhost", Password: hg.Password, QUICPort: hg.QUICPort,
+		TLSCertFile: "misc/tls_test_cert.pem", QUICConnections: 2}
+	quicClient, err := NewClient(proxyNode, false)
+	assert.Nil(t, err)
+	c := quicClient.(*client)
+	first, err := c.acquireQUICConn(context.Background())
+	if !assert.Nil(t, err) {
+		return
+	}
+	first.finishTask()
+	_ = first.CloseWithError(0, "")
+	<-first.Context().Done()
+
+	// the acquirers waiting for the dials in progress don't open more connections than the slots
+	quicConns := make(chan *clientQUICConn, 8)
+	var wg sync.WaitGroup
+	for range cap(quicConns) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			quicConn, err := c.acquireQUICConn(context.Background())
+			if assert.Nil(t, err) {
+				quicConns <- quicConn
+			}
+		}()
+	}
+	wg.Wait()
+	close(quicConns)
+	distinct := make(map[*clientQUICConn]struct{})
+	for quicConn := range quicConns {
+		distinct[quicConn] = struct{}{}
+		quicConn.finishTask()
+	}
+	assert.LessOrEqual(t, len(distinct), 2)
+	for quicConn := range distinct {
+		_ = quicConn.CloseWithError(0, "")
+	}
+}
@@ -0,0 +1,440 @@
+package congestion
+
+import (
+	"math/rand/v2"
+	"time"
+
+	quicCongestion "github.com/quic-go/quic-go/congestion"
+)
+
+// BBR (v1) estimates the bottleneck bandwidth and the min RTT of the path, and sends at the estimated bandwidth rather
+// than backing off on every packet loss like CUBIC, which suits long-haul links with random losses,
+// see https://datatracker.ietf.org/doc/html/draft-cardwell-iccrg-bbr-congestion-control-00
+
+const (
+	bbrStartupGain            = 2.885 // 2/ln(2)
+	bbrDrainGain              = 1 / bbrStartupGain
+	bbrProbeBandwidthCwndGain = 2
+	bbrBandwidthFilterRounds  = 10
+	bbrMinRTTExpiry           = 10 * time.Second
+	bbrProbeRTTDuration       = 200 * time.Millisecond
+	bbrFullBandwidthThreshold = 1.25
+	bbrFullBandwidthRounds    = 3
+	// the packets which are neither acknowledged nor lost in time, e.g., the ones of the dropped Initial packet number space
+	bbrSentPacketExpiry = 30 * time.Second
+)
+
+var bbrPacingGainCycle = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBandwidth
+	bbrProbeRTT
+)
+
+// the connection's delivery states when a packet is sent, to estimate the delivery rate when it's acknowledged,
+// see https://datatracker.ietf.org/doc/html/draft-cheng-iccrg-delivery-rate-estimation-02
+
+type bbrSentPacket struct {
+	sentTime      time.Time
+	delivered     quicCongestion.ByteCount
+	deliveredTime time.Time
+	firstSentTime time.Time
+}
+
+type bbrSender struct {
+	rttStats        *quicCongestion.RTTStats
+	maxDatagramSize quicCongestion.ByteCount
+	pacer           *pacer
+
+	mode             bbrMode
+	pacingGain       float64
+	cwndGain         float64
+	congestionWindow quicCongestion.ByteCount
+	bytesInFlight    quicCongestion.ByteCount
+
+	// the packet numbers of the Initial, Handshake and 1-RTT packet number spaces overlap,
+	// and a later packet replaces the earlier one with the same number, which only affects a few samples in the handshake
+	sentPackets       map[quicCongestion.PacketNumber]*bbrSentPacket
+	largestSentPacket quicCongestion.PacketNumber
+	delivered         quicCongestion.ByteCount
+	deliveredTime     time.Time
+	firstSentTime     time.Time
+	bandwidthFilter   maxBandwidthFilter
+
+	round              uint64
+	nextRoundDelivered quicCongestion.ByteCount
+	// whether the congestion window or the pacing stops sending in the round, or the bandwidth may be limited by the app
+	senderLimitedInRound bool
+	lossInRound          bool
+
+	fullBandwidthReached bool
+	fullBandwidth        uint64
+	fullBandwidthRounds  int
+
+	minRTT     time.Duration
+	minRTTTime time.Time
+	rttUpdated bool
+
+	cycleIndex     int
+	cycleStartTime time.Time
+
+	probeRTTDoneTime         time.Time
+	probeRTTRoundDone        bool
+	congestionWindowPreProbe quicCongestion.ByteCount
+
+	inRecovery        bool
+	recoveryEndPacket quicCongestion.PacketNumber
+	recoveryWindow    quicCongestion.ByteCount
+}
+
+var _ quicCongestion.CongestionControl = new(bbrSender)
+
+func NewBBRSender(rttStats *quicCongestion.RTTStats, initialMaxDatagramSize quicCongestion.ByteCount) quicCongestion.CongestionControl {
+	s := &bbrSender{rttStats: rttStats, maxDatagramSize: initialMaxDatagramSize, mode: bbrStartup,
+		pacingGain: bbrStartupGain, cwndGain: bbrStartupGain,
+		congestionWindow: initialCongestionWindowSize * initialMaxDatagramSize,
+		sentPackets:      make(map[quicCongestion.PacketNumber]*bbrSentPacket)}
+	s.pacer = newPacer(initialMaxDatagramSize, s.pacingRate)
+	return s
+}
+
+func (s *bbrSender) TimeUntilSend(_ quicCongestion.ByteCount) time.Time {
+	return s.pacer.timeUntilSend()
+}
+
+func (s *bbrSender) HasPacingBudget(now time.Time) bool {
+	if s.pacer.budget(now) < s.maxDatagramSize {
+		s.senderLimitedInRound = true
+		return false
+	}
+	return true
+}
+
+func (s *bbrSender) OnPacketSent(sentTime time.Time, bytesInFlight quicCongestion.ByteCount,
+	packetNumber quicCongestion.PacketNumber, bytes quicCongestion.ByteCount, isRetransmittable bool) {
+	s.pacer.sentPacket(sentTime, bytes)
+	if !isRetransmittable {
+		return
+	}
+	s.bytesInFlight = bytesInFlight
+	s.largestSentPacket = max(s.largestSentPacket, packetNumber)
+	if bytesInFlight <= bytes {
+		// the first packet sent after idle starts a new sending interval
+		s.firstSentTime = sentTime
+		s.deliveredTime = sentTime
+	}
+	s.sentPackets[packetNumber] = &bbrSentPacket{sentTime: sentTime, delivered: s.delivered,
+		deliveredTime: s.deliveredTime, firstSentTime: s.firstSentTime}
+}
+
+func (s *bbrSender) CanSend(bytesInFlight quicCongestion.ByteCount) bool {
+	if bytesInFlight < s.GetCongestionWindow() {
+		return true
+	}
+	s.senderLimitedInRound = true
+	return false
+}
+
+// quic-go calls it after updating the RTT stats with a new sample
+
+func (s *bbrSender) MaybeExitSlowStart() {
+	s.rttUpdated = true
+}
+
+func (s *bbrSender) OnPacketAcked(number quicCongestion.PacketNumber, ackedBytes quicCongestion.ByteCount,
+	_ quicCongestion.ByteCount, eventTime time.Time) {
+	s.bytesInFlight = max(s.bytesInFlight-ackedBytes, 0)
+	roundStart := s.sampleBandwidth(number, ackedBytes, eventTime)
+	if roundStart {
+		s.checkFullBandwidthReached()
+		s.senderLimitedInRound = false
+		s.lossInRound = false
+		s.removeExpiredSentPackets(eventTime)
+	}
+	s.updateMinRTT(eventTime)
+	s.updateMode(eventTime, roundStart)
+	s.updateRecovery(number, ackedBytes)
+	s.updateCongestionWindow(ackedBytes)
+}
+
+// returns whether a new round trip starts
+
+func (s *bbrSender) sampleBandwidth(number quicCongestion.PacketNumber, ackedBytes quicCongestion.ByteCount, eventTime time.Time) bool {
+	s.delivered += ackedBytes
+	s.deliveredTime = eventTime
+	packet, ok := s.sentPackets[number]
+	if !ok {
+		return false
+	}
+	delete(s.sentPackets, number)
+	s.firstSentTime = packet.sentTime
+
+	interval := max(packet.sentTime.Sub(packet.firstSentTime), eventTime.Sub(packet.deliveredTime))
+	// a sample in a shorter interval than the min RTT may be inflated by the ACK compression
+	if interval > 0 && interval >= s.minRTT {
+		bandwidth := uint64(float64(s.delivered-packet.delivered) / interval.Seconds())
+		s.bandwidthFilter.update(bandwidth, s.round)
+	}
+	if packet.delivered >= s.nextRoundDelivered {
+		s.nextRoundDelivered = s.delivered
+		s.round++
+		return true
+	}
+	return false
+}
+
+func (s *bbrSender) checkFullBandwidthReached() {
+	// the bandwidth doesn't grow because the app doesn't send more
+	if s.fullBandwidthReached || !s.senderLimitedInRound {
+		return
+	}
+	bandwidth := s.bandwidth()
+	if float64(bandwidth) >= float64(s.fullBandwidth)*bbrFullBandwidthThreshold {
+		s.fullBandwidth = bandwidth
+		s.fullBandwidthRounds = 0
+		return
+	}
+	s.fullBandwidthRounds++
+	s.fullBandwidthReached = s.fullBandwidthRounds >= bbrFullBandwidthRounds
+}
+
+func (s *bbrSender) updateMinRTT(eventTime time.Time) {
+	if !s.rttUpdated {
+		return
+	}
+	s.rttUpdated = false
+	sample := s.rttStats.LatestRTT()
+	expired := !s.minRTTTime.IsZero() && eventTime.Sub(s.minRTTTime) > bbrMinRTTExpiry
+	if s.minRTT == 0 || sample <= s.minRTT || expired {
+		s.minRTT = sample
+		s.minRTTTime = eventTime
+	}
+	if expired && s.mode != bbrProbeRTT {
+		s.mode = bbrProbeRTT
+		s.pacingGain = 1
+		s.cwndGain = 1
+		s.probeRTTDoneTime = time.Time{}
+		s.congestionWindowPreProbe = s.congestionWindow
+	}
+}
+
+func (s *bbrSender) updateMode(eventTime time.Time, roundStart bool) {
+	switch s.mode {
+	case bbrStartup:
+		if s.fullBandwidthReached {
+			s.mode = bbrDrain
+			s.pacingGain = bbrDrainGain
+		}
+	case bbrDrain:
+		if s.bytesInFlight <= s.targetWindow(1) {
+			s.enterProbeBandwidth(eventTime)
+		}
+	case bbrProbeBandwidth:
+		if s.isNextCyclePhase(eventTime) {
+			s.cycleIndex = (s.cycleIndex + 1) % len(bbrPacingGainCycle)
+			s.cycleStartTime = eventTime
+			s.pacingGain = bbrPacingGainCycle[s.cycleIndex]
+		}
+	case bbrProbeRTT:
+		if s.probeRTTDoneTime.IsZero() {
+			if s.bytesInFlight <= s.minCongestionWindow() {
+				s.probeRTTDoneTime = eventTime.Add(bbrProbeRTTDuration)
+				s.probeRTTRoundDone = false
+				s.nextRoundDelivered = s.delivered
+			}
+			return
+		}
+		if roundStart {
+			s.probeRTTRoundDone = true
+		}
+		if s.probeRTTRoundDone && !eventTime.Before(s.probeRTTDoneTime) {
+			s.minRTTTime = eventTime
+			s.congestionWindow = max(s.congestionWindow, s.congestionWindowPreProbe)
+			if s.fullBandwidthReached {
+				s.enterProbeBandwidth(eventTime)
+			} else {
+				s.mode = bbrStartup
+				s.pacingGain = bbrStartupGain
+				s.cwndGain = bbrStartupGain
+			}
+		}
+	}
+}
+
+func (s *bbrSender) enterProbeBandwidth(eventTime time.Time) {
+	s.mode = bbrProbeBandwidth
+	s.cwndGain = bbrProbeBandwidthCwndGain
+	// starts with a random phase except the draining one
+	s.cycleIndex = rand.IntN(len(bbrPacingGainCycle) - 1)
+	if s.cycleIndex >= 1 {
+		s.cycleIndex++
+	}
+	s.cycleStartTime = eventTime
+	s.pacingGain = bbrPacingGainCycle[s.cycleIndex]
+}
+
+func (s *bbrSender) isNextCyclePhase(eventTime time.Time) bool {
+	fullLength := eventTime.Sub(s.cycleStartTime) > s.minRTT
+	switch {
+	case s.pacingGain > 1:
+		return fullLength && (s.lossInRound || s.bytesInFlight >= s.targetWindow(s.pacingGain))
+	case s.pacingGain < 1:
+		return fullLength || s.bytesInFlight <= s.targetWindow(1)
+	default:
+		return fullLength
+	}
+}
+
+func (s *bbrSender) updateRecovery(number quicCongestion.PacketNumber, ackedBytes quicCongestion.ByteCount) {
+	if !s.inRecovery {
+		return
+	}
+	if number > s.recoveryEndPacket {
+		s.inRecovery = false
+		return
+	}
+	// the packet conservation, which sends one packet for one acknowledged
+	s.recoveryWindow = max(s.recoveryWindow+ackedBytes, s.bytesInFlight+ackedBytes, s.minCongestionWindow())
+}
+
+func (s *bbrSender) updateCongestionWindow(ackedBytes quicCongestion.ByteCount) {
+	if s.mode == bbrProbeRTT {
+		return
+	}
+	target := s.targetWindow(s.cwndGain)
+	if s.fullBandwidthReached {
+		s.congestionWindow = min(s.congestionWindow+ackedBytes, target)
+	} else if s.congestionWindow < target || s.delivered < initialCongestionWindowSize*s.maxDatagramSize {
+		s.congestionWindow += ackedBytes
+	}
+	s.congestionWindow = min(max(s.congestionWindow, s.minCongestionWindow()), s.maxCongestionWindow())
+}
+
+func (s *bbrSender) OnCongestionEvent(number quicCongestion.PacketNumber, lostBytes quicCongestion.ByteCount,
+	priorInFlight quicCongestion.ByteCount) {
+	// BBR v1 doesn't respond to the ECN marks, which are reported without lost bytes
+	if lostBytes == 0 {
+		return
+	}
+	delete(s.sentPackets, number)
+	s.bytesInFlight = max(s.bytesInFlight-lostBytes, 0)
+	s.lossInRound = true
+	if !s.inRecovery {
+		s.inRecovery = true
+		s.recoveryEndPacket = s.largestSentPacket
+		s.recoveryWindow = max(priorInFlight-lostBytes, s.minCongestionWindow())
+		return
+	}
+	s.recoveryWindow = max(s.recoveryWindow-lostBytes, s.minCongestionWindow())
+}
+
+func (s *bbrSender) OnRetransmissionTimeout(packetsRetransmitted bool) {
+	if packetsRetransmitted {
+		s.inRecovery = false
+	}
+}
+
+func (s *bbrSender) SetMaxDatagramSize(size quicCongestion.ByteCount) {
+	if size < s.maxDatagramSize {
+		// quic-go's path MTU discovery only increases it
+		return
+	}
+	s.congestionWindow = s.congestionWindow / s.maxDatagramSize * size
+	s.maxDatagramSize = size
+	s.pacer.maxDatagramSize = size
+}
+
+func (s *bbrSender) InSlowStart() bool {
+	return s.mode == bbrStartup
+}
+
+func (s *bbrSender) InRecovery() bool {
+	return s.inRecovery
+}
+
+func (s *bbrSender) GetCongestionWindow() quicCongestion.ByteCount {
+	congestionWindow := s.congestionWindow
+	if s.mode == bbrProbeRTT {
+		congestionWindow = min(congestionWindow, s.minCongestionWindow())
+	}
+	if s.inRecovery {
+		congestionWindow = min(congestionWindow, s.recoveryWindow)
+	}
+	return congestionWindow
+}
+
+// the estimated bottleneck bandwidth in bytes per second
+
+func (s *bbrSender) bandwidth() uint64 {
+	return s.bandwidthFilter.get(s.round)
+}
+
+func (s *bbrSender) pacingRate() uint64 {
+	bandwidth := s.bandwidth()
+	if bandwidth == 0 {
+		rtt := s.rttStats.SmoothedRTT()
+		if rtt == 0 {
+			rtt = defaultInitialRTT
+		}
+		bandwidth = uint64(float64(initialCongestionWindowSize*s.maxDatagramSize) / rtt.Seconds())
+	}
+	return uint64(float64(bandwidth) * s.pacingGain)
+}
+
+// the estimated BDP (bandwidth-delay product) multiplied by the 'gain', with the allowance for the delayed and
+// aggregated ACKs
+
+func (s *bbrSender) targetWindow(gain float64) quicCongestion.ByteCount {
+	bandwidth := s.bandwidth()
+	if bandwidth == 0 || s.minRTT == 0 {
+		return initialCongestionWindowSize * s.maxDatagramSize
+	}
+	bdp := quicCongestion.ByteCount(float64(bandwidth) * s.minRTT.Seconds() * gain)
+	return bdp + 3*s.maxDatagramSize
+}
+
+func (s *bbrSender) minCongestionWindow() quicCongestion.ByteCount {
+	return minCongestionWindowSize * s.maxDatagramSize
+}
+
+func (s *bbrSender) maxCongestionWindow() quicCongestion.ByteCount {
+	return maxCongestionWindowSize * s.maxDatagramSize
+}
+
+func (s *bbrSender) removeExpiredSentPackets(now time.Time) {
+	for number, packet := range s.sentPackets {
+		if now.Sub(packet.sentTime) > bbrSentPacketExpiry {
+			delete(s.sentPackets, number)
+		}
+	}
+}
+
+// maxBandwidthFilter keeps the max bandwidth sample of each recent round trip
+
+type maxBandwidthFilter struct {
+	rounds  [bbrBandwidthFilterRounds]uint64
+	samples [bbrBandwidthFilterRounds]uint64
+}
+
+func (f *maxBandwidthFilter) update(bandwidth uint64, round uint64) {
+	i := round % bbrBandwidthFilterRounds
+	if f.rounds[i] != round {
+		f.rounds[i] = round
+		f.samples[i] = 0
+	}
+	f.samples[i] = max(f.samples[i], bandwidth)
+}
+
+func (f *maxBandwidthFilter) get(round uint64) uint64 {
+	var bandwidth uint64
+	for i, sampleRound := range f.rounds {
+		if sampleRound+bbrBandwidthFilterRounds > round {
+			bandwidth = max(bandwidth, f.samples[i])
+		}
+	}
+	return bandwidth
+}
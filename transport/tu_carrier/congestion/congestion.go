@@ -0,0 +1,16 @@
+// Package congestion implements the congestion controls of the QUIC carrier other than quic-go's default CUBIC,
+// which are plugged into quic-go by the 'CongestionControl' field of quic.Config in the quic-go fork of 'third_party'.
+package congestion
+
+import "time"
+
+// in the max datagram sizes
+const (
+	initialCongestionWindowSize = 32
+	minCongestionWindowSize     = 4
+	// the same as quic-go's limit of the packets in flight
+	maxCongestionWindowSize = 10000
+)
+
+// before the first RTT sample, the same as quic-go's
+const defaultInitialRTT = 100 * time.Millisecond
@@ -0,0 +1,145 @@
+package congestion
+
+import (
+	"time"
+
+	quicCongestion "github.com/quic-go/quic-go/congestion"
+)
+
+// the fixed-rate congestion control (like Hysteria's Brutal) sends at the configured rate whatever the packet losses are,
+// and raises the sending rate by the loss rate in the recent seconds, so the received rate is still the configured one.
+// It's only for the links whose bandwidth is known, or it causes more congestion and losses.
+
+const (
+	fixedRateLossWindowSeconds = 5
+	// the samples are too few to estimate the loss rate
+	fixedRateMinSamples = 50
+	// limits the sending rate to 1.25x of the configured rate
+	fixedRateMinAckRate = 0.8
+	// the congestion window is the BDP (bandwidth-delay product) multiplied by it
+	fixedRateCwndGain = 2
+)
+
+type fixedRateSender struct {
+	rttStats        *quicCongestion.RTTStats
+	maxDatagramSize quicCongestion.ByteCount
+	pacer           *pacer
+	// in bytes per second
+	rate uint64
+
+	// the acknowledged and lost packets in the recent seconds, which are indexed by the Unix second mod the window
+	slots [fixedRateLossWindowSeconds]fixedRateSlot
+	// the ack rate is updated when the packets are acknowledged or lost
+	ackRate     float64
+	lastAckTime time.Time
+}
+
+type fixedRateSlot struct {
+	second int64
+	acked  uint64
+	lost   uint64
+}
+
+var _ quicCongestion.CongestionControl = new(fixedRateSender)
+
+// FixedRate returns the factory of the fixed-rate congestion control which sends at 'rate' bytes per second
+
+func FixedRate(rate uint64) quicCongestion.Factory {
+	return func(rttStats *quicCongestion.RTTStats, initialMaxDatagramSize quicCongestion.ByteCount) quicCongestion.CongestionControl {
+		s := &fixedRateSender{rttStats: rttStats, maxDatagramSize: initialMaxDatagramSize, rate: rate, ackRate: 1}
+		s.pacer = newPacer(initialMaxDatagramSize, s.pacingRate)
+		return s
+	}
+}
+
+func (s *fixedRateSender) TimeUntilSend(_ quicCongestion.ByteCount) time.Time {
+	return s.pacer.timeUntilSend()
+}
+
+func (s *fixedRateSender) HasPacingBudget(now time.Time) bool {
+	return s.pacer.budget(now) >= s.maxDatagramSize
+}
+
+func (s *fixedRateSender) OnPacketSent(sentTime time.Time, _ quicCongestion.ByteCount, _ quicCongestion.PacketNumber,
+	bytes quicCongestion.ByteCount, _ bool) {
+	s.pacer.sentPacket(sentTime, bytes)
+}
+
+func (s *fixedRateSender) CanSend(bytesInFlight quicCongestion.ByteCount) bool {
+	return bytesInFlight < s.GetCongestionWindow()
+}
+
+func (s *fixedRateSender) MaybeExitSlowStart() {}
+
+func (s *fixedRateSender) OnPacketAcked(_ quicCongestion.PacketNumber, _ quicCongestion.ByteCount, _ quicCongestion.ByteCount,
+	eventTime time.Time) {
+	s.lastAckTime = eventTime
+	s.slotOf(eventTime.Unix()).acked++
+	s.updateAckRate(eventTime.Unix())
+}
+
+func (s *fixedRateSender) OnCongestionEvent(_ quicCongestion.PacketNumber, lostBytes quicCongestion.ByteCount,
+	_ quicCongestion.ByteCount) {
+	// the ECN marks are reported without lost bytes, and they're ignored like the losses
+	if lostBytes == 0 {
+		return
+	}
+	// quic-go doesn't report the loss time, and the packets are mostly declared lost when an ACK is received
+	lossTime := s.lastAckTime
+	if lossTime.IsZero() {
+		lossTime = time.Now()
+	}
+	s.slotOf(lossTime.Unix()).lost++
+	s.updateAckRate(lossTime.Unix())
+}
+
+func (s *fixedRateSender) slotOf(second int64) *fixedRateSlot {
+	slot := &s.slots[second%fixedRateLossWindowSeconds]
+	if slot.second != second {
+		*slot = fixedRateSlot{second: second}
+	}
+	return slot
+}
+
+func (s *fixedRateSender) updateAckRate(now int64) {
+	var acked, lost uint64
+	for _, slot := range s.slots {
+		if now-slot.second < fixedRateLossWindowSeconds {
+			acked += slot.acked
+			lost += slot.lost
+		}
+	}
+	if acked+lost < fixedRateMinSamples {
+		s.ackRate = 1
+		return
+	}
+	s.ackRate = max(float64(acked)/float64(acked+lost), fixedRateMinAckRate)
+}
+
+func (s *fixedRateSender) OnRetransmissionTimeout(bool) {}
+
+func (s *fixedRateSender) SetMaxDatagramSize(size quicCongestion.ByteCount) {
+	s.maxDatagramSize = size
+	s.pacer.maxDatagramSize = size
+}
+
+func (s *fixedRateSender) InSlowStart() bool {
+	return false
+}
+
+func (s *fixedRateSender) InRecovery() bool {
+	return false
+}
+
+func (s *fixedRateSender) GetCongestionWindow() quicCongestion.ByteCount {
+	rtt := s.rttStats.SmoothedRTT()
+	if rtt == 0 {
+		rtt = defaultInitialRTT
+	}
+	congestionWindow := quicCongestion.ByteCount(float64(s.rate) * rtt.Seconds() * fixedRateCwndGain / s.ackRate)
+	return min(max(congestionWindow, minCongestionWindowSize*s.maxDatagramSize), maxCongestionWindowSize*s.maxDatagramSize)
+}
+
+func (s *fixedRateSender) pacingRate() uint64 {
+	return uint64(float64(s.rate) / s.ackRate)
+}
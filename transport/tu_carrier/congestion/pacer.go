@@ -0,0 +1,68 @@
+package congestion
+
+import (
+	"time"
+
+	quicCongestion "github.com/quic-go/quic-go/congestion"
+)
+
+const (
+	maxBurstPackets = 10
+	// the same as quic-go's minimum pacing delay and timer granularity
+	minPacingDelay   = time.Millisecond
+	timerGranularity = time.Millisecond
+)
+
+// pacer is a token bucket which is refilled at the rate of 'bandwidth' in bytes per second,
+// the same as quic-go's pacer for its default congestion control
+
+type pacer struct {
+	budgetAtLastSent quicCongestion.ByteCount
+	maxDatagramSize  quicCongestion.ByteCount
+	lastSentTime     time.Time
+	bandwidth        func() uint64
+}
+
+func newPacer(maxDatagramSize quicCongestion.ByteCount, bandwidth func() uint64) *pacer {
+	p := &pacer{maxDatagramSize: maxDatagramSize, bandwidth: bandwidth}
+	p.budgetAtLastSent = p.maxBurstSize()
+	return p
+}
+
+func (p *pacer) sentPacket(sentTime time.Time, size quicCongestion.ByteCount) {
+	budget := p.budget(sentTime)
+	if size >= budget {
+		p.budgetAtLastSent = 0
+	} else {
+		p.budgetAtLastSent = budget - size
+	}
+	p.lastSentTime = sentTime
+}
+
+func (p *pacer) budget(now time.Time) quicCongestion.ByteCount {
+	if p.lastSentTime.IsZero() {
+		return p.maxBurstSize()
+	}
+	maxBurstSize := p.maxBurstSize()
+	// in float64 to avoid overflows after a long idle time
+	refilled := min(float64(p.bandwidth())*now.Sub(p.lastSentTime).Seconds(), float64(maxBurstSize))
+	return min(maxBurstSize, p.budgetAtLastSent+quicCongestion.ByteCount(refilled))
+}
+
+func (p *pacer) maxBurstSize() quicCongestion.ByteCount {
+	return max(quicCongestion.ByteCount(uint64(minPacingDelay+timerGranularity)*p.bandwidth()/uint64(time.Second)),
+		maxBurstPackets*p.maxDatagramSize)
+}
+
+// returns the zero time if a packet can be sent now
+
+func (p *pacer) timeUntilSend() time.Time {
+	if p.budgetAtLastSent >= p.maxDatagramSize {
+		return time.Time{}
+	}
+	bandwidth := max(p.bandwidth(), 1)
+	missing := uint64(p.maxDatagramSize-p.budgetAtLastSent) * uint64(time.Second)
+	// rounds up, so the budget is enough for a packet when the timer fires
+	delay := time.Duration((missing + bandwidth - 1) / bandwidth)
+	return p.lastSentTime.Add(max(minPacingDelay, delay))
+}
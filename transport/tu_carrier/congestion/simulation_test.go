@@ -0,0 +1,140 @@
+package congestion
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	quicCongestion "github.com/quic-go/quic-go/congestion"
+	"github.com/stretchr/testify/assert"
+)
+
+// simulatedLink is a bottleneck link with a FIFO queue, where the lost packets are found when their ACKs should arrive
+
+type simulatedLink struct {
+	// in bytes per second
+	bandwidth uint64
+	rtt       time.Duration
+	lossRate  float64
+}
+
+type simulatedPacket struct {
+	number   quicCongestion.PacketNumber
+	sentTime time.Time
+	ackTime  time.Time
+	lost     bool
+}
+
+type simulationResult struct {
+	// in bytes per second in the second half of the simulation
+	goodput uint64
+	// the max queuing delay in the second half of the simulation
+	maxQueuingDelay time.Duration
+}
+
+const simulatedPacketSize = quicCongestion.InitialPacketSize
+
+func simulate(newSender quicCongestion.Factory, link simulatedLink, duration time.Duration) (quicCongestion.CongestionControl, simulationResult) {
+	rttStats := new(quicCongestion.RTTStats)
+	sender := newSender(rttStats, simulatedPacketSize)
+	random := rand.New(rand.NewPCG(1, 2))
+	start := time.Unix(1700000000, 0)
+	half, end := start.Add(duration/2), start.Add(duration)
+
+	var result simulationResult
+	var packets []simulatedPacket
+	var nextNumber quicCongestion.PacketNumber
+	var bytesInFlight, acked quicCongestion.ByteCount
+	linkFreeTime := start
+	for now := start; now.Before(end); {
+		for len(packets) > 0 && !packets[0].ackTime.After(now) {
+			packet := packets[0]
+			packets = packets[1:]
+			priorInFlight := bytesInFlight
+			bytesInFlight -= simulatedPacketSize
+			if packet.lost {
+				sender.OnCongestionEvent(packet.number, simulatedPacketSize, priorInFlight)
+				continue
+			}
+			rttStats.UpdateRTT(packet.ackTime.Sub(packet.sentTime), 0, packet.ackTime)
+			sender.MaybeExitSlowStart()
+			sender.OnPacketAcked(packet.number, simulatedPacketSize, priorInFlight, packet.ackTime)
+			if packet.ackTime.After(half) {
+				acked += simulatedPacketSize
+			}
+		}
+
+		canSend := sender.CanSend(bytesInFlight)
+		if canSend && sender.HasPacingBudget(now) {
+			bytesInFlight += simulatedPacketSize
+			sender.OnPacketSent(now, bytesInFlight, nextNumber, simulatedPacketSize, true)
+			departureTime := laterTime(now, linkFreeTime).Add(time.Duration(uint64(simulatedPacketSize) * uint64(time.Second) / link.bandwidth))
+			if now.After(half) {
+				result.maxQueuingDelay = max(result.maxQueuingDelay, linkFreeTime.Sub(now))
+			}
+			linkFreeTime = departureTime
+			packets = append(packets, simulatedPacket{number: nextNumber, sentTime: now,
+				ackTime: departureTime.Add(link.rtt), lost: random.Float64() < link.lossRate})
+			nextNumber++
+			continue
+		}
+
+		next := end
+		if len(packets) > 0 {
+			next = packets[0].ackTime
+		}
+		if canSend {
+			if sendTime := sender.TimeUntilSend(bytesInFlight); sendTime.Before(next) {
+				next = sendTime
+			}
+		}
+		now = laterTime(next, now.Add(time.Microsecond))
+	}
+	result.goodput = uint64(acked) * uint64(time.Second) / uint64(duration/2)
+	return sender, result
+}
+
+func laterTime(t1, t2 time.Time) time.Time {
+	if t1.After(t2) {
+		return t1
+	}
+	return t2
+}
+
+func TestBBRSender(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		link simulatedLink
+	}{
+		{"without losses", simulatedLink{bandwidth: 10_000_000, rtt: 50 * time.Millisecond}},
+		{"with random losses", simulatedLink{bandwidth: 10_000_000, rtt: 200 * time.Millisecond, lossRate: 0.02}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, result := simulate(NewBBRSender, tt.link, 20*time.Second)
+			bbr := sender.(*bbrSender)
+			assert.Equal(t, bbrProbeBandwidth, bbr.mode)
+			assert.InEpsilon(t, tt.link.bandwidth, bbr.bandwidth(), 0.1)
+			assert.Greater(t, float64(result.goodput), float64(tt.link.bandwidth)*(1-tt.link.lossRate)*0.85)
+			// the congestion window is twice the BDP
+			assert.LessOrEqual(t, result.maxQueuingDelay, tt.link.rtt*5/4)
+		})
+	}
+}
+
+func TestFixedRateSender(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		link simulatedLink
+	}{
+		{"without losses", simulatedLink{bandwidth: 10_000_000, rtt: 50 * time.Millisecond}},
+		{"with random losses", simulatedLink{bandwidth: 10_000_000, rtt: 200 * time.Millisecond, lossRate: 0.1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var rate uint64 = 5_000_000
+			sender, result := simulate(FixedRate(rate), tt.link, 20*time.Second)
+			// the lost packets are made up by sending more
+			assert.InEpsilon(t, rate, result.goodput, 0.05)
+			assert.InEpsilon(t, 1/(1-tt.link.lossRate), float64(sender.(*fixedRateSender).pacingRate())/float64(rate), 0.05)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package tu_carrier
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/quic-go/quic-go"
+)
+
+// fallbackConn hands over a QUIC connection which fails to authenticate to an HTTP/3 server.
+// Our accept loops keep accepting the streams and pass them here, so the HTTP/3 server must not accept them itself.
+
+type fallbackConn struct {
+	quic.Connection
+	streams    chan quic.Stream
+	uniStreams chan quic.ReceiveStream
+}
+
+func newFallbackConn(quicConn quic.Connection) *fallbackConn {
+	return &fallbackConn{Connection: quicConn, streams: make(chan quic.Stream), uniStreams: make(chan quic.ReceiveStream)}
+}
+
+func (c *fallbackConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	select {
+	case stream := <-c.streams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.Context().Done():
+		return nil, context.Cause(c.Context())
+	}
+}
+
+func (c *fallbackConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case uniStream := <-c.uniStreams:
+		return uniStream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.Context().Done():
+		return nil, context.Cause(c.Context())
+	}
+}
+
+func (c *fallbackConn) addStream(stream quic.Stream) {
+	select {
+	case c.streams <- stream:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *fallbackConn) addUniStream(uniStream quic.ReceiveStream) {
+	select {
+	case c.uniStreams <- uniStream:
+	case <-c.Context().Done():
+	}
+}
+
+// the streams whose first bytes have been read to check the TUIC version
+
+type peekedStream struct {
+	quic.Stream
+	reader io.Reader
+}
+
+func newPeekedStream(stream quic.Stream, peeked []byte) *peekedStream {
+	return &peekedStream{Stream: stream, reader: io.MultiReader(bytes.NewReader(peeked), stream)}
+}
+
+func (s *peekedStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+type peekedReceiveStream struct {
+	quic.ReceiveStream
+	reader io.Reader
+}
+
+func newPeekedReceiveStream(uniStream quic.ReceiveStream, peeked []byte) *peekedReceiveStream {
+	return &peekedReceiveStream{ReceiveStream: uniStream, reader: io.MultiReader(bytes.NewReader(peeked), uniStream)}
+}
+
+func (s *peekedReceiveStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
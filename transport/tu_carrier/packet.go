@@ -0,0 +1,254 @@
+package tu_carrier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/quic-go/quic-go"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
+)
+
+/*
+https://github.com/EAimTY/tuic/blob/dev/SPEC.md#command-type-packet
++----------+--------+------------+---------+------+----------+----------+
+| ASSOC_ID | PKT_ID | FRAG_TOTAL | FRAG_ID | SIZE |   ADDR   |   DATA   |
++----------+--------+------------+---------+------+----------+----------+
+|    2     |   2    |     1      |    1    |  2   | Variable | Variable |
++----------+--------+------------+---------+------+----------+----------+
+Only the first fragment has the ADDR, others use the None address.
+
+Dissociate
++----------+
+| ASSOC_ID |
++----------+
+|    2     |
++----------+
+*/
+
+const (
+	// version + type + ASSOC_ID + PKT_ID + FRAG_TOTAL + FRAG_ID + SIZE
+	packetCommandHeaderSize = 1 + 1 + 2 + 2 + 1 + 1 + 2
+	maxFragmentCount        = 255
+	// the incomplete packets are dropped after this time
+	fragmentTimeout = 15 * time.Second
+	// the oldest incomplete packet is dropped for a new one when a QUIC connection has this many ones,
+	// so a peer which never completes its packets can't take up the memory until they expire
+	maxPendingPackets = 256
+)
+
+type packetFragment struct {
+	assocID   uint16
+	packetID  uint16
+	fragTotal byte
+	fragID    byte
+	// nil for the None address
+	addr *transport.SocketAddress
+	data []byte
+}
+
+func (f *packetFragment) sizeInBytes() int {
+	return packetCommandHeaderSize + tuicAddressSizeInBytes(f.addr) + len(f.data)
+}
+
+func (f *packetFragment) writeTo(buf *bytes.Buffer) {
+	buf.WriteByte(tuicVersion)
+	buf.WriteByte(packetCommandType)
+	_ = binary.Write(buf, binary.BigEndian, f.assocID)
+	_ = binary.Write(buf, binary.BigEndian, f.packetID)
+	buf.WriteByte(f.fragTotal)
+	buf.WriteByte(f.fragID)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(f.data)))
+	writeTUICAddress(buf, f.addr)
+	buf.Write(f.data)
+}
+
+// reads a packet command whose version and type have been read
+
+func readPacketFragment(r io.Reader) (*packetFragment, error) {
+	var header [packetCommandHeaderSize - 2]byte
+	_, err := ioutil.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	fragment := &packetFragment{
+		assocID:   binary.BigEndian.Uint16(header[0:]),
+		packetID:  binary.BigEndian.Uint16(header[2:]),
+		fragTotal: header[4],
+		fragID:    header[5],
+	}
+	if fragment.fragTotal == 0 || fragment.fragID >= fragment.fragTotal {
+		return nil, errors.Newf("invalid fragment %v of %v in the packet command", fragment.fragID, fragment.fragTotal)
+	}
+	fragment.addr, err = readTUICAddressOrNone(r)
+	if err != nil {
+		return nil, err
+	}
+	if fragment.fragID == 0 && fragment.addr == nil {
+		return nil, errors.New("no address in the first fragment of the packet command")
+	}
+	_, fragment.data, err = ioutil.ReadN(r, int(binary.BigEndian.Uint16(header[6:])))
+	if err != nil {
+		return nil, err
+	}
+	return fragment, nil
+}
+
+func readDissociateCommand(r io.Reader) (uint16, error) {
+	var assocID [2]byte
+	_, err := ioutil.ReadFull(r, assocID[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(assocID[:]), nil
+}
+
+func sendDissociateCommand(quicConn quic.Connection, assocID uint16) error {
+	stream, err := quicConn.OpenUniStream()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = stream.Write([]byte{tuicVersion, dissociateCommandType, byte(assocID >> 8), byte(assocID)})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(stream.Close())
+}
+
+// sends a packet over a QUIC stream, or over QUIC datagrams with fragmentation if it's too large for one datagram
+
+func sendPacket(quicConn quic.Connection, overStream bool, assocID, packetID uint16, addr *transport.SocketAddress, payload []byte) error {
+	fragment := &packetFragment{assocID: assocID, packetID: packetID, fragTotal: 1, addr: addr, data: payload}
+	if overStream {
+		stream, err := quicConn.OpenUniStream()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = writeFragment(stream, fragment)
+		if err != nil {
+			return err
+		}
+		return errors.WithStack(stream.Close())
+	}
+
+	err := sendFragmentDatagram(quicConn, fragment)
+	var tooLargeErr *quic.DatagramTooLargeError
+	if !errors.As(err, &tooLargeErr) {
+		return err
+	}
+	// every fragment uses the first fragment's header size, so they are all small enough
+	maxFragmentDataSize := int(tooLargeErr.MaxDatagramPayloadSize) - (fragment.sizeInBytes() - len(payload))
+	if maxFragmentDataSize <= 0 {
+		return errors.WithStack(err)
+	}
+	fragTotal := (len(payload) + maxFragmentDataSize - 1) / maxFragmentDataSize
+	if fragTotal > maxFragmentCount {
+		return errors.Newf("the UDP packet is too large to be fragmented: %v byte(s)", len(payload))
+	}
+	fragment.fragTotal = byte(fragTotal)
+	for i := range fragTotal {
+		fragment.fragID = byte(i)
+		if i > 0 {
+			fragment.addr = nil
+		}
+		fragment.data = payload[i*maxFragmentDataSize : min((i+1)*maxFragmentDataSize, len(payload))]
+		err = sendFragmentDatagram(quicConn, fragment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendFragmentDatagram(quicConn quic.Connection, fragment *packetFragment) error {
+	datagram := pool.Get(fragment.sizeInBytes())
+	defer pool.Put(datagram)
+	fragment.writeTo(bytes.NewBuffer(datagram[:0]))
+	// it's safe to put back the 'datagram' as the 'SendDatagram' copies it
+	return errors.WithStack(quicConn.SendDatagram(datagram))
+}
+
+func writeFragment(w io.Writer, fragment *packetFragment) error {
+	bs := pool.Get(fragment.sizeInBytes())
+	defer pool.Put(bs)
+	fragment.writeTo(bytes.NewBuffer(bs[:0]))
+	return errors.WithStack(ioutil.Write_(w, bs))
+}
+
+// packetAssembler reassembles the fragments of the packets from all associations of a QUIC connection
+
+type packetAssembler struct {
+	packets map[uint32]*fragmentedPacket
+	mutex   sync.Mutex
+}
+
+type fragmentedPacket struct {
+	addr          *transport.SocketAddress
+	fragments     [][]byte
+	receivedCount int
+	createdAt     time.Time
+}
+
+func newPacketAssembler() *packetAssembler {
+	return &packetAssembler{packets: make(map[uint32]*fragmentedPacket)}
+}
+
+// returns the packet's address and payload when all of its fragments are received
+
+func (a *packetAssembler) add(fragment *packetFragment) (*transport.SocketAddress, []byte, bool) {
+	if fragment.fragTotal == 1 {
+		return fragment.addr, fragment.data, true
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	key := uint32(fragment.assocID)<<16 | uint32(fragment.packetID)
+	packet, ok := a.packets[key]
+	if !ok || len(packet.fragments) != int(fragment.fragTotal) {
+		a.removeExpiredPackets()
+		if !ok && len(a.packets) >= maxPendingPackets {
+			a.removeOldestPacket()
+		}
+		packet = &fragmentedPacket{fragments: make([][]byte, fragment.fragTotal), createdAt: time.Now()}
+		a.packets[key] = packet
+	}
+	if packet.fragments[fragment.fragID] != nil {
+		return nil, nil, false
+	}
+	packet.fragments[fragment.fragID] = fragment.data
+	packet.receivedCount++
+	if fragment.addr != nil {
+		packet.addr = fragment.addr
+	}
+	if packet.receivedCount < len(packet.fragments) {
+		return nil, nil, false
+	}
+
+	delete(a.packets, key)
+	return packet.addr, bytes.Join(packet.fragments, nil), true
+}
+
+func (a *packetAssembler) removeOldestPacket() {
+	var oldestKey uint32
+	var oldest *fragmentedPacket
+	for key, packet := range a.packets {
+		if oldest == nil || packet.createdAt.Before(oldest.createdAt) {
+			oldestKey, oldest = key, packet
+		}
+	}
+	delete(a.packets, oldestKey)
+}
+
+func (a *packetAssembler) removeExpiredPackets() {
+	now := time.Now()
+	for key, packet := range a.packets {
+		if now.Sub(packet.createdAt) > fragmentTimeout {
+			delete(a.packets, key)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package tu_carrier
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/quic-go/quic-go"
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+)
+
+// the packets are dropped if the other side can't consume them in time
+const associationQueueSize = 64
+
+// packetConn is a UDP association, whose packets are dispatched by the QUIC connection
+
+type packetConn struct {
+	quicConn quic.Connection
+	assocID  uint16
+	packetID atomic.Uint32
+	// the client uses the configured UDP relay mode, and the server replies in the same mode as the client's last packet
+	overStream atomic.Bool
+
+	packets       chan *associationPacket
+	closed        chan struct{}
+	closeOnce     sync.Once
+	closeCallback func()
+}
+
+type associationPacket struct {
+	addr    *transport.SocketAddress
+	payload []byte
+}
+
+var _ transport.PacketConn = new(packetConn)
+
+func newPacketConn(quicConn quic.Connection, assocID uint16, overStream bool, closeCallback func()) *packetConn {
+	conn := &packetConn{quicConn: quicConn, assocID: assocID, packets: make(chan *associationPacket, associationQueueSize),
+		closed: make(chan struct{}), closeCallback: closeCallback}
+	conn.overStream.Store(overStream)
+	return conn
+}
+
+func (c *packetConn) deliver(addr *transport.SocketAddress, payload []byte) {
+	payloadCopy := pool.Get(len(payload))
+	copy(payloadCopy, payload)
+	select {
+	case c.packets <- &associationPacket{addr, payloadCopy}:
+	default:
+		pool.Put(payloadCopy)
+		logger.Debug("drop a packet over QUIC as the association's queue is full", "access", addr.ToHostStr())
+	}
+}
+
+func (c *packetConn) ReadPacket(b []byte) (int, *transport.SocketAddress, error) {
+	select {
+	case packet := <-c.packets:
+		n := copy(b, packet.payload)
+		pool.Put(packet.payload)
+		return n, packet.addr, nil
+	case <-c.closed:
+		return 0, nil, errors.WithStack(net.ErrClosed)
+	}
+}
+
+func (c *packetConn) WritePacket(b []byte, addr *transport.SocketAddress) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.WithStack(net.ErrClosed)
+	default:
+	}
+	packetID := uint16(c.packetID.Add(1) - 1)
+	err := sendPacket(c.quicConn, c.overStream.Load(), c.assocID, packetID, addr, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.closeCallback()
+	})
+	return nil
+}
+
+// associations are the UDP associations of a QUIC connection
+
+type associations struct {
+	conns map[uint16]*packetConn
+	mutex sync.Mutex
+}
+
+func newAssociations() *associations {
+	return &associations{conns: make(map[uint16]*packetConn)}
+}
+
+func (a *associations) get(assocID uint16) (*packetConn, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	conn, ok := a.conns[assocID]
+	return conn, ok
+}
+
+func (a *associations) remove(assocID uint16) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.conns, assocID)
+}
+
+func (a *associations) closeAllWhenDone(quicConn quic.Connection) {
+	<-quicConn.Context().Done()
+	a.mutex.Lock()
+	conns := make([]*packetConn, 0, len(a.conns))
+	for _, conn := range a.conns {
+		conns = append(conns, conn)
+	}
+	a.mutex.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,50 @@
+package tu_carrier
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketAssembler(t *testing.T) {
+	assembler := newPacketAssembler()
+	addr := transport.NewSocketAddressByDomain("example.com", 53)
+	_, _, ok := assembler.add(&packetFragment{assocID: 1, packetID: 1, fragTotal: 2, fragID: 1, data: []byte("world")})
+	assert.False(t, ok)
+	// a repeated fragment is ignored
+	_, _, ok = assembler.add(&packetFragment{assocID: 1, packetID: 1, fragTotal: 2, fragID: 1, data: []byte("world")})
+	assert.False(t, ok)
+	packetAddr, payload, ok := assembler.add(&packetFragment{assocID: 1, packetID: 1, fragTotal: 2, fragID: 0, addr: addr,
+		data: []byte("hello ")})
+	assert.True(t, ok)
+	assert.Equal(t, addr, packetAddr)
+	assert.Equal(t, "hello world", string(payload))
+	assert.Empty(t, assembler.packets)
+}
+
+// the incomplete packets are capped for each QUIC connection, and the oldest one is dropped for a new one
+
+func TestPacketAssemblerEvictsOldestPacket(t *testing.T) {
+	assembler := newPacketAssembler()
+	startedAt := time.Now()
+	for packetID := range uint16(maxPendingPackets + 1) {
+		_, _, ok := assembler.add(&packetFragment{assocID: 1, packetID: packetID, fragTotal: 2, fragID: 1, data: []byte("b")})
+		assert.False(t, ok)
+		// the packets can be created in the same clock tick
+		if packet, ok := assembler.packets[1<<16|uint32(packetID)]; ok {
+			packet.createdAt = startedAt.Add(time.Duration(packetID) * time.Millisecond)
+		}
+	}
+	assert.Len(t, assembler.packets, maxPendingPackets)
+
+	addr := transport.NewSocketAddressByDomain("example.com", 53)
+	// the first packet is dropped, so its last fragment starts it over
+	_, _, ok := assembler.add(&packetFragment{assocID: 1, packetID: 0, fragTotal: 2, fragID: 0, addr: addr, data: []byte("a")})
+	assert.False(t, ok)
+	_, payload, ok := assembler.add(&packetFragment{assocID: 1, packetID: maxPendingPackets, fragTotal: 2, fragID: 0, addr: addr,
+		data: []byte("a")})
+	assert.True(t, ok)
+	assert.Equal(t, "ab", string(payload))
+}
@@ -1,44 +1,55 @@
 package tu_carrier
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/transport/socks"
+	"github.com/ringo-is-a-color/heteroglossia/transport/tu_carrier/congestion"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/log"
 	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 )
 
 const (
 	tuicVersion byte = 5
 
-	authCommandType      byte = 0
-	connectCommandType   byte = 0x01
-	heartbeatCommandType byte = 0x04
+	authCommandType       byte = 0
+	connectCommandType    byte = 0x01
+	packetCommandType     byte = 0x02
+	dissociateCommandType byte = 0x03
+	heartbeatCommandType  byte = 0x04
 
 	// label should begin with 'EXPORTER' according to https://datatracker.ietf.org/doc/html/rfc5705#section-4
+	// it's used as the UUID by an hg client, while a standard TUIC client uses its user's UUID
 	authCommandUUID      = "EXPORTER_hg_QUIC" // needs to be 16 bytes
 	authCommandUUIDSize  = len(authCommandUUID)
 	authCommandTokenSize = 32
 	authCommandDataSize  = authCommandUUIDSize + authCommandTokenSize
 
-	authCommandSendErrCode           = 0x00
-	authCommandSendErrStr            = "Fail to send an authentication command"
-	authCommandReceiveTimeoutErrCode = 0x01
-	connectCommandSendErrCode        = 0x10
-	connectCommandSendErrStr         = "Fail to send a connect command"
-	heartbeatCommandSendErrCode      = 0x40
-	heartbeatCommandSendErrStr       = "Fail to send a heartbeat command"
-	handleUniStreamErrCode           = 0x100
-	handleUniStreamErrStr            = "Fail to handle a unidirectional command"
-	receiveDatagramErrCode           = 0x104
-	receiveDatagramStreamErrStr      = "Fail to receive a datagram"
-	handleDatagramErrCode            = 0x105
-	handleDatagramStreamErrStr       = "Fail to handle a datagram"
-	connectionContextDoneErrCode     = 0x110
-	connectionContextDoneErrStr      = "connection's context is done"
+	authCommandSendErrCode       = 0x00
+	authCommandSendErrStr        = "Fail to send an authentication command"
+	connectCommandSendErrCode    = 0x10
+	connectCommandSendErrStr     = "Fail to send a connect command"
+	heartbeatCommandSendErrCode  = 0x40
+	heartbeatCommandSendErrStr   = "Fail to send a heartbeat command"
+	handleUniStreamErrCode       = 0x100
+	handleUniStreamErrStr        = "Fail to handle a unidirectional command"
+	receiveDatagramErrCode       = 0x104
+	receiveDatagramStreamErrStr  = "Fail to receive a datagram"
+	handleDatagramErrCode        = 0x105
+	handleDatagramStreamErrStr   = "Fail to handle a datagram"
+	connectionContextDoneErrCode = 0x110
+	connectionContextDoneErrStr  = "connection's context is done"
+	connectionDrainedErrCode     = 0x111
+	connectionDrainedErrStr      = "connection is drained"
 
 	authTimeout = 7 * time.Second
 )
@@ -46,6 +57,8 @@ const (
 var (
 	authCommandReceiveTimeoutErrStr = fmt.Sprintf("fail to receive authentication command in %v", authTimeout)
 	heartbeatInterval               = netutil.KeepAlive
+	routeCheckInterval              = 5 * time.Second
+	logger                          = log.NewLogger("tu_carrier")
 
 	quicClientConfig = &quic.Config{
 		EnableDatagrams:       true,
@@ -55,12 +68,44 @@ var (
 
 	quicServerConfig = &quic.Config{
 		EnableDatagrams:       true,
+		Allow0RTT:             true,
 		MaxIncomingStreams:    1 << 60,
 		MaxIncomingUniStreams: 1 << 60,
 		MaxIdleTimeout:        netutil.IdleTimeout,
 	}
 )
 
+// the max windows are the limits of quic-go's auto-tuning, and quic-go's defaults are used for the zero ones
+
+func quicConfigWithReceiveWindows(config *quic.Config, streamWindow, connectionWindow uint64) *quic.Config {
+	config = config.Clone()
+	config.MaxStreamReceiveWindow = streamWindow
+	config.MaxConnectionReceiveWindow = connectionWindow
+	return config
+}
+
+// quic-go's default CUBIC is used when it's not set
+
+func quicConfigWithCongestionControl(config *quic.Config, congestionControl string, fixedRate conf.Bytes) *quic.Config {
+	config = config.Clone()
+	switch congestionControl {
+	case conf.QUICCongestionControlBBR:
+		config.CongestionControl = congestion.NewBBRSender
+	case conf.QUICCongestionControlFixedRate:
+		config.CongestionControl = congestion.FixedRate(uint64(fixedRate))
+	}
+	return config
+}
+
+// the QUIC carrier uses HTTP/3's ALPN by default to look like an HTTP/3 site
+
+func quicALPN(alpn []string) []string {
+	if len(alpn) > 0 {
+		return alpn
+	}
+	return []string{http3.NextProtoH3}
+}
+
 func validateVersion(version byte) error {
 	if version != tuicVersion {
 		return errors.Newf("excepted version %v in the client authentication command, but got %v", tuicVersion, version)
@@ -68,9 +113,13 @@ func validateVersion(version byte) error {
 	return nil
 }
 
-func authToken(quicConn quic.Connection, password []byte) ([]byte, error) {
-	tls := quicConn.ConnectionState().TLS
-	return errors.WithStack2(tls.ExportKeyingMaterial(authCommandUUID, password, authCommandTokenSize))
+// https://github.com/EAimTY/tuic/blob/dev/SPEC.md#authenticate
+// the token is the TLS Keying Material Exporter's output with the UUID as the label and the password as the context
+
+func authToken(quicConn quic.Connection, uuid [authCommandUUIDSize]byte, password []byte) ([]byte, error) {
+	// the exporter of quic-go's connection state also works with the fingerprinted TLS handshake
+	exportKeyingMaterial := quicConn.ConnectionState().ExportKeyingMaterial
+	return errors.WithStack2(exportKeyingMaterial(string(uuid[:]), password, authCommandTokenSize))
 }
 
 const (
@@ -91,3 +140,52 @@ var tuicAddressType = [3]byte{tuicAddressTypeIpv4, tuicAddressTypeIpv6, tuicAddr
 func readTUICAddress(r io.Reader) (*transport.SocketAddress, error) {
 	return transport.ReadAddressWithType(r, tuicAddressType)
 }
+
+// returns nil for the None address
+
+func readTUICAddressOrNone(r io.Reader) (*transport.SocketAddress, error) {
+	addressType, err := ioutil.Read1(r)
+	if err != nil {
+		return nil, err
+	}
+	if addressType == tuicAddressTypeNone {
+		return nil, nil
+	}
+	return readTUICAddress(io.MultiReader(bytes.NewReader([]byte{addressType}), r))
+}
+
+func tuicAddressSizeInBytes(addr *transport.SocketAddress) int {
+	if addr == nil {
+		return 1
+	}
+	return socks.SOCKSLikeAddrSizeInBytes(addr)
+}
+
+/*
+https://github.com/EAimTY/tuic/blob/dev/SPEC.md#address
++------+----------+----------+
+| TYPE |   ADDR   |   PORT   |
++------+----------+----------+
+|  1   | Variable |    2     |
++------+----------+----------+
+* 0xff: None, which has no ADDR and PORT
+* 0x00: fully-qualified domain name
+* 0x01: IPv4 address
+* 0x02: IPv6 address
+*/
+func writeTUICAddress(buf *bytes.Buffer, addr *transport.SocketAddress) {
+	if addr == nil {
+		buf.WriteByte(tuicAddressTypeNone)
+		return
+	}
+	typeIndex := buf.Len()
+	socks.WriteSOCKSLikeAddr(buf, addr)
+	switch addr.AddrType {
+	case transport.IPv4:
+		buf.Bytes()[typeIndex] = tuicAddressTypeIpv4
+	case transport.IPv6:
+		buf.Bytes()[typeIndex] = tuicAddressTypeIpv6
+	default:
+		buf.Bytes()[typeIndex] = tuicAddressTypeDomain
+	}
+}
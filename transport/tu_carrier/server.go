@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/tls"
 
+	"github.com/google/uuid"
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
@@ -14,15 +16,25 @@ import (
 type server struct {
 	hg           *conf.Hg
 	targetClient transport.Client
+	// the users with the 'tuic-uuid' for the standard TUIC clients
+	tuicUsers map[[authCommandUUIDSize]byte]conf.HgUser
 
-	tlsConfig                    *tls.Config
-	tlsBadAuthFallbackServerPort uint16
+	tlsConfig *tls.Config
+	// serves the QUIC connections which fail to authenticate
+	fallbackServer *http3.Server
 }
 
 var _ transport.Server = new(server)
 
 func NewServer(hg *conf.Hg, targetClient transport.Client) transport.Server {
-	return &server{hg: hg, targetClient: targetClient}
+	tuicUsers := make(map[[authCommandUUIDSize]byte]conf.HgUser)
+	for _, user := range hg.AllUsers() {
+		if user.TUICUUID != "" {
+			// the UUID is validated when parsing the config
+			tuicUsers[uuid.MustParse(user.TUICUUID)] = user
+		}
+	}
+	return &server{hg: hg, targetClient: targetClient, tuicUsers: tuicUsers}
 }
 
 func (s *server) ListenAndServe(ctx context.Context) error {
@@ -31,12 +43,24 @@ func (s *server) ListenAndServe(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	// the TLS config is shared with other carriers
+	s.tlsConfig = s.tlsConfig.Clone()
+	s.tlsConfig.NextProtos = quicALPN(s.hg.QUICALPN)
 
-	// TODO: tlsBadAuthFallbackServerPort
-	return netutil.ListenQUICAndAccept(ctx, s.hg.QUICPort, s.tlsConfig, quicServerConfig, func(quicConn quic.Connection) {
-		ctx = contextutil.WithSourceAndInboundValues(ctx, quicConn.RemoteAddr().String(), "QUIC carrier")
-		serverConn := &serverQUICConn{s, quicConn, make(chan struct{})}
+	httpHandler, err := netutil.FallbackHTTPHandler(s.hg)
+	if err != nil {
+		return err
+	}
+	s.fallbackServer = &http3.Server{Handler: httpHandler}
+	quicConfig := quicConfigWithReceiveWindows(quicServerConfig, s.hg.QUICStreamReceiveWindow, s.hg.QUICConnectionReceiveWindow)
+	quicConfig = quicConfigWithCongestionControl(quicConfig, s.hg.QUICCongestionControl, s.hg.QUICFixedRate)
+	return netutil.ListenQUICAndAccept(ctx, s.hg.QUICPort, s.tlsConfig, quicConfig, func(quicConn quic.Connection) {
+		ctx := contextutil.WithSourceAndInboundValues(ctx, quicConn.RemoteAddr().String(), "QUIC carrier")
+		serverConn := &serverQUICConn{server: s, Connection: quicConn, authDone: make(chan struct{}),
+			fallback: newFallbackConn(quicConn), fallbackStarted: make(chan struct{}),
+			assembler: newPacketAssembler(), associations: newAssociations()}
 		go serverConn.handleAuthTimeout()
+		go serverConn.associations.closeAllWhenDone(quicConn)
 		go serverConn.processIncomingUniStreams(ctx)
 		go serverConn.processIncomingStreams(ctx)
 		go serverConn.processIncomingDatagram(ctx)
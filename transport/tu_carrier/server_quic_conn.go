@@ -3,16 +3,19 @@ package tu_carrier
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/quic-go/quic-go"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 )
 
 // one server has n serverQUICConn/quic.Connection
@@ -21,6 +24,16 @@ type serverQUICConn struct {
 	quic.Connection
 
 	authDone chan struct{}
+	// the authenticated user's name, which is only written before closing 'authDone'
+	user string
+	// the connection is served as an HTTP/3 site instead if it fails to authenticate
+	fallback        *fallbackConn
+	fallbackStarted chan struct{}
+	// guards closing 'authDone' and 'fallbackStarted', as only one of them can happen
+	stateMutex sync.Mutex
+
+	assembler    *packetAssembler
+	associations *associations
 }
 
 func (c *serverQUICConn) handleAuthTimeout() {
@@ -28,10 +41,67 @@ func (c *serverQUICConn) handleAuthTimeout() {
 	case <-c.authDone:
 	case <-c.Context().Done():
 	case <-time.After(authTimeout):
-		_ = c.CloseWithError(authCommandReceiveTimeoutErrCode, authCommandReceiveTimeoutErrStr)
+		c.fallBack(errors.New(authCommandReceiveTimeoutErrStr))
+	}
+}
+
+// serves the connection as an HTTP/3 site like what the TLS carrier does, and returns false if it has been authenticated
+
+func (c *serverQUICConn) fallBack(reason error) bool {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	select {
+	case <-c.authDone:
+		return false
+	case <-c.fallbackStarted:
+		return true
+	default:
+	}
+
+	logger.Debug("serve a QUIC connection as an HTTP/3 site", "source", c.RemoteAddr().String(), "reason", reason.Error())
+	close(c.fallbackStarted)
+	go func() {
+		err := c.server.fallbackServer.ServeQUICConn(c.fallback)
+		if err != nil {
+			logger.Debug("the HTTP/3 site's QUIC connection is closed", "source", c.RemoteAddr().String(), "reason", err.Error())
+		}
+	}()
+	return true
+}
+
+func (c *serverQUICConn) isFallingBack() bool {
+	select {
+	case <-c.fallbackStarted:
+		return true
+	default:
+		return false
 	}
 }
 
+// the authentication is ignored if the connection is falling back or has been authenticated by another stream
+
+func (c *serverQUICConn) completeAuth(user string) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	select {
+	case <-c.authDone:
+	case <-c.fallbackStarted:
+	default:
+		c.user = user
+		close(c.authDone)
+	}
+}
+
+// a stream is handed over to the fallback if the connection is falling back or it isn't from a TUIC client
+
+func (c *serverQUICConn) shouldFallBack(version byte) (bool, error) {
+	err := validateVersion(version)
+	if err != nil {
+		return c.fallBack(err), err
+	}
+	return c.isFallingBack(), nil
+}
+
 func (c *serverQUICConn) processIncomingUniStreams(ctx context.Context) {
 	for {
 		uniStream, err := c.AcceptUniStream(ctx)
@@ -39,22 +109,39 @@ func (c *serverQUICConn) processIncomingUniStreams(ctx context.Context) {
 			// this can happen when timeout
 			return
 		}
+		if c.isFallingBack() {
+			c.fallback.addUniStream(uniStream)
+			continue
+		}
 		go func() {
-			err = c.handleUniStream(uniStream)
+			err := c.handleUniStream(ctx, uniStream)
 			if err != nil {
-				log.InfoWithError("fail to handle a QUIC unidirectional stream", err)
+				logger.InfoWithError("fail to handle a QUIC unidirectional stream", err)
 				_ = c.CloseWithError(handleUniStreamErrCode, fmt.Sprintf("%v: %v", handleUniStreamErrStr, err.Error()))
 			}
 		}()
 	}
 }
 
-func (c *serverQUICConn) handleUniStream(stream quic.ReceiveStream) error {
-	command, err := validateVersionAndGetCommandType(stream)
+func (c *serverQUICConn) handleUniStream(ctx context.Context, stream quic.ReceiveStream) error {
+	// read the version alone as an HTTP/3 client's stream may only have its 1-byte stream type for a while
+	_, version, err := ioutil.ReadN(stream, 1)
 	if err != nil {
 		return err
 	}
-	switch command {
+	fallBack, err := c.shouldFallBack(version[0])
+	if fallBack {
+		c.fallback.addUniStream(newPeekedReceiveStream(stream, version))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, command, err := ioutil.ReadN(stream, 1)
+	if err != nil {
+		return err
+	}
+	switch command[0] {
 	case authCommandType:
 		select {
 		case <-c.authDone:
@@ -66,24 +153,76 @@ func (c *serverQUICConn) handleUniStream(stream quic.ReceiveStream) error {
 		if err != nil {
 			return err
 		}
-		if !bytes.Equal(authCommandDataBs[0:authCommandUUIDSize], []byte(authCommandUUID)) {
-			return errors.New("incorrect UUID '%v' in request authenticate command", uuid.UUID(authCommandDataBs[0:authCommandUUIDSize]))
+		user, err := c.lookUpUser([authCommandUUIDSize]byte(authCommandDataBs[0:authCommandUUIDSize]),
+			authCommandDataBs[authCommandUUIDSize:authCommandDataSize])
+		if err == nil && c.server.hg.TLSClientAuth != nil {
+			err = netutil.VerifyClientCertUser(c.server.hg, c.ConnectionState().TLS, user)
 		}
-		token, err := authToken(c, []byte(c.server.hg.Password.String))
 		if err != nil {
+			if c.fallBack(err) {
+				return nil
+			}
 			return err
 		}
-		if !bytes.Equal(token, authCommandDataBs[authCommandUUIDSize:authCommandDataSize]) {
-			return errors.New("incorrect token in request authenticate command")
-		}
 
-		close(c.authDone)
+		c.completeAuth(user)
+		return nil
+	case packetCommandType:
+		return c.handlePacketCommand(ctx, stream, true)
+	case dissociateCommandType:
+		assocID, err := readDissociateCommand(stream)
+		if err != nil {
+			return err
+		}
+		conn, ok := c.associations.get(assocID)
+		if ok {
+			_ = conn.Close()
+		}
 		return nil
 	default:
-		return errors.Newf("unknown command type %v", command)
+		return errors.Newf("unknown command type %v", command[0])
 	}
 }
 
+// an hg client's token is derived from the TLS session, so we have to try every user's password to find the matched one,
+// while a standard TUIC client's user is looked up by its UUID
+
+func (c *serverQUICConn) lookUpUser(receivedUUID [authCommandUUIDSize]byte, receivedToken []byte) (string, error) {
+	if receivedUUID == [authCommandUUIDSize]byte([]byte(authCommandUUID)) {
+		for _, user := range c.server.hg.AllUsers() {
+			ok, err := c.validateToken(receivedUUID, user.Password.String, receivedToken)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return user.Name, nil
+			}
+		}
+		return "", errors.New("incorrect token in request authenticate command")
+	}
+
+	user, ok := c.server.tuicUsers[receivedUUID]
+	if !ok {
+		return "", errors.Newf("unknown UUID '%v' in request authenticate command", uuid.UUID(receivedUUID))
+	}
+	ok, err := c.validateToken(receivedUUID, user.Password.String, receivedToken)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.Newf("incorrect token for UUID '%v' in request authenticate command", uuid.UUID(receivedUUID))
+	}
+	return user.Name, nil
+}
+
+func (c *serverQUICConn) validateToken(uuid [authCommandUUIDSize]byte, password string, receivedToken []byte) (bool, error) {
+	token, err := authToken(c, uuid, []byte(password))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(token, receivedToken) == 1, nil
+}
+
 func (c *serverQUICConn) processIncomingStreams(ctx context.Context) {
 	for {
 		stream, err := c.AcceptStream(ctx)
@@ -91,10 +230,14 @@ func (c *serverQUICConn) processIncomingStreams(ctx context.Context) {
 			// this can happen when timeout
 			return
 		}
+		if c.isFallingBack() {
+			c.fallback.addStream(stream)
+			continue
+		}
 		go func() {
-			err = c.handleStream(ctx, stream)
+			err := c.handleStream(ctx, stream)
 			if err != nil {
-				log.InfoWithError("fail to handle a QUIC stream", errors.WithStack(err))
+				logger.InfoWithError("fail to handle a QUIC stream", errors.WithStack(err))
 				_ = c.CloseWithError(handleUniStreamErrCode, fmt.Sprintf("%v: %v", handleUniStreamErrStr, err.Error()))
 			}
 		}()
@@ -102,17 +245,23 @@ func (c *serverQUICConn) processIncomingStreams(ctx context.Context) {
 }
 
 func (c *serverQUICConn) handleStream(ctx context.Context, stream quic.Stream) error {
-	_, bs, err := ioutil.ReadN(stream, 2)
-	if err != nil && !errors.IsIoEof(err) {
+	_, version, err := ioutil.ReadN(stream, 1)
+	if err != nil {
 		return err
 	}
-
-	err = validateVersion(bs[0])
+	fallBack, err := c.shouldFallBack(version[0])
+	if fallBack {
+		c.fallback.addStream(newPeekedStream(stream, version))
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	command := bs[1]
-	switch command {
+	_, command, err := ioutil.ReadN(stream, 1)
+	if err != nil {
+		return err
+	}
+	switch command[0] {
 	case connectCommandType:
 		accessAddr, err := readTUICAddress(stream)
 		if err != nil {
@@ -121,13 +270,19 @@ func (c *serverQUICConn) handleStream(ctx context.Context, stream quic.Stream) e
 
 		select {
 		case <-c.authDone:
+		case <-c.fallbackStarted:
+			stream.CancelRead(0)
+			return stream.Close()
 		case <-ctx.Done():
 			return nil
 		}
+		if c.user != "" {
+			ctx = contextutil.WithUser(ctx, c.user)
+		}
 		conn := newServerTCPConn(c, stream, accessAddr)
 		return transport.ForwardTCP(ctx, accessAddr, conn, c.server.targetClient)
 	default:
-		return errors.Newf("unknown command type %v", command)
+		return errors.Newf("unknown command type %v", command[0])
 	}
 }
 
@@ -138,27 +293,85 @@ func (c *serverQUICConn) processIncomingDatagram(ctx context.Context) {
 			_ = c.CloseWithError(receiveDatagramErrCode, receiveDatagramStreamErrStr)
 			return
 		}
-		err = c.handleDatagram(datagram)
+		// an HTTP/3 site doesn't use datagrams
+		if c.isFallingBack() {
+			continue
+		}
+		err = c.handleDatagram(ctx, datagram)
 		if err != nil {
-			_ = c.CloseWithError(handleUniStreamErrCode, handleUniStreamErrStr)
+			if c.fallBack(err) {
+				continue
+			}
+			logger.InfoWithError("fail to handle a QUIC datagram", err)
+			_ = c.CloseWithError(handleDatagramErrCode, handleDatagramStreamErrStr)
 			return
 		}
 	}
 }
 
-func (c *serverQUICConn) handleDatagram(datagram []byte) error {
-	command, err := validateVersionAndGetCommandType(bytes.NewReader(datagram))
+func (c *serverQUICConn) handleDatagram(ctx context.Context, datagram []byte) error {
+	datagramReader := bytes.NewReader(datagram)
+	command, err := validateVersionAndGetCommandType(datagramReader)
 	if err != nil {
 		return err
 	}
 	switch command {
 	case heartbeatCommandType:
 		return nil
+	case packetCommandType:
+		return c.handlePacketCommand(ctx, datagramReader, false)
 	default:
 		return errors.Newf("unknown command type %v", command)
 	}
 }
 
+// a new UDP association is created by its first packet, and it's closed by a dissociate command or the QUIC connection
+
+func (c *serverQUICConn) handlePacketCommand(ctx context.Context, r io.Reader, overStream bool) error {
+	fragment, err := readPacketFragment(r)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.authDone:
+	case <-c.fallbackStarted:
+		return nil
+	case <-c.Context().Done():
+		return nil
+	}
+	addr, payload, ok := c.assembler.add(fragment)
+	if !ok {
+		return nil
+	}
+
+	assocID := fragment.assocID
+	c.associations.mutex.Lock()
+	conn, ok := c.associations.conns[assocID]
+	if !ok {
+		conn = newPacketConn(c, assocID, overStream, func() { c.associations.remove(assocID) })
+		c.associations.conns[assocID] = conn
+	}
+	c.associations.mutex.Unlock()
+	conn.overStream.Store(overStream)
+	if !ok {
+		go c.forward(ctx, conn, addr)
+	}
+	conn.deliver(addr, payload)
+	return nil
+}
+
+func (c *serverQUICConn) forward(ctx context.Context, conn *packetConn, accessAddr *transport.SocketAddress) {
+	ctx = contextutil.WithValues(ctx, contextutil.InboundTag, "QUIC carrier's UDP relay")
+	if c.user != "" {
+		ctx = contextutil.WithUser(ctx, c.user)
+	}
+	err := transport.ForwardUDP(ctx, accessAddr, conn, c.server.targetClient)
+	_ = conn.Close()
+	if err != nil {
+		logger.InfoWithError("fail to relay packets over QUIC", err)
+	}
+}
+
 func (c *serverQUICConn) CloseWithError(code quic.ApplicationErrorCode, desc string) error {
 	return c.Connection.CloseWithError(code, desc)
 }
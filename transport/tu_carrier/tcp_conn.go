@@ -8,7 +8,6 @@ import (
 
 	"github.com/quic-go/quic-go"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
-	"github.com/ringo-is-a-color/heteroglossia/transport/socks"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
 )
@@ -66,51 +65,19 @@ https://github.com/EAimTY/tuic/blob/dev/SPEC.md#authenticate
 +----------+
 */
 func (c *tcpConn) writeConnectCommand() (int, error) {
-	// 16 + 2 = len(password) + len(CRLF)
-	// we don't write the second CRLF like Trojan protocol
-	connectCommandSize := 2 + c.connectAddressSizeInBytes()
-	connectCommandBs := make([]byte, connectCommandSize)
+	connectCommandSize := 2 + tuicAddressSizeInBytes(c.accessAddr)
+	connectCommandBuf := bytes.NewBuffer(make([]byte, 0, connectCommandSize))
+	connectCommandBuf.WriteByte(tuicVersion)
+	connectCommandBuf.WriteByte(connectCommandType)
+	writeTUICAddress(connectCommandBuf, c.accessAddr)
 
-	connectCommandBs[0] = tuicVersion
-	connectCommandBs[1] = connectCommandType
-	addressBuf := bytes.NewBuffer(connectCommandBs[2:2])
-	c.writeConnectAddress(addressBuf)
-
-	n, err := ioutil.Write(c.Stream, connectCommandBs)
+	n, err := ioutil.Write(c.Stream, connectCommandBuf.Bytes())
 	if err != nil {
 		return n, errors.WithStack(err)
 	}
 	return n, nil
 }
 
-func (c *tcpConn) connectAddressSizeInBytes() int {
-	return socks.SOCKSLikeAddrSizeInBytes(c.accessAddr)
-}
-
-/*
-https://github.com/EAimTY/tuic/blob/dev/SPEC.md#address
-+------+----------+----------+
-| TYPE |   ADDR   |   PORT   |
-+------+----------+----------+
-|  1   | Variable |    2     |
-+------+----------+----------+
-* 0x00: fully-qualified domain name
-* 0x01: IPv4 address
-* 0x02: IPv6 address
-*/
-func (c *tcpConn) writeConnectAddress(buf *bytes.Buffer) {
-	socks.WriteSOCKSLikeAddr(buf, c.accessAddr)
-	bufBs := buf.Bytes()
-	switch c.accessAddr.AddrType {
-	case transport.IPv4:
-		bufBs[0] = 0x01
-	case transport.IPv6:
-		bufBs[0] = 0x02
-	default:
-		bufBs[0] = 0x00
-	}
-}
-
 func (c *tcpConn) Close() error {
 	// Make sure a possible writer does not block the lock forever. We need it, so we can close the writer
 	// side of the stream safely.
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"os/exec"
 	"strings"
 
@@ -26,7 +27,13 @@ func Run(name string, arg ...string) (string, error) {
 }
 
 func RunWithStdoutErrResults(name string, arg ...string) (string, string, error) {
-	cmd, outputBuilder, errorBuilder := exec.Command(name, arg...), new(strings.Builder), new(strings.Builder)
+	return RunContextWithStdoutErrResults(context.Background(), name, arg...)
+}
+
+// the command is killed when the context is done
+
+func RunContextWithStdoutErrResults(ctx context.Context, name string, arg ...string) (string, string, error) {
+	cmd, outputBuilder, errorBuilder := exec.CommandContext(ctx, name, arg...), new(strings.Builder), new(strings.Builder)
 	cmd.Stdout = outputBuilder
 	cmd.Stderr = errorBuilder
 	err := cmd.Run()
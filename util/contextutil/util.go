@@ -7,12 +7,25 @@ import (
 const (
 	SourceTag  = "source"
 	InboundTag = "inbound"
+	// the authenticated username of an inbound user
+	UserTag = "user"
 )
 
 func WithSourceAndInboundValues(ctx context.Context, sourceAddr, inbound string) context.Context {
 	return WithValues(ctx, SourceTag, sourceAddr, InboundTag, inbound)
 }
 
+func WithUser(ctx context.Context, user string) context.Context {
+	return WithValues(ctx, UserTag, user)
+}
+
+// returns an empty string if no user is authenticated
+
+func User(ctx context.Context) string {
+	user, _ := ctx.Value(UserTag).(string)
+	return user
+}
+
 func WithValues(ctx context.Context, kv ...interface{}) context.Context {
 	if len(kv)%2 != 0 {
 		panic("odd numbers of key-value pairs")
@@ -51,6 +51,8 @@ var Join = xerrors.Append
 
 var Is = errors.Is
 
+var As = errors.As
+
 func IsIoEof(err error) bool {
 	return errors.Is(err, io.EOF)
 }
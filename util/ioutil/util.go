@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 
+	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 )
 
@@ -74,10 +75,26 @@ func Write_(w io.Writer, response []byte) error {
 	return err
 }
 
+// Meter is told about every chunk relayed by 'PipeWithMeter' before the chunk is written,
+// so it can block to throttle the relay or return an error to stop it
+
+type Meter interface {
+	Account(n int) error
+}
+
 func Pipe(a, b io.ReadWriteCloser) error {
+	return PipeWithMeter(a, b, nil)
+}
+
+func PipeWithMeter(a, b io.ReadWriteCloser, meter Meter) error {
 	done := make(chan error, 1)
 	cp := func(r, w io.ReadWriteCloser) {
-		_, err := io.Copy(r, w)
+		var err error
+		if meter == nil {
+			_, err = io.Copy(r, w)
+		} else {
+			err = copyWithMeter(r, w, meter)
+		}
 		done <- err
 		_ = r.Close()
 	}
@@ -91,3 +108,29 @@ func Pipe(a, b io.ReadWriteCloser) error {
 	}
 	return errors.WithStack(err)
 }
+
+// 'io.Copy' may use 'io.WriterTo' or 'io.ReaderFrom' which hides the chunks from us, so we copy them ourselves
+
+func copyWithMeter(dst io.Writer, src io.Reader, meter Meter) error {
+	buf := pool.Get(BufSize)
+	defer pool.Put(buf)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			meterErr := meter.Account(n)
+			if meterErr != nil {
+				return meterErr
+			}
+			_, writeErr := dst.Write(buf[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if err != nil {
+			if errors.IsIoEof(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
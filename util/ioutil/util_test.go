@@ -0,0 +1,74 @@
+package ioutil
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// limitMeter fails once more than 'limit' bytes are relayed
+
+type limitMeter struct {
+	limit int64
+	used  atomic.Int64
+}
+
+func (m *limitMeter) Account(n int) error {
+	if m.used.Add(int64(n)) > m.limit {
+		return errors.New("the limit is exceeded")
+	}
+	return nil
+}
+
+func TestPipeWithMeter(t *testing.T) {
+	client, serverA := net.Pipe()
+	serverB, target := net.Pipe()
+	meter := &limitMeter{limit: 10}
+	done := make(chan error, 1)
+	go func() {
+		done <- PipeWithMeter(serverA, serverB, meter)
+	}()
+
+	// both directions are accounted
+	assertRelayed(t, client, target, "hello")
+	assertRelayed(t, target, client, "world")
+	assert.Equal(t, int64(10), meter.used.Load())
+
+	// the chunk exceeding the limit isn't relayed, and the relay stops
+	go func() {
+		_, _ = client.Write([]byte("!"))
+	}()
+	_, err := target.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.NotNil(t, <-done)
+}
+
+func TestPipeWithMeterClosed(t *testing.T) {
+	client, serverA := net.Pipe()
+	serverB, target := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- PipeWithMeter(serverA, serverB, &limitMeter{limit: 10})
+	}()
+
+	assertRelayed(t, client, target, "hello")
+	_ = client.Close()
+	assert.Nil(t, <-done)
+	_, err := target.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func assertRelayed(t *testing.T, src, dst net.Conn, data string) {
+	go func() {
+		_, err := src.Write([]byte(data))
+		assert.Nil(t, err)
+	}()
+	buf := make([]byte, len(data))
+	_, err := io.ReadFull(dst, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, data, string(buf))
+}
@@ -1,50 +1,176 @@
 package log
 
 import (
+	"context"
 	"fmt"
+	"io"
+	stdlog "log"
 	"log/slog"
+	"os"
 	"sync/atomic"
+	"time"
 
 	"github.com/mdobak/go-xerrors"
 	"github.com/ringo-is-a-color/heteroglossia/util/osutil"
 )
 
-var verbose = atomic.Bool{}
+const componentTag = "component"
 
-func Debug(msg string, args ...any) {
-	slog.Debug(msg, args...)
+type settings struct {
+	level           slog.Level
+	componentLevels map[string]slog.Level
+	json            bool
 }
 
-var Info = slog.Info
+var current atomic.Pointer[settings]
 
-func InfoWithError(msg string, err error, args ...any) {
-	slog.Info(msg, append(args, "err", err)...)
-	if verbose.Load() == true {
-		// skip first stack trace which used in 'github.com/ringo-is-a-color/heteroglossia/util/errors' package
-		stacktrace := xerrors.StackTrace(err)
-		if len(stacktrace) > 1 {
-			fmt.Print(stacktrace[1:])
-		} else {
-			fmt.Print(stacktrace)
-		}
+func init() {
+	current.Store(&settings{level: slog.LevelInfo})
+}
+
+// Setup applies the global level, the per-component overrides and the output format, which is JSON if 'json' is true.
+// It should be called once before any server starts.
+func Setup(level slog.Level, componentLevels map[string]slog.Level, json bool) {
+	setup(os.Stderr, level, componentLevels, json)
+}
+
+func setup(w io.Writer, level slog.Level, componentLevels map[string]slog.Level, json bool) {
+	s := &settings{level: level, componentLevels: componentLevels, json: json}
+	// the handler filters nothing by itself, so let the most verbose level pass through it
+	minLevel := s.level
+	for _, level := range s.componentLevels {
+		minLevel = min(minLevel, level)
 	}
+	if s.json {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: minLevel})))
+	} else {
+		stdlog.SetOutput(w)
+		slog.SetLogLoggerLevel(minLevel)
+	}
+	current.Store(s)
 }
 
-var Warn = slog.Warn
+// Logger logs messages for one subsystem, so its level can be overridden by 'log.components' in the config file.
+type Logger struct {
+	component string
+}
 
-func WarnWithError(msg string, err error, args ...any) {
-	slog.Warn(msg, append(args, "err", err)...)
-	fmt.Print(xerrors.StackTrace(err)[1:])
+var root = new(Logger)
+
+func NewLogger(component string) *Logger {
+	return &Logger{component}
 }
 
-var Error = slog.Error
+func (l *Logger) level() slog.Level {
+	s := current.Load()
+	if level, ok := s.componentLevels[l.component]; ok {
+		return level
+	}
+	return s.level
+}
 
-func Fatal(msg string, err error, args ...any) {
-	slog.Error(msg, append(args, "err", err)...)
+func (l *Logger) Enabled(level slog.Level) bool {
+	return level >= l.level()
+}
+
+func (l *Logger) log(level slog.Level, msg string, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.logIgnoringLevel(level, msg, args...)
+}
+
+// logIgnoringLevel passes the message to the handler directly, so neither the logger's level nor the handler's filters it
+
+func (l *Logger) logIgnoringLevel(level slog.Level, msg string, args ...any) {
+	if l.component != "" {
+		args = append([]any{componentTag, l.component}, args...)
+	}
+	record := slog.NewRecord(time.Now(), level, msg, 0)
+	record.Add(args...)
+	_ = slog.Default().Handler().Handle(context.Background(), record)
+}
+
+func (l *Logger) logWithError(level slog.Level, msg string, err error, printStacktrace bool, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	args = append(args, "err", err)
+	// skip first stack trace which used in 'github.com/ringo-is-a-color/heteroglossia/util/errors' package
+	stacktrace := xerrors.StackTrace(err)
+	if len(stacktrace) > 1 {
+		stacktrace = stacktrace[1:]
+	}
+	if !printStacktrace || len(stacktrace) == 0 {
+		l.log(level, msg, args...)
+		return
+	}
+	// a raw stack trace printed between lines breaks the JSON output, so we put it into an attribute instead
+	if current.Load().json {
+		l.log(level, msg, append(args, "stacktrace", stacktrace.String())...)
+		return
+	}
+	l.log(level, msg, args...)
+	fmt.Print(stacktrace)
+}
+
+func (l *Logger) Debug(msg string, args ...any) {
+	l.log(slog.LevelDebug, msg, args...)
+}
+
+func (l *Logger) Info(msg string, args ...any) {
+	l.log(slog.LevelInfo, msg, args...)
+}
+
+// InfoWithError only prints the stack trace when the debug level is enabled for this logger
+
+func (l *Logger) InfoWithError(msg string, err error, args ...any) {
+	l.logWithError(slog.LevelInfo, msg, err, l.Enabled(slog.LevelDebug), args...)
+}
+
+func (l *Logger) Warn(msg string, args ...any) {
+	l.log(slog.LevelWarn, msg, args...)
+}
+
+func (l *Logger) WarnWithError(msg string, err error, args ...any) {
+	l.logWithError(slog.LevelWarn, msg, err, true, args...)
+}
+
+func (l *Logger) Error(msg string, args ...any) {
+	l.log(slog.LevelError, msg, args...)
+}
+
+// Fatal always logs the message whatever the level is, as it's the last one before exiting
+
+func (l *Logger) Fatal(msg string, err error, args ...any) {
+	l.logIgnoringLevel(slog.LevelError, msg, append(args, "err", err)...)
 	osutil.Exit(1)
 }
 
-func SetVerbose(b bool) {
-	verbose.Store(b)
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+func Debug(msg string, args ...any) {
+	root.Debug(msg, args...)
+}
+
+func Info(msg string, args ...any) {
+	root.Info(msg, args...)
+}
+
+func InfoWithError(msg string, err error, args ...any) {
+	root.InfoWithError(msg, err, args...)
+}
+
+func Warn(msg string, args ...any) {
+	root.Warn(msg, args...)
+}
+
+func WarnWithError(msg string, err error, args ...any) {
+	root.WarnWithError(msg, err, args...)
+}
+
+func Error(msg string, args ...any) {
+	root.Error(msg, args...)
+}
+
+func Fatal(msg string, err error, args ...any) {
+	root.Fatal(msg, err, args...)
 }
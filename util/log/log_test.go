@@ -0,0 +1,100 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupWithBuffer sets up the logging into the returned buffer, and the previous setup is restored after the test
+
+func setupWithBuffer(t *testing.T, level slog.Level, componentLevels map[string]slog.Level, json bool) *bytes.Buffer {
+	defaultLogger := slog.Default()
+	settings := current.Load()
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		current.Store(settings)
+	})
+	buf := new(bytes.Buffer)
+	setup(buf, level, componentLevels, json)
+	return buf
+}
+
+func jsonLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var attrs map[string]any
+		assert.Nil(t, json.Unmarshal([]byte(line), &attrs))
+		lines = append(lines, attrs)
+	}
+	return lines
+}
+
+func TestComponentLevels(t *testing.T) {
+	buf := setupWithBuffer(t, slog.LevelWarn, map[string]slog.Level{"router": slog.LevelDebug, "updater": slog.LevelError}, true)
+	NewLogger("router").Debug("router debug")
+	NewLogger("updater").Warn("updater warn")
+	NewLogger("updater").Error("updater error")
+	NewLogger("tu_carrier").Info("tu_carrier info")
+	NewLogger("tu_carrier").Warn("tu_carrier warn")
+	Info("root info")
+	Warn("root warn")
+
+	var msgs []string
+	for _, line := range jsonLines(t, buf) {
+		msgs = append(msgs, line["msg"].(string))
+	}
+	assert.Equal(t, []string{"router debug", "updater error", "tu_carrier warn", "root warn"}, msgs)
+}
+
+func TestJSONOutput(t *testing.T) {
+	buf := setupWithBuffer(t, slog.LevelInfo, nil, true)
+	NewLogger("router").Info("a message", "key", "value")
+	Warn("a root message")
+
+	lines := jsonLines(t, buf)
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	assert.Equal(t, "INFO", lines[0]["level"])
+	assert.Equal(t, "a message", lines[0]["msg"])
+	assert.Equal(t, "router", lines[0][componentTag])
+	assert.Equal(t, "value", lines[0]["key"])
+	assert.Equal(t, "WARN", lines[1]["level"])
+	assert.NotContains(t, lines[1], componentTag)
+}
+
+// the stack trace is an attribute of the JSON line rather than the raw lines after it
+
+func TestStacktraceAttribute(t *testing.T) {
+	buf := setupWithBuffer(t, slog.LevelInfo, nil, true)
+	WarnWithError("a failure", errors.Newf("an error"))
+	// the stack trace of the info level is only printed with the debug level
+	NewLogger("router").InfoWithError("another failure", errors.Newf("another error"))
+
+	lines := jsonLines(t, buf)
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	assert.Equal(t, "an error", lines[0]["err"])
+	assert.Contains(t, lines[0]["stacktrace"], "TestStacktraceAttribute")
+	assert.NotContains(t, lines[1], "stacktrace")
+}
+
+// the message before exiting is logged whatever the level is
+
+func TestLogIgnoringLevel(t *testing.T) {
+	buf := setupWithBuffer(t, slog.LevelError+4, nil, false)
+	Error("an error")
+	root.logIgnoringLevel(slog.LevelError, "a fatal error")
+	assert.NotContains(t, buf.String(), "an error")
+	assert.Contains(t, buf.String(), "ERROR a fatal error")
+}
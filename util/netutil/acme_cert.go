@@ -3,24 +3,78 @@ package netutil
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 	"github.com/ringo-is-a-color/heteroglossia/util/log"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
-func tlsConfigWithAutomatedCertificate(ctx context.Context, host string) *tls.Config {
-	certManager := autocert.Manager{
-		Prompt:      autocert.AcceptTOS,
-		Cache:       autocert.DirCache("certs"),
-		HostPolicy:  autocert.HostWhitelist(host),
-		RenewBefore: 10 * 24 * time.Hour,
+const acmeRenewBefore = 10 * 24 * time.Hour
+
+func tlsConfigWithAutomatedCertificate(ctx context.Context, host string, acmeConf *conf.TLSACME) (*tls.Config, error) {
+	client, eab, err := acmeClient(acmeConf)
+	if err != nil {
+		return nil, err
+	}
+	if acmeConf.Challenge == conf.ACMEChallengeDNS01 {
+		// autocert doesn't support the DNS-01 challenge
+		provider, err := newDNSProvider(acmeConf.DNSProvider)
+		if err != nil {
+			return nil, err
+		}
+		certManager := &dns01CertManager{client: client, email: acmeConf.Email, eab: eab, host: host,
+			cache: autocert.DirCache(acmeConf.StorageDir), provider: provider,
+			propagationWait: time.Duration(acmeConf.DNSProvider.PropagationSeconds) * time.Second}
+		go certManager.obtainAndRenew(ctx)
+		return &tls.Config{GetCertificate: certManager.GetCertificate}, nil
+	}
+
+	certManager := &autocert.Manager{
+		Prompt:                 autocert.AcceptTOS,
+		Cache:                  autocert.DirCache(acmeConf.StorageDir),
+		HostPolicy:             autocert.HostWhitelist(host),
+		RenewBefore:            acmeRenewBefore,
+		Client:                 client,
+		Email:                  acmeConf.Email,
+		ExternalAccountBinding: eab,
+	}
+	if acmeConf.Challenge == conf.ACMEChallengeTLSALPN01 {
+		// the TLS carrier clients don't use ALPN, and HTTP/1.1 is kept for the browsers visiting the fallback site
+		return &tls.Config{GetCertificate: certManager.GetCertificate, NextProtos: []string{"http/1.1", acme.ALPNProto}}, nil
 	}
 	go func() {
-		err := ListenHTTPAndServe(ctx, ":80", certManager.HTTPHandler(nil))
+		// the HTTP-01 challenge is only tried after this is called
+		err := ListenHTTPAndServe(ctx, net.JoinHostPort("", strconv.Itoa(acmeConf.HTTPPort)), certManager.HTTPHandler(nil))
 		if err != nil {
 			log.Fatal("fail to start a HTTP server for automatic renewing certificate", err)
 		}
 	}()
-	return &tls.Config{GetCertificate: certManager.GetCertificate}
+	return &tls.Config{GetCertificate: certManager.GetCertificate}, nil
+}
+
+func acmeClient(acmeConf *conf.TLSACME) (*acme.Client, *acme.ExternalAccountBinding, error) {
+	client := &acme.Client{DirectoryURL: acmeConf.DirectoryURL}
+	if acmeConf.CACertFile != "" {
+		certPool, _, err := loadCertBundle(acmeConf.CACertFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.HTTPClient = HTTPClient(&http.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool}})
+	}
+	if acmeConf.EABKeyID == "" {
+		return client, nil, nil
+	}
+	hmacKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(acmeConf.EABHMACKey, "="))
+	if err != nil {
+		return nil, nil, errors.New(err, "fail to decode the ACME 'eab-hmac-key' field as base64url")
+	}
+	return client, &acme.ExternalAccountBinding{KID: acmeConf.EABKeyID, Key: hmacKey}, nil
 }
@@ -0,0 +1,247 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"sync/atomic"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// the same cache key and format as autocert, so the account and certificate are kept when the challenge type is changed
+const acmeAccountKeyCacheKey = "acme_account+key"
+
+var (
+	acmeRenewCheckInterval = 12 * time.Hour
+	acmeRetryInterval      = 10 * time.Minute
+)
+
+// dns01CertManager obtains the certificate with the DNS-01 challenge when starting, and renews it in the background
+
+type dns01CertManager struct {
+	client          *acme.Client
+	email           string
+	eab             *acme.ExternalAccountBinding
+	host            string
+	cache           autocert.Cache
+	provider        dnsProvider
+	propagationWait time.Duration
+	registered      bool
+	cert            atomic.Pointer[tls.Certificate]
+}
+
+func (m *dns01CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, errors.New("the ACME certificate isn't obtained yet")
+	}
+	return cert, nil
+}
+
+func (m *dns01CertManager) obtainAndRenew(ctx context.Context) {
+	cert, err := m.cachedCert(ctx)
+	if err == nil {
+		m.cert.Store(cert)
+	} else if !errors.Is(err, autocert.ErrCacheMiss) {
+		log.WarnWithError("fail to load the cached ACME certificate", err, "host", m.host)
+	}
+	for {
+		interval := acmeRenewCheckInterval
+		cert := m.cert.Load()
+		if cert == nil || time.Until(cert.Leaf.NotAfter) < acmeRenewBefore {
+			err := m.obtain(ctx)
+			if err != nil {
+				log.WarnWithError("fail to obtain the ACME certificate", err, "host", m.host)
+				interval = acmeRetryInterval
+			} else {
+				log.Info("obtain the ACME certificate", "host", m.host)
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *dns01CertManager) obtain(ctx context.Context) error {
+	err := m.register(ctx)
+	if err != nil {
+		return err
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.host))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		err = m.authorize(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{m.host}}, key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	cert := &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}
+	m.cert.Store(cert)
+
+	var buf bytes.Buffer
+	err = encodePrivateKey(&buf, key)
+	if err != nil {
+		return err
+	}
+	for _, certDER := range der {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	}
+	return errors.WithStack(m.cache.Put(ctx, m.host, buf.Bytes()))
+}
+
+func (m *dns01CertManager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+	if m.client.Key == nil {
+		key, err := m.accountKey(ctx)
+		if err != nil {
+			return err
+		}
+		m.client.Key = key
+	}
+	var contact []string
+	if m.email != "" {
+		contact = []string{"mailto:" + m.email}
+	}
+	_, err := m.client.Register(ctx, &acme.Account{Contact: contact, ExternalAccountBinding: m.eab}, acme.AcceptTOS)
+	// the key may be registered when hg ran last time
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return errors.New(err, "fail to register the ACME account")
+	}
+	m.registered = true
+	return nil
+}
+
+func (m *dns01CertManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, acmeAccountKeyCacheKey)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("fail to decode the cached ACME account key")
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		return key, errors.WithStack(err)
+	}
+	if !errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, errors.WithStack(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var buf bytes.Buffer
+	err = encodePrivateKey(&buf, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, errors.WithStack(m.cache.Put(ctx, acmeAccountKeyCacheKey, buf.Bytes()))
+}
+
+func (m *dns01CertManager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if authz.Status != acme.StatusPending {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return errors.Newf("the CA doesn't offer the DNS-01 challenge for %v", authz.Identifier.Value)
+	}
+	value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fqdn := "_acme-challenge." + authz.Identifier.Value
+	err = m.provider.present(ctx, fqdn, value)
+	if err != nil {
+		return errors.Newf(err, "fail to set the TXT record %v", fqdn)
+	}
+	defer func() {
+		// the context may be done, but the record should still be removed
+		err := m.provider.cleanUp(context.Background(), fqdn, value)
+		if err != nil {
+			log.WarnWithError("fail to remove the TXT record", err, "fqdn", fqdn)
+		}
+	}()
+	select {
+	case <-time.After(m.propagationWait):
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+
+	_, err = m.client.Accept(ctx, challenge)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return errors.WithStack(err)
+}
+
+func (m *dns01CertManager) cachedCert(ctx context.Context) (*tls.Certificate, error) {
+	data, err := m.cache.Get(ctx, m.host)
+	if err != nil {
+		return nil, err
+	}
+	// the private key and the certificates are in the same PEM data, and the leaf is parsed since Go 1.23
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &cert, nil
+}
+
+func encodePrivateKey(buf *bytes.Buffer, key *ecdsa.PrivateKey) error {
+	keyBs, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBs}))
+}
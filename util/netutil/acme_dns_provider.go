@@ -0,0 +1,163 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/cmd"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+)
+
+// dnsProvider sets and removes the TXT records for the ACME DNS-01 challenge
+
+type dnsProvider interface {
+	present(ctx context.Context, fqdn, value string) error
+	cleanUp(ctx context.Context, fqdn, value string) error
+}
+
+func newDNSProvider(providerConf *conf.ACMEDNSProvider) (dnsProvider, error) {
+	switch providerConf.Name {
+	case conf.ACMEDNSProviderCloudflare:
+		return &cloudflareDNSProvider{baseURL: cloudflareAPIURL, apiToken: providerConf.APIToken,
+			recordIDs: make(map[string]cloudflareRecord)}, nil
+	case conf.ACMEDNSProviderExec:
+		return &execDNSProvider{command: providerConf.Command}, nil
+	default:
+		return nil, errors.Newf("unsupported ACME DNS provider '%v'", providerConf.Name)
+	}
+}
+
+// runs the command with the arguments "present" or "cleanup", the record's FQDN and its value,
+// e.g., a script calling pebble-challtestsrv's '/set-txt' and '/clear-txt' APIs
+
+type execDNSProvider struct {
+	command string
+}
+
+func (p *execDNSProvider) present(ctx context.Context, fqdn, value string) error {
+	_, _, err := cmd.RunContextWithStdoutErrResults(ctx, p.command, "present", fqdn, value)
+	return err
+}
+
+func (p *execDNSProvider) cleanUp(ctx context.Context, fqdn, value string) error {
+	_, _, err := cmd.RunContextWithStdoutErrResults(ctx, p.command, "cleanup", fqdn, value)
+	return err
+}
+
+// https://developers.cloudflare.com/api/operations/dns-records-for-a-zone-create-dns-record
+
+const cloudflareAPIURL = "https://api.cloudflare.com/client/v4"
+
+type cloudflareDNSProvider struct {
+	// 'cloudflareAPIURL' except in the tests
+	baseURL  string
+	apiToken string
+	// the created records to remove, whose keys are the FQDNs and values
+	recordIDs      map[string]cloudflareRecord
+	recordIDsMutex sync.Mutex
+}
+
+type cloudflareRecord struct {
+	zoneID, id string
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (p *cloudflareDNSProvider) present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	reqBody := map[string]any{"type": "TXT", "name": fqdn, "content": value, "ttl": 120}
+	var record struct {
+		ID string `json:"id"`
+	}
+	err = p.request(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", reqBody, &record)
+	if err != nil {
+		return err
+	}
+	p.recordIDsMutex.Lock()
+	p.recordIDs[fqdn+" "+value] = cloudflareRecord{zoneID, record.ID}
+	p.recordIDsMutex.Unlock()
+	return nil
+}
+
+func (p *cloudflareDNSProvider) cleanUp(ctx context.Context, fqdn, value string) error {
+	p.recordIDsMutex.Lock()
+	record, ok := p.recordIDs[fqdn+" "+value]
+	delete(p.recordIDs, fqdn+" "+value)
+	p.recordIDsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return p.request(ctx, http.MethodDelete, "/zones/"+record.zoneID+"/dns_records/"+record.id, nil, nil)
+}
+
+// finds the zone of the longest domain suffix, e.g., 'example.com' for '_acme-challenge.www.example.com'
+
+func (p *cloudflareDNSProvider) zoneID(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(fqdn, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		err := p.request(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(strings.Join(labels[i:], ".")), nil, &zones)
+		if err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", errors.Newf("no Cloudflare zone for %v", fqdn)
+}
+
+func (p *cloudflareDNSProvider) request(ctx context.Context, method, path string, reqBody, result any) error {
+	var body bytes.Buffer
+	if reqBody != nil {
+		err := json.NewEncoder(&body).Encode(reqBody)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, &body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.apiToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var cfResp cloudflareResponse
+	err = json.NewDecoder(resp.Body).Decode(&cfResp)
+	if err != nil {
+		return errors.Newf(err, "fail to parse the Cloudflare API response of %v", resp.Status)
+	}
+	if !cfResp.Success {
+		var messages []string
+		for _, cfErr := range cfResp.Errors {
+			messages = append(messages, cfErr.Message)
+		}
+		return errors.Newf("the Cloudflare API responds %v: %v", resp.Status, strings.Join(messages, "; "))
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.WithStack(json.Unmarshal(cfResp.Result, result))
+}
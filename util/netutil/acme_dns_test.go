@@ -0,0 +1,296 @@
+package netutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestCloudflareDNSProvider(t *testing.T) {
+	var requests []string
+	var requestsMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsMutex.Lock()
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		requestsMutex.Unlock()
+		assert.Equal(t, "Bearer the-token", r.Header.Get("Authorization"))
+		var result any
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones":
+			zones := map[string]string{"example.com": "apex-zone", "www.example.com": "www-zone"}
+			result = []map[string]string{}
+			if zoneID, ok := zones[r.URL.Query().Get("name")]; ok {
+				result = []map[string]string{{"id": zoneID}}
+			}
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/dns_records"):
+			var record map[string]any
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&record))
+			assert.Equal(t, "TXT", record["type"])
+			result = map[string]string{"id": "record-of-" + record["name"].(string)}
+		case r.Method == http.MethodDelete:
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"success":false,"errors":[{"message":"no route"}]}`))
+			return
+		}
+		resultBs, err := json.Marshal(result)
+		assert.Nil(t, err)
+		_ = json.NewEncoder(w).Encode(cloudflareResponse{Success: true, Result: resultBs})
+	}))
+	defer server.Close()
+
+	p := &cloudflareDNSProvider{baseURL: server.URL, apiToken: "the-token", recordIDs: make(map[string]cloudflareRecord)}
+	ctx := context.Background()
+	// the zone of the longest suffix is used
+	assert.Nil(t, p.present(ctx, "_acme-challenge.www.example.com", "value1"))
+	assert.Nil(t, p.present(ctx, "_acme-challenge.api.example.com", "value2"))
+	assert.Nil(t, p.cleanUp(ctx, "_acme-challenge.www.example.com", "value1"))
+	assert.Nil(t, p.cleanUp(ctx, "_acme-challenge.api.example.com", "value2"))
+	// the records which aren't created are not removed
+	assert.Nil(t, p.cleanUp(ctx, "_acme-challenge.api.example.com", "value2"))
+	assert.Equal(t, []string{
+		"GET /zones?name=www.example.com",
+		"POST /zones/www-zone/dns_records",
+		"GET /zones?name=api.example.com",
+		"GET /zones?name=example.com",
+		"POST /zones/apex-zone/dns_records",
+		"DELETE /zones/www-zone/dns_records/record-of-_acme-challenge.www.example.com",
+		"DELETE /zones/apex-zone/dns_records/record-of-_acme-challenge.api.example.com",
+	}, requests)
+
+	err := p.present(ctx, "_acme-challenge.example.org", "value3")
+	assert.ErrorContains(t, err, "no Cloudflare zone")
+}
+
+func TestExecDNSProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command is a shell script")
+	}
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "output")
+	command := filepath.Join(dir, "dns.sh")
+	script := "#!/bin/sh\n[ \"$3\" = sleep ] && exec sleep 10\necho \"$@\" >> " + outputFile + "\n"
+	assert.Nil(t, os.WriteFile(command, []byte(script), 0700))
+
+	p := &execDNSProvider{command: command}
+	assert.Nil(t, p.present(context.Background(), "_acme-challenge.example.com", "the value"))
+	assert.Nil(t, p.cleanUp(context.Background(), "_acme-challenge.example.com", "the value"))
+	output, err := os.ReadFile(outputFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "present _acme-challenge.example.com the value\ncleanup _acme-challenge.example.com the value\n", string(output))
+
+	// the command is killed when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.NotNil(t, p.present(ctx, "_acme-challenge.example.com", "sleep"))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestDNS01CertManagerObtain(t *testing.T) {
+	ca := startFakeACMEServer(t)
+	provider := &recordingDNSProvider{records: make(map[string]string)}
+	ca.provider = provider
+	cache := autocert.DirCache(t.TempDir())
+	m := &dns01CertManager{client: &acme.Client{DirectoryURL: ca.server.URL + "/dir"}, host: "example.com",
+		cache: cache, provider: provider}
+	_, err := m.cachedCert(context.Background())
+	assert.ErrorIs(t, err, autocert.ErrCacheMiss)
+
+	assert.Nil(t, m.obtain(context.Background()))
+	cert, err := m.GetCertificate(nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"example.com"}, cert.Leaf.DNSNames)
+	record, err := m.client.DNS01ChallengeRecord(fakeACMEChallengeToken)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"present _acme-challenge.example.com " + record, "cleanup _acme-challenge.example.com " + record},
+		provider.calls)
+
+	// another manager loads the certificate and the account key from the cache
+	other := &dns01CertManager{client: &acme.Client{DirectoryURL: ca.server.URL + "/dir"}, host: "example.com", cache: cache}
+	cachedCert, err := other.cachedCert(context.Background())
+	if assert.Nil(t, err) {
+		assert.Equal(t, cert.Certificate, cachedCert.Certificate)
+		assert.Equal(t, cert.Leaf.SerialNumber, cachedCert.Leaf.SerialNumber)
+	}
+	accountKey, err := other.accountKey(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, m.client.Key.Public().(*ecdsa.PublicKey).Equal(accountKey.Public()))
+}
+
+type recordingDNSProvider struct {
+	calls   []string
+	records map[string]string
+	mutex   sync.Mutex
+}
+
+func (p *recordingDNSProvider) present(_ context.Context, fqdn, value string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.calls = append(p.calls, "present "+fqdn+" "+value)
+	p.records[fqdn] = value
+	return nil
+}
+
+func (p *recordingDNSProvider) cleanUp(_ context.Context, fqdn, value string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.calls = append(p.calls, "cleanup "+fqdn+" "+value)
+	delete(p.records, fqdn)
+	return nil
+}
+
+func (p *recordingDNSProvider) hasRecord(fqdn string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, ok := p.records[fqdn]
+	return ok
+}
+
+const fakeACMEChallengeToken = "the-token"
+
+// a fake ACME server for one order of one domain, which trusts the JWS requests without verifying their signatures,
+// and the challenge is valid if the TXT record is presented when it's accepted
+// https://datatracker.ietf.org/doc/html/rfc8555#section-7
+
+type fakeACMEServer struct {
+	server   *httptest.Server
+	provider *recordingDNSProvider
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+
+	mutex          sync.Mutex
+	challengeValid bool
+	certDER        []byte
+}
+
+func startFakeACMEServer(t *testing.T) *fakeACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.Nil(t, err)
+
+	ca := &fakeACMEServer{caKey: caKey, caCert: caCert}
+	ca.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ca.serve(t, w, r)
+	}))
+	t.Cleanup(ca.server.Close)
+	return ca
+}
+
+func (ca *fakeACMEServer) serve(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	url := ca.server.URL
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 10))
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&jws))
+		var err error
+		payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+		assert.Nil(t, err)
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	status := "pending"
+	if ca.challengeValid {
+		status = "valid"
+	}
+	var resp any
+	switch r.URL.Path {
+	case "/dir":
+		resp = map[string]string{"newNonce": url + "/nonce", "newAccount": url + "/account", "newOrder": url + "/order"}
+	case "/nonce":
+		return
+	case "/account":
+		w.Header().Set("Location", url+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		resp = map[string]string{"status": "valid"}
+	case "/order":
+		w.Header().Set("Location", url+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		resp = ca.order(status)
+	case "/order/1":
+		resp = ca.order(status)
+	case "/authz/1":
+		resp = map[string]any{"identifier": map[string]string{"type": "dns", "value": "example.com"}, "status": status,
+			"challenges": []map[string]string{{"type": "dns-01", "url": url + "/challenge/1", "token": fakeACMEChallengeToken,
+				"status": status}}}
+	case "/challenge/1":
+		ca.challengeValid = ca.provider.hasRecord("_acme-challenge.example.com")
+		resp = map[string]string{"type": "dns-01", "url": url + "/challenge/1", "token": fakeACMEChallengeToken, "status": "valid"}
+	case "/finalize/1":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		assert.Nil(t, json.Unmarshal(payload, &req))
+		ca.certDER = ca.issue(t, req.CSR)
+		resp = ca.order(status)
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.certDER})
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (ca *fakeACMEServer) order(authzStatus string) map[string]any {
+	url := ca.server.URL
+	order := map[string]any{"identifiers": []map[string]string{{"type": "dns", "value": "example.com"}},
+		"authorizations": []string{url + "/authz/1"}, "finalize": url + "/finalize/1", "status": "pending"}
+	switch {
+	case ca.certDER != nil:
+		order["status"] = "valid"
+		order["certificate"] = url + "/cert/1"
+	case authzStatus == "valid":
+		order["status"] = "ready"
+	}
+	return order
+}
+
+func (ca *fakeACMEServer) issue(t *testing.T, csrStr string) []byte {
+	csrDER, err := base64.RawURLEncoding.DecodeString(csrStr)
+	assert.Nil(t, err)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	assert.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()), DNSNames: csr.DNSNames,
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+	assert.Nil(t, err)
+	return certDER
+}
@@ -0,0 +1,125 @@
+package netutil
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/log"
+)
+
+// the files are checked periodically rather than watched, so the replacements by renaming or symlinks also work
+var certReloadCheckInterval = time.Minute
+
+// certReloader serves the certificate matching the client's SNI from the cert/key pairs,
+// and reloads a pair when its files are modified
+
+type certReloader struct {
+	pairs []conf.TLSCertKeyPair
+	// the same order as 'pairs'
+	certs    atomic.Pointer[[]*tls.Certificate]
+	modTimes []time.Time
+}
+
+func newCertReloader(pairs []conf.TLSCertKeyPair) (*certReloader, error) {
+	reloader := &certReloader{pairs: pairs, modTimes: make([]time.Time, len(pairs))}
+	certs := make([]*tls.Certificate, len(pairs))
+	for i, pair := range pairs {
+		cert, modTime, err := loadCertKeyPair(pair)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+		reloader.modTimes[i] = modTime
+	}
+	reloader.certs.Store(&certs)
+	return reloader, nil
+}
+
+// the first pair is the default one for the clients without a matching SNI
+
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *r.certs.Load()
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certs[0], nil
+}
+
+func (r *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.reloadModified()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *certReloader) reloadModified() {
+	var newCerts []*tls.Certificate
+	for i, pair := range r.pairs {
+		modTime, err := certKeyPairModTime(pair)
+		if err != nil {
+			log.WarnWithError("fail to check the TLS certificate/key pair files", err, "cert", pair.CertFile)
+			continue
+		}
+		if modTime.Equal(r.modTimes[i]) {
+			continue
+		}
+		cert, modTime, err := loadCertKeyPair(pair)
+		if err != nil {
+			// the files may be being written, so the next check retries
+			log.WarnWithError("fail to reload the TLS certificate/key pair files", err, "cert", pair.CertFile)
+			continue
+		}
+		if newCerts == nil {
+			newCerts = append([]*tls.Certificate(nil), *r.certs.Load()...)
+		}
+		newCerts[i] = cert
+		r.modTimes[i] = modTime
+		log.Info("reload the TLS certificate/key pair files", "cert", pair.CertFile)
+	}
+	if newCerts != nil {
+		r.certs.Store(&newCerts)
+	}
+}
+
+func loadCertKeyPair(pair conf.TLSCertKeyPair) (*tls.Certificate, time.Time, error) {
+	// get the modification time first, so the files modified during the loading are reloaded next time
+	modTime, err := certKeyPairModTime(pair)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, time.Time{}, errors.New(err, "fail to load TLS Certificate/Key pair files")
+	}
+	return &cert, modTime, nil
+}
+
+// the later modification time of the two files
+
+func certKeyPairModTime(pair conf.TLSCertKeyPair) (time.Time, error) {
+	certFileInfo, err := os.Stat(pair.CertFile)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	keyFileInfo, err := os.Stat(pair.KeyFile)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	if keyFileInfo.ModTime().After(certFileInfo.ModTime()) {
+		return keyFileInfo.ModTime(), nil
+	}
+	return certFileInfo.ModTime(), nil
+}
@@ -0,0 +1,187 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/log"
+)
+
+var (
+	// the CRLs are shared by different server types like the certificates, and their keys are the CRL files
+	crlReloaders      = make(map[string]*crlReloader)
+	crlReloadersMutex sync.Mutex
+)
+
+// the client certificates are only verified if they're given, and the revoked ones are checked after the handshakes,
+// so the clients without them or with the revoked ones can be served by the fallbacks like the ones with wrong passwords,
+// rather than failing the handshakes which don't look like a normal website
+
+func setupClientAuth(tlsConfig *tls.Config, clientAuth *conf.TLSClientAuth) error {
+	caCerts, err := loadCerts(clientAuth.CACertFile)
+	if err != nil {
+		return err
+	}
+	certPool := x509.NewCertPool()
+	for _, caCert := range caCerts {
+		certPool.AddCert(caCert)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = certPool
+	if clientAuth.CRLFile == "" {
+		return nil
+	}
+
+	crlReloadersMutex.Lock()
+	defer crlReloadersMutex.Unlock()
+	if _, ok := crlReloaders[clientAuth.CRLFile]; ok {
+		return nil
+	}
+	reloader, err := newCRLReloader(clientAuth.CRLFile, caCerts)
+	if err != nil {
+		return err
+	}
+	go reloader.watch(context.Background())
+	crlReloaders[clientAuth.CRLFile] = reloader
+	return nil
+}
+
+// VerifyClientCertUser checks that the client's verified certificate isn't revoked by the CRL of 'tls-client-auth',
+// and its subject common name is the name of one of the users and the 'user' matched by the client's password
+
+func VerifyClientCertUser(hg *conf.Hg, state tls.ConnectionState, user string) error {
+	if len(state.VerifiedChains) == 0 {
+		return errors.New("no verified client certificate")
+	}
+	cert := state.VerifiedChains[0][0]
+	clientAuth := hg.TLSClientAuth
+	if clientAuth.CRLFile != "" {
+		crlReloadersMutex.Lock()
+		reloader, ok := crlReloaders[clientAuth.CRLFile]
+		crlReloadersMutex.Unlock()
+		if !ok {
+			return errors.Newf("the CRL file '%v' isn't loaded", clientAuth.CRLFile)
+		}
+		err := reloader.verify(cert)
+		if err != nil {
+			return err
+		}
+	}
+	certUser := cert.Subject.CommonName
+	isUser := slices.ContainsFunc(hg.AllUsers(), func(hgUser conf.HgUser) bool {
+		return hgUser.Name == certUser
+	})
+	if !isUser || certUser != user {
+		return errors.Newf("the client certificate of '%v' isn't for the user '%v' of the password", certUser, user)
+	}
+	return nil
+}
+
+type crlReloader struct {
+	crlFile string
+	caCerts []*x509.Certificate
+	crl     atomic.Pointer[x509.RevocationList]
+	modTime time.Time
+}
+
+func newCRLReloader(crlFile string, caCerts []*x509.Certificate) (*crlReloader, error) {
+	reloader := &crlReloader{crlFile: crlFile, caCerts: caCerts}
+	crl, modTime, err := reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	reloader.crl.Store(crl)
+	reloader.modTime = modTime
+	return reloader, nil
+}
+
+// an expired CRL rejects all the certificates, as the ones revoked after it aren't known
+
+func (r *crlReloader) verify(cert *x509.Certificate) error {
+	crl := r.crl.Load()
+	if isExpired(crl) {
+		return errors.Newf("the CRL file '%v' expired at %v", r.crlFile, crl.NextUpdate)
+	}
+	if !bytes.Equal(cert.RawIssuer, crl.RawIssuer) {
+		return nil
+	}
+	for _, revoked := range crl.RevokedCertificateEntries {
+		if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return errors.Newf("the client certificate of '%v' is revoked", cert.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+func isExpired(crl *x509.RevocationList) bool {
+	return !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate)
+}
+
+// the same as the certificates, the file is checked periodically
+
+func (r *crlReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fileInfo, err := os.Stat(r.crlFile)
+			if err != nil {
+				log.WarnWithError("fail to check the CRL file", err, "crl", r.crlFile)
+				continue
+			}
+			if fileInfo.ModTime().Equal(r.modTime) {
+				continue
+			}
+			crl, modTime, err := r.load()
+			if err != nil {
+				log.WarnWithError("fail to reload the CRL file", err, "crl", r.crlFile)
+				continue
+			}
+			r.crl.Store(crl)
+			r.modTime = modTime
+			log.Info("reload the CRL file", "crl", r.crlFile)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *crlReloader) load() (*x509.RevocationList, time.Time, error) {
+	fileInfo, err := os.Stat(r.crlFile)
+	if err != nil {
+		return nil, time.Time{}, errors.WithStack(err)
+	}
+	crlBs, err := ioutil.ReadFile(r.crlFile)
+	if err != nil {
+		return nil, time.Time{}, errors.New(err, "fail to load the CRL file")
+	}
+	block, _ := pem.Decode(crlBs)
+	if block != nil {
+		crlBs = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(crlBs)
+	if err != nil {
+		return nil, time.Time{}, errors.New(err, "fail to parse the CRL file")
+	}
+	if isExpired(crl) {
+		return nil, time.Time{}, errors.Newf("the CRL expired at %v", crl.NextUpdate)
+	}
+	for _, caCert := range r.caCerts {
+		if crl.CheckSignatureFrom(caCert) == nil {
+			return crl, fileInfo.ModTime(), nil
+		}
+	}
+	return nil, time.Time{}, errors.New("the CRL isn't signed by the CA certificates of 'tls-client-auth'")
+}
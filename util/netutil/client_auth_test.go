@@ -0,0 +1,56 @@
+package netutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a CRL whose next update has passed isn't loaded, and the loaded one which expires later rejects all the certificates
+
+func TestCRLReloaderWithExpiredCRL(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "hg test CA"}, IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign, NotAfter: time.Now().Add(time.Hour)}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.Nil(t, err)
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{CommonName: "cert-user"}, NotAfter: time.Now().Add(time.Hour)}, caCert, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(certDER)
+	assert.Nil(t, err)
+
+	crlFile := filepath.Join(t.TempDir(), "ca.crl")
+	writeCRL := func(nextUpdate time.Time) {
+		crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1),
+			ThisUpdate: time.Now().Add(-2 * time.Hour), NextUpdate: nextUpdate}, caCert, caKey)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0600))
+	}
+
+	writeCRL(time.Now().Add(-time.Hour))
+	_, err = newCRLReloader(crlFile, []*x509.Certificate{caCert})
+	assert.ErrorContains(t, err, "expired")
+
+	writeCRL(time.Now().Add(time.Hour))
+	reloader, err := newCRLReloader(crlFile, []*x509.Certificate{caCert})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, reloader.verify(cert))
+	reloader.crl.Load().NextUpdate = time.Now().Add(-time.Second)
+	assert.ErrorContains(t, reloader.verify(cert), "expired")
+}
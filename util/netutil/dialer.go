@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"net/netip"
 	"time"
 
 	"github.com/quic-go/quic-go"
+	utls "github.com/refraction-networking/utls"
+	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
 )
 
@@ -14,6 +17,12 @@ var (
 	dialer               = net.Dialer{Timeout: dialerTimeout, KeepAlive: KeepAlive}
 	dialerTimeout        = 10 * time.Second
 	quicHandshakeTimeout = 10 * time.Second
+
+	tlsFingerprints = map[string]utls.ClientHelloID{
+		conf.TLSFingerprintChrome:  utls.HelloChrome_Auto,
+		conf.TLSFingerprintFirefox: utls.HelloFirefox_Auto,
+		conf.TLSFingerprintSafari:  utls.HelloSafari_Auto,
+	}
 )
 
 func dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -28,16 +37,78 @@ func DialTCP(ctx context.Context, addr string) (*net.TCPConn, error) {
 	return conn.(*net.TCPConn), nil
 }
 
-func DialTLS(ctx context.Context, addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
+func DialUDP(ctx context.Context, addr string) (*net.UDPConn, error) {
+	conn, err := dial(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// RouteLocalIP returns the local IP which the system uses to reach the remote address, and no packets are sent
+
+func RouteLocalIP(remoteAddr *net.UDPAddr) (netip.Addr, error) {
+	conn, err := net.DialUDP("udp", nil, remoteAddr)
+	if err != nil {
+		return netip.Addr{}, errors.WithStack(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+// ListenUDP returns an unconnected UDP socket, which can send packets to any address
+
+func ListenUDP() (*net.UDPConn, error) {
+	return errors.WithStack2(net.ListenUDP("udp", nil))
+}
+
+// DialTLS runs TLS over the TCP socket wrapped by 'wrapConn', e.g., an obfuscator's
+
+func DialTLS(ctx context.Context, addr string, tlsConfig *tls.Config, wrapConn func(conn net.Conn) net.Conn) (*tls.Conn, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(wrapConn(conn), tlsConfig), nil
+}
+
+// DialUTLS sends the ClientHello of the browser 'fingerprint' instead of Go's, and it returns after the handshake
+
+func DialUTLS(ctx context.Context, addr string, tlsConfig *tls.Config, fingerprint string,
+	wrapConn func(conn net.Conn) net.Conn) (net.Conn, error) {
 	conn, err := dial(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return tls.Client(conn, tlsConfig), nil
+	uTLSConn := UTLSClient(wrapConn(conn), uTLSConfigOf(tlsConfig), fingerprint)
+	err = uTLSConn.HandshakeContext(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return uTLSConn, nil
+}
+
+// only the client's fields used by hg are converted
+
+func uTLSConfigOf(tlsConfig *tls.Config) *utls.Config {
+	uTLSConfig := &utls.Config{ServerName: tlsConfig.ServerName, RootCAs: tlsConfig.RootCAs, KeyLogWriter: tlsConfig.KeyLogWriter,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify, VerifyPeerCertificate: tlsConfig.VerifyPeerCertificate}
+	for _, cert := range tlsConfig.Certificates {
+		uTLSConfig.Certificates = append(uTLSConfig.Certificates, utls.Certificate{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey})
+	}
+	return uTLSConfig
+}
+
+func UTLSClient(conn net.Conn, uTLSConfig *utls.Config, fingerprint string) *utls.UConn {
+	return utls.UClient(conn, uTLSConfig, tlsFingerprints[fingerprint])
 }
 
-func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.Connection, error) {
+// DialQUICEarly returns before the handshake completes if the TLS config has a session ticket for 0-RTT,
+// otherwise it returns after the handshake
+
+func DialQUICEarly(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
 	ctx, cancel := context.WithTimeout(ctx, quicHandshakeTimeout)
 	defer cancel()
-	return errors.WithStack2(quic.DialAddr(ctx, addr, tlsConf, quicConf))
+	return errors.WithStack2(quic.DialAddrEarly(ctx, addr, tlsConf, quicConf))
 }
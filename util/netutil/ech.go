@@ -0,0 +1,320 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// https://datatracker.ietf.org/doc/html/draft-ietf-tls-esni-22#section-4
+	echConfigVersion   = 0xfe0d
+	hpkeKEMX25519      = 0x0020
+	hpkeKDFHKDFSHA256  = 0x0001
+	hpkeAEADAES128GCM  = 0x0001
+	hpkeAEADChaCha20   = 0x0003
+	echMaxNameLength   = 0
+	dnsTypeHTTPS       = dnsmessage.Type(65)
+	svcParamKeyECH     = 5
+	echDoHFetchTimeout = 10 * time.Second
+	// the HTTPS records with a smaller TTL are still cached for this long, so they're not fetched for every dial
+	echMinTTL           = time.Minute
+	dnsMessageMediaType = "application/dns-message"
+)
+
+var (
+	// the ECHConfigLists of the nodes, which are fetched when they're needed and replaced by the servers' retry configs
+	echConfigListCaches      = make(map[echConfigListKey]*echConfigListCache)
+	echConfigListCachesMutex sync.Mutex
+	// the ECHConfigLists are fetched through the routes, and it's set when the router is created
+	echDoHHTTPClient atomic.Pointer[http.Client]
+)
+
+type echConfigListKey struct {
+	host, configList, dohURL string
+}
+
+type echConfigListCache struct {
+	configList []byte
+	// zero for an inline 'tls-ech-config-list', which never expires
+	expiry time.Time
+}
+
+// the context of a fetch, so a node whose DoH server is routed to itself doesn't fetch again recursively
+type echFetchingKey struct{}
+
+// SetECHDoHHTTPClient sets the HTTP client to query 'tls-ech-doh-url', e.g., the router's one
+
+func SetECHDoHHTTPClient(httpClient *http.Client) {
+	echDoHHTTPClient.Store(httpClient)
+}
+
+// ECHKey returns the server's ECH key from 'tls-ech', and the ECHConfigList for the clients' 'tls-ech-config-list'
+
+func ECHKey(ech *conf.TLSECH) (tls.EncryptedClientHelloKey, []byte, error) {
+	privateKeyBs, err := base64.RawURLEncoding.DecodeString(ech.PrivateKey)
+	if err != nil {
+		return tls.EncryptedClientHelloKey{}, nil, errors.Newf(err, "fail to decode the ECH private key '%v'", ech.PrivateKey)
+	}
+	privateKey, err := ecdh.X25519().NewPrivateKey(privateKeyBs)
+	if err != nil {
+		return tls.EncryptedClientHelloKey{}, nil, errors.New(err, "invalid ECH private key")
+	}
+	publicKey := privateKey.PublicKey().Bytes()
+	// derive the config ID from the key, so it's stable across restarts
+	configID := sha256.Sum256(publicKey)
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(echConfigVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configID[0])
+		b.AddUint16(hpkeKEMX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(publicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range []uint16{hpkeAEADAES128GCM, hpkeAEADChaCha20} {
+				b.AddUint16(hpkeKDFHKDFSHA256)
+				b.AddUint16(aead)
+			}
+		})
+		b.AddUint8(echMaxNameLength)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(ech.PublicName))
+		})
+		// no extensions
+		b.AddUint16(0)
+	})
+	config, err := b.Bytes()
+	if err != nil {
+		return tls.EncryptedClientHelloKey{}, nil, errors.WithStack(err)
+	}
+
+	b = cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(config)
+	})
+	configList, err := b.Bytes()
+	if err != nil {
+		return tls.EncryptedClientHelloKey{}, nil, errors.WithStack(err)
+	}
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: privateKeyBs, SendAsRetry: true}, configList, nil
+}
+
+func decodeECHConfigList(proxyNode *conf.ProxyNode) ([]byte, error) {
+	configList, err := base64.StdEncoding.DecodeString(proxyNode.TLSECHConfigList)
+	if err != nil {
+		return nil, errors.New(err, "fail to decode 'tls-ech-config-list'")
+	}
+	return configList, nil
+}
+
+// TLSClientConfigWithECH returns the node's TLS config with its current ECHConfigList,
+// which is fetched via 'tls-ech-doh-url' when it's not cached or its TTL expires
+
+func TLSClientConfigWithECH(ctx context.Context, proxyNode *conf.ProxyNode, tlsConfig *tls.Config) (*tls.Config, error) {
+	if proxyNode.TLSECHConfigList == "" && proxyNode.TLSECHDoHURL == "" {
+		return tlsConfig, nil
+	}
+	key := echConfigListKeyOf(proxyNode)
+	echConfigListCachesMutex.Lock()
+	cache, ok := echConfigListCaches[key]
+	echConfigListCachesMutex.Unlock()
+	if !ok || (!cache.expiry.IsZero() && time.Now().After(cache.expiry)) {
+		var err error
+		cache, err = newECHConfigListCache(ctx, proxyNode)
+		if err != nil {
+			return nil, err
+		}
+		echConfigListCachesMutex.Lock()
+		echConfigListCaches[key] = cache
+		echConfigListCachesMutex.Unlock()
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.EncryptedClientHelloConfigList = cache.configList
+	return tlsConfig, nil
+}
+
+// UpdateECHConfigList replaces the node's ECHConfigList with the retry configs when the server rejects ECH,
+// and returns true if the dial can be retried with them,
+// or the fetched ECHConfigList is dropped to be fetched again if the server doesn't send any
+
+func UpdateECHConfigList(proxyNode *conf.ProxyNode, err error) bool {
+	var rejectionErr *tls.ECHRejectionError
+	if !errors.As(err, &rejectionErr) {
+		return false
+	}
+	key := echConfigListKeyOf(proxyNode)
+	echConfigListCachesMutex.Lock()
+	defer echConfigListCachesMutex.Unlock()
+	cache, ok := echConfigListCaches[key]
+	if !ok {
+		return false
+	}
+	if len(rejectionErr.RetryConfigList) == 0 {
+		if proxyNode.TLSECHDoHURL != "" {
+			delete(echConfigListCaches, key)
+		}
+		return false
+	}
+	// the retry configs are authenticated with the certificate of the public name, and they're used until the TTL expires
+	echConfigListCaches[key] = &echConfigListCache{configList: rejectionErr.RetryConfigList, expiry: cache.expiry}
+	return true
+}
+
+// DropECHConfigList drops the fetched ECHConfigList to be fetched again for the next dial, e.g.,
+// when the rejection of ECH isn't told apart from the other handshake failures
+
+func DropECHConfigList(proxyNode *conf.ProxyNode) {
+	if proxyNode.TLSECHDoHURL == "" {
+		return
+	}
+	echConfigListCachesMutex.Lock()
+	defer echConfigListCachesMutex.Unlock()
+	delete(echConfigListCaches, echConfigListKeyOf(proxyNode))
+}
+
+func echConfigListKeyOf(proxyNode *conf.ProxyNode) echConfigListKey {
+	return echConfigListKey{proxyNode.Host, proxyNode.TLSECHConfigList, proxyNode.TLSECHDoHURL}
+}
+
+func newECHConfigListCache(ctx context.Context, proxyNode *conf.ProxyNode) (*echConfigListCache, error) {
+	if proxyNode.TLSECHConfigList != "" {
+		configList, err := decodeECHConfigList(proxyNode)
+		if err != nil {
+			return nil, err
+		}
+		return &echConfigListCache{configList: configList}, nil
+	}
+	if ctx.Value(echFetchingKey{}) != nil {
+		return nil, errors.Newf("the DNS-over-HTTPS server '%v' is routed to the node '%v' which needs its ECHConfigList",
+			proxyNode.TLSECHDoHURL, proxyNode.Host)
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, echFetchingKey{}, true), echDoHFetchTimeout)
+	defer cancel()
+	configList, ttl, err := fetchECHConfigList(ctx, proxyNode.TLSECHDoHURL, proxyNode.Host)
+	if err != nil {
+		return nil, errors.Newf(err, "fail to fetch the ECHConfigList of '%v' via '%v'", proxyNode.Host, proxyNode.TLSECHDoHURL)
+	}
+	return &echConfigListCache{configList: configList, expiry: time.Now().Add(max(ttl, echMinTTL))}, nil
+}
+
+// fetchECHConfigList queries the host's HTTPS record with DNS over HTTPS and returns its 'ech' parameter with the TTL
+// https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+// https://datatracker.ietf.org/doc/html/rfc9460#section-2.2
+
+func fetchECHConfigList(ctx context.Context, dohURL, host string) ([]byte, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsTypeHTTPS, Class: dnsmessage.ClassINET}},
+	}
+	queryBs, err := query.Pack()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dohURL, bytes.NewReader(queryBs))
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", dnsMessageMediaType)
+	req.Header.Set("Accept", dnsMessageMediaType)
+	httpClient := echDoHHTTPClient.Load()
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Newf("the DNS-over-HTTPS server responds %v", resp.Status)
+	}
+	respBs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	var parser dnsmessage.Parser
+	_, err = parser.Start(respBs)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	err = parser.SkipAllQuestions()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	for {
+		header, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return nil, 0, errors.New("no 'ech' parameter in the HTTPS records")
+		}
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		if header.Type != dnsTypeHTTPS {
+			err = parser.SkipAnswer()
+			if err != nil {
+				return nil, 0, errors.WithStack(err)
+			}
+			continue
+		}
+		resource, err := parser.UnknownResource()
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		configList, ok := parseSVCBECHParam(resource.Data)
+		if ok {
+			return configList, time.Duration(header.TTL) * time.Second, nil
+		}
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc9460#section-2.2
+
+func parseSVCBECHParam(data []byte) ([]byte, bool) {
+	s := cryptobyte.String(data)
+	var priority uint16
+	if !s.ReadUint16(&priority) || priority == 0 {
+		// the alias mode has no parameters
+		return nil, false
+	}
+	// the target name is never compressed
+	for {
+		var label cryptobyte.String
+		if !s.ReadUint8LengthPrefixed(&label) {
+			return nil, false
+		}
+		if len(label) == 0 {
+			break
+		}
+	}
+	for !s.Empty() {
+		var key uint16
+		var value cryptobyte.String
+		if !s.ReadUint16(&key) || !s.ReadUint16LengthPrefixed(&value) {
+			return nil, false
+		}
+		if key == svcParamKeyECH {
+			return value, true
+		}
+	}
+	return nil, false
+}
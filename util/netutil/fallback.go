@@ -0,0 +1,60 @@
+package netutil
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+)
+
+// FallbackHTTPHandler serves the requests which fail to authenticate with the 'tls-bad-auth-fallback-*' fields.
+// As an HTTP/3 request can't be forwarded as a TCP stream, 'tls-bad-auth-fallback-addr' is used as an HTTP upstream here.
+// It returns nil when no fallback is set, which responds 404 for all requests.
+
+func FallbackHTTPHandler(hg *conf.Hg) (http.Handler, error) {
+	switch {
+	case hg.TLSBadAuthFallbackSiteDir != "":
+		return http.FileServer(http.Dir(hg.TLSBadAuthFallbackSiteDir)), nil
+	case hg.TLSBadAuthFallbackURL != "":
+		return newReverseProxy(hg.TLSBadAuthFallbackURL, false, hg.TLSBadAuthFallbackXForwarded)
+	case hg.TLSBadAuthFallbackAddr != "":
+		return newReverseProxy("http://"+hg.TLSBadAuthFallbackAddr, true, hg.TLSBadAuthFallbackXForwarded)
+	default:
+		return nil, nil
+	}
+}
+
+// a local upstream, e.g., the web server which the TCP forward also reaches, sees the visited 'Host' like a direct visit,
+// while the 'Host' header is rewritten to a remote upstream's, so its virtual host works as a normal visit
+
+func newReverseProxy(upstream string, isLocal, xForwarded bool) (http.Handler, error) {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keepsHost := isLocal || isLocalHost(upstreamURL.Hostname())
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstreamURL)
+			if keepsHost {
+				r.Out.Host = r.In.Host
+			}
+			if xForwarded {
+				r.SetXForwarded()
+				// the visits are always over TLS or QUIC, though they're served here after being decrypted
+				r.Out.Header.Set("X-Forwarded-Proto", "https")
+			}
+		},
+	}, nil
+}
+
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
@@ -0,0 +1,79 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"golang.org/x/net/http2"
+)
+
+// HTTP2ClientPreface is what an HTTP/2 connection begins with
+// https://datatracker.ietf.org/doc/html/rfc9113#section-3.4
+
+var HTTP2ClientPreface = []byte(http2.ClientPreface)
+
+// ServeHTTPConn serves the HTTP requests of an accepted connection whose TLS layer has been removed,
+// which are HTTP/2 ones if 'isHTTP2' is true, and it returns after the connection is closed,
+// including the case that a handler hijacks it and closes it later
+
+func ServeHTTPConn(ctx context.Context, conn net.Conn, httpHandler http.Handler, isHTTP2 bool) error {
+	if isHTTP2 {
+		(&http2.Server{IdleTimeout: IdleTimeout}).ServeConn(conn, &http2.ServeConnOpts{Context: ctx, Handler: httpHandler})
+		return nil
+	}
+	ln := &singleConnListener{conn: &closeNotifyingConn{Conn: conn, closed: make(chan struct{})}, ctx: ctx}
+	server := &http.Server{
+		Handler:           httpHandler,
+		ReadHeaderTimeout: httpReadTimeout,
+		IdleTimeout:       IdleTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	err := server.Serve(ln)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+type singleConnListener struct {
+	conn     *closeNotifyingConn
+	accepted bool
+	ctx      context.Context
+}
+
+func (ln *singleConnListener) Accept() (net.Conn, error) {
+	if !ln.accepted {
+		ln.accepted = true
+		return ln.conn, nil
+	}
+	select {
+	case <-ln.conn.closed:
+	case <-ln.ctx.Done():
+		_ = ln.conn.Close()
+	}
+	return nil, net.ErrClosed
+}
+
+func (ln *singleConnListener) Close() error {
+	return nil
+}
+
+func (ln *singleConnListener) Addr() net.Addr {
+	return ln.conn.LocalAddr()
+}
+
+type closeNotifyingConn struct {
+	net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *closeNotifyingConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
@@ -85,13 +85,41 @@ func ListenHTTPAndServeWithListenerCallback(ctx context.Context, addr string, ht
 	}, nil)
 }
 
-func ListenTLSAndAccept(ctx context.Context, addr string, tlsConfig *tls.Config, connHandler func(conn net.Conn)) error {
+// ListenTLSAndAccept runs TLS over the accepted TCP sockets wrapped by 'wrapConn', e.g., an obfuscator's
+
+func ListenTLSAndAccept(ctx context.Context, addr string, tlsConfig *tls.Config, wrapConn func(conn net.Conn) net.Conn,
+	connHandler func(conn net.Conn)) error {
 	return listenTCPAndAccept(ctx, addr, func(ln net.Listener) error {
-		tlsLn := tls.NewListener(ln, tlsConfig)
-		return accept(tlsLn, connHandler)
+		return accept(ln, func(conn net.Conn) {
+			connHandler(tls.Server(wrapConn(conn), tlsConfig))
+		})
 	}, nil)
 }
 
+// the 'udpConn' is closed when the 'ctx' is done, which makes the 'serve' return
+
+func ListenUDPAndServe(ctx context.Context, port int, serve func(udpConn *net.UDPConn) error) error {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// use 'context.WithCancel' to avoid memory leak in the below goroutine
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = udpConn.Close()
+	}()
+	addServerListener(udpConn)
+	defer removeServerListener(udpConn)
+
+	err = serve(udpConn)
+	if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
 func ListenQUICAndAccept(ctx context.Context, port int, tlsConfig *tls.Config, quicConfig *quic.Config,
 	connHandler func(quicConn quic.Connection)) error {
 	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
@@ -99,7 +127,8 @@ func ListenQUICAndAccept(ctx context.Context, port int, tlsConfig *tls.Config, q
 		return errors.WithStack(err)
 	}
 
-	// we can use 0.5-RTT here because we don't use TLS client authentication
+	// we can use 0.5-RTT here, as the connections are only handled after the handshakes complete below,
+	// when the client certificates of 'tls-client-auth' have been verified
 	ln, err := quic.ListenEarly(udpConn, tlsConfig, quicConfig)
 	// use 'context.WithCancel' to avoid memory leak in the below goroutine
 	ctx, cancel := context.WithCancel(ctx)
@@ -117,16 +146,22 @@ func ListenQUICAndAccept(ctx context.Context, port int, tlsConfig *tls.Config, q
 	for {
 		conn, err := ln.Accept(ctx)
 		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) || ctx.Err() != nil {
+				return nil
+			}
 			return errors.WithStack(err)
 		}
 
-		select {
-		case <-conn.HandshakeComplete():
-			// handshake completed
-			connHandler(conn)
-		case <-conn.Context().Done():
-			// connection closed before handshake completion, e.g., due to handshake failure
-		}
+		// the connection's 0-RTT data is only handled after the handshake completes, so it can't be replayed
+		go func() {
+			select {
+			case <-conn.HandshakeComplete():
+				// handshake completed
+				connHandler(conn)
+			case <-conn.Context().Done():
+				// connection closed before handshake completion, e.g., due to handshake failure
+			}
+		}()
 	}
 }
 
@@ -137,6 +172,30 @@ func StopAllServerListeners() {
 	})
 }
 
+// IsServerListening reports whether one of the server listeners listens on the 'port' of the 'network',
+// which is "tcp" or "udp"
+
+func IsServerListening(network string, port int) bool {
+	listening := false
+	serverListener.Range(func(key, value any) bool {
+		var addr net.Addr
+		switch ln := key.(type) {
+		case interface{ Addr() net.Addr }:
+			addr = ln.Addr()
+		case *net.UDPConn:
+			addr = ln.LocalAddr()
+		}
+		switch addr := addr.(type) {
+		case *net.TCPAddr:
+			listening = network == "tcp" && addr.Port == port
+		case *net.UDPAddr:
+			listening = network == "udp" && addr.Port == port
+		}
+		return !listening
+	})
+	return listening
+}
+
 func addServerListener(listenerCloser io.Closer) {
 	serverListener.Store(listenerCloser, struct{}{})
 }
@@ -0,0 +1,207 @@
+package netutil
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand/v2"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	utls "github.com/refraction-networking/utls"
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+)
+
+// the Initial packets of Chrome's HTTP/3 connections, which are modeled after Chrome instead of captured from it:
+// they're padded to 1250 bytes, and the first Destination Connection ID has 8 bytes
+const (
+	chromeQUICInitialPacketSize         = 1250
+	chromeQUICInitialConnectionIDLength = 8
+)
+
+// QUICClientConfigWithFingerprint makes the QUIC client's Initial packets look like the browser 'fingerprint's,
+// and only Chrome is supported. The fingerprinted TLS stack doesn't resume sessions, so there is no 0-RTT.
+
+func QUICClientConfigWithFingerprint(quicConfig *quic.Config, fingerprint string) (*quic.Config, error) {
+	switch fingerprint {
+	case "":
+		return quicConfig, nil
+	case conf.TLSFingerprintChrome:
+		quicConfig = quicConfig.Clone()
+		quicConfig.InitialPacketSize = chromeQUICInitialPacketSize
+		quicConfig.InitialConnectionIDLength = chromeQUICInitialConnectionIDLength
+		quicConfig.TLSClient = newChromeQUICTLSClient
+		return quicConfig, nil
+	default:
+		return nil, errors.Newf("the QUIC carrier doesn't support the TLS fingerprint '%v'", fingerprint)
+	}
+}
+
+// uTLSQUICClient adapts uTLS's QUIC client to quic-go's, and the ClientHello spec is built when the handshake starts
+// as it carries the transport parameters
+
+type uTLSQUICClient struct {
+	conn                *utls.UQUICConn
+	nextProtos          []string
+	transportParameters []byte
+}
+
+var _ quic.TLSClientConn = new(uTLSQUICClient)
+
+func newChromeQUICTLSClient(config *tls.QUICConfig) quic.TLSClientConn {
+	uTLSConfig := uTLSConfigOf(config.TLSConfig)
+	uTLSConfig.NextProtos = config.TLSConfig.NextProtos
+	uTLSConfig.MinVersion = utls.VersionTLS13
+	return &uTLSQUICClient{conn: utls.UQUICClient(&utls.QUICConfig{TLSConfig: uTLSConfig}, utls.HelloCustom),
+		nextProtos: config.TLSConfig.NextProtos}
+}
+
+func (c *uTLSQUICClient) Start(ctx context.Context) error {
+	transportParameters, err := parseQUICTransportParameters(c.transportParameters)
+	if err != nil {
+		return err
+	}
+	err = c.conn.ApplyPreset(chromeQUICClientHelloSpec(c.nextProtos, transportParameters))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(c.conn.Start(ctx))
+}
+
+func (c *uTLSQUICClient) HandleData(level tls.QUICEncryptionLevel, data []byte) error {
+	return errors.WithStack(c.conn.HandleData(uTLSQUICEncryptionLevel(level), data))
+}
+
+func (c *uTLSQUICClient) NextEvent() tls.QUICEvent {
+	event := c.conn.NextEvent()
+	return tls.QUICEvent{Kind: tlsQUICEventKind(event.Kind), Level: tlsQUICEncryptionLevel(event.Level),
+		Data: event.Data, Suite: event.Suite}
+}
+
+func (c *uTLSQUICClient) Close() error {
+	return errors.WithStack(c.conn.Close())
+}
+
+func (c *uTLSQUICClient) ConnectionState() tls.ConnectionState {
+	state := c.conn.ConnectionState()
+	return tls.ConnectionState{Version: state.Version, HandshakeComplete: state.HandshakeComplete, DidResume: state.DidResume,
+		CipherSuite: state.CipherSuite, NegotiatedProtocol: state.NegotiatedProtocol, ServerName: state.ServerName,
+		PeerCertificates: state.PeerCertificates, VerifiedChains: state.VerifiedChains,
+		SignedCertificateTimestamps: state.SignedCertificateTimestamps, OCSPResponse: state.OCSPResponse}
+}
+
+// the uTLS QUIC client waits for the transport parameters when the ClientHello is built, though the ones in the spec
+// are sent
+
+func (c *uTLSQUICClient) SetTransportParameters(params []byte) {
+	c.transportParameters = params
+	c.conn.SetTransportParameters(params)
+}
+
+func (c *uTLSQUICClient) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	state := c.conn.ConnectionState()
+	return errors.WithStack2(state.ExportKeyingMaterial(label, context, length))
+}
+
+// the levels and the event kinds have the same names in crypto/tls and uTLS
+
+func uTLSQUICEncryptionLevel(level tls.QUICEncryptionLevel) utls.QUICEncryptionLevel {
+	switch level {
+	case tls.QUICEncryptionLevelEarly:
+		return utls.QUICEncryptionLevelEarly
+	case tls.QUICEncryptionLevelHandshake:
+		return utls.QUICEncryptionLevelHandshake
+	case tls.QUICEncryptionLevelApplication:
+		return utls.QUICEncryptionLevelApplication
+	default:
+		return utls.QUICEncryptionLevelInitial
+	}
+}
+
+func tlsQUICEncryptionLevel(level utls.QUICEncryptionLevel) tls.QUICEncryptionLevel {
+	switch level {
+	case utls.QUICEncryptionLevelEarly:
+		return tls.QUICEncryptionLevelEarly
+	case utls.QUICEncryptionLevelHandshake:
+		return tls.QUICEncryptionLevelHandshake
+	case utls.QUICEncryptionLevelApplication:
+		return tls.QUICEncryptionLevelApplication
+	default:
+		return tls.QUICEncryptionLevelInitial
+	}
+}
+
+func tlsQUICEventKind(kind utls.QUICEventKind) tls.QUICEventKind {
+	switch kind {
+	case utls.QUICSetReadSecret:
+		return tls.QUICSetReadSecret
+	case utls.QUICSetWriteSecret:
+		return tls.QUICSetWriteSecret
+	case utls.QUICWriteData:
+		return tls.QUICWriteData
+	case utls.QUICTransportParameters:
+		return tls.QUICTransportParameters
+	case utls.QUICTransportParametersRequired:
+		return tls.QUICTransportParametersRequired
+	case utls.QUICRejectedEarlyData:
+		return tls.QUICRejectedEarlyData
+	case utls.QUICHandshakeDone:
+		return tls.QUICHandshakeDone
+	default:
+		return tls.QUICNoEvent
+	}
+}
+
+// quic-go's transport parameters (including its GREASE one) are kept as they are, then the version information
+// is added like Chrome, and they're shuffled as Chrome doesn't send them in a fixed order
+
+func parseQUICTransportParameters(b []byte) (utls.TransportParameters, error) {
+	var parameters utls.TransportParameters
+	for len(b) > 0 {
+		id, n, err := quicvarint.Parse(b)
+		if err != nil {
+			return nil, errors.New(err, "invalid QUIC transport parameter ID")
+		}
+		b = b[n:]
+		length, n, err := quicvarint.Parse(b)
+		if err != nil || uint64(len(b)-n) < length {
+			return nil, errors.New("invalid QUIC transport parameter length")
+		}
+		b = b[n:]
+		parameters = append(parameters, &utls.FakeQUICTransportParameter{Id: id, Val: b[:length]})
+		b = b[length:]
+	}
+	parameters = append(parameters, &utls.VersionInformation{ChoosenVersion: utls.VERSION_1,
+		AvailableVersions: []uint32{utls.VERSION_GREASE, utls.VERSION_1}, LegacyID: true})
+	rand.Shuffle(len(parameters), func(i, j int) {
+		parameters[i], parameters[j] = parameters[j], parameters[i]
+	})
+	return parameters, nil
+}
+
+// https://github.com/refraction-networking/utls/blob/master/u_parrots.go, but for Chrome's HTTP/3: only TLS 1.3,
+// no GREASE, session ID or padding extension, and the extensions are shuffled
+
+func chromeQUICClientHelloSpec(nextProtos []string, transportParameters utls.TransportParameters) *utls.ClientHelloSpec {
+	return &utls.ClientHelloSpec{
+		TLSVersMin:         utls.VersionTLS13,
+		TLSVersMax:         utls.VersionTLS13,
+		CipherSuites:       []uint16{utls.TLS_AES_128_GCM_SHA256, utls.TLS_AES_256_GCM_SHA384, utls.TLS_CHACHA20_POLY1305_SHA256},
+		CompressionMethods: []uint8{0},
+		Extensions: utls.ShuffleChromeTLSExtensions([]utls.TLSExtension{
+			&utls.SupportedCurvesExtension{Curves: []utls.CurveID{utls.X25519, utls.CurveP256, utls.CurveP384}},
+			&utls.ALPNExtension{AlpnProtocols: nextProtos},
+			&utls.SupportedVersionsExtension{Versions: []uint16{utls.VersionTLS13}},
+			&utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []utls.SignatureScheme{
+				utls.ECDSAWithP256AndSHA256, utls.PSSWithSHA256, utls.PKCS1WithSHA256,
+				utls.ECDSAWithP384AndSHA384, utls.PSSWithSHA384, utls.PKCS1WithSHA384,
+				utls.PSSWithSHA512, utls.PKCS1WithSHA512, utls.PKCS1WithSHA1}},
+			&utls.KeyShareExtension{KeyShares: []utls.KeyShare{{Group: utls.X25519}}},
+			&utls.PSKKeyExchangeModesExtension{Modes: []uint8{utls.PskModeDHE}},
+			&utls.SNIExtension{},
+			&utls.ApplicationSettingsExtension{SupportedProtocols: nextProtos},
+			&utls.UtlsCompressCertExtension{Algorithms: []utls.CertCompressionAlgo{utls.CertCompressionBrotli}},
+			&utls.QUICTransportParametersExtension{TransportParameters: transportParameters},
+		}),
+	}
+}
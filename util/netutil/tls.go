@@ -2,11 +2,14 @@ package netutil
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"os"
 	"path"
+	"strings"
 	"sync"
 
 	"github.com/ringo-is-a-color/heteroglossia/conf"
@@ -17,49 +20,84 @@ import (
 )
 
 var (
-	tlsClientConfigMap      = make(map[string]*tls.Config)
+	tlsClientConfigMap      = make(map[tlsClientConfigKey]*tls.Config)
 	tlsClientConfigMapMutex sync.Mutex
 
-	tlsServerConfigMap      = make(map[string]*tls.Config)
+	tlsServerConfigMap      = make(map[tlsServerConfigKey]*tls.Config)
 	tlsServerConfigMapMutex sync.Mutex
 )
 
+// the nodes or servers with the same host share a tls.Config unless their other TLS settings differ
+
+type tlsClientConfigKey struct {
+	host, certFile, sni, pinnedSPKISHA256 string
+	insecureSkipVerify                    bool
+	echConfigList, echDoHURL              string
+	clientCertKeyPair                     conf.TLSCertKeyPair
+}
+
+type tlsServerConfigKey struct {
+	host, certKeyPairs string
+	ech                conf.TLSECH
+	clientAuth         conf.TLSClientAuth
+}
+
 const tlsKeyLogFilepath = "logs/tls_key.log"
 
 func TLSClientConfig(proxyNode *conf.ProxyNode, tlsKeyLog bool) (*tls.Config, error) {
 	tlsClientConfigMapMutex.Lock()
 	defer tlsClientConfigMapMutex.Unlock()
-	tlsConfig, ok := tlsClientConfigMap[proxyNode.Host]
+	key := tlsClientConfigKey{proxyNode.Host, proxyNode.TLSCertFile, proxyNode.TLSSNI, strings.Join(proxyNode.TLSPinnedSPKISHA256, ","),
+		proxyNode.TLSInsecureSkipVerify, proxyNode.TLSECHConfigList, proxyNode.TLSECHDoHURL, conf.TLSCertKeyPair{}}
+	if proxyNode.TLSClientCertKeyPair != nil {
+		key.clientCertKeyPair = *proxyNode.TLSClientCertKeyPair
+	}
+	tlsConfig, ok := tlsClientConfigMap[key]
 	if ok {
 		return tlsConfig, nil
 	}
 
-	if proxyNode.TLSCertFile == "" {
-		tlsConfig = &tls.Config{ServerName: proxyNode.Host}
-	} else {
-		certBs, err := ioutil.ReadFile(proxyNode.TLSCertFile)
+	tlsConfig = &tls.Config{ServerName: proxyNode.Host, InsecureSkipVerify: proxyNode.TLSInsecureSkipVerify}
+	if proxyNode.TLSCertFile != "" {
+		certPool, serverName, err := loadCertBundle(proxyNode.TLSCertFile)
 		if err != nil {
-			return nil, errors.New(err, "fail to load the TLS certificate file")
+			return nil, err
 		}
-		certPool := x509.NewCertPool()
-		block, _ := pem.Decode(certBs)
-		if block == nil {
-			return nil, errors.New(err, "fail to decode the TLS certificate file")
+		tlsConfig.RootCAs = certPool
+		if serverName != "" {
+			tlsConfig.ServerName = serverName
 		}
-		cert, err := x509.ParseCertificate(block.Bytes)
+	}
+	if proxyNode.TLSSNI != "" {
+		tlsConfig.ServerName = proxyNode.TLSSNI
+	}
+	if proxyNode.TLSClientCertKeyPair != nil {
+		cert, err := tls.LoadX509KeyPair(proxyNode.TLSClientCertKeyPair.CertFile, proxyNode.TLSClientCertKeyPair.KeyFile)
 		if err != nil {
-			return nil, errors.New(err, "fail to parse the TLS certificate")
+			return nil, errors.New(err, "fail to load the TLS client Certificate/Key pair files")
 		}
-		// https://stackoverflow.com/a/73912711
-		if len(cert.DNSNames) == 0 {
-			return nil, errors.New(err, "no DNSNames in the TLS certificate")
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(proxyNode.TLSPinnedSPKISHA256) > 0 {
+		verifyPeerCertificate, err := pinnedSPKIVerifier(proxyNode.TLSPinnedSPKISHA256, proxyNode.TLSInsecureSkipVerify)
+		if err != nil {
+			return nil, err
 		}
-		certPool.AppendCertsFromPEM(certBs)
-		tlsConfig = &tls.Config{
-			RootCAs:    certPool,
-			ServerName: cert.DNSNames[0],
+		tlsConfig.VerifyPeerCertificate = verifyPeerCertificate
+	}
+	if proxyNode.TLSInsecureSkipVerify {
+		log.Warn("the TLS certificate of the node isn't verified, which is only for the lab use", "host", proxyNode.Host)
+	}
+	// the ECHConfigList is set by 'TLSClientConfigWithECH' for each dial, as it's fetched via DoH and may be replaced
+	if proxyNode.TLSECHConfigList != "" {
+		_, err := decodeECHConfigList(proxyNode)
+		if err != nil {
+			return nil, err
 		}
 	}
+	if proxyNode.TLSECHConfigList != "" || proxyNode.TLSECHDoHURL != "" {
+		tlsConfig.MinVersion = tls.VersionTLS13
+	}
 	if tlsKeyLog {
 		err := os.MkdirAll(path.Dir(tlsKeyLogFilepath), 0700)
 		if err != nil {
@@ -81,30 +119,154 @@ func TLSClientConfig(proxyNode *conf.ProxyNode, tlsKeyLog bool) (*tls.Config, er
 		}
 	}
 
-	tlsClientConfigMap[proxyNode.Host] = tlsConfig
+	tlsClientConfigMap[key] = tlsConfig
 	return tlsConfig, nil
 }
 
+// loadCertBundle trusts all the certificates in the PEM file,
+// and returns the first DNS name in them as the server name, which is empty if there are no DNS names
+
+func loadCertBundle(certFile string) (*x509.CertPool, string, error) {
+	certs, err := loadCerts(certFile)
+	if err != nil {
+		return nil, "", err
+	}
+	certPool := x509.NewCertPool()
+	serverName := ""
+	for _, cert := range certs {
+		certPool.AddCert(cert)
+		// https://stackoverflow.com/a/73912711
+		if serverName == "" && len(cert.DNSNames) > 0 {
+			serverName = cert.DNSNames[0]
+		}
+	}
+	return certPool, serverName, nil
+}
+
+func loadCerts(certFile string) ([]*x509.Certificate, error) {
+	certBs, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.New(err, "fail to load the TLS certificate file")
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certBs = pem.Decode(certBs)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.New(err, "fail to parse the TLS certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates in the TLS certificate file")
+	}
+	return certs, nil
+}
+
+// pinnedSPKIVerifier accepts the verified certificate chains with a public key whose SHA-256 hash is one of the pins.
+// With 'InsecureSkipVerify', there are no verified chains, and only the leaf certificate is checked, as the other
+// certificates sent by the server aren't proven to be related to it
+// https://datatracker.ietf.org/doc/html/rfc7469#section-2.6
+
+func pinnedSPKIVerifier(pins []string, insecureSkipVerify bool) (func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error, error) {
+	pinSet := make(map[[sha256.Size]byte]struct{}, len(pins))
+	for _, pin := range pins {
+		pinBs, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return nil, errors.Newf(err, "fail to decode the SPKI SHA-256 pin '%v'", pin)
+		}
+		if len(pinBs) != sha256.Size {
+			return nil, errors.Newf("the SPKI SHA-256 pin '%v' isn't %v bytes", pin, sha256.Size)
+		}
+		pinSet[[sha256.Size]byte(pinBs)] = struct{}{}
+	}
+	isPinned := func(cert *x509.Certificate) bool {
+		_, ok := pinSet[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]
+		return ok
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if insecureSkipVerify {
+			if len(rawCerts) > 0 {
+				leaf, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if isPinned(leaf) {
+					return nil
+				}
+			}
+			return errors.New("the server's certificate doesn't match the SPKI SHA-256 pins")
+		}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if isPinned(cert) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificates of the server's verified chains match the SPKI SHA-256 pins")
+	}, nil
+}
+
 func TLSServerConfig(hg *conf.Hg) (*tls.Config, error) {
 	tlsServerConfigMapMutex.Lock()
 	defer tlsServerConfigMapMutex.Unlock()
-	tlsConfig, ok := tlsServerConfigMap[hg.Host]
+	pairs := hg.AllTLSCertKeyPairs()
+	key := tlsServerConfigKey{host: hg.Host}
+	for _, pair := range pairs {
+		key.certKeyPairs += pair.CertFile + " " + pair.KeyFile + "\n"
+	}
+	if hg.TLSECH != nil {
+		key.ech = *hg.TLSECH
+	}
+	if hg.TLSClientAuth != nil {
+		key.clientAuth = *hg.TLSClientAuth
+	}
+	tlsConfig, ok := tlsServerConfigMap[key]
 	if ok {
 		return tlsConfig, nil
 	}
 
-	if hg.TLSCertKeyPair == nil {
+	if len(pairs) == 0 {
 		// use context.Background() for reusing the same tls.Config for different server types,
 		// otherwise cancel one context can stop tls.Config used by others
-		tlsConfig = tlsConfigWithAutomatedCertificate(context.Background(), hg.Host)
+		var err error
+		tlsConfig, err = tlsConfigWithAutomatedCertificate(context.Background(), hg.Host, hg.TLSACME)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		cert, err := tls.LoadX509KeyPair(hg.TLSCertKeyPair.CertFile, hg.TLSCertKeyPair.KeyFile)
+		reloader, err := newCertReloader(pairs)
+		if err != nil {
+			return nil, err
+		}
+		// the same as above, it's shared by different server types
+		go reloader.watch(context.Background())
+		tlsConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+	}
+
+	if hg.TLSClientAuth != nil {
+		err := setupClientAuth(tlsConfig, hg.TLSClientAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hg.TLSECH != nil {
+		echKey, configList, err := ECHKey(hg.TLSECH)
 		if err != nil {
-			return nil, errors.New(err, "fail to load TLS Certificate/Key pair files")
+			return nil, err
 		}
-		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		tlsConfig.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{echKey}
+		log.Info("the ECHConfigList for the clients' 'tls-ech-config-list'", "configList", base64.StdEncoding.EncodeToString(configList))
 	}
 
-	tlsServerConfigMap[hg.Host] = tlsConfig
+	tlsServerConfigMap[key] = tlsConfig
 	return tlsConfig, nil
 }
@@ -0,0 +1,53 @@
+package netutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a forged leaf certificate followed by the pinned one is rejected, as only the verified chains (or the leaf without
+// the verification) are checked against the pins
+
+func TestPinnedSPKIVerifierWithForgedLeaf(t *testing.T) {
+	pinnedCert := newSelfSignedCert(t, "pinned")
+	forgedCert := newSelfSignedCert(t, "forged")
+	pin := sha256.Sum256(pinnedCert.RawSubjectPublicKeyInfo)
+	pins := []string{base64.StdEncoding.EncodeToString(pin[:])}
+	rawCerts := [][]byte{forgedCert.Raw, pinnedCert.Raw}
+
+	insecureVerifier, err := pinnedSPKIVerifier(pins, true)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.NotNil(t, insecureVerifier(rawCerts, nil))
+	assert.Nil(t, insecureVerifier([][]byte{pinnedCert.Raw}, nil))
+
+	verifier, err := pinnedSPKIVerifier(pins, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.NotNil(t, verifier(rawCerts, [][]*x509.Certificate{{forgedCert}}))
+	assert.Nil(t, verifier(rawCerts, [][]*x509.Certificate{{forgedCert}, {pinnedCert}}))
+}
+
+func newSelfSignedCert(t *testing.T, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: commonName},
+		NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(certDER)
+	assert.Nil(t, err)
+	return cert
+}
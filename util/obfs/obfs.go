@@ -0,0 +1,43 @@
+package obfs
+
+import (
+	"net"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+)
+
+// Obfuscator wraps the socket under a carrier, so what the carrier writes is obfuscated on the wire,
+// and what it reads is restored
+
+type Obfuscator interface {
+	WrapConn(conn net.Conn) net.Conn
+}
+
+// New returns the obfuscators configured by 'obfsConf' chained, whose padding frames are also shaped,
+// and it returns a no-op one if 'obfsConf' is nil
+
+func New(obfsConf *conf.Obfuscation) Obfuscator {
+	var obfuscators chain
+	if obfsConf == nil {
+		return obfuscators
+	}
+	if obfsConf.ShapingMaxSize > 0 {
+		obfuscators = append(obfuscators, &shaping{obfsConf.ShapingMinSize, obfsConf.ShapingMaxSize, obfsConf.ShapingMaxDelayMS,
+			obfsConf.ShapingDelayedWrites})
+	}
+	if obfsConf.PaddingPackets > 0 {
+		obfuscators = append(obfuscators, &padding{obfsConf.PaddingPackets, obfsConf.PaddingMaxSize})
+	}
+	return obfuscators
+}
+
+// the first obfuscator wraps the socket directly
+
+type chain []Obfuscator
+
+func (c chain) WrapConn(conn net.Conn) net.Conn {
+	for _, obfuscator := range c {
+		conn = obfuscator.WrapConn(conn)
+	}
+	return conn
+}
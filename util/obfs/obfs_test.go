@@ -0,0 +1,139 @@
+package obfs
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/randutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// wireConn records the sizes of the writes on the wire, and its reads return what's written
+
+type wireConn struct {
+	net.Conn
+	buf           bytes.Buffer
+	writeSizes    []int
+	writeDeadline time.Time
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	return c.buf.Read(b)
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	if !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.writeSizes = append(c.writeSizes, len(b))
+	return c.buf.Write(b)
+}
+
+func (c *wireConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return nil
+}
+
+func TestPadding(t *testing.T) {
+	obfuscator := New(&conf.Obfuscation{PaddingPackets: 3, PaddingMaxSize: 100})
+	wire := new(wireConn)
+	conn := obfuscator.WrapConn(wire)
+	dataSizes := []int{1, 50, 517, 1400, 9}
+	data := writeRandomData(t, conn, dataSizes)
+
+	paddingSizes := make(map[int]struct{})
+	for i, writeSize := range wire.writeSizes[:3] {
+		paddingSize := writeSize - paddingHeaderSize - dataSizes[i]
+		assert.GreaterOrEqual(t, paddingSize, 0)
+		assert.LessOrEqual(t, paddingSize, 100)
+		paddingSizes[paddingSize] = struct{}{}
+	}
+	assert.Greater(t, len(paddingSizes), 1, "the padding sizes should be random")
+	assert.Equal(t, dataSizes[3:], wire.writeSizes[3:], "only the first packets should be padded")
+	assertReadData(t, obfuscator.WrapConn(wire), data)
+}
+
+func TestShaping(t *testing.T) {
+	obfuscator := New(&conf.Obfuscation{ShapingMinSize: 100, ShapingMaxSize: 300})
+	wire := new(wireConn)
+	conn := obfuscator.WrapConn(wire)
+	data := writeRandomData(t, conn, []int{64 * 1024, 16 * 1024})
+
+	var totalSize, smallSegments int
+	sizes := make(map[int]struct{})
+	for _, writeSize := range wire.writeSizes {
+		assert.LessOrEqual(t, writeSize, 300)
+		// only the last segment of each write can be smaller than the min size
+		if writeSize < 100 {
+			smallSegments++
+		}
+		totalSize += writeSize
+		sizes[writeSize] = struct{}{}
+	}
+	assert.LessOrEqual(t, smallSegments, 2)
+	// the sizes are uniformly distributed, so their mean is close to 200
+	assert.InDelta(t, 200, float64(totalSize)/float64(len(wire.writeSizes)), 20)
+	assert.Greater(t, len(sizes), 100)
+	assertReadData(t, obfuscator.WrapConn(wire), data)
+}
+
+// only the first writes are delayed, and the delays end at the write deadline
+
+func TestShapingDelays(t *testing.T) {
+	obfuscator := New(&conf.Obfuscation{ShapingMinSize: 10, ShapingMaxSize: 10, ShapingMaxDelayMS: 10, ShapingDelayedWrites: 1})
+	conn := obfuscator.WrapConn(new(wireConn))
+	start := time.Now()
+	writeRandomData(t, conn, []int{1000})
+	// 99 delays of up to 10ms, whose mean is 5ms
+	assert.Greater(t, time.Since(start), 200*time.Millisecond)
+	start = time.Now()
+	writeRandomData(t, conn, []int{1000})
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	obfuscator = New(&conf.Obfuscation{ShapingMinSize: 10, ShapingMaxSize: 10, ShapingMaxDelayMS: 1000, ShapingDelayedWrites: 1})
+	conn = obfuscator.WrapConn(new(wireConn))
+	assert.Nil(t, conn.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	start = time.Now()
+	bs, err := randutil.RandNBytes(1000)
+	assert.Nil(t, err)
+	n, err := conn.Write(bs)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, n, 1000)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestPaddingWithShaping(t *testing.T) {
+	obfuscator := New(&conf.Obfuscation{PaddingPackets: 2, PaddingMaxSize: 1000, ShapingMinSize: 10, ShapingMaxSize: 20})
+	wire := new(wireConn)
+	conn := obfuscator.WrapConn(wire)
+	data := writeRandomData(t, conn, []int{3000, 100, 5})
+
+	for _, writeSize := range wire.writeSizes {
+		assert.LessOrEqual(t, writeSize, 20)
+	}
+	assertReadData(t, obfuscator.WrapConn(wire), data)
+}
+
+func writeRandomData(t *testing.T, conn net.Conn, sizes []int) []byte {
+	var data []byte
+	for _, size := range sizes {
+		bs, err := randutil.RandNBytes(size)
+		assert.Nil(t, err)
+		n, err := conn.Write(bs)
+		assert.Nil(t, err)
+		assert.Equal(t, size, n)
+		data = append(data, bs...)
+	}
+	return data
+}
+
+func assertReadData(t *testing.T, conn net.Conn, expected []byte) {
+	data, err := io.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, data)
+}
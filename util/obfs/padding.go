@@ -0,0 +1,105 @@
+package obfs
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"net"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/ringo-is-a-color/heteroglossia/util/randutil"
+)
+
+/*
+padding frames the first 'packets' writes in each direction with random padding, so the sizes of the first packets,
+e.g., the ClientHello or the Shadowsocks request header, don't tell the protocol, and the later writes are sent as they are
++-----------+--------------+----------+----------+
+| Data size | Padding size |   Data   | Padding  |
++-----------+--------------+----------+----------+
+|     2     |      2       | Variable | Variable |
++-----------+--------------+----------+----------+
+*/
+
+type padding struct {
+	packets int
+	maxSize int
+}
+
+var _ Obfuscator = new(padding)
+
+const (
+	paddingHeaderSize   = 4
+	maxPaddingDataSize  = 65535
+	paddingDataSizeSize = 2
+)
+
+func (p *padding) WrapConn(conn net.Conn) net.Conn {
+	return &paddingConn{Conn: conn, packets: p.packets, maxPaddingSize: p.maxSize}
+}
+
+type paddingConn struct {
+	net.Conn
+	packets        int
+	maxPaddingSize int
+
+	readPackets       int
+	unreadDataSize    int
+	unreadPaddingSize int
+	writtenPackets    int
+}
+
+var _ net.Conn = new(paddingConn)
+
+func (c *paddingConn) Read(b []byte) (int, error) {
+	for c.unreadDataSize == 0 {
+		if c.unreadPaddingSize > 0 {
+			_, err := io.CopyN(io.Discard, c.Conn, int64(c.unreadPaddingSize))
+			if err != nil {
+				return 0, err
+			}
+			c.unreadPaddingSize = 0
+		}
+		if c.readPackets == c.packets {
+			return c.Conn.Read(b)
+		}
+		var header [paddingHeaderSize]byte
+		_, err := io.ReadFull(c.Conn, header[:])
+		if err != nil {
+			return 0, err
+		}
+		c.readPackets++
+		c.unreadDataSize = int(binary.BigEndian.Uint16(header[:paddingDataSizeSize]))
+		c.unreadPaddingSize = int(binary.BigEndian.Uint16(header[paddingDataSizeSize:]))
+	}
+	n, err := c.Conn.Read(b[:min(len(b), c.unreadDataSize)])
+	c.unreadDataSize -= n
+	return n, err
+}
+
+func (c *paddingConn) Write(b []byte) (int, error) {
+	var written int
+	for c.writtenPackets < c.packets && len(b) > 0 {
+		dataSize := min(len(b), maxPaddingDataSize)
+		paddingSize := rand.IntN(c.maxPaddingSize + 1)
+		frame := pool.Get(paddingHeaderSize + dataSize + paddingSize)
+		binary.BigEndian.PutUint16(frame, uint16(dataSize))
+		binary.BigEndian.PutUint16(frame[paddingDataSizeSize:], uint16(paddingSize))
+		copy(frame[paddingHeaderSize:], b[:dataSize])
+		_, err := randutil.RandBytes(frame[paddingHeaderSize+dataSize:])
+		if err == nil {
+			_, err = c.Conn.Write(frame)
+		}
+		pool.Put(frame)
+		if err != nil {
+			return written, err
+		}
+		c.writtenPackets++
+		written += dataSize
+		b = b[dataSize:]
+	}
+	if len(b) == 0 {
+		return written, nil
+	}
+	n, err := c.Conn.Write(b)
+	return written + n, err
+}
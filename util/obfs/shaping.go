@@ -0,0 +1,102 @@
+package obfs
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// shaping splits each write into the segments of random sizes with random delays between them, so the packets' sizes
+// and timing don't follow the carrier's records or chunks, which relies on TCP_NODELAY set by Go by default.
+// The delays are only added in the first 'delayedWrites' writes like the padding, so the bulk data isn't slowed down
+
+type shaping struct {
+	minSize       int
+	maxSize       int
+	maxDelayMS    int
+	delayedWrites int
+}
+
+var _ Obfuscator = new(shaping)
+
+func (s *shaping) WrapConn(conn net.Conn) net.Conn {
+	return &shapingConn{Conn: conn, shaping: s, writeDeadlineChanged: make(chan struct{})}
+}
+
+type shapingConn struct {
+	net.Conn
+	shaping *shaping
+	writes  int
+
+	// the delays end at the write deadline, and they're woken up to check it again when it's changed
+	writeDeadline        time.Time
+	writeDeadlineChanged chan struct{}
+	writeDeadlineMutex   sync.Mutex
+}
+
+var _ net.Conn = new(shapingConn)
+
+func (c *shapingConn) Write(b []byte) (int, error) {
+	delayed := c.shaping.maxDelayMS > 0 && c.writes < c.shaping.delayedWrites
+	c.writes++
+	var written int
+	for len(b) > 0 {
+		if written > 0 && delayed {
+			c.delay(time.Duration(rand.IntN(c.shaping.maxDelayMS+1)) * time.Millisecond)
+		}
+		size := min(len(b), c.shaping.minSize+rand.IntN(c.shaping.maxSize-c.shaping.minSize+1))
+		n, err := c.Conn.Write(b[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[size:]
+	}
+	return written, nil
+}
+
+// sleeps for 'delay' unless the write deadline comes first, then the next segment's write fails with the socket's
+// deadline error
+
+func (c *shapingConn) delay(delay time.Duration) {
+	end := time.Now().Add(delay)
+	for {
+		c.writeDeadlineMutex.Lock()
+		deadline, deadlineChanged := c.writeDeadline, c.writeDeadlineChanged
+		c.writeDeadlineMutex.Unlock()
+		wakeUp := end
+		if !deadline.IsZero() && deadline.Before(wakeUp) {
+			wakeUp = deadline
+		}
+		duration := time.Until(wakeUp)
+		if duration <= 0 {
+			return
+		}
+		timer := time.NewTimer(duration)
+		select {
+		case <-timer.C:
+			return
+		case <-deadlineChanged:
+			timer.Stop()
+		}
+	}
+}
+
+func (c *shapingConn) SetDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *shapingConn) SetWriteDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *shapingConn) setWriteDeadline(t time.Time) {
+	c.writeDeadlineMutex.Lock()
+	defer c.writeDeadlineMutex.Unlock()
+	c.writeDeadline = t
+	close(c.writeDeadlineChanged)
+	c.writeDeadlineChanged = make(chan struct{})
+}
@@ -0,0 +1,218 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/ringo-is-a-color/heteroglossia/util/errors"
+	"github.com/ringo-is-a-color/heteroglossia/util/ioutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/log"
+	"github.com/ringo-is-a-color/heteroglossia/util/osutil"
+	"golang.org/x/time/rate"
+)
+
+const (
+	saveInterval = time.Minute
+	monthLayout  = "2006-01"
+)
+
+type userState struct {
+	name  string
+	quota *conf.UserQuota
+	// shared by all connections of the user, nil if there is no rate limit
+	limiter *rate.Limiter
+
+	// the used traffic in 'month'
+	used      atomic.Uint64
+	month     string
+	monthLock sync.Mutex
+}
+
+// the persisted state file
+type state struct {
+	Month string            `json:"month"`
+	Used  map[string]uint64 `json:"used"`
+}
+
+var (
+	users     atomic.Pointer[map[string]*userState]
+	stateFile string
+	saveLock  sync.Mutex
+	// replaced in tests to cross a month
+	now = time.Now
+)
+
+// Setup loads the used monthly quotas from the state file, and starts to save them periodically.
+// It should be called once before any server starts.
+
+func Setup(quotaConf *conf.Quota) error {
+	if len(quotaConf.Users) == 0 {
+		return nil
+	}
+
+	stateFile = quotaConf.StateFile
+	savedState, err := load(stateFile)
+	if err != nil {
+		return err
+	}
+	month := currentMonth()
+	userStates := make(map[string]*userState, len(quotaConf.Users))
+	for name, userQuota := range quotaConf.Users {
+		user := &userState{name: name, quota: userQuota, limiter: newLimiter(userQuota.RateLimit), month: month}
+		if savedState.Month == month {
+			user.used.Store(savedState.Used[name])
+		}
+		userStates[name] = user
+	}
+	users.Store(&userStates)
+
+	go func() {
+		ticker := time.NewTicker(saveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			save()
+		}
+	}()
+	osutil.RegisterProgramTerminationHandler(save)
+	return nil
+}
+
+// NewConnMeter returns a meter for a new connection of the user, or nil if the user has no quota.
+// It returns an error if the user's monthly quota is used up.
+// The meter stops waiting for the rate limits when the relay's 'ctx' is done.
+
+func NewConnMeter(ctx context.Context, user string) (ioutil.Meter, error) {
+	userStates := users.Load()
+	if userStates == nil || user == "" {
+		return nil, nil
+	}
+	userState, ok := (*userStates)[user]
+	if !ok {
+		return nil, nil
+	}
+	err := userState.checkMonthlyQuota(userState.usedInCurrentMonth())
+	if err != nil {
+		return nil, err
+	}
+	return &connMeter{ctx, userState, newLimiter(userState.quota.ConnectionRateLimit)}, nil
+}
+
+type connMeter struct {
+	ctx     context.Context
+	user    *userState
+	limiter *rate.Limiter
+}
+
+var _ ioutil.Meter = new(connMeter)
+
+func (m *connMeter) Account(n int) error {
+	// reset the used traffic first if a new month comes
+	_ = m.user.usedInCurrentMonth()
+	err := m.user.checkMonthlyQuota(m.user.used.Add(uint64(n)))
+	if err != nil {
+		return err
+	}
+
+	err = wait(m.ctx, m.user.limiter, n)
+	if err != nil {
+		return err
+	}
+	return wait(m.ctx, m.limiter, n)
+}
+
+// resets the used traffic when a new month comes
+
+func (s *userState) usedInCurrentMonth() uint64 {
+	month := currentMonth()
+	s.monthLock.Lock()
+	defer s.monthLock.Unlock()
+	if s.month != month {
+		s.month = month
+		s.used.Store(0)
+	}
+	return s.used.Load()
+}
+
+func (s *userState) checkMonthlyQuota(used uint64) error {
+	monthlyQuota := uint64(s.quota.MonthlyQuota)
+	if monthlyQuota != 0 && used > monthlyQuota {
+		return errors.Newf("the monthly quota of the user '%v' is used up", s.name)
+	}
+	return nil
+}
+
+func newLimiter(bytesPerSecond conf.Bytes) *rate.Limiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	// allow a burst of one second's traffic
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(max(bytesPerSecond, 1)))
+}
+
+func wait(ctx context.Context, limiter *rate.Limiter, n int) error {
+	if limiter == nil {
+		return nil
+	}
+	// 'WaitN' fails directly if n exceeds the limiter's burst size, so we wait for them part by part
+	for n > 0 {
+		size := min(n, limiter.Burst())
+		err := limiter.WaitN(ctx, size)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		n -= size
+	}
+	return nil
+}
+
+func currentMonth() string {
+	return now().Format(monthLayout)
+}
+
+func load(stateFile string) (*state, error) {
+	savedState := &state{}
+	bs, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return savedState, nil
+		}
+		return nil, errors.New(err, "fail to read the quota state file")
+	}
+	err = json.Unmarshal(bs, savedState)
+	if err != nil {
+		return nil, errors.Newf(err, "fail to parse the quota state file %v", stateFile)
+	}
+	return savedState, nil
+}
+
+func save() {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	userStates := users.Load()
+	if userStates == nil {
+		return
+	}
+
+	currentState := &state{Month: currentMonth(), Used: make(map[string]uint64, len(*userStates))}
+	for name, user := range *userStates {
+		currentState.Used[name] = user.usedInCurrentMonth()
+	}
+	bs, err := json.Marshal(currentState)
+	if err != nil {
+		log.WarnWithError("fail to encode the quota state", errors.WithStack(err))
+		return
+	}
+	// write to a temporary file first so a crash in the middle doesn't corrupt the old state file
+	err = os.WriteFile(stateFile+".new", bs, 0600)
+	if err == nil {
+		err = os.Rename(stateFile+".new", stateFile)
+	}
+	if err != nil {
+		log.WarnWithError("fail to save the quota state file", errors.WithStack(err), "path", stateFile)
+	}
+}
@@ -0,0 +1,90 @@
+package quota
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+var (
+	january  = time.Date(2026, time.January, 31, 23, 59, 0, 0, time.Local)
+	february = time.Date(2026, time.February, 1, 0, 1, 0, 0, time.Local)
+)
+
+// setup sets up the quotas with 'stateFile' at the time 'at', and the quotas are removed after the test
+
+func setup(t *testing.T, stateFile string, at time.Time) {
+	now = func() time.Time { return at }
+	t.Cleanup(func() {
+		users.Store(nil)
+		now = time.Now
+	})
+	err := Setup(&conf.Quota{StateFile: stateFile, Users: map[string]*conf.UserQuota{"alice": {MonthlyQuota: 100}}})
+	assert.Nil(t, err)
+}
+
+func TestConnMeter(t *testing.T) {
+	setup(t, filepath.Join(t.TempDir(), "quota.json"), january)
+	ctx := context.Background()
+	for _, user := range []string{"", "bob"} {
+		meter, err := NewConnMeter(ctx, user)
+		assert.Nil(t, err)
+		assert.Nil(t, meter)
+	}
+
+	meter, err := NewConnMeter(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Nil(t, meter.Account(60))
+	// the quota is used up only when the used traffic exceeds it
+	assert.Nil(t, meter.Account(40))
+	assert.NotNil(t, meter.Account(1))
+	_, err = NewConnMeter(ctx, "alice")
+	assert.NotNil(t, err)
+}
+
+func TestMonthRollover(t *testing.T) {
+	setup(t, filepath.Join(t.TempDir(), "quota.json"), january)
+	meter, err := NewConnMeter(context.Background(), "alice")
+	assert.Nil(t, err)
+	assert.NotNil(t, meter.Account(101))
+
+	now = func() time.Time { return february }
+	assert.Nil(t, meter.Account(100))
+	assert.Equal(t, uint64(100), (*users.Load())["alice"].used.Load())
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "quota.json")
+	setup(t, stateFile, january)
+	meter, err := NewConnMeter(context.Background(), "alice")
+	assert.Nil(t, err)
+	assert.Nil(t, meter.Account(42))
+	save()
+
+	setup(t, stateFile, january)
+	assert.Equal(t, uint64(42), (*users.Load())["alice"].used.Load())
+	// the state file of the last month is ignored
+	setup(t, stateFile, february)
+	assert.Equal(t, uint64(0), (*users.Load())["alice"].used.Load())
+}
+
+func TestWait(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, wait(ctx, nil, 1<<20))
+
+	// 100 bytes at once, then 250 bytes at 1000 bytes per second, which is more than the burst
+	limiter := rate.NewLimiter(1000, 100)
+	start := time.Now()
+	assert.Nil(t, wait(ctx, limiter, 350))
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// the relay stops waiting when it's closed
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.NotNil(t, wait(ctx, limiter, 100))
+}
@@ -0,0 +1,143 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/conf"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// WriteCertBundle writes another certificate without DNS names followed by the one in 'certFile'
+
+func WriteCertBundle(t *testing.T, certFile string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	certBs, err := os.ReadFile(certFile)
+	assert.Nil(t, err)
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), certBs...)
+	bundleFile := filepath.Join(t.TempDir(), "bundle.pem")
+	assert.Nil(t, os.WriteFile(bundleFile, bundle, 0600))
+	return bundleFile
+}
+
+func SPKISHA256Pin(t *testing.T, certFile string) string {
+	certBs, err := os.ReadFile(certFile)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(certBs)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(pin[:])
+}
+
+// WriteCertKeyPair writes a self-signed certificate for 'dnsName' and its key
+
+func WriteCertKeyPair(t *testing.T, dnsName string) *conf.TLSCertKeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{dnsName}, NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	pair := &conf.TLSCertKeyPair{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	assert.Nil(t, os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600))
+	assert.Nil(t, os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return pair
+}
+
+// WriteClientAuthFiles writes a CA, its CRL and a client certificate signed by it for 'user',
+// which is revoked by the CRL if 'revoked' is true
+
+func WriteClientAuthFiles(t *testing.T, user string, revoked bool) (*conf.TLSClientAuth, *conf.TLSCertKeyPair) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "hg test CA"}, IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign, NotAfter: time.Now().Add(time.Hour)}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.Nil(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: user},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+
+	// another certificate is revoked if this one isn't
+	revokedSerialNumber := big.NewInt(3)
+	if revoked {
+		revokedSerialNumber = template.SerialNumber
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: revokedSerialNumber, RevocationTime: time.Now()}},
+		NextUpdate:                time.Now().Add(time.Hour)}, caCert, caKey)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	clientAuth := &conf.TLSClientAuth{CACertFile: filepath.Join(dir, "ca.pem"), CRLFile: filepath.Join(dir, "ca.crl")}
+	pair := &conf.TLSCertKeyPair{CertFile: filepath.Join(dir, "client_cert.pem"), KeyFile: filepath.Join(dir, "client_key.pem")}
+	assert.Nil(t, os.WriteFile(clientAuth.CACertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+	assert.Nil(t, os.WriteFile(clientAuth.CRLFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0600))
+	assert.Nil(t, os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600))
+	assert.Nil(t, os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return clientAuth, pair
+}
+
+// StartDoHServer answers the HTTPS record with the 'ech' parameter for all queries until the test finishes
+// https://datatracker.ietf.org/doc/html/rfc9460#section-2.2
+
+func StartDoHServer(t *testing.T, echConfigList []byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queryBs, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		var query dnsmessage.Message
+		err = query.Unpack(queryBs)
+		if !assert.Nil(t, err) || !assert.Len(t, query.Questions, 1) {
+			return
+		}
+		svcb := []byte{0, 1, 0, 0, 5}
+		svcb = binary.BigEndian.AppendUint16(svcb, uint16(len(echConfigList)))
+		svcb = append(svcb, echConfigList...)
+		question := query.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 60},
+				Body:   &dnsmessage.UnknownResource{Type: question.Type, Data: svcb},
+			}},
+		}
+		respBs, err := resp.Pack()
+		assert.Nil(t, err)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(respBs)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
@@ -1,56 +1,274 @@
 package testutil
 
 import (
+	"bytes"
 	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "github.com/flashlabs/rootpath"
 	"github.com/ringo-is-a-color/heteroglossia/conf"
 	"github.com/ringo-is-a-color/heteroglossia/transport"
 	"github.com/ringo-is-a-color/heteroglossia/transport/direct"
+	"github.com/ringo-is-a-color/heteroglossia/util/contextutil"
+	"github.com/ringo-is-a-color/heteroglossia/util/netutil"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestClientServerConnection(t *testing.T, newClient func(proxyNode *conf.ProxyNode) (transport.Client, error),
-	newServer func(hg *conf.Hg, targetClient transport.Client) transport.Server) {
-	serverConf, err := conf.Parse("server_example.conf.json")
+type (
+	NewClientFunc = func(proxyNode *conf.ProxyNode) (transport.Client, error)
+	NewServerFunc = func(hg *conf.Hg, targetClient transport.Client) transport.Server
+)
+
+// TestClientServerConnection checks a request through the client to the server, where 'mutateHg' and 'mutateNode'
+// set up the tested feature on the hg inbound and its outbound, and either can be nil,
+// then it returns the user which the server authenticates
+
+func TestClientServerConnection(t *testing.T, mutateHg func(hg *conf.Hg), mutateNode func(hg *conf.Hg, proxyNode *conf.ProxyNode),
+	newClient NewClientFunc, newServer NewServerFunc) string {
+	client, targetClient := startClientServer(t, mutateHg, mutateNode, newClient, newServer)
+	server := startWebServer()
+	defer server.Close()
+	resp, err := transport.HTTPClientThroughRouter(client).Get(server.URL)
+	if assert.Nil(t, err) {
+		_ = resp.Body.Close()
+		assert.True(t, resp.StatusCode >= 200 && resp.StatusCode < 300)
+	}
+	return targetClient.recordedUser()
+}
+
+// TestClientServerConnectionFailure is the same as 'TestClientServerConnection', but the request is expected to fail,
+// e.g., as the server rejects the client, or to be answered by the server's bad-auth fallback rather than the target
+
+func TestClientServerConnectionFailure(t *testing.T, mutateHg func(hg *conf.Hg), mutateNode func(hg *conf.Hg, proxyNode *conf.ProxyNode),
+	newClient NewClientFunc, newServer NewServerFunc) {
+	client, targetClient := startClientServer(t, mutateHg, mutateNode, newClient, newServer)
+	server := startWebServer()
+	defer server.Close()
+	resp, err := transport.HTTPClientThroughRouter(client).Get(server.URL)
+	if err == nil {
+		_ = resp.Body.Close()
+		assert.False(t, resp.StatusCode >= 200 && resp.StatusCode < 300)
+	}
+	assert.Empty(t, targetClient.recordedUser())
+}
+
+// TestClientServerPacketConnection is the same as 'TestClientServerConnection' for UDP, which exchanges packets
+// with an echo server through the client and server
+
+func TestClientServerPacketConnection(t *testing.T, mutateHg func(hg *conf.Hg), mutateNode func(hg *conf.Hg, proxyNode *conf.ProxyNode),
+	newClient NewClientFunc, newServer NewServerFunc) string {
+	client, targetClient := startClientServer(t, mutateHg, mutateNode, newClient, newServer)
+	echoServer, err := startUDPEchoServer()
 	assert.Nil(t, err)
-	assert.NotNil(t, serverConf.Inbounds.Hg)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	defer echoServer.Close()
+	echoServerAddr := transport.NewSocketAddressByAddrPort(echoServer.LocalAddr().(*net.UDPAddr).AddrPort())
+	packetConn, err := client.DialUDP(context.Background(), echoServerAddr)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer packetConn.Close()
+
+	received := make(chan []byte, 16)
 	go func() {
-		server := newServer(serverConf.Inbounds.Hg, direct.NewClient())
-		err := server.ListenAndServe(ctx)
-		assert.Nil(t, err)
+		buf := make([]byte, transport.MaxUDPPacketSize)
+		for {
+			n, addr, err := packetConn.ReadPacket(buf)
+			if err != nil {
+				return
+			}
+			if addr.ToHostStr() == echoServerAddr.ToHostStr() {
+				select {
+				case received <- bytes.Clone(buf[:n]):
+				default:
+				}
+			}
+		}
 	}()
-	client, err := newClient(toProxyNode(serverConf.Inbounds.Hg))
+	// the large packet may be fragmented by the carrier, e.g., the QUIC carrier over QUIC datagrams
+	for _, payload := range [][]byte{[]byte("hello over UDP"), bytes.Repeat([]byte("a large UDP packet"), 512)} {
+		assert.Equal(t, payload, exchangePacket(t, packetConn, echoServerAddr, payload, received))
+	}
+	return targetClient.recordedUser()
+}
+
+func startClientServer(t *testing.T, mutateHg func(hg *conf.Hg), mutateNode func(hg *conf.Hg, proxyNode *conf.ProxyNode),
+	newClient NewClientFunc, newServer NewServerFunc) (transport.Client, *userRecordingClient) {
+	hg := ServerConf(t)
+	if mutateHg != nil {
+		mutateHg(hg)
+	}
+	proxyNode := ProxyNodeOf(hg)
+	if mutateNode != nil {
+		mutateNode(hg, proxyNode)
+	}
+	targetClient := &userRecordingClient{Client: direct.NewClient()}
+	StartServer(t, hg, newServer(hg, targetClient))
+	client, err := newClient(proxyNode)
 	assert.Nil(t, err)
+	return client, targetClient
+}
 
-	server := startWebServer()
-	defer server.Close()
-	httpClient := transport.HTTPClientThroughRouter(client)
-	resp, err := httpClient.Get(server.URL)
+// ServerConf returns the hg inbound of 'server_example.conf.json' on the free ports picked by the system,
+// so the servers of different tests don't conflict
 
+func ServerConf(t *testing.T) *conf.Hg {
+	serverConf, err := conf.Parse("server_example.conf.json")
 	assert.Nil(t, err)
-	assert.True(t, resp.StatusCode >= 200 && resp.StatusCode < 300)
+	hg := serverConf.Inbounds.Hg
+	assert.NotNil(t, hg)
+	hg.TCPPort = freePort(t)
+	hg.TLSPort = freePort(t)
+	hg.QUICPort = freePort(t)
+	return hg
 }
 
-func startWebServer() *httptest.Server {
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
-	})
-	return httptest.NewServer(handler)
+// the port is free for both TCP and UDP, as the TCP carrier's UDP relay uses the same port number
+
+func freePort(t *testing.T) int {
+	for range 10 {
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{})
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		_ = ln.Close()
+		if err == nil {
+			_ = udpConn.Close()
+			return port
+		}
+	}
+	assert.Fail(t, "no free port for both TCP and UDP")
+	return 0
 }
 
-func toProxyNode(hg *conf.Hg) *conf.ProxyNode {
+// ProxyNodeOf returns an outbound to the hg inbound
+
+func ProxyNodeOf(hg *conf.Hg) *conf.ProxyNode {
 	return &conf.ProxyNode{
 		Host:        hg.Host,
 		Password:    hg.Password,
 		TCPPort:     hg.TCPPort,
+		SSMethod:    hg.SSMethod,
 		TLSPort:     hg.TLSPort,
 		TLSCertFile: hg.TLSCertKeyPair.CertFile,
 		QUICPort:    hg.QUICPort,
 	}
 }
+
+// StartServer serves in another goroutine until the test finishes,
+// and returns after the server listens on its carrier's ports of 'hg'
+
+func StartServer(t *testing.T, hg *conf.Hg, server transport.Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	serverDone := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-serverDone
+	})
+	go func() {
+		defer close(serverDone)
+		assert.Nil(t, server.ListenAndServe(ctx))
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for !isListening(hg) {
+		select {
+		case <-serverDone:
+			assert.Fail(t, "the server stops before listening")
+			return
+		case <-timeout:
+			assert.Fail(t, "the server doesn't listen in time")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// the TCP carrier's UDP relay listens on the same port number as the TCP one
+
+func isListening(hg *conf.Hg) bool {
+	return netutil.IsServerListening("tcp", hg.TCPPort) && netutil.IsServerListening("udp", hg.TCPPort) ||
+		netutil.IsServerListening("tcp", hg.TLSPort) || netutil.IsServerListening("udp", hg.QUICPort)
+}
+
+func exchangePacket(t *testing.T, packetConn transport.PacketConn, addr *transport.SocketAddress, payload []byte,
+	received <-chan []byte) []byte {
+	_, err := packetConn.WritePacket(payload, addr)
+	assert.Nil(t, err)
+	select {
+	case reply := <-received:
+		return reply
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
+
+func startUDPEchoServer() (*net.UDPConn, error) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, transport.MaxUDPPacketSize)
+		for {
+			n, addr, err := udpConn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	}()
+	return udpConn, nil
+}
+
+func NewPassword(t *testing.T, str string) conf.Password {
+	var pw conf.Password
+	err := pw.UnmarshalJSON([]byte(strconv.Quote(str)))
+	assert.Nil(t, err)
+	return pw
+}
+
+// Users returns two users, and the hg inbound's 'password' becomes the identity key with them
+
+func Users(t *testing.T) []conf.HgUser {
+	return []conf.HgUser{
+		{Name: "user1", Password: NewPassword(t, "3e2f8a8d1b4c4a0e9c6b7d5e4f3a2b1c")},
+		{Name: "user2", Password: NewPassword(t, "a1b2c3d4e5f60718293a4b5c6d7e8f90")},
+	}
+}
+
+const TUICTestUUID = "6f1d5a3c-2b4e-4c8a-9d7f-0e1b2c3d4e5f"
+
+type userRecordingClient struct {
+	transport.Client
+	user atomic.Value
+}
+
+func (c *userRecordingClient) DialTCP(ctx context.Context, addr *transport.SocketAddress) (net.Conn, error) {
+	c.user.Store(contextutil.User(ctx))
+	return c.Client.DialTCP(ctx, addr)
+}
+
+func (c *userRecordingClient) DialUDP(ctx context.Context, addr *transport.SocketAddress) (transport.PacketConn, error) {
+	c.user.Store(contextutil.User(ctx))
+	return c.Client.DialUDP(ctx, addr)
+}
+
+func (c *userRecordingClient) recordedUser() string {
+	user, _ := c.user.Load().(string)
+	return user
+}
+
+func startWebServer() *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return httptest.NewServer(handler)
+}
@@ -2,10 +2,14 @@ package updater
 
 import (
 	"time"
+
+	"github.com/ringo-is-a-color/heteroglossia/util/log"
 )
 
 const day = 24 * time.Hour
 
+var logger = log.NewLogger("updater")
+
 func StartUpdateCron(f func()) {
 	f()
 	tick := time.Tick(day)
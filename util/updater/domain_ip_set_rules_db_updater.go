@@ -5,7 +5,6 @@ import (
 	"time"
 
 	"github.com/ringo-is-a-color/heteroglossia/conf/rule"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
 )
 
 const (
@@ -32,6 +31,6 @@ func UpdateRuleFile(client *http.Client) (bool, error) {
 }
 
 func updateRulesFiles(client *http.Client) error {
-	log.Info("start to update rules' files")
+	logger.Info("start to update rules' files")
 	return updateFile(client, rule.DomainIPSetRulesDBFilename, domainIPSetRulesFileURL, domainIPSetRulesFileSHA256SumURL)
 }
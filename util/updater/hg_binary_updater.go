@@ -10,7 +10,6 @@ import (
 
 	"github.com/ringo-is-a-color/heteroglossia/util/cli"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
 	"golang.org/x/mod/semver"
 )
 
@@ -34,7 +33,7 @@ func UpdateHgBinary(client *http.Client) (bool, string, error) {
 	}
 
 	if semver.Compare(latestTagVersion, currentVersion) > 0 {
-		log.Info("start to update to the latest release version of heteroglossia", "version", latestTagVersion)
+		logger.Info("start to update to the latest release version of heteroglossia", "version", latestTagVersion)
 		// an absolute path returns
 		executablePath, err := os.Executable()
 		if err != nil {
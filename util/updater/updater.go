@@ -19,7 +19,6 @@ import (
 
 	"github.com/ringo-is-a-color/heteroglossia/util/cli"
 	"github.com/ringo-is-a-color/heteroglossia/util/errors"
-	"github.com/ringo-is-a-color/heteroglossia/util/log"
 )
 
 func needUpdateFile(filepath string, needUpdateInterval time.Duration) (bool, error) {
@@ -184,7 +183,7 @@ func extractHgBinaryTarGz(tarGzFile *os.File) (string, error) {
 			defer func(file *os.File) {
 				err := file.Close()
 				if err != nil {
-					log.WarnWithError("fail to close the file when extracting", err,
+					logger.WarnWithError("fail to close the file when extracting", err,
 						"tar.gz file", tarGzFile.Name(), "uncompressed file name", header.Name)
 				}
 			}(uncompressedFile)
@@ -197,7 +196,7 @@ func extractHgBinaryTarGz(tarGzFile *os.File) (string, error) {
 				newDownloadHgBinaryPath = uncompressedFile.Name()
 			}
 		default:
-			log.Warn("unknown type of the header when extracting",
+			logger.Warn("unknown type of the header when extracting",
 				"tar.gz file", tarGzFile.Name(), "uncompressed file name", header.Name, "header type", header.Typeflag)
 		}
 	}